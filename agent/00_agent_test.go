@@ -15,6 +15,8 @@ import (
 	"github.com/digitalrebar/provision/v4/api"
 	"github.com/digitalrebar/provision/v4/models"
 	"github.com/digitalrebar/provision/v4/test"
+	"github.com/digitalrebar/provision/v4/test/fakeserver"
+	"github.com/pborman/uuid"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -23,8 +25,44 @@ var (
 	myToken             string
 	session             *api.Client
 	actuallyPowerThings = false
+	// fakeServer is the in-process stand-in for dr-provision that the
+	// tests run against when dr-provision is not installed.
+	fakeServer *fakeserver.Server
 )
 
+// startFakeServer starts fakeServer in tmpDir and logs in to it.
+func startFakeServer() error {
+	var err error
+	if fakeServer, err = fakeserver.New(tmpDir); err != nil {
+		return err
+	}
+	if err = fakeServer.Start("127.0.0.1:0", "127.0.0.1:0"); err != nil {
+		return err
+	}
+	session, err = api.UserSession(fakeServer.Endpoint(), fakeserver.DefaultUsername, fakeserver.DefaultPassword)
+	if err != nil {
+		return err
+	}
+	return session.MakeProxy(path.Join(tmpDir, ".socket"))
+}
+
+// cleanUp removes objs and the jobs of any machines among them, so
+// that the tests that count jobs are not thrown off.
+func cleanUp(objs ...models.Model) {
+	jobs := []*models.Job{}
+	session.Req().UrlFor("jobs").Do(&jobs)
+	for _, obj := range objs {
+		if m, ok := obj.(*models.Machine); ok {
+			for _, job := range jobs {
+				if uuid.Equal(job.Machine, m.Uuid) {
+					session.Req().Delete(job)
+				}
+			}
+		}
+		session.Req().Delete(obj)
+	}
+}
+
 type crudTest struct {
 	name      string
 	expectRes interface{}
@@ -160,6 +198,18 @@ func TestMain(m *testing.M) {
 		log.Printf("Creating temp dir for file root failed: %v", err)
 		os.Exit(1)
 	}
+	if _, err := exec.LookPath("dr-provision"); err != nil {
+		log.Printf("dr-provision is not installed, using the fake server")
+		if err := startFakeServer(); err != nil {
+			log.Printf("Error starting the fake server: %v", err)
+			os.RemoveAll(tmpDir)
+			os.Exit(1)
+		}
+		ret := m.Run()
+		fakeServer.Close()
+		os.RemoveAll(tmpDir)
+		os.Exit(ret)
+	}
 	if err := test.StartServer(tmpDir, 10021); err != nil {
 		log.Printf("Error starting dr-provision: %v", err)
 		os.RemoveAll(tmpDir)
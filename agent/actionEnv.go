@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// actionEnv controls who a script action runs as and what
+// environment it runs with.  Like actionLimits, it comes from the
+// Meta on the template that the action was rendered from, falling
+// back to the Meta on the Task:
+//
+// * RunAs is the user to run the action as, optionally followed by
+//   :group.  Both can be names or numeric IDs.  The group defaults to
+//   the primary group of the user.  The agent must be running as root
+//   to use it.  The action runs in a directory of its own in the task
+//   directory, which is given to the user and is what RS_TASK_DIR is
+//   set to.
+//
+// * CleanEnv, if true, starts the action with only PATH, LANG,
+//   LC_ALL, TZ, and TERM from the agent's environment instead of all
+//   of it.
+//
+// * EnvRemove is a comma separated list of environment variables to
+//   remove.  A name ending in * removes every variable that starts
+//   with the rest of the name.
+//
+// * Env is a newline separated list of NAME=value environment
+//   variables to add.  They are added last, so they override
+//   everything else.
+//
+// * WorkDir is the directory to run the action in.  Relative paths
+//   are relative to the task directory, which is the default.
+//
+// * Umask is the octal umask to run the action with.  It is set by
+//   running the action through /bin/sh.
+type actionEnv struct {
+	runUser, runGroup string
+	clean             bool
+	remove, add       []string
+	dir               string
+	umask             int
+}
+
+// cleanEnvVars are the variables from the agent's environment that
+// CleanEnv keeps.
+var cleanEnvVars = []string{"PATH", "LANG", "LC_ALL", "TZ", "TERM"}
+
+// parseActionEnv gets the environment for an action from the Meta on
+// its template, falling back to the Meta on its task.
+func parseActionEnv(actionMeta, taskMeta map[string]string) (*actionEnv, error) {
+	res := &actionEnv{umask: -1}
+	if val := metaValue(actionMeta, taskMeta, "RunAs"); val != "" {
+		parts := strings.SplitN(val, ":", 2)
+		res.runUser = parts[0]
+		if len(parts) == 2 {
+			res.runGroup = parts[1]
+		}
+		if res.runUser == "" {
+			return nil, fmt.Errorf("Invalid RunAs %q: missing user", val)
+		}
+	}
+	if val := metaValue(actionMeta, taskMeta, "CleanEnv"); val != "" {
+		clean, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CleanEnv %q: %v", val, err)
+		}
+		res.clean = clean
+	}
+	for _, name := range strings.Split(metaValue(actionMeta, taskMeta, "EnvRemove"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			res.remove = append(res.remove, name)
+		}
+	}
+	for _, line := range strings.Split(metaValue(actionMeta, taskMeta, "Env"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.Contains(line, "=") || strings.HasPrefix(line, "=") {
+			return nil, fmt.Errorf("Invalid Env %q: must be NAME=value", line)
+		}
+		res.add = append(res.add, line)
+	}
+	res.dir = metaValue(actionMeta, taskMeta, "WorkDir")
+	if val := metaValue(actionMeta, taskMeta, "Umask"); val != "" {
+		umask, err := strconv.ParseUint(val, 8, 32)
+		if err != nil || umask > 0777 {
+			return nil, fmt.Errorf("Invalid Umask %q: must be an octal number up to 0777", val)
+		}
+		res.umask = int(umask)
+	}
+	return res, nil
+}
+
+// removed returns whether the variable in env should be removed.
+func (e *actionEnv) removed(env string) bool {
+	name := strings.SplitN(env, "=", 2)[0]
+	for _, r := range e.remove {
+		if name == r || (strings.HasSuffix(r, "*") && strings.HasPrefix(name, strings.TrimSuffix(r, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// environ builds the environment for the action from the agent's
+// environment and the vars the agent always sets.
+func (e *actionEnv) environ(base, vars []string) []string {
+	res := []string{}
+	for _, env := range base {
+		if e.clean {
+			keep := false
+			for _, name := range cleanEnvVars {
+				keep = keep || strings.HasPrefix(env, name+"=")
+			}
+			if !keep {
+				continue
+			}
+		}
+		res = append(res, env)
+	}
+	res = append(res, vars...)
+	kept := res[:0]
+	for _, env := range res {
+		if !e.removed(env) {
+			kept = append(kept, env)
+		}
+	}
+	return append(kept, e.add...)
+}
+
+// workDir returns the directory to run the action in.
+func (e *actionEnv) workDir(taskDir string) string {
+	if e.dir == "" {
+		return taskDir
+	}
+	if path.IsAbs(e.dir) {
+		return e.dir
+	}
+	return path.Join(taskDir, e.dir)
+}
@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestActionEnv(t *testing.T) {
+	e, err := parseActionEnv(
+		map[string]string{"RunAs": "nobody:nogroup", "EnvRemove": "SECRET, AWS_*", "Env": "FOO=bar\n\nRS_UUID=override\n"},
+		map[string]string{"RunAs": "root", "CleanEnv": "false", "WorkDir": "sub", "Umask": "027"})
+	if err != nil {
+		t.Fatalf("ERROR: Unexpected error parsing environment: %v", err)
+	}
+	if e.runUser != "nobody" || e.runGroup != "nogroup" || e.clean || e.umask != 027 {
+		t.Errorf("ERROR: Unexpected environment %+v", e)
+	}
+	if dir := e.workDir("/tmp/task"); dir != "/tmp/task/sub" {
+		t.Errorf("ERROR: Expected workdir /tmp/task/sub, got %s", dir)
+	}
+	base := []string{"PATH=/bin", "SECRET=x", "AWS_KEY=y", "AWS=z", "HOME=/root"}
+	vars := []string{"RS_UUID=1234"}
+	got := strings.Join(e.environ(base, vars), " ")
+	want := "PATH=/bin AWS=z HOME=/root RS_UUID=1234 FOO=bar RS_UUID=override"
+	if got != want {
+		t.Errorf("ERROR: Expected env %q, got %q", want, got)
+	}
+	e.clean = true
+	got = strings.Join(e.environ(base, vars), " ")
+	want = "PATH=/bin RS_UUID=1234 FOO=bar RS_UUID=override"
+	if got != want {
+		t.Errorf("ERROR: Expected clean env %q, got %q", want, got)
+	}
+	e, err = parseActionEnv(nil, nil)
+	if err != nil || e.runUser != "" || e.umask != -1 || e.workDir("/tmp/task") != "/tmp/task" {
+		t.Errorf("ERROR: Unexpected default environment %+v: %v", e, err)
+	}
+	for _, bad := range []map[string]string{
+		{"RunAs": ":wheel"},
+		{"CleanEnv": "sometimes"},
+		{"Env": "NOVALUE"},
+		{"Umask": "999"},
+	} {
+		if _, err := parseActionEnv(bad, nil); err == nil {
+			t.Errorf("ERROR: Expected %v to be invalid", bad)
+		} else {
+			t.Logf("Got expected error %v", err)
+		}
+	}
+}
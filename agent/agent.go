@@ -3,6 +3,7 @@ package agent
 import (
 	"bufio"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -36,6 +37,7 @@ const (
 	AGENT_REBOOT
 	AGENT_POWEROFF
 	AGENT_KEXEC
+	AGENT_RUN_CONTEXT
 )
 
 type si struct {
@@ -63,6 +65,19 @@ type si struct {
 // Additionally, this agent will automatically reboot the system when
 // it detects that the machine's boot environment has changed, unless
 // the machine is in an OS install, in which case the agent will exit.
+//
+// If the agent has an Executor for the Engine of the Context that the
+// machine switches to, it will use the Executor to run the tasks for
+// that Context.
+//
+// Job log writes and job state updates that cannot reach dr-provision
+// are spooled and replayed in order once it can be reached again, so
+// that tasks keep running through short outages.  If the agent has a
+// StateLoc, the spool is kept there so it survives agent restarts.
+//
+// The agent can also serve a local status API (see StatusSocket) and
+// Prometheus metrics (see MetricsAddr and MetricsTextfile), and can
+// report what it would do without doing it (see DryRun).
 type Agent struct {
 	state                                     state
 	waitTimeout                               time.Duration
@@ -79,6 +94,16 @@ type Agent struct {
 	taskMux                                   *sync.Mutex
 	exitNow                                   bool
 	kill                                      chan error
+	executors                                 map[string]Executor
+	cancelContext                             func()
+	spool                                     *spool
+	statusSock, statusAddr                    string
+	status                                    Status
+	paused                                    bool
+	pauseCond                                 *sync.Cond
+	metricsAddr, metricsDir                   string
+	metrics                                   *metrics
+	shadowDir                                 string
 }
 
 func (a *Agent) saveState() (err error) {
@@ -111,6 +136,15 @@ func (a *Agent) saveState() (err error) {
 	return
 }
 
+// spoolDir is where the spool for job logs and state updates lives
+// if the agent has a stateDir.
+func (a *Agent) spoolDir() string {
+	if a.stateDir == "" {
+		return ""
+	}
+	return path.Join(a.stateDir, a.machine.Key()+".spool")
+}
+
 func (a *Agent) tmpDir() string {
 	return path.Dir(a.runnerDir)
 }
@@ -131,6 +165,8 @@ func New(c *api.Client, m *models.Machine,
 		waitTimeout:       1 * time.Hour,
 		taskMux:           &sync.Mutex{},
 	}
+	res.pauseCond = sync.NewCond(res.taskMux)
+	res.status.Started = time.Now()
 	if res.logger == nil {
 		res.logger = os.Stderr
 	}
@@ -170,6 +206,58 @@ func (a *Agent) RunnerDir(s string) *Agent {
 	return a
 }
 
+// MetricsAddr has the agent serve Prometheus metrics at /metrics on
+// addr while it runs.
+func (a *Agent) MetricsAddr(addr string) *Agent {
+	a.metricsAddr = addr
+	return a
+}
+
+// MetricsTextfile has the agent keep its Prometheus metrics in
+// drp_agent.prom in dir, for the node exporter textfile collector.
+func (a *Agent) MetricsTextfile(dir string) *Agent {
+	a.metricsDir = dir
+	return a
+}
+
+// Executor has the agent use e to run the tasks for Contexts whose
+// Engine is engine.  It is only used when the agent is not running
+// in a Context itself.
+func (a *Agent) Executor(engine string, e Executor) *Agent {
+	if a.executors == nil {
+		a.executors = map[string]Executor{}
+	}
+	a.executors[engine] = e
+	return a
+}
+
+// executorFor returns the Context named name and the Executor for
+// it, if the agent runs tasks for it.
+func (a *Agent) executorFor(name string) (*models.Context, Executor) {
+	if a.context != "" || name == "" || len(a.executors) == 0 {
+		return nil, nil
+	}
+	c := &models.Context{}
+	if err := a.client.FillModel(c, name); err != nil {
+		return nil, nil
+	}
+	if e, ok := a.executors[c.Engine]; ok {
+		return c, e
+	}
+	return nil, nil
+}
+
+// inExecutorContext tests whether the machine is in a Context the
+// agent has an Executor for.
+func (a *Agent) inExecutorContext(ref interface{}) (bool, error) {
+	m, ok := ref.(*models.Machine)
+	if !ok {
+		return false, nil
+	}
+	c, _ := a.executorFor(m.Context)
+	return c != nil, nil
+}
+
 func (a *Agent) markNotRunnable() {
 	if !(a.machine.Context == "" && a.context == "") {
 		return
@@ -199,6 +287,7 @@ func (a *Agent) power(cmdLine string) error {
 		}
 	}
 	a.markNotRunnable()
+	action := cmdLine
 	args := []string{}
 	if runtime.GOOS == "windows" {
 		switch cmdLine {
@@ -209,6 +298,7 @@ func (a *Agent) power(cmdLine string) error {
 		}
 		cmdLine = "shutdown"
 	}
+	a.metrics.power(action)
 	cmd := exec.Command(cmdLine, args...)
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
@@ -249,6 +339,12 @@ func (a *Agent) init() {
 		a.events = nil
 	}
 	var err error
+	// Updates from before a restart or outage have to land before we
+	// decide what to do with the current job.
+	if a.err = a.spool.drain(); a.err != nil {
+		a.exitOrSleep()
+		return
+	}
 	currentJob := &models.Job{Uuid: a.machine.CurrentJob}
 	if a.client.Req().Fill(currentJob) == nil && currentJob.Context == a.context {
 		// Only reset job state if we were responsible for creating it in the first place.
@@ -267,6 +363,7 @@ func (a *Agent) init() {
 		a.exitOrSleep()
 		return
 	}
+	a.metrics.eventsOpen()
 	a.state = AGENT_WAIT_FOR_RUNNABLE
 }
 
@@ -401,6 +498,7 @@ func (a *Agent) doKexec() {
 		a.state = AGENT_EXIT
 		return
 	}
+	a.metrics.power("kexec")
 	var cmdErr error
 	if _, err := exec.LookPath("systemctl"); err == nil {
 		cmdErr = exec.Command("systemctl", "kexec").Run()
@@ -449,12 +547,14 @@ func (a *Agent) waitOn(m *models.Machine, cond api.TestFunc) {
 	// * The machine is available, and
 	// * The ancilliary condition is met, and
 	// * Either the machine context matches the one the agent cares about, or
+	// * The machine is in a context the agent has an Executor for, or
 	// * The bootenv changed.
 	found, err := a.events.WaitFor(m,
 		api.AndItems(
 			api.EqualItem("Available", true),
 			api.OrItems(
 				api.EqualItem("Context", a.context),
+				a.inExecutorContext,
 				api.NotItem(api.EqualItem("BootEnv", a.machine.BootEnv))),
 			cond),
 		a.waitTimeout)
@@ -482,6 +582,8 @@ func (a *Agent) waitOn(m *models.Machine, cond api.TestFunc) {
 			} else {
 				a.state = AGENT_WAIT_FOR_RUNNABLE
 			}
+		} else if m.Runnable {
+			a.state = AGENT_RUN_CONTEXT
 		}
 	default:
 		err := &models.Error{
@@ -500,7 +602,9 @@ func (a *Agent) waitOn(m *models.Machine, cond api.TestFunc) {
 func (a *Agent) waitRunnable() {
 	m := models.Clone(a.machine).(*models.Machine)
 	a.logf("Waiting on machine to become runnable\n")
+	start := time.Now()
 	a.waitOn(m, api.EqualItem("Runnable", true))
+	a.metrics.waitedRunnable(time.Since(start))
 }
 
 // runTask attempts to run the next task on the Machine.  It may
@@ -517,12 +621,26 @@ func (a *Agent) waitRunnable() {
 // * AGENT_WAIT_FOR_RUNNABLE if no other conditions were met.
 func (a *Agent) runTask() {
 	var err error
+	if err = a.spool.drain(); err != nil {
+		a.err = err
+		a.initOrExit()
+		return
+	}
 	a.taskMux.Lock()
+	if a.paused && !a.exitNow {
+		a.logf("Agent paused, waiting to be resumed\n")
+	}
+	for a.paused && !a.exitNow {
+		a.pauseCond.Wait()
+	}
 	if a.exitNow {
 		a.taskMux.Unlock()
 		return
 	}
 	a.task, err = newRunner(a, a.machine, a.runnerDir, a.chrootDir, a.logger)
+	if a.task != nil {
+		a.status.Job, a.status.Task = a.task.j.Key(), a.task.j.Task
+	}
 	a.taskMux.Unlock()
 	if err != nil {
 		a.err = err
@@ -544,7 +662,12 @@ func (a *Agent) runTask() {
 		a.state = AGENT_WAIT_FOR_CHANGE_STAGE
 		return
 	}
-	defer func() { a.taskMux.Lock(); defer a.taskMux.Unlock(); a.task = nil }()
+	defer func() {
+		a.taskMux.Lock()
+		defer a.taskMux.Unlock()
+		a.task = nil
+		a.status.Job, a.status.Task = "", ""
+	}()
 	a.logf("Runner created for task %s:%s:%s (%d:%d)\n",
 		a.task.j.Workflow,
 		a.task.j.Stage,
@@ -557,7 +680,16 @@ func (a *Agent) runTask() {
 		a.task.Close()
 		return
 	}
-	if err := a.task.run(); err != nil {
+	start := time.Now()
+	err = a.task.run()
+	if a.task.t != nil {
+		exitState := a.task.j.ExitState
+		if exitState == "" {
+			exitState = "failed"
+		}
+		a.metrics.task(a.task.t.Name, time.Since(start), exitState)
+	}
+	if err != nil {
 		a.err = err
 		a.initOrExit()
 		return
@@ -588,6 +720,57 @@ func (a *Agent) runTask() {
 	}
 }
 
+// runContext uses the Executor for the machine's Context to run the
+// tasks in that Context.  It transitions to AGENT_WAIT_FOR_RUNNABLE if
+// the tasks in the Context made progress, and otherwise handles it
+// like an error.
+func (a *Agent) runContext() {
+	c, e := a.executorFor(a.machine.Context)
+	if c == nil {
+		a.state = AGENT_WAIT_FOR_RUNNABLE
+		return
+	}
+	a.taskMux.Lock()
+	if a.exitNow {
+		a.taskMux.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancelContext = cancel
+	a.taskMux.Unlock()
+	defer func() {
+		a.taskMux.Lock()
+		a.cancelContext = nil
+		a.taskMux.Unlock()
+		cancel()
+	}()
+	before := a.machine.CurrentTask
+	env := []string{
+		"RS_ENDPOINT=" + a.client.Endpoint(),
+		"RS_TOKEN=" + a.client.Token(),
+		"RS_UUID=" + a.machine.Key(),
+		"RS_CONTEXT=" + c.Name,
+	}
+	a.logf("Running tasks in context %s with engine %s\n", c.Name, c.Engine)
+	err := e.Run(ctx, c, a.machine, env, a.logger)
+	m := &models.Machine{}
+	if ferr := a.client.FillModel(m, a.machine.Key()); ferr != nil && err == nil {
+		err = ferr
+	} else if ferr == nil {
+		a.machine = m
+	}
+	if err == nil && a.machine.Context == c.Name && a.machine.CurrentTask == before {
+		err = fmt.Errorf("Context %s did not run any tasks", c.Name)
+	}
+	if err != nil {
+		a.err = err
+		a.initOrExit()
+		return
+	}
+	a.logf("Finished running tasks in context %s\n", c.Name)
+	a.state = AGENT_WAIT_FOR_RUNNABLE
+}
+
 // waitChangeStage has waitOn wait for any of the following on the
 // machine to change:
 //
@@ -741,6 +924,10 @@ func (a *Agent) Kill() error {
 		a.task.log("Agent signalled to exit")
 		a.task.kill()
 	}
+	if a.cancelContext != nil {
+		a.cancelContext()
+	}
+	a.pauseCond.Broadcast()
 	a.taskMux.Unlock()
 	return <-a.kill
 }
@@ -754,6 +941,9 @@ func (a *Agent) Close() {
 
 // Run kicks off the state machine for this agent.
 func (a *Agent) Run() error {
+	if a.shadowDir != "" {
+		return a.dryRun()
+	}
 	if a.context == "" && (a.machine.HasFeature("original-change-stage") ||
 		!a.machine.HasFeature("change-stage-v2")) {
 		newM := models.Clone(a.machine).(*models.Machine)
@@ -788,11 +978,33 @@ func (a *Agent) Run() error {
 		a.runnerDir = runnerDir
 	}
 	a.loadState()
+	spool, err := newSpool(a.spoolDir(), a.client, a.logger)
+	if err != nil {
+		return err
+	}
+	a.spool = spool
+	defer spool.close()
+	stopStatus, err := a.serveStatus()
+	if err != nil {
+		return err
+	}
+	defer stopStatus()
+	metricsState := ""
+	if a.stateDir != "" {
+		metricsState = path.Join(a.stateDir, a.machine.Key()+".metrics.json")
+	}
+	if a.metricsAddr != "" || a.metricsDir != "" {
+		if a.metrics, err = newMetrics(metricsState, a.metricsAddr, a.metricsDir); err != nil {
+			return err
+		}
+		defer a.metrics.close()
+	}
 	for {
 		a.taskMux.Lock()
 		if a.exitNow {
 			a.state = AGENT_EXIT
 		}
+		a.snapshot()
 		a.taskMux.Unlock()
 		if err := os.MkdirAll(a.runnerDir, 0755); err != nil {
 			return err
@@ -822,6 +1034,9 @@ func (a *Agent) Run() error {
 				a.chrootDir = ""
 				a.waitRunnable()
 			} else {
+				if err := a.spool.drain(); err != nil {
+					a.logf("%v\n", err)
+				}
 				a.logf("Agent exiting\n")
 				a.taskMux.Lock()
 				if a.exitNow {
@@ -833,6 +1048,9 @@ func (a *Agent) Run() error {
 		case AGENT_KEXEC:
 			a.logf("Attempting to kexec\n")
 			a.doKexec()
+		case AGENT_RUN_CONTEXT:
+			a.logf("Agent running tasks in context %s\n", a.machine.Context)
+			a.runContext()
 		case AGENT_REBOOT:
 			a.logf("Agent rebooting\n")
 			return a.power("reboot")
@@ -0,0 +1,138 @@
+// +build linux
+
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroup is the cgroup v2 directory that limits a single action.
+type cgroup struct {
+	dir string
+	fd  *os.File
+}
+
+func cgroupWrite(dir, file, val string) error {
+	return ioutil.WriteFile(path.Join(dir, file), []byte(val), 0644)
+}
+
+// enterCgroup creates a cgroup under drp-agent with the limits in l,
+// and arranges for cmd to be started in it, so that nothing cmd runs
+// can escape the limits.  started must be called once cmd has been
+// started.
+func (r *runner) enterCgroup(cmd *exec.Cmd, l *actionLimits) (*cgroup, error) {
+	if !l.wantCgroup() {
+		return nil, nil
+	}
+	if _, err := os.Stat(path.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("cgroup v2 is not mounted at %s", cgroupRoot)
+	}
+	controllers := []string{}
+	if l.cpu > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if l.memory > 0 {
+		controllers = append(controllers, "memory")
+	}
+	if l.pids > 0 {
+		controllers = append(controllers, "pids")
+	}
+	parent := path.Join(cgroupRoot, "drp-agent")
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{cgroupRoot, parent} {
+		for _, c := range controllers {
+			if err := cgroupWrite(dir, "cgroup.subtree_control", "+"+c); err != nil {
+				return nil, fmt.Errorf("Unable to enable the %s controller in %s: %v", c, dir, err)
+			}
+		}
+	}
+	dir, err := ioutil.TempDir(parent, r.j.Key()+"-")
+	if err != nil {
+		return nil, err
+	}
+	res := &cgroup{dir: dir}
+	limits := [][2]string{}
+	if l.cpu > 0 {
+		limits = append(limits, [2]string{"cpu.max", fmt.Sprintf("%d 100000", int64(l.cpu*100000))})
+	}
+	if l.memory > 0 {
+		limits = append(limits, [2]string{"memory.max", strconv.FormatInt(l.memory, 10)})
+	}
+	if l.pids > 0 {
+		limits = append(limits, [2]string{"pids.max", strconv.FormatInt(l.pids, 10)})
+	}
+	for _, lim := range limits {
+		if err := cgroupWrite(dir, lim[0], lim[1]); err != nil {
+			res.close()
+			return nil, fmt.Errorf("Unable to set %s: %v", lim[0], err)
+		}
+	}
+	if res.fd, err = os.OpenFile(dir, os.O_RDONLY|syscall.O_DIRECTORY, 0); err != nil {
+		res.close()
+		return nil, err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(res.fd.Fd())
+	return res, nil
+}
+
+// started releases what was only needed to start the command in the
+// cgroup.
+func (cg *cgroup) started() {
+	if cg != nil && cg.fd != nil {
+		cg.fd.Close()
+		cg.fd = nil
+	}
+}
+
+// oomKilled returns whether the memory limit on the cgroup caused
+// anything in it to be killed.
+func (cg *cgroup) oomKilled() bool {
+	if cg == nil {
+		return false
+	}
+	fi, err := os.Open(path.Join(cg.dir, "memory.events"))
+	if err != nil {
+		return false
+	}
+	defer fi.Close()
+	sc := bufio.NewScanner(fi)
+	for sc.Scan() {
+		parts := strings.Fields(sc.Text())
+		if len(parts) == 2 && parts[0] == "oom_kill" {
+			return parts[1] != "0"
+		}
+	}
+	return false
+}
+
+// close kills anything left in the cgroup and removes it.
+func (cg *cgroup) close() {
+	if cg == nil {
+		return
+	}
+	cg.started()
+	cgroupWrite(cg.dir, "cgroup.kill", "1")
+	for i := 0; i < 10; i++ {
+		if os.Remove(cg.dir) == nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,51 @@
+// +build linux
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/pborman/uuid"
+)
+
+func TestCgroup(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Cgroups can only be set up as root")
+	}
+	r := &runner{j: &models.Job{Uuid: uuid.NewRandom()}}
+	cmd := exec.Command("/bin/sh", "-c", "cat /proc/self/cgroup")
+	cg, err := r.enterCgroup(cmd, &actionLimits{pids: 10})
+	controllers, _ := ioutil.ReadFile(path.Join(cgroupRoot, "cgroup.controllers"))
+	if !strings.Contains(" "+strings.TrimSpace(string(controllers))+" ", " pids ") {
+		// The limits cannot be applied, and the action must not run
+		// without them.
+		if err == nil {
+			cg.close()
+			t.Errorf("ERROR: Expected the cgroup to fail without the cgroup v2 pids controller")
+		} else {
+			t.Logf("Got expected error %v", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("ERROR: Unable to set up the cgroup: %v", err)
+	}
+	defer cg.close()
+	out, err := cmd.Output()
+	cg.started()
+	if err != nil {
+		t.Fatalf("ERROR: Command failed: %v", err)
+	}
+	// The command is in the cgroup from the start, so it is in there
+	// when it looks.
+	want := "0::" + strings.TrimPrefix(cg.dir, cgroupRoot) + "\n"
+	if !strings.Contains(string(out), want) {
+		t.Errorf("ERROR: Expected %q in the cgroups of the command, got %q", want, out)
+	}
+}
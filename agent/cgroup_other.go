@@ -0,0 +1,24 @@
+// +build !linux
+
+package agent
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+type cgroup struct{}
+
+func (r *runner) enterCgroup(cmd *exec.Cmd, l *actionLimits) (*cgroup, error) {
+	if l.wantCgroup() {
+		return nil, fmt.Errorf("CPU, memory, and pids limits not supported on %v", runtime.GOOS)
+	}
+	return nil, nil
+}
+
+func (cg *cgroup) started() {}
+
+func (cg *cgroup) oomKilled() bool { return false }
+
+func (cg *cgroup) close() {}
@@ -27,6 +27,13 @@ func bindMount(newRoots string, srcFS ...string) error {
 	return nil
 }
 
+// unbindMount undoes bindMount.
+func unbindMount(newRoots string, srcFS ...string) {
+	for i := len(srcFS) - 1; i > -1; i-- {
+		syscall.Unmount(path.Join(newRoots, srcFS[i]), 0)
+	}
+}
+
 func (r *runner) bindFSes() []string {
 	return []string{"/proc", "/sys", "/dev", "/dev/pts", r.agentDir}
 }
@@ -46,8 +53,5 @@ func (r *runner) exitChroot() {
 	if r.chrootDir == "" {
 		return
 	}
-	fses := r.bindFSes()
-	for i := len(fses) - 1; i > -1; i-- {
-		syscall.Unmount(path.Join(r.chrootDir, fses[i]), 0)
-	}
+	unbindMount(r.chrootDir, r.bindFSes()...)
 }
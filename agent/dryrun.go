@@ -0,0 +1,298 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/VictorLowther/jsonpatch2/utils"
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/digitalrebar/provision/v4/render"
+)
+
+// DryRun has Run report what the agent would do for the machine
+// instead of doing it.  Nothing on the machine is changed and no jobs
+// are created:
+//
+// * The actions of the machine's current job are fetched from
+//   dr-provision.  The actions of the tasks after it are rendered
+//   locally, since they do not have jobs yet.
+//
+// * Files are written under shadowDir instead of where they belong.
+//   Relative paths go in a directory for each task, and absolute paths
+//   go under shadowDir/root.
+//
+// * Scripts are written to the directory for their task and printed,
+//   but not run.
+//
+// * stage:, bootenv:, and context: tasks, and what the agent would do
+//   when it runs out of tasks, are reported as the state the agent
+//   would transition to.
+func (a *Agent) DryRun(shadowDir string) *Agent {
+	a.shadowDir = shadowDir
+	return a
+}
+
+// dryRun walks a copy of the machine through its task list.
+type dryRun struct {
+	a        *Agent
+	m        *models.Machine
+	job      *models.Job
+	renderer *render.Renderer
+}
+
+func (d *dryRun) logf(f string, args ...interface{}) {
+	d.a.logf("Dry run: "+f+"\n", args...)
+}
+
+func (d *dryRun) transition(s state, f string, args ...interface{}) {
+	d.logf("would transition to %s: %s", s, fmt.Sprintf(f, args...))
+}
+
+// loadRenderer builds a Renderer from the objects on dr-provision.
+// Tokens in the rendered actions are placeholders.
+func (d *dryRun) loadRenderer() error {
+	if d.renderer != nil {
+		return nil
+	}
+	src := render.NewObjects()
+	for _, prefix := range []string{"templates", "params", "profiles", "stages", "tasks", "bootenvs"} {
+		objs, err := d.a.client.ListModel(prefix)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objs {
+			src.Add(obj)
+		}
+	}
+	info, err := d.a.client.Info()
+	if err != nil {
+		return err
+	}
+	addr := info.Address.String()
+	d.renderer = &render.Renderer{
+		Source:             src,
+		Info:               info,
+		ProvisionerAddress: addr,
+		ProvisionerURL:     "http://" + net.JoinHostPort(addr, strconv.Itoa(info.FilePort)),
+		ApiURL:             d.a.client.Endpoint(),
+	}
+	return nil
+}
+
+// actions returns the actions for the task at idx, from the current
+// job if it is for that task.
+func (d *dryRun) actions(idx int, task *models.Task) (models.JobActions, error) {
+	if d.job != nil && d.job.CurrentIndex == idx && d.job.Task == task.Name {
+		d.logf("fetching actions for %s from job %s", task.Name, d.job.Key())
+		res, err := jobActions(d.a.client, d.job, runtime.GOOS)
+		return res.FilterOS(runtime.GOOS), err
+	}
+	if err := d.loadRenderer(); err != nil {
+		return nil, err
+	}
+	d.logf("rendering actions for %s locally", task.Name)
+	res, rerr := d.renderer.RenderTask(d.m, task)
+	if rerr != nil {
+		return nil, rerr
+	}
+	return res.FilterOS(runtime.GOOS), nil
+}
+
+// shadowPath returns where p goes under dir.  p is cleaned as if it
+// were absolute, so that it cannot climb out of dir with "..".
+func shadowPath(dir, p string) (string, error) {
+	res := path.Join(dir, path.Clean("/"+p))
+	if res == path.Clean(dir) || !strings.HasPrefix(res, path.Clean(dir)+"/") {
+		return "", fmt.Errorf("%s is not a valid path under %s", p, dir)
+	}
+	return res, nil
+}
+
+// runTask writes the files of the task at idx to the shadow directory
+// and prints its scripts.
+func (d *dryRun) runTask(idx int, name string) error {
+	task := &models.Task{}
+	if err := d.a.client.FillModel(task, name); err != nil {
+		return err
+	}
+	actions, err := d.actions(idx, task)
+	if err != nil {
+		return err
+	}
+	taskDir, err := shadowPath(d.a.shadowDir, fmt.Sprintf("%03d-%s", idx, name))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(taskDir, 0755); err != nil {
+		return err
+	}
+	for _, action := range actions {
+		if action.Path == "" {
+			script, err := shadowPath(taskDir, name+"-"+action.Name)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(script, []byte(action.Content), 0600); err != nil {
+				return err
+			}
+			d.logf("would run script %s, saved as %s:\n%s", action.Name, script, action.Content)
+			continue
+		}
+		dest, err := shadowPath(taskDir, action.Path)
+		if strings.HasPrefix(action.Path, "/") {
+			dest, err = shadowPath(path.Join(d.a.shadowDir, "root"), action.Path)
+		}
+		if err != nil {
+			return err
+		}
+		if action.Link != "" {
+			d.logf("would link %s to %s", action.Path, action.Link)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(dest, []byte(action.Content), 0644); err != nil {
+			return err
+		}
+		d.logf("would write %s to %s, saved as %s", action.Name, action.Path, dest)
+	}
+	return nil
+}
+
+// changeStage reports what the agent would do when the machine runs
+// out of tasks, following the same rules as Agent.changeStage.
+func (d *dryRun) changeStage() error {
+	if d.m.Workflow != "" {
+		d.transition(AGENT_WAIT_FOR_CHANGE_STAGE, "the workflow %s is complete", d.m.Workflow)
+		return nil
+	}
+	inInstall := strings.HasSuffix(d.m.BootEnv, "-install")
+	var cmObj interface{}
+	csMap := map[string]string{}
+	if err := d.a.client.Req().Get().
+		UrlForM(d.m, "params", "change-stage/map").
+		Params("aggregate", "true").Do(&cmObj); err == nil {
+		if err := utils.Remarshal(cmObj, &csMap); err != nil {
+			return err
+		}
+	}
+	var nextStage, targetState string
+	if ns, ok := csMap[d.m.Stage]; ok {
+		pieces := strings.SplitN(ns, ":", 2)
+		nextStage = pieces[0]
+		if len(pieces) == 2 {
+			targetState = pieces[1]
+		}
+	}
+	if nextStage == "" {
+		if inInstall {
+			nextStage = "local"
+		} else {
+			nextStage = d.m.Stage
+		}
+	}
+	if nextStage == d.m.Stage {
+		d.transition(AGENT_WAIT_FOR_CHANGE_STAGE, "there is no next stage after %s", d.m.Stage)
+		return nil
+	}
+	newStage := &models.Stage{}
+	if err := d.a.client.FillModel(newStage, nextStage); err != nil {
+		return err
+	}
+	d.logf("would change stage from %s to %s", d.m.Stage, nextStage)
+	next, why := AGENT_WAIT_FOR_RUNNABLE, "the stage keeps the bootenv"
+	if newStage.BootEnv != "" && newStage.BootEnv != d.m.BootEnv {
+		next, why = d.reboot(), "stage "+nextStage+" wants bootenv "+newStage.BootEnv
+	}
+	switch targetState {
+	case "Reboot":
+		next, why = d.reboot(), "the change-stage/map says to reboot"
+	case "Stop":
+		next, why = AGENT_EXIT, "the change-stage/map says to stop"
+	case "Shutdown":
+		next, why = AGENT_POWEROFF, "the change-stage/map says to shut down"
+	}
+	if newStage.Reboot {
+		next, why = d.reboot(), "stage "+nextStage+" has the Reboot flag"
+	}
+	d.transition(next, "%s", why)
+	return nil
+}
+
+// reboot returns the state rebootOrExit would transition to.
+func (d *dryRun) reboot() state {
+	if strings.HasSuffix(d.m.BootEnv, "-install") {
+		return AGENT_EXIT
+	}
+	return AGENT_REBOOT
+}
+
+// dryRun is what Run does instead of running the agent when DryRun
+// has been called.
+func (a *Agent) dryRun() error {
+	if err := os.MkdirAll(a.shadowDir, 0755); err != nil {
+		return err
+	}
+	d := &dryRun{a: a, m: models.Clone(a.machine).(*models.Machine)}
+	if !d.m.Runnable {
+		d.logf("machine %s is not runnable, the agent would wait for it to be", d.m.Name)
+	}
+	idx := d.m.CurrentTask
+	if idx < 0 {
+		idx = 0
+	}
+	if d.m.CurrentJob != nil {
+		job := &models.Job{}
+		if err := a.client.FillModel(job, d.m.CurrentJob.String()); err == nil && job.CurrentIndex == idx {
+			if job.State == "finished" {
+				idx++
+			} else {
+				d.job = job
+			}
+		}
+	}
+	for ; idx < len(d.m.Tasks); idx++ {
+		name := d.m.Tasks[idx]
+		d.logf("task %d: %s", idx, name)
+		parts := strings.SplitN(name, ":", 2)
+		if len(parts) == 1 {
+			if c, _ := a.executorFor(d.m.Context); d.m.Context != a.context && c == nil {
+				d.logf("skipping %s, it runs in context %q", name, d.m.Context)
+				continue
+			}
+			if err := d.runTask(idx, name); err != nil {
+				return err
+			}
+			continue
+		}
+		switch parts[0] {
+		case "stage":
+			d.logf("would change stage from %s to %s", d.m.Stage, parts[1])
+			d.m.Stage = parts[1]
+		case "bootenv":
+			if parts[1] != d.m.BootEnv && a.context == "" {
+				d.transition(d.reboot(), "bootenv changes from %s to %s", d.m.BootEnv, parts[1])
+			}
+			d.m.BootEnv = parts[1]
+		case "context":
+			d.logf("would change context from %q to %q", d.m.Context, parts[1])
+			if c, _ := a.executorFor(parts[1]); c != nil {
+				d.transition(AGENT_RUN_CONTEXT, "engine %s runs the tasks for context %s", c.Engine, c.Name)
+			}
+			d.m.Context = parts[1]
+		case "chroot":
+			d.logf("would run the following tasks chrooted into %s", parts[1])
+		default:
+			d.logf("unknown task type %s", parts[0])
+		}
+	}
+	return d.changeStage()
+}
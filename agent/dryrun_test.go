@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+func TestShadowPath(t *testing.T) {
+	for p, want := range map[string]string{
+		"file.txt":                "/shadow/task/file.txt",
+		"sub/../file.txt":         "/shadow/task/file.txt",
+		"../../etc/cron.d/x":      "/shadow/task/etc/cron.d/x",
+		"/etc/hosts":              "/shadow/task/etc/hosts",
+		"task-../../../../escape": "/shadow/task/escape",
+	} {
+		got, err := shadowPath("/shadow/task", p)
+		if err != nil || got != want {
+			t.Errorf("ERROR: shadowPath(%q): expected %s, got %s: %v", p, want, got, err)
+		}
+	}
+	for _, p := range []string{"", "..", "/", "a/../.."} {
+		if got, err := shadowPath("/shadow/task", p); err == nil {
+			t.Errorf("ERROR: shadowPath(%q): expected an error, got %s", p, got)
+		} else {
+			t.Logf("Got expected error %v", err)
+		}
+	}
+}
+
+func TestAgentDryRun(t *testing.T) {
+	tjd, err := ioutil.TempDir("", "fakeagent-")
+	if err != nil {
+		t.Fatalf("Failed to create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(tjd)
+	task := &models.Task{
+		Name: "dry-task",
+		Templates: []models.TemplateInfo{
+			{Name: "rel", Path: "rel.txt", Contents: "{{.Param \"greeting\"}}\n"},
+			{Name: "abs", Path: path.Join(tjd, "real", "abs.txt"), Contents: "abs\n"},
+			{Name: "escape", Path: "../../escape.txt", Contents: "escape\n"},
+			{Name: "script", Contents: "#!/usr/bin/env bash\ntouch " + path.Join(tjd, "ran") + "\n"},
+		},
+	}
+	stage := &models.Stage{Name: "dry-stage", Tasks: []string{"dry-task"}}
+	next := &models.Stage{Name: "dry-next", Reboot: true}
+	m := &models.Machine{
+		Name:  "dry-agent",
+		Stage: "dry-stage",
+		Params: map[string]interface{}{
+			"greeting":         "hello",
+			"change-stage/map": map[string]interface{}{"dry-stage": "dry-next"},
+		},
+		Meta: models.Meta{"feature-flags": "change-stage-v2"},
+	}
+	defer cleanUp(m, stage, next, task)
+	for _, obj := range []models.Model{task, stage, next, m} {
+		if f, ok := obj.(models.Filler); ok {
+			f.Fill()
+		}
+		if err := session.CreateModel(obj); err != nil {
+			t.Fatalf("ERROR: Failed to create %s: %v", obj.Prefix(), err)
+		}
+	}
+	shadow := path.Join(tjd, "shadow")
+	dryRun := func() string {
+		t.Helper()
+		log := &bytes.Buffer{}
+		a, err := New(session, m, true, true, false, log)
+		if err != nil {
+			t.Fatalf("ERROR: Agent create failed: %v", err)
+		}
+		if err := a.Timeout(time.Second).DryRun(shadow).Run(); err != nil {
+			t.Errorf("ERROR: Dry run failed: %v", err)
+		}
+		t.Logf("Agent log:\n%s", log.String())
+		return log.String()
+	}
+	log := dryRun()
+	for _, want := range []string{
+		"rendering actions for dry-task locally",
+		"would run script script",
+		"would change stage from dry-stage to dry-next",
+		"would transition to AGENT_REBOOT: stage dry-next has the Reboot flag",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("ERROR: Dry run log missing %q", want)
+		}
+	}
+	for name, want := range map[string]string{
+		"000-dry-task/rel.txt":                 "hello\n",
+		path.Join("root", tjd, "real/abs.txt"): "abs\n",
+		"000-dry-task/escape.txt":              "escape\n",
+	} {
+		if buf, err := ioutil.ReadFile(path.Join(shadow, name)); err != nil || string(buf) != want {
+			t.Errorf("ERROR: Shadow %s has %q: %v", name, string(buf), err)
+		}
+	}
+	for _, name := range []string{"ran", "real", "escape.txt"} {
+		if _, err := os.Stat(path.Join(tjd, name)); err == nil {
+			t.Errorf("ERROR: Dry run made %s outside the shadow directory", name)
+		}
+	}
+	if err := session.FillModel(m, m.Key()); err != nil {
+		t.Fatalf("ERROR: Failed to refetch machine: %v", err)
+	}
+	if m.CurrentJob != nil || m.Stage != "dry-stage" || m.CurrentTask != -1 {
+		t.Errorf("ERROR: Dry run changed the machine: job %v, stage %s, task %d", m.CurrentJob, m.Stage, m.CurrentTask)
+	}
+	// With a job to run, its actions come from dr-provision.
+	job := &models.Job{Machine: m.Uuid}
+	if err := session.CreateModel(job); err != nil {
+		t.Fatalf("ERROR: Failed to create job: %v", err)
+	}
+	if err := session.FillModel(m, m.Key()); err != nil {
+		t.Fatalf("ERROR: Failed to refetch machine: %v", err)
+	}
+	if log := dryRun(); !strings.Contains(log, "fetching actions for dry-task from job "+job.Key()) {
+		t.Errorf("ERROR: Dry run did not use the actions of job %s", job.Key())
+	}
+	if err := session.FillModel(job, job.Key()); err != nil || job.State != "created" {
+		t.Errorf("ERROR: Dry run changed job state to %s: %v", job.State, err)
+	}
+}
@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+// Executor runs the tasks for a Machine in a Context by starting an
+// agent for that Context in the execution environment that the
+// Context describes, such as a container made from its Image.
+type Executor interface {
+	// Run starts an agent for m in c and waits for it to exit.  The
+	// agent should run until it has nothing left to do in c.  env has
+	// the RS_ variables the agent needs to talk to dr-provision, and
+	// all output should go to out.  Cancelling ctx should stop the
+	// agent.
+	Run(ctx context.Context, c *models.Context, m *models.Machine, env []string, out io.Writer) error
+}
+
+// contextAgentArgs are the arguments that run an agent for m in c.
+// The image or rootfs must have drpcli on its PATH.
+func contextAgentArgs(c *models.Context, m *models.Machine) []string {
+	return []string{"drpcli", "machines", "processjobs", m.Key(), "--oneshot", "--context", c.Name}
+}
+
+// OCIExecutor runs the agent for a Context in a container made from
+// the Context's Image, using an OCI runtime CLI like podman or docker.
+type OCIExecutor struct {
+	// Runtime is the CLI to run, such as "podman" or "docker".
+	Runtime string
+	// Args are extra arguments to pass to "run".
+	Args []string
+}
+
+func (o *OCIExecutor) command(ctx context.Context, c *models.Context, m *models.Machine, env []string) (*exec.Cmd, error) {
+	if c.Image == "" {
+		return nil, fmt.Errorf("Context %s has no Image", c.Name)
+	}
+	args := []string{"run", "--rm", "--network", "host", "--name", "drp-" + c.Name + "-" + m.Key()}
+	for _, e := range env {
+		// Only pass the names, so that the values (which include
+		// the token) are not on the command line.
+		args = append(args, "-e", strings.SplitN(e, "=", 2)[0])
+	}
+	args = append(args, o.Args...)
+	args = append(args, c.Image)
+	args = append(args, contextAgentArgs(c, m)...)
+	cmd := exec.CommandContext(ctx, o.Runtime, args...)
+	cmd.Env = append(os.Environ(), env...)
+	return cmd, nil
+}
+
+// Run runs the agent in a new container, which is removed when the
+// agent exits.
+func (o *OCIExecutor) Run(ctx context.Context, c *models.Context, m *models.Machine, env []string, out io.Writer) error {
+	cmd, err := o.command(ctx, c, m, env)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout, cmd.Stderr = out, out
+	return cmd.Run()
+}
+
+// RootfsExecutor runs the agent for a Context chrooted into a local
+// directory that has a root filesystem in it.  The Image of the
+// Context is the path to the directory, relative to Dir if it is not
+// absolute.  A relative Image may not refer to anything outside Dir.
+// /proc, /sys, /dev, and /dev/pts are bind mounted into the
+// directory while the agent runs.  It is only supported on Linux.
+type RootfsExecutor struct {
+	Dir string
+}
+
+func (r *RootfsExecutor) root(c *models.Context) (string, error) {
+	if c.Image == "" {
+		return "", fmt.Errorf("Context %s has no Image", c.Name)
+	}
+	root := c.Image
+	if !path.IsAbs(root) {
+		if rel := path.Clean(root); rel == ".." || strings.HasPrefix(rel, "../") {
+			return "", fmt.Errorf("Context %s: rootfs %s is outside %s", c.Name, c.Image, r.Dir)
+		}
+		root = path.Join(r.Dir, root)
+	}
+	if st, err := os.Stat(root); err != nil || !st.IsDir() {
+		return "", fmt.Errorf("Context %s: rootfs %s is not a directory", c.Name, root)
+	}
+	return root, nil
+}
@@ -0,0 +1,32 @@
+// +build linux
+
+package agent
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"syscall"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+// Run runs the agent chrooted into the rootfs for c.
+func (r *RootfsExecutor) Run(ctx context.Context, c *models.Context, m *models.Machine, env []string, out io.Writer) error {
+	root, err := r.root(c)
+	if err != nil {
+		return err
+	}
+	fses := []string{"/proc", "/sys", "/dev", "/dev/pts"}
+	if err := bindMount(root, fses...); err != nil {
+		return err
+	}
+	defer unbindMount(root, fses...)
+	// env runs in the chroot, so it finds drpcli in the rootfs.
+	cmd := exec.CommandContext(ctx, "/usr/bin/env", contextAgentArgs(c, m)...)
+	cmd.Dir = "/"
+	cmd.Env = append([]string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}, env...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: root}
+	cmd.Stdout, cmd.Stderr = out, out
+	return cmd.Run()
+}
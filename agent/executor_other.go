@@ -0,0 +1,16 @@
+// +build !linux
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+func (r *RootfsExecutor) Run(ctx context.Context, c *models.Context, m *models.Machine, env []string, out io.Writer) error {
+	return fmt.Errorf("RootfsExecutor not supported on %v", runtime.GOOS)
+}
@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+func TestExecutors(t *testing.T) {
+	m := &models.Machine{Uuid: []byte{0xde, 0xad, 0xbe, 0xef, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}}
+	c := &models.Context{Name: "ctx", Engine: "podman", Image: "img:latest"}
+	o := &OCIExecutor{Runtime: "podman", Args: []string{"--privileged"}}
+	cmd, err := o.command(context.Background(), c, m, []string{"RS_TOKEN=secret", "RS_UUID=" + m.Key()})
+	if err != nil {
+		t.Fatalf("ERROR: Unexpected error making command: %v", err)
+	}
+	args := strings.Join(cmd.Args, " ")
+	want := "podman run --rm --network host --name drp-ctx-" + m.Key() +
+		" -e RS_TOKEN -e RS_UUID --privileged img:latest drpcli machines processjobs " +
+		m.Key() + " --oneshot --context ctx"
+	if args != want {
+		t.Errorf("ERROR: Expected args %q, got %q", want, args)
+	}
+	if strings.Contains(args, "secret") {
+		t.Errorf("ERROR: Token is on the command line: %q", args)
+	}
+	if cmd.Env[len(cmd.Env)-2] != "RS_TOKEN=secret" {
+		t.Errorf("ERROR: Expected RS_TOKEN in the environment, got %v", cmd.Env)
+	}
+	if _, err := o.command(context.Background(), &models.Context{Name: "bad"}, m, nil); err == nil {
+		t.Errorf("ERROR: Expected a Context without an Image to fail")
+	} else {
+		t.Logf("Got expected error %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "rootfs-")
+	if err != nil {
+		t.Fatalf("ERROR: Unable to make tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(path.Join(dir, "ctx"), 0755)
+	r := &RootfsExecutor{Dir: dir}
+	for image, want := range map[string]string{
+		"ctx":                  path.Join(dir, "ctx"),
+		path.Join(dir, "ctx"):  path.Join(dir, "ctx"),
+		"missing":              "",
+		path.Join(dir, "gone"): "",
+		"..":                   "",
+		"ctx/../..":            "",
+	} {
+		root, err := r.root(&models.Context{Name: "ctx", Image: image})
+		if want == "" {
+			if err == nil {
+				t.Errorf("ERROR: Expected rootfs %s to be invalid", image)
+			} else {
+				t.Logf("Got expected error %v", err)
+			}
+			continue
+		}
+		if err != nil || root != want {
+			t.Errorf("ERROR: Expected rootfs %s for %s, got %s: %v", want, image, root, err)
+		}
+	}
+}
+
+// fakeExecutor runs the agent for a Context in-process.
+type fakeExecutor struct {
+	ran []string
+}
+
+func (f *fakeExecutor) Run(ctx context.Context, c *models.Context, m *models.Machine, env []string, out io.Writer) error {
+	f.ran = append(f.ran, c.Name)
+	a, err := New(session, m, true, true, false, out)
+	if err != nil {
+		return err
+	}
+	return a.Context(c.Name).Timeout(time.Second).Run()
+}
+
+func TestAgentContext(t *testing.T) {
+	tjd, err := ioutil.TempDir("", "fakeagent-")
+	if err != nil {
+		t.Fatalf("Failed to create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(tjd)
+	ctxTask := &models.Task{
+		Name: "ctx-task",
+		Templates: []models.TemplateInfo{
+			{Name: "file", Path: path.Join(tjd, "ctx.txt"), Contents: "in context\n"},
+		},
+	}
+	localTask := &models.Task{
+		Name: "local-task",
+		Templates: []models.TemplateInfo{
+			{Name: "file", Path: path.Join(tjd, "local.txt"), Contents: "local\n"},
+		},
+	}
+	c := &models.Context{Name: "fake-ctx", Engine: "fake", Image: "img"}
+	stage := &models.Stage{
+		Name:  "ctx-stage",
+		Tasks: []string{"context:fake-ctx", "ctx-task", "context:", "local-task"},
+	}
+	m := &models.Machine{
+		Name:  "ctx-agent",
+		Stage: "ctx-stage",
+		Meta:  models.Meta{"feature-flags": "change-stage-v2"},
+	}
+	defer cleanUp(m, stage, c, ctxTask, localTask)
+	for _, obj := range []models.Model{ctxTask, localTask, c, stage, m} {
+		if f, ok := obj.(models.Filler); ok {
+			f.Fill()
+		}
+		if err := session.CreateModel(obj); err != nil {
+			t.Fatalf("ERROR: Failed to create %s: %v", obj.Prefix(), err)
+		}
+	}
+	log := &bytes.Buffer{}
+	fake := &fakeExecutor{}
+	a, err := New(session, m, true, true, false, log)
+	if err != nil {
+		t.Fatalf("ERROR: Agent create failed: %v", err)
+	}
+	if err := a.Timeout(time.Second).Executor("fake", fake).Run(); err != nil {
+		t.Errorf("ERROR: Agent run failed: %v", err)
+	}
+	if err := session.FillModel(m, m.Key()); err != nil {
+		t.Fatalf("ERROR: Failed to refetch machine: %v", err)
+	}
+	if m.CurrentTask != 4 || !m.WorkflowComplete || m.Context != "" {
+		t.Errorf("ERROR: Machine did not finish its tasks: %d in %q", m.CurrentTask, m.Context)
+	}
+	if len(fake.ran) != 1 || fake.ran[0] != "fake-ctx" {
+		t.Errorf("ERROR: Expected the executor to run once for fake-ctx, got %v", fake.ran)
+	}
+	for name, want := range map[string]string{"ctx.txt": "in context\n", "local.txt": "local\n"} {
+		if buf, err := ioutil.ReadFile(path.Join(tjd, name)); err != nil || string(buf) != want {
+			t.Errorf("ERROR: %s has %q: %v", name, string(buf), err)
+		}
+	}
+	t.Logf("Agent log:\n%s", log.String())
+}
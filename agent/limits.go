@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// actionLimits are the limits placed on a single script action.  They
+// come from the Meta on the template that the action was rendered
+// from, falling back to the Meta on the Task:
+//
+// * Timeout is how long the action may run for, either as a duration
+//   ("90s", "1h30m") or as a number of seconds.  When it runs out, the
+//   whole process group of the action is sent SIGTERM.
+//
+// * TimeoutGrace is how long to wait after SIGTERM before sending
+//   SIGKILL.  It defaults to 10 seconds.
+//
+// * CPULimit is the number of CPUs the action may use, e.g. "0.5".
+//
+// * MemoryLimit is the number of bytes of memory the action may use,
+//   with an optional K, M, G, or T suffix.
+//
+// * PidsLimit is the number of processes the action may have.
+//
+// CPULimit, MemoryLimit, and PidsLimit can only be enforced on Linux
+// systems that have cgroup v2 mounted at /sys/fs/cgroup.  Actions
+// that set them fail anywhere else.
+type actionLimits struct {
+	timeout, grace time.Duration
+	cpu            float64
+	memory, pids   int64
+}
+
+// wantCgroup returns whether any of the limits need a cgroup.
+func (l *actionLimits) wantCgroup() bool {
+	return l.cpu > 0 || l.memory > 0 || l.pids > 0
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if secs, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("must not be negative")
+	}
+	return d, err
+}
+
+func parseBytes(s string) (int64, error) {
+	mult := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	case "T":
+		mult = 1 << 40
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err == nil && v <= 0 {
+		err = fmt.Errorf("must be greater than 0")
+	}
+	return v * mult, err
+}
+
+// metaValue returns the trimmed value of key from the Meta of an
+// action's template, falling back to the Meta of its task.
+func metaValue(actionMeta, taskMeta map[string]string, key string) string {
+	val, ok := actionMeta[key]
+	if !ok {
+		val = taskMeta[key]
+	}
+	return strings.TrimSpace(val)
+}
+
+// parseLimits gets the limits for an action from the Meta on its
+// template, falling back to the Meta on its task.
+func parseLimits(actionMeta, taskMeta map[string]string) (*actionLimits, error) {
+	res := &actionLimits{grace: 10 * time.Second}
+	for _, key := range []string{"Timeout", "TimeoutGrace", "CPULimit", "MemoryLimit", "PidsLimit"} {
+		val := metaValue(actionMeta, taskMeta, key)
+		if val == "" {
+			continue
+		}
+		var err error
+		switch key {
+		case "Timeout":
+			res.timeout, err = parseDuration(val)
+		case "TimeoutGrace":
+			res.grace, err = parseDuration(val)
+		case "CPULimit":
+			res.cpu, err = strconv.ParseFloat(val, 64)
+			if err == nil && res.cpu <= 0 {
+				err = fmt.Errorf("must be greater than 0")
+			}
+		case "MemoryLimit":
+			res.memory, err = parseBytes(val)
+		case "PidsLimit":
+			res.pids, err = strconv.ParseInt(val, 10, 64)
+			if err == nil && res.pids <= 0 {
+				err = fmt.Errorf("must be greater than 0")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s %q: %v", key, val, err)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLimits(t *testing.T) {
+	l, err := parseLimits(
+		map[string]string{"Timeout": "90s", "MemoryLimit": "512M"},
+		map[string]string{"Timeout": "10", "TimeoutGrace": "5", "CPULimit": "0.5", "PidsLimit": "100"})
+	if err != nil {
+		t.Fatalf("ERROR: Unexpected error parsing limits: %v", err)
+	}
+	if l.timeout != 90*time.Second || l.grace != 5*time.Second ||
+		l.cpu != 0.5 || l.memory != 512<<20 || l.pids != 100 {
+		t.Errorf("ERROR: Unexpected limits %+v", l)
+	}
+	if !l.wantCgroup() {
+		t.Errorf("ERROR: Expected limits to want a cgroup")
+	}
+	l, err = parseLimits(nil, nil)
+	if err != nil || l.timeout != 0 || l.grace != 10*time.Second || l.wantCgroup() {
+		t.Errorf("ERROR: Unexpected default limits %+v: %v", l, err)
+	}
+	for _, bad := range []map[string]string{
+		{"Timeout": "forever"},
+		{"Timeout": "-1m"},
+		{"CPULimit": "0"},
+		{"MemoryLimit": "lots"},
+		{"PidsLimit": "-3"},
+	} {
+		if _, err := parseLimits(bad, nil); err == nil {
+			t.Errorf("ERROR: Expected %v to be invalid", bad)
+		} else {
+			t.Logf("Got expected error %v", err)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+// +build !windows,!plan9
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on the file at name, creating it
+// if needed.  It fails instead of waiting if something else holds the
+// lock.  The returned func releases the lock.
+func lockFile(name string) (func(), error) {
+	fi, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(fi.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		fi.Close()
+		return nil, fmt.Errorf("%s is locked by another agent: %v", name, err)
+	}
+	return func() { fi.Close() }, nil
+}
@@ -0,0 +1,16 @@
+// +build windows plan9
+
+package agent
+
+import "os"
+
+// lockFile creates the file at name.  There is no locking on this
+// platform, so it only keeps the file open until the returned func is
+// called.
+func lockFile(name string) (func(), error) {
+	fi, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return func() { fi.Close() }, nil
+}
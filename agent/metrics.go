@@ -0,0 +1,306 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// taskBuckets are the upper bounds, in seconds, of the histogram of
+// task durations.
+var taskBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}
+
+// taskHistogram is the histogram of how long one task took to run.
+type taskHistogram struct {
+	Buckets []uint64
+	Count   uint64
+	Sum     float64
+}
+
+// metricsData is what the agent counts.  It is saved in the stateDir
+// of the agent so that the counters keep counting across restarts and
+// the reboots that the agent does.
+type metricsData struct {
+	// TaskDurations is by task name.
+	TaskDurations map[string]*taskHistogram
+	// Tasks is by task name and then by the ExitState of the job.
+	Tasks map[string]map[string]uint64
+	// Failures is by task name.
+	Failures map[string]uint64
+	// ExitCodes is by task name and then by exit code.
+	ExitCodes map[string]map[string]uint64
+	// PowerActions is by reboot, poweroff, or kexec.
+	PowerActions map[string]uint64
+	// EventReconnects is how many times the event stream was reopened.
+	EventReconnects uint64
+	// WaitRunnableSeconds is the total time spent waiting for the
+	// machine to become runnable.
+	WaitRunnableSeconds float64
+}
+
+// metrics collects Prometheus metrics for the agent, serves them on
+// addr, and writes them to textfileDir for the node exporter textfile
+// collector.  All methods are safe to call on a nil metrics.
+type metrics struct {
+	mux          *sync.Mutex
+	data         metricsData
+	stateFile    string
+	textfileDir  string
+	started      time.Time
+	eventsOpened bool
+	stop         func()
+}
+
+func newMetrics(stateFile, addr, textfileDir string) (*metrics, error) {
+	res := &metrics{
+		mux:         &sync.Mutex{},
+		stateFile:   stateFile,
+		textfileDir: textfileDir,
+		started:     time.Now(),
+		stop:        func() {},
+	}
+	if textfileDir != "" {
+		if st, err := os.Stat(textfileDir); err != nil || !st.IsDir() {
+			return nil, fmt.Errorf("Metrics textfile directory %s is not a directory", textfileDir)
+		}
+	}
+	if stateFile != "" {
+		if buf, err := ioutil.ReadFile(stateFile); err == nil {
+			json.Unmarshal(buf, &res.data)
+		}
+	}
+	d := &res.data
+	if d.TaskDurations == nil {
+		d.TaskDurations = map[string]*taskHistogram{}
+	}
+	if d.Tasks == nil {
+		d.Tasks = map[string]map[string]uint64{}
+	}
+	if d.Failures == nil {
+		d.Failures = map[string]uint64{}
+	}
+	if d.ExitCodes == nil {
+		d.ExitCodes = map[string]map[string]uint64{}
+	}
+	if d.PowerActions == nil {
+		d.PowerActions = map[string]uint64{}
+	}
+	if addr != "" {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to serve metrics on %s: %v", addr, err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			w.Write(res.render())
+		})
+		go (&http.Server{Handler: mux}).Serve(l)
+		res.stop = func() { l.Close() }
+	}
+	res.update(func(*metricsData) {})
+	return res, nil
+}
+
+// update changes the metrics with fn, and then saves them and writes
+// the textfile.
+func (m *metrics) update(fn func(*metricsData)) {
+	if m == nil {
+		return
+	}
+	m.mux.Lock()
+	fn(&m.data)
+	if m.stateFile != "" {
+		if buf, err := json.Marshal(&m.data); err == nil {
+			writeAtomic(m.stateFile, buf)
+		}
+	}
+	m.mux.Unlock()
+	if m.textfileDir != "" {
+		writeAtomic(path.Join(m.textfileDir, "drp_agent.prom"), m.render())
+	}
+}
+
+// writeAtomic replaces the file at dst with buf, so that nothing
+// reading it ever sees a partial write.
+func writeAtomic(dst string, buf []byte) error {
+	fi, err := ioutil.TempFile(path.Dir(dst), "."+path.Base(dst)+"-")
+	if err != nil {
+		return err
+	}
+	_, err = fi.Write(buf)
+	if cerr := fi.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(fi.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(fi.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(fi.Name())
+	}
+	return err
+}
+
+// task records that task ran for d and ended with exitState.
+func (m *metrics) task(task string, d time.Duration, exitState string) {
+	m.update(func(data *metricsData) {
+		h := data.TaskDurations[task]
+		if h == nil {
+			h = &taskHistogram{Buckets: make([]uint64, len(taskBuckets))}
+			data.TaskDurations[task] = h
+		}
+		for i, b := range taskBuckets {
+			if d.Seconds() <= b && i < len(h.Buckets) {
+				h.Buckets[i]++
+			}
+		}
+		h.Count++
+		h.Sum += d.Seconds()
+		if data.Tasks[task] == nil {
+			data.Tasks[task] = map[string]uint64{}
+		}
+		data.Tasks[task][exitState]++
+		switch exitState {
+		case "failed", "timeout", "resource-limit", "cancelled":
+			data.Failures[task]++
+		}
+	})
+}
+
+// exitCode records the exit code of an action of task.
+func (m *metrics) exitCode(task string, code int) {
+	m.update(func(data *metricsData) {
+		if data.ExitCodes[task] == nil {
+			data.ExitCodes[task] = map[string]uint64{}
+		}
+		data.ExitCodes[task][strconv.Itoa(code)]++
+	})
+}
+
+// power records that the agent is about to reboot, poweroff, or kexec.
+func (m *metrics) power(action string) {
+	m.update(func(data *metricsData) { data.PowerActions[action]++ })
+}
+
+// eventsOpen records that the event stream was opened, which is a
+// reconnect if it is not the first time.
+func (m *metrics) eventsOpen() {
+	if m == nil {
+		return
+	}
+	m.mux.Lock()
+	reconnect := m.eventsOpened
+	m.eventsOpened = true
+	m.mux.Unlock()
+	if reconnect {
+		m.update(func(data *metricsData) { data.EventReconnects++ })
+	}
+}
+
+// waitedRunnable records time spent waiting for the machine to be runnable.
+func (m *metrics) waitedRunnable(d time.Duration) {
+	m.update(func(data *metricsData) { data.WaitRunnableSeconds += d.Seconds() })
+}
+
+func (m *metrics) close() {
+	if m != nil {
+		m.stop()
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labels(kv ...string) string {
+	res := []string{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		res = append(res, kv[i]+`="`+labelEscaper.Replace(kv[i+1])+`"`)
+	}
+	return "{" + strings.Join(res, ",") + "}"
+}
+
+func sortedKeys(m interface{}) []string {
+	res := []string{}
+	switch v := m.(type) {
+	case map[string]uint64:
+		for k := range v {
+			res = append(res, k)
+		}
+	case map[string]map[string]uint64:
+		for k := range v {
+			res = append(res, k)
+		}
+	case map[string]*taskHistogram:
+		for k := range v {
+			res = append(res, k)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// render returns the metrics in the Prometheus text format.
+func (m *metrics) render() []byte {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	d := &m.data
+	buf := &bytes.Buffer{}
+	header := func(name, kind, help string) {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	header("drp_agent_start_time_seconds", "gauge", "When the agent started, in seconds since the epoch.")
+	fmt.Fprintf(buf, "drp_agent_start_time_seconds %d\n", m.started.Unix())
+	header("drp_agent_task_duration_seconds", "histogram", "How long tasks took to run.")
+	for _, task := range sortedKeys(d.TaskDurations) {
+		h := d.TaskDurations[task]
+		for i, b := range taskBuckets {
+			if i < len(h.Buckets) {
+				fmt.Fprintf(buf, "drp_agent_task_duration_seconds_bucket%s %d\n", labels("task", task, "le", formatFloat(b)), h.Buckets[i])
+			}
+		}
+		fmt.Fprintf(buf, "drp_agent_task_duration_seconds_bucket%s %d\n", labels("task", task, "le", "+Inf"), h.Count)
+		fmt.Fprintf(buf, "drp_agent_task_duration_seconds_sum%s %s\n", labels("task", task), formatFloat(h.Sum))
+		fmt.Fprintf(buf, "drp_agent_task_duration_seconds_count%s %d\n", labels("task", task), h.Count)
+	}
+	header("drp_agent_tasks_total", "counter", "Tasks run, by the ExitState of their job.")
+	for _, task := range sortedKeys(d.Tasks) {
+		for _, state := range sortedKeys(d.Tasks[task]) {
+			fmt.Fprintf(buf, "drp_agent_tasks_total%s %d\n", labels("task", task, "exit_state", state), d.Tasks[task][state])
+		}
+	}
+	header("drp_agent_task_failures_total", "counter", "Tasks that failed, timed out, hit a resource limit, or were cancelled.")
+	for _, task := range sortedKeys(d.Failures) {
+		fmt.Fprintf(buf, "drp_agent_task_failures_total%s %d\n", labels("task", task), d.Failures[task])
+	}
+	header("drp_agent_action_exit_codes_total", "counter", "Exit codes of task actions.")
+	for _, task := range sortedKeys(d.ExitCodes) {
+		for _, code := range sortedKeys(d.ExitCodes[task]) {
+			fmt.Fprintf(buf, "drp_agent_action_exit_codes_total%s %d\n", labels("task", task, "code", code), d.ExitCodes[task][code])
+		}
+	}
+	header("drp_agent_power_actions_total", "counter", "Reboots, poweroffs, and kexecs done by the agent.")
+	for _, action := range sortedKeys(d.PowerActions) {
+		fmt.Fprintf(buf, "drp_agent_power_actions_total%s %d\n", labels("action", action), d.PowerActions[action])
+	}
+	header("drp_agent_event_stream_reconnects_total", "counter", "How many times the agent reopened its event stream.")
+	fmt.Fprintf(buf, "drp_agent_event_stream_reconnects_total %d\n", d.EventReconnects)
+	header("drp_agent_wait_runnable_seconds_total", "counter", "Time spent waiting for the machine to become runnable.")
+	fmt.Fprintf(buf, "drp_agent_wait_runnable_seconds_total %s\n", formatFloat(d.WaitRunnableSeconds))
+	return buf.Bytes()
+}
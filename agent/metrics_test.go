@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+func TestMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics-")
+	if err != nil {
+		t.Fatalf("ERROR: Unable to make tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := path.Join(dir, "metrics.json")
+	m, err := newMetrics(stateFile, "", dir)
+	if err != nil {
+		t.Fatalf("ERROR: Unable to make metrics: %v", err)
+	}
+	m.task("install", 20*time.Second, "complete")
+	m.task("install", 2*time.Second, "timeout")
+	m.task(`odd"name`, time.Second, "failed")
+	m.exitCode("install", 0)
+	m.exitCode("install", 0)
+	m.power("reboot")
+	m.eventsOpen()
+	m.eventsOpen()
+	m.waitedRunnable(1500 * time.Millisecond)
+	m.close()
+	// A new agent picks up where the last one left off.
+	m, err = newMetrics(stateFile, "", dir)
+	if err != nil {
+		t.Fatalf("ERROR: Unable to reload metrics: %v", err)
+	}
+	m.power("kexec")
+	buf, err := ioutil.ReadFile(path.Join(dir, "drp_agent.prom"))
+	if err != nil {
+		t.Fatalf("ERROR: No textfile written: %v", err)
+	}
+	text := string(buf)
+	for _, want := range []string{
+		`drp_agent_task_duration_seconds_bucket{task="install",le="1"} 0`,
+		`drp_agent_task_duration_seconds_bucket{task="install",le="5"} 1`,
+		`drp_agent_task_duration_seconds_bucket{task="install",le="30"} 2`,
+		`drp_agent_task_duration_seconds_bucket{task="install",le="+Inf"} 2`,
+		`drp_agent_task_duration_seconds_sum{task="install"} 22`,
+		`drp_agent_task_duration_seconds_count{task="install"} 2`,
+		`drp_agent_tasks_total{task="install",exit_state="complete"} 1`,
+		`drp_agent_tasks_total{task="install",exit_state="timeout"} 1`,
+		`drp_agent_task_failures_total{task="install"} 1`,
+		`drp_agent_task_failures_total{task="odd\"name"} 1`,
+		`drp_agent_action_exit_codes_total{task="install",code="0"} 2`,
+		`drp_agent_power_actions_total{action="kexec"} 1`,
+		`drp_agent_power_actions_total{action="reboot"} 1`,
+		"drp_agent_event_stream_reconnects_total 1\n",
+		"drp_agent_wait_runnable_seconds_total 1.5\n",
+		"# TYPE drp_agent_task_duration_seconds histogram\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("ERROR: Metrics missing %q", want)
+		}
+	}
+	if _, err := newMetrics("", "", path.Join(dir, "missing")); err == nil {
+		t.Errorf("ERROR: Expected a missing textfile dir to fail")
+	} else {
+		t.Logf("Got expected error %v", err)
+	}
+}
+
+func TestAgentMetricsTextfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics-agent-")
+	if err != nil {
+		t.Fatalf("ERROR: Unable to make tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	task := &models.Task{
+		Name: "metrics-task",
+		Templates: []models.TemplateInfo{
+			{Name: "script", Contents: "#!/usr/bin/env bash\necho ran {{.Task.Name}}\n"},
+		},
+	}
+	stage := &models.Stage{Name: "metrics-stage", Tasks: []string{"metrics-task"}}
+	m := &models.Machine{
+		Name:  "metrics-agent",
+		Stage: "metrics-stage",
+		Meta:  models.Meta{"feature-flags": "change-stage-v2"},
+	}
+	defer cleanUp(m, stage, task)
+	for _, obj := range []models.Model{task, stage, m} {
+		if f, ok := obj.(models.Filler); ok {
+			f.Fill()
+		}
+		if err := session.CreateModel(obj); err != nil {
+			t.Fatalf("ERROR: Failed to create %s: %v", obj.Prefix(), err)
+		}
+	}
+	log := &bytes.Buffer{}
+	a, err := New(session, m, true, true, false, log)
+	if err != nil {
+		t.Fatalf("ERROR: Agent create failed: %v", err)
+	}
+	if err := a.Timeout(time.Second).MetricsTextfile(dir).Run(); err != nil {
+		t.Errorf("ERROR: Agent run failed: %v", err)
+	}
+	buf, err := ioutil.ReadFile(path.Join(dir, "drp_agent.prom"))
+	if err != nil {
+		t.Fatalf("ERROR: No textfile written: %v", err)
+	}
+	for _, want := range []string{
+		`drp_agent_tasks_total{task="metrics-task",exit_state="complete"} 1`,
+		`drp_agent_action_exit_codes_total{task="metrics-task",code="0"} 1`,
+	} {
+		if !strings.Contains(string(buf), want) {
+			t.Errorf("ERROR: Metrics textfile missing %q", want)
+		}
+	}
+	t.Logf("Agent log:\n%s", log.String())
+}
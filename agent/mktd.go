@@ -3,6 +3,7 @@
 package agent
 
 import (
+	"fmt"
 	"os"
 	"sync"
 )
@@ -17,3 +18,14 @@ func mktd(p string) error {
 	defer unix.Umask(umask)
 	return os.MkdirAll(p, 0777|os.ModeSticky)
 }
+
+// umaskCommand returns the command line that runs args with the umask
+// set to mask, unless mask is negative.  The umask is set by a shell
+// in the child, because the agent's own umask applies to everything
+// else it is doing at the same time.
+func umaskCommand(mask int, args []string) ([]string, error) {
+	if mask < 0 {
+		return args, nil
+	}
+	return append([]string{"/bin/sh", "-c", fmt.Sprintf(`umask %03o && exec "$@"`, mask), "sh"}, args...), nil
+}
@@ -2,8 +2,19 @@
 
 package agent
 
-import "os"
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
 
 func mktd(p string) error {
 	return os.MkdirAll(p, 01777)
 }
+
+func umaskCommand(mask int, args []string) ([]string, error) {
+	if mask >= 0 {
+		return nil, fmt.Errorf("Umask not supported on %v", runtime.GOOS)
+	}
+	return args, nil
+}
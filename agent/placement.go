@@ -0,0 +1,265 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// filePlacement controls how a file action is put in place.  Like
+// actionLimits, it comes from the Meta on the template that the
+// action was rendered from, falling back to the Meta on the Task:
+//
+// * Mode is the octal mode of the file.  New files default to 0644,
+//   and existing files keep their mode.
+//
+// * Owner and Group are the user and group that should own the file,
+//   as names or numeric IDs.
+//
+// * Write is "replace" (the default) to replace the file, "append" to
+//   add to the end of the file, or "missing" to only write the file if
+//   it does not already exist.
+//
+// * Backup, if true, saves the existing file to Path.bak before it is
+//   changed.
+//
+// * SkipIdentical, if true, leaves the file alone if it already has
+//   the contents that would be written.  Mode, Owner, and Group are
+//   still applied.
+//
+// * Atomic, if true, writes the file under a temporary name in the
+//   same directory and then renames it into place.
+//
+// If the template has a Link, a symlink to Link is made at Path
+// instead of writing the contents.  Links are always put in place
+// atomically, and are left alone if they already point to Link.
+type filePlacement struct {
+	mode                          os.FileMode
+	setMode                       bool
+	owner, group, write           string
+	backup, skipIdentical, atomic bool
+}
+
+// parsePlacement gets the placement for a file action from the Meta
+// on its template, falling back to the Meta on its task.
+func parsePlacement(actionMeta, taskMeta map[string]string) (*filePlacement, error) {
+	res := &filePlacement{
+		mode:  0644,
+		owner: metaValue(actionMeta, taskMeta, "Owner"),
+		group: metaValue(actionMeta, taskMeta, "Group"),
+		write: metaValue(actionMeta, taskMeta, "Write"),
+	}
+	if val := metaValue(actionMeta, taskMeta, "Mode"); val != "" {
+		mode, err := strconv.ParseUint(val, 8, 32)
+		if err != nil || mode > 07777 {
+			return nil, fmt.Errorf("Invalid Mode %q: must be an octal number up to 07777", val)
+		}
+		res.mode = os.FileMode(mode & 0777)
+		if mode&04000 != 0 {
+			res.mode |= os.ModeSetuid
+		}
+		if mode&02000 != 0 {
+			res.mode |= os.ModeSetgid
+		}
+		if mode&01000 != 0 {
+			res.mode |= os.ModeSticky
+		}
+		res.setMode = true
+	}
+	switch res.write {
+	case "":
+		res.write = "replace"
+	case "replace", "append", "missing":
+	default:
+		return nil, fmt.Errorf("Invalid Write %q: must be replace, append, or missing", res.write)
+	}
+	for key, val := range map[string]*bool{
+		"Backup":        &res.backup,
+		"SkipIdentical": &res.skipIdentical,
+		"Atomic":        &res.atomic,
+	} {
+		if s := metaValue(actionMeta, taskMeta, key); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s %q: %v", key, s, err)
+			}
+			*val = b
+		}
+	}
+	return res, nil
+}
+
+// finish sets the ownership and mode of a placed file.  Ownership
+// goes first, as changing it clears the setuid and setgid bits.
+func (p *filePlacement) finish(dst string, uid, gid int) error {
+	if uid >= 0 || gid >= 0 {
+		if err := os.Chown(dst, uid, gid); err != nil {
+			return err
+		}
+	}
+	if p.setMode {
+		return os.Chmod(dst, p.mode)
+	}
+	return nil
+}
+
+// tempName returns an unused name in the same directory as dst to
+// make a link at before renaming it into place.
+func tempName(dst string) (string, error) {
+	fi, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	if err != nil {
+		return "", err
+	}
+	fi.Close()
+	return fi.Name(), os.Remove(fi.Name())
+}
+
+// saveBackup copies the file or link at dst to dst.bak.
+func saveBackup(dst string, fi os.FileInfo) error {
+	bak := dst + ".bak"
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(dst)
+		if err != nil {
+			return err
+		}
+		os.Remove(bak)
+		return os.Symlink(target, bak)
+	}
+	buf, err := ioutil.ReadFile(dst)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(bak, buf, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chmod(bak, fi.Mode().Perm())
+}
+
+// link puts a symlink to target at dst.  It returns a description of
+// what it did.
+func (p *filePlacement) link(dst, target string) (string, error) {
+	if p.write == "append" {
+		return "", fmt.Errorf("Cannot append to a link")
+	}
+	uid, gid, err := fileOwner(p.owner, p.group)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Lstat(dst)
+	exists := err == nil
+	if exists {
+		if p.write == "missing" {
+			return "already exists, left alone", nil
+		}
+		if old, err := os.Readlink(dst); err == nil && old == target {
+			return "already linked, left alone", nil
+		}
+		if p.backup {
+			if err := saveBackup(dst, fi); err != nil {
+				return "", fmt.Errorf("Unable to back up %s: %v", dst, err)
+			}
+		}
+	}
+	tmp, err := tempName(dst)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Symlink(target, tmp); err != nil {
+		return "", err
+	}
+	if uid >= 0 || gid >= 0 {
+		if err := os.Lchown(tmp, uid, gid); err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return "linked to " + target, nil
+}
+
+// place writes content to dst.  It returns a description of what it
+// did.
+func (p *filePlacement) place(dst string, content []byte) (string, error) {
+	uid, gid, err := fileOwner(p.owner, p.group)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Lstat(dst)
+	exists := err == nil
+	if exists && p.write == "missing" {
+		return "already exists, left alone", nil
+	}
+	var old []byte
+	if exists && fi.Mode().IsRegular() && (p.skipIdentical || p.write == "append") {
+		if old, err = ioutil.ReadFile(dst); err != nil {
+			return "", err
+		}
+	}
+	data := content
+	if p.write == "append" && old != nil {
+		data = append(append([]byte{}, old...), content...)
+	}
+	if p.skipIdentical && exists && fi.Mode().IsRegular() && bytes.Equal(old, data) {
+		return "unchanged, left alone", p.finish(dst, uid, gid)
+	}
+	if exists && p.backup {
+		if err := saveBackup(dst, fi); err != nil {
+			return "", fmt.Errorf("Unable to back up %s: %v", dst, err)
+		}
+	}
+	if p.atomic {
+		mode := p.mode
+		if !p.setMode && exists && fi.Mode().IsRegular() {
+			mode = fi.Mode().Perm()
+		}
+		tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+		if err != nil {
+			return "", err
+		}
+		_, err = tmp.Write(data)
+		if err == nil && (uid >= 0 || gid >= 0) {
+			err = tmp.Chown(uid, gid)
+		}
+		if err == nil {
+			err = tmp.Chmod(mode)
+		}
+		if err == nil {
+			err = tmp.Sync()
+		}
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), dst)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return "", err
+		}
+		return "written", nil
+	}
+	if p.write == "append" {
+		fi, err := os.OpenFile(dst, os.O_WRONLY|os.O_APPEND|os.O_CREATE, p.mode)
+		if err != nil {
+			return "", err
+		}
+		_, err = fi.Write(content)
+		if cerr := fi.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", err
+		}
+		return "appended", p.finish(dst, uid, gid)
+	}
+	if err := ioutil.WriteFile(dst, data, p.mode); err != nil {
+		return "", err
+	}
+	return "written", p.finish(dst, uid, gid)
+}
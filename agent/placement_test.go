@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFilePlacement(t *testing.T) {
+	dir, err := ioutil.TempDir("", "placement-")
+	if err != nil {
+		t.Fatalf("ERROR: Unable to make tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	dst := path.Join(dir, "file")
+	place := func(meta map[string]string, content, want, wantWhat string) {
+		t.Helper()
+		p, err := parsePlacement(meta, nil)
+		if err != nil {
+			t.Fatalf("ERROR: Unexpected error parsing %v: %v", meta, err)
+		}
+		what, err := p.place(dst, []byte(content))
+		if err != nil {
+			t.Fatalf("ERROR: Unexpected error placing with %v: %v", meta, err)
+		}
+		buf, _ := ioutil.ReadFile(dst)
+		if string(buf) != want || what != wantWhat {
+			t.Errorf("ERROR: With %v, expected %q (%s), got %q (%s)", meta, want, wantWhat, string(buf), what)
+		}
+	}
+	place(nil, "one\n", "one\n", "written")
+	if fi, _ := os.Stat(dst); fi.Mode().Perm() != 0644 {
+		t.Errorf("ERROR: Expected mode 0644, got %v", fi.Mode())
+	}
+	place(map[string]string{"Write": "append", "Mode": "0600"}, "two\n", "one\ntwo\n", "appended")
+	if fi, _ := os.Stat(dst); fi.Mode().Perm() != 0600 {
+		t.Errorf("ERROR: Expected mode 0600, got %v", fi.Mode())
+	}
+	place(map[string]string{"Write": "missing"}, "three\n", "one\ntwo\n", "already exists, left alone")
+	place(map[string]string{"SkipIdentical": "true", "Mode": "0640"}, "one\ntwo\n", "one\ntwo\n", "unchanged, left alone")
+	if fi, _ := os.Stat(dst); fi.Mode().Perm() != 0640 {
+		t.Errorf("ERROR: Expected mode 0640, got %v", fi.Mode())
+	}
+	place(map[string]string{"Backup": "true", "Atomic": "true"}, "four\n", "four\n", "written")
+	if fi, _ := os.Stat(dst); fi.Mode().Perm() != 0640 {
+		t.Errorf("ERROR: Expected atomic write to keep mode 0640, got %v", fi.Mode())
+	}
+	if buf, _ := ioutil.ReadFile(dst + ".bak"); string(buf) != "one\ntwo\n" {
+		t.Errorf("ERROR: Expected backup to have the old contents, got %q", string(buf))
+	}
+	p, _ := parsePlacement(nil, nil)
+	link := path.Join(dir, "link")
+	for i := 0; i < 2; i++ {
+		if _, err := p.link(link, dst); err != nil {
+			t.Fatalf("ERROR: Unexpected error linking: %v", err)
+		}
+	}
+	if target, err := os.Readlink(link); err != nil || target != dst {
+		t.Errorf("ERROR: Expected link to %s, got %s: %v", dst, target, err)
+	}
+	for _, bad := range []map[string]string{
+		{"Mode": "rwx"},
+		{"Mode": "17777"},
+		{"Write": "sometimes"},
+		{"Atomic": "maybe"},
+	} {
+		if _, err := parsePlacement(bad, nil); err == nil {
+			t.Errorf("ERROR: Expected %v to be invalid", bad)
+		} else {
+			t.Logf("Got expected error %v", err)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// +build !windows,!plan9
+
+package agent
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcGroup makes cmd the leader of a new process group, so that
+// it and everything it starts can be signalled together.
+func setProcGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalGroup sends sig to the process group that cmd leads.
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
+
+// pauseGroup stops or continues the process group that cmd leads.
+func pauseGroup(cmd *exec.Cmd, stop bool) error {
+	if stop {
+		return signalGroup(cmd, syscall.SIGSTOP)
+	}
+	return signalGroup(cmd, syscall.SIGCONT)
+}
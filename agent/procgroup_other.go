@@ -0,0 +1,25 @@
+// +build windows plan9
+
+package agent
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+func setProcGroup(cmd *exec.Cmd) {}
+
+// signalGroup kills the process cmd started.  Signals other than
+// kill are not supported, so any signal kills it.
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
+
+func pauseGroup(cmd *exec.Cmd, stop bool) error {
+	return fmt.Errorf("Pausing commands not supported on %v", runtime.GOOS)
+}
@@ -0,0 +1,113 @@
+// +build !windows,!plan9
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// lookupUser finds a user by name or numeric ID.
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		u, err = user.LookupId(name)
+	}
+	return u, err
+}
+
+// lookupGroup finds a group by name or numeric ID.
+func lookupGroup(name string) (*user.Group, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		g, err = user.LookupGroupId(name)
+	}
+	return g, err
+}
+
+// fileOwner returns the uid and gid for the Owner and Group of a
+// file action, or -1 for each one that is not set.
+func fileOwner(owner, group string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner != "" {
+		u, err := lookupUser(owner)
+		if err != nil {
+			return -1, -1, fmt.Errorf("Unknown Owner %s", owner)
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return -1, -1, fmt.Errorf("Owner %s has a non-numeric uid %s", owner, u.Uid)
+		}
+	}
+	if group != "" {
+		g, err := lookupGroup(group)
+		if err != nil {
+			return -1, -1, fmt.Errorf("Unknown Group %s", group)
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return -1, -1, fmt.Errorf("Group %s has a non-numeric gid %s", group, g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
+
+// runAs arranges for cmd to run as the RunAs user and group.  It
+// returns the uid and gid it will run as (or -1 if RunAs is not set),
+// along with the HOME, USER, and LOGNAME vars for the user.
+func runAs(cmd *exec.Cmd, e *actionEnv) (int, int, []string, error) {
+	if e.runUser == "" {
+		return -1, -1, nil, nil
+	}
+	u, err := lookupUser(e.runUser)
+	if err != nil {
+		return -1, -1, nil, fmt.Errorf("Unknown RunAs user %s", e.runUser)
+	}
+	gidStr := u.Gid
+	groups := []uint32{}
+	if e.runGroup != "" {
+		g, err := lookupGroup(e.runGroup)
+		if err != nil {
+			return -1, -1, nil, fmt.Errorf("Unknown RunAs group %s", e.runGroup)
+		}
+		gidStr = g.Gid
+	} else if gids, err := u.GroupIds(); err == nil {
+		for _, g := range gids {
+			if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+				groups = append(groups, uint32(id))
+			}
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return -1, -1, nil, fmt.Errorf("RunAs user %s has a non-numeric uid %s", e.runUser, u.Uid)
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return -1, -1, nil, fmt.Errorf("RunAs group %s has a non-numeric gid %s", e.runGroup, gidStr)
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    uint32(uid),
+		Gid:    uint32(gid),
+		Groups: groups,
+	}
+	vars := []string{"HOME=" + u.HomeDir, "USER=" + u.Username, "LOGNAME=" + u.Username}
+	return uid, gid, vars, nil
+}
+
+// chownTree gives everything in dir to uid and gid, so that an
+// action running as the RunAs user can use the task directory.
+func chownTree(dir string, uid, gid int) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, uid, gid)
+	})
+}
@@ -0,0 +1,25 @@
+// +build windows plan9
+
+package agent
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+func runAs(cmd *exec.Cmd, e *actionEnv) (int, int, []string, error) {
+	if e.runUser != "" {
+		return -1, -1, nil, fmt.Errorf("RunAs not supported on %v", runtime.GOOS)
+	}
+	return -1, -1, nil, nil
+}
+
+func fileOwner(owner, group string) (int, int, error) {
+	if owner != "" || group != "" {
+		return -1, -1, fmt.Errorf("Owner and Group not supported on %v", runtime.GOOS)
+	}
+	return -1, -1, nil
+}
+
+func chownTree(dir string, uid, gid int) error { return nil }
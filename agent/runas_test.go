@@ -0,0 +1,91 @@
+// +build !windows,!plan9
+
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/digitalrebar/provision/v4/api"
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/pborman/uuid"
+	"golang.org/x/sys/unix"
+)
+
+func TestRunAs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("RunAs can only be used as root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("There is no nobody user")
+	}
+	agentDir, err := ioutil.TempDir("", "runas-test-")
+	if err != nil {
+		t.Fatalf("ERROR: Unable to make tmpdir: %v", err)
+	}
+	defer os.RemoveAll(agentDir)
+	os.Chmod(agentDir, 0755)
+	taskDir, err := ioutil.TempDir(agentDir, "task-")
+	if err != nil {
+		t.Fatalf("ERROR: Unable to make task dir: %v", err)
+	}
+	out := &bytes.Buffer{}
+	r := &runner{
+		c:        api.DisconnectedClient(),
+		j:        &models.Job{Uuid: uuid.NewRandom(), Task: "task"},
+		m:        &models.Machine{Uuid: uuid.NewRandom()},
+		t:        &models.Task{Name: "task"},
+		in:       &lockedWriter{w: out},
+		logger:   ioutil.Discard,
+		agentDir: agentDir,
+		cmdMux:   &sync.Mutex{},
+		token:    "token",
+	}
+	action := &models.JobAction{
+		Name:    "whoami",
+		Meta:    map[string]string{"RunAs": "nobody", "Umask": "077"},
+		Content: "#!/bin/sh\necho \"uid=$(id -u) umask=$(umask)\" > \"$RS_TASK_DIR/out\"\n",
+	}
+	old := unix.Umask(022)
+	defer unix.Umask(old)
+	if err := r.perform(action, taskDir); err != nil {
+		t.Fatalf("ERROR: Action failed: %v\n%s", err, out)
+	}
+	if mask := unix.Umask(022); mask != 022 {
+		t.Errorf("ERROR: Expected the agent umask to stay 022, got %03o", mask)
+	}
+	owner := func(p string) uint32 {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			t.Fatalf("ERROR: Unable to stat %s: %v", p, err)
+		}
+		return fi.Sys().(*syscall.Stat_t).Uid
+	}
+	if uid := owner(taskDir); uid != 0 {
+		t.Errorf("ERROR: Expected the task directory to stay owned by root, got %d", uid)
+	}
+	// The action got a directory of its own in the task directory.
+	dirs, _ := ioutil.ReadDir(taskDir)
+	if len(dirs) != 1 || !dirs[0].IsDir() {
+		t.Fatalf("ERROR: Expected one directory for the action in %s, got %v\n%s", taskDir, dirs, out)
+	}
+	dir := path.Join(taskDir, dirs[0].Name())
+	if uid := owner(dir); strconv.FormatUint(uint64(uid), 10) != nobody.Uid {
+		t.Errorf("ERROR: Expected %s to be owned by nobody, got %d", dir, uid)
+	}
+	buf, err := ioutil.ReadFile(path.Join(dir, "out"))
+	if err != nil {
+		t.Fatalf("ERROR: Expected the action to write its output: %v\n%s", err, out)
+	}
+	if want := "uid=" + nobody.Uid + " umask=0077\n"; string(buf) != want {
+		t.Errorf("ERROR: Expected %q from the action, got %q", want, buf)
+	}
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// sandboxConfig controls whether a script action runs in a sandbox.
+// Like actionLimits, it comes from the Meta on the template that the
+// action was rendered from, falling back to the Meta on the Task:
+//
+// * Sandbox, if true, runs the action in new mount, PID, and UTS
+//   namespaces.  The mounts the action sees are read-only, except for
+//   the runner directory, fresh scratch tmpfs mounts on /tmp,
+//   /var/tmp, and TMPDIR, and the SandboxWritable directories.  /dev
+//   only has null, zero, full, random, urandom, tty, a private pts,
+//   and a scratch shm.  /proc only shows the sandbox's processes, the
+//   parts of it that can change the kernel (such as /proc/sys and
+//   /proc/sysrq-trigger) are read-only, and the ones that leak kernel
+//   information (such as /proc/kcore and /proc/keys) are hidden.  The
+//   action runs with no_new_privs, and without the capabilities it
+//   would need to remount, load modules, make devices, do raw I/O, or
+//   trace processes, but an action that runs as root still has the
+//   rest of root's privileges, such as on the network and over the
+//   contents of the writable directories.  Set RunAs as well to run it
+//   as an unprivileged user.  It is only supported on Linux.
+//
+// * SandboxNetwork, if false, also runs the action in a new network
+//   namespace that only has loopback.  An action without network
+//   cannot talk to dr-provision.  It defaults to true.
+//
+// * SandboxWritable is a comma separated list of absolute paths to
+//   existing directories that the action can write to.
+type sandboxConfig struct {
+	enabled, network bool
+	writable         []string
+}
+
+// parseSandbox gets the sandbox for an action from the Meta on its
+// template, falling back to the Meta on its task.
+func parseSandbox(actionMeta, taskMeta map[string]string) (*sandboxConfig, error) {
+	res := &sandboxConfig{network: true}
+	for key, val := range map[string]*bool{
+		"Sandbox":        &res.enabled,
+		"SandboxNetwork": &res.network,
+	} {
+		if s := metaValue(actionMeta, taskMeta, key); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s %q: %v", key, s, err)
+			}
+			*val = b
+		}
+	}
+	for _, dir := range strings.Split(metaValue(actionMeta, taskMeta, "SandboxWritable"), ",") {
+		if dir = strings.TrimSpace(dir); dir == "" {
+			continue
+		}
+		if !path.IsAbs(dir) {
+			return nil, fmt.Errorf("Invalid SandboxWritable %q: must be an absolute path", dir)
+		}
+		res.writable = append(res.writable, path.Clean(dir))
+	}
+	return res, nil
+}
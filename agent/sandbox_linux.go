@@ -0,0 +1,448 @@
+// +build linux
+
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// sandboxArg0 is the name the agent runs itself under to set up a
+// sandbox and run an action in it.
+const sandboxArg0 = "drp-agent-sandbox"
+
+func init() {
+	if len(os.Args) == 2 && os.Args[0] == sandboxArg0 {
+		os.Exit(sandboxMain(os.Args[1]))
+	}
+}
+
+// sandboxSpec is what the agent passes to itself to set up a sandbox.
+type sandboxSpec struct {
+	// Root is an empty directory to build the sandbox in.
+	Root string
+	// Scratch are the directories to mount fresh tmpfs on.
+	Scratch []string
+	// Writable are the directories to bind read-write.
+	Writable []string
+	// Network is whether the sandbox shares the host network.
+	Network bool
+	// Dir, Path, and Args are for the action to run.
+	Dir, Path string
+	Args      []string
+	// Uid and Gid are for RunAs, or -1.
+	Uid, Gid int
+	Groups   []uint32
+}
+
+// enterSandbox changes cmd to run the agent as sandboxArg0 in new
+// namespaces, which will then set up the sandbox and run what cmd
+// would have.  The returned func cleans up after cmd exits.
+func (r *runner) enterSandbox(cmd *exec.Cmd, sb *sandboxConfig) (func(), error) {
+	if !sb.enabled {
+		return func() {}, nil
+	}
+	root, err := ioutil.TempDir(r.agentDir, "sandbox-")
+	if err != nil {
+		return nil, err
+	}
+	spec := &sandboxSpec{
+		Root:     root,
+		Writable: append([]string{r.agentDir}, sb.writable...),
+		Network:  sb.network,
+		Dir:      cmd.Dir,
+		Path:     cmd.Path,
+		Args:     cmd.Args,
+		Uid:      -1,
+		Gid:      -1,
+	}
+	for _, dir := range []string{"/tmp", "/var/tmp", path.Dir(r.agentDir)} {
+		found := false
+		for _, s := range spec.Scratch {
+			found = found || s == dir
+		}
+		if !found {
+			spec.Scratch = append(spec.Scratch, dir)
+		}
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	// The sandbox has to be set up as root, so the action drops to
+	// the RunAs user afterwards.
+	if c := cmd.SysProcAttr.Credential; c != nil {
+		spec.Uid, spec.Gid, spec.Groups = int(c.Uid), int(c.Gid), c.Groups
+		cmd.SysProcAttr.Credential = nil
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS
+	if !sb.network {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	buf, err := json.Marshal(spec)
+	if err != nil {
+		os.Remove(root)
+		return nil, err
+	}
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = []string{sandboxArg0, string(buf)}
+	return func() { os.Remove(root) }, nil
+}
+
+// unescapeMount undoes the octal escapes in paths in mountinfo.
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	res := []byte{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				res = append(res, byte(v))
+				i += 3
+				continue
+			}
+		}
+		res = append(res, s[i])
+	}
+	return string(res)
+}
+
+// remountReadOnly makes every mount at or under root read-only,
+// except for the ones under /proc.
+func remountReadOnly(root string) error {
+	fi, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	mounts := [][2]string{}
+	sc := bufio.NewScanner(fi)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		mp := unescapeMount(fields[4])
+		if mp != root && !strings.HasPrefix(mp, root+"/") {
+			continue
+		}
+		rel := strings.TrimPrefix(mp, root)
+		if rel == "/proc" || strings.HasPrefix(rel, "/proc/") {
+			continue
+		}
+		mounts = append(mounts, [2]string{mp, fields[5]})
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+		for _, opt := range strings.Split(m[1], ",") {
+			switch opt {
+			case "nosuid":
+				flags |= syscall.MS_NOSUID
+			case "nodev":
+				flags |= syscall.MS_NODEV
+			case "noexec":
+				flags |= syscall.MS_NOEXEC
+			case "noatime":
+				flags |= syscall.MS_NOATIME
+			case "nodiratime":
+				flags |= syscall.MS_NODIRATIME
+			case "relatime":
+				flags |= syscall.MS_RELATIME
+			}
+		}
+		if err := syscall.Mount("", m[0], "", flags, ""); err != nil {
+			return fmt.Errorf("Unable to make %s read-only: %v", m[0], err)
+		}
+	}
+	return nil
+}
+
+// loopbackUp brings up lo in a new network namespace.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var ifr struct {
+		Name  [syscall.IFNAMSIZ]byte
+		Flags uint16
+		_     [22]byte
+	}
+	copy(ifr.Name[:], "lo")
+	for _, req := range []uintptr{syscall.SIOCGIFFLAGS, syscall.SIOCSIFFLAGS} {
+		if req == syscall.SIOCSIFFLAGS {
+			ifr.Flags |= syscall.IFF_UP
+		}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
+
+// sandboxDevices are the devices from the host /dev that are bound
+// into the /dev of the sandbox.
+var sandboxDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// setupDev mounts a minimal /dev on the sandbox in place of the host
+// one, with just sandboxDevices, a private devpts instance, and a
+// scratch /dev/shm.
+func setupDev(root string) error {
+	dev := path.Join(root, "dev")
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=755"); err != nil {
+		return fmt.Errorf("Unable to mount /dev: %v", err)
+	}
+	for _, name := range sandboxDevices {
+		src, tgt := path.Join("/dev", name), path.Join(dev, name)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if err := ioutil.WriteFile(tgt, nil, 0666); err != nil {
+			return err
+		}
+		if err := syscall.Mount(src, tgt, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("Unable to bind %s: %v", src, err)
+		}
+	}
+	for _, dir := range []string{"pts", "shm"} {
+		if err := os.Mkdir(path.Join(dev, dir), 0755); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Mount("devpts", path.Join(dev, "pts"), "devpts",
+		syscall.MS_NOSUID|syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620"); err != nil {
+		return fmt.Errorf("Unable to mount /dev/pts: %v", err)
+	}
+	if err := syscall.Mount("tmpfs", path.Join(dev, "shm"), "tmpfs",
+		syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("Unable to mount /dev/shm: %v", err)
+	}
+	for name, tgt := range map[string]string{
+		"ptmx":   "pts/ptmx",
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	} {
+		if err := os.Symlink(tgt, path.Join(dev, name)); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Mount("", dev, "", syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("Unable to make /dev read-only: %v", err)
+	}
+	return nil
+}
+
+// sandboxProcReadOnly are the parts of /proc that can change the host
+// kernel, and are made read-only in the sandbox.
+var sandboxProcReadOnly = []string{"bus", "fs", "irq", "sys", "sysrq-trigger"}
+
+// sandboxProcMasked are the parts of /proc that leak information about
+// the host kernel, and are hidden in the sandbox.
+var sandboxProcMasked = []string{"acpi", "asound", "kcore", "keys", "latency_stats", "sched_debug", "scsi", "timer_list", "timer_stats"}
+
+// setupProc mounts a /proc for the PID namespace of the sandbox, with
+// sandboxProcReadOnly made read-only, and sandboxProcMasked hidden
+// behind /dev/null or an empty read-only tmpfs.
+func setupProc(root string) error {
+	proc := path.Join(root, "proc")
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	if err := syscall.Mount("proc", proc, "proc", flags, ""); err != nil {
+		return fmt.Errorf("Unable to mount /proc: %v", err)
+	}
+	for _, name := range sandboxProcReadOnly {
+		tgt := path.Join(proc, name)
+		if _, err := os.Stat(tgt); err != nil {
+			continue
+		}
+		if err := syscall.Mount(tgt, tgt, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("Unable to bind /proc/%s: %v", name, err)
+		}
+		if err := syscall.Mount("", tgt, "", flags|syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("Unable to make /proc/%s read-only: %v", name, err)
+		}
+	}
+	for _, name := range sandboxProcMasked {
+		tgt := path.Join(proc, name)
+		fi, err := os.Stat(tgt)
+		if err != nil {
+			continue
+		}
+		if fi.IsDir() {
+			err = syscall.Mount("tmpfs", tgt, "tmpfs", flags|syscall.MS_RDONLY, "size=0")
+		} else {
+			err = syscall.Mount(path.Join(root, "dev", "null"), tgt, "", syscall.MS_BIND, "")
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to hide /proc/%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// sandboxDropCaps are the capabilities dropped from the bounding set
+// of the action, so that even as root it cannot undo the sandbox:
+// remount or unmount things, load modules, make or poke at devices,
+// trace processes, or escape a chroot.
+var sandboxDropCaps = []uintptr{
+	unix.CAP_SYS_ADMIN,
+	unix.CAP_SYS_MODULE,
+	unix.CAP_MKNOD,
+	unix.CAP_SYS_RAWIO,
+	unix.CAP_SYS_PTRACE,
+	unix.CAP_SYS_CHROOT,
+	unix.CAP_SYS_BOOT,
+	unix.CAP_SYS_TIME,
+	unix.CAP_MAC_ADMIN,
+	unix.CAP_MAC_OVERRIDE,
+	unix.CAP_BPF,
+}
+
+// dropPrivileges drops sandboxDropCaps from the bounding set and sets
+// no_new_privs, both of which the action inherits.
+func dropPrivileges() error {
+	for _, c := range sandboxDropCaps {
+		// Older kernels do not know about the newer capabilities.
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, c, 0, 0, 0); err != nil && err != unix.EINVAL {
+			return fmt.Errorf("Unable to drop capability %d: %v", c, err)
+		}
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("Unable to set no_new_privs: %v", err)
+	}
+	return nil
+}
+
+// setupSandbox builds the sandbox described by spec and makes it the
+// root of the current mount namespace.
+func setupSandbox(spec *sandboxSpec) error {
+	// Keep all our mounts out of the host mount namespace.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("Unable to make mounts private: %v", err)
+	}
+	root := spec.Root
+	if err := syscall.Mount("/", root, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("Unable to bind / to %s: %v", root, err)
+	}
+	if err := remountReadOnly(root); err != nil {
+		return err
+	}
+	if err := setupDev(root); err != nil {
+		return err
+	}
+	for _, dir := range spec.Scratch {
+		tgt := path.Join(root, dir)
+		if st, err := os.Stat(tgt); err != nil || !st.IsDir() {
+			continue
+		}
+		if err := syscall.Mount("tmpfs", tgt, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("Unable to mount scratch %s: %v", dir, err)
+		}
+	}
+	for _, dir := range spec.Writable {
+		tgt := path.Join(root, dir)
+		if err := os.MkdirAll(tgt, 0755); err != nil {
+			return fmt.Errorf("Unable to make %s: %v", dir, err)
+		}
+		if err := syscall.Mount(dir, tgt, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("Unable to bind writable %s: %v", dir, err)
+		}
+	}
+	if err := setupProc(root); err != nil {
+		return err
+	}
+	if !spec.Network {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("Unable to bring up loopback: %v", err)
+		}
+	}
+	if err := syscall.Chdir(root); err != nil {
+		return err
+	}
+	// pivot_root fails if we are already in a chroot, in which case
+	// chroot again.
+	if err := syscall.PivotRoot(".", "."); err == nil {
+		if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+			return fmt.Errorf("Unable to detach the old root: %v", err)
+		}
+	} else if err := syscall.Chroot("."); err != nil {
+		return fmt.Errorf("Unable to change root to %s: %v", root, err)
+	}
+	return syscall.Chdir("/")
+}
+
+// sandboxMain runs in the agent as PID 1 of the sandbox.  It sets up
+// the sandbox, runs the action, passes on signals to it, and reaps
+// everything that exits until the action does.  It returns the exit
+// code of the action, or 255 if the sandbox could not be set up.
+func sandboxMain(arg string) int {
+	spec := &sandboxSpec{}
+	if err := json.Unmarshal([]byte(arg), spec); err != nil {
+		fmt.Fprintf(os.Stderr, "Sandbox: invalid spec: %v\n", err)
+		return 255
+	}
+	if err := setupSandbox(spec); err != nil {
+		fmt.Fprintf(os.Stderr, "Sandbox: %v\n", err)
+		return 255
+	}
+	if err := dropPrivileges(); err != nil {
+		fmt.Fprintf(os.Stderr, "Sandbox: %v\n", err)
+		return 255
+	}
+	cmd := exec.Command(spec.Path)
+	cmd.Args = spec.Args
+	cmd.Dir = spec.Dir
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if spec.Uid >= 0 {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{
+			Uid:    uint32(spec.Uid),
+			Gid:    uint32(spec.Gid),
+			Groups: spec.Groups,
+		}}
+	}
+	sigs := make(chan os.Signal, 4)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT)
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Sandbox: unable to start %s: %v\n", spec.Path, err)
+		return 255
+	}
+	go func() {
+		for sig := range sigs {
+			syscall.Kill(-1, sig.(syscall.Signal))
+		}
+	}()
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return 255
+		}
+		if pid != cmd.Process.Pid {
+			continue
+		}
+		if status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return status.ExitStatus()
+	}
+}
@@ -0,0 +1,85 @@
+// +build linux
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSandbox(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Sandboxes can only be set up as root")
+	}
+	// Not under /tmp, which the sandbox replaces with a scratch tmpfs.
+	cwd, _ := os.Getwd()
+	base, err := ioutil.TempDir(cwd, "sandbox-test-")
+	if err != nil {
+		t.Fatalf("ERROR: Unable to make tmpdir: %v", err)
+	}
+	defer os.RemoveAll(base)
+	base, _ = filepath.EvalSymlinks(base)
+	agentDir := path.Join(base, "agent", "runner")
+	writable := path.Join(base, "writable")
+	outside := path.Join(base, "outside")
+	for _, dir := range []string{agentDir, writable, outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("ERROR: Unable to make %s: %v", dir, err)
+		}
+	}
+	script := `
+echo ok > "$A/file" && echo wrote-agent
+echo ok > "$W/file" && echo wrote-writable
+echo ok > /tmp/file && echo wrote-tmp
+echo bad > "$O/file" && echo wrote-outside
+mount -o remount,rw / && echo remounted
+mount -o remount,rw "$O" && echo remounted
+mknod "$W/mem" c 1 1 && echo made-node
+[ -e /dev/mem ] && echo has-mem
+echo ok > /dev/null && echo has-null
+[ -w /proc/sys/kernel/core_pattern ] && echo proc-sys-writable
+[ -w /proc/sysrq-trigger ] && echo sysrq-writable
+[ -s /proc/kcore ] && echo has-kcore
+[ -r /proc/self/status ] && echo has-proc
+true
+`
+	r := &runner{agentDir: agentDir}
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.Dir = agentDir
+	cmd.Env = []string{"A=" + agentDir, "W=" + writable, "O=" + outside, "PATH=/usr/sbin:/usr/bin:/sbin:/bin"}
+	leave, err := r.enterSandbox(cmd, &sandboxConfig{enabled: true, network: true, writable: []string{writable}})
+	if err != nil {
+		t.Fatalf("ERROR: Unable to set up sandbox: %v", err)
+	}
+	defer leave()
+	out, err := cmd.CombinedOutput()
+	if err != nil && strings.Contains(string(out), "Sandbox:") {
+		t.Skipf("Unable to set up a sandbox here: %s", out)
+	}
+	t.Logf("Sandbox output:\n%s", out)
+	for _, want := range []string{"wrote-agent", "wrote-writable", "wrote-tmp", "has-null", "has-proc"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("ERROR: Expected %s in the sandbox", want)
+		}
+	}
+	for _, bad := range []string{"wrote-outside", "remounted", "made-node", "has-mem", "proc-sys-writable", "sysrq-writable", "has-kcore"} {
+		if strings.Contains(string(out), bad) {
+			t.Errorf("ERROR: Did not expect %s in the sandbox", bad)
+		}
+	}
+	for _, p := range []string{path.Join(agentDir, "file"), path.Join(writable, "file")} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("ERROR: Expected %s to be written: %v", p, err)
+		}
+	}
+	for _, p := range []string{path.Join(outside, "file"), path.Join(writable, "mem")} {
+		if _, err := os.Stat(p); err == nil {
+			t.Errorf("ERROR: Expected %s not to be written", p)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSandbox(t *testing.T) {
+	sb, err := parseSandbox(
+		map[string]string{"SandboxNetwork": "false"},
+		map[string]string{"Sandbox": "true", "SandboxWritable": "/var/lib/thing/, /srv"})
+	if err != nil {
+		t.Fatalf("ERROR: Unexpected error parsing sandbox: %v", err)
+	}
+	if !sb.enabled || sb.network || strings.Join(sb.writable, " ") != "/var/lib/thing /srv" {
+		t.Errorf("ERROR: Unexpected sandbox %+v", sb)
+	}
+	sb, err = parseSandbox(nil, nil)
+	if err != nil || sb.enabled || !sb.network || len(sb.writable) != 0 {
+		t.Errorf("ERROR: Unexpected default sandbox %+v: %v", sb, err)
+	}
+	for _, bad := range []map[string]string{
+		{"Sandbox": "please"},
+		{"SandboxWritable": "relative/dir"},
+	} {
+		if _, err := parseSandbox(bad, nil); err == nil {
+			t.Errorf("ERROR: Expected %v to be invalid", bad)
+		} else {
+			t.Logf("Got expected error %v", err)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictorLowther/jsonpatch2"
+	"github.com/digitalrebar/provision/v4/api"
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+// spoolRetry is how often the spool tries to replay queued updates.
+var spoolRetry = 5 * time.Second
+
+// spoolEntry is an update to dr-provision that the agent could not
+// make when it wanted to.  It is either a chunk of a Job log or a
+// patch to an object.
+type spoolEntry struct {
+	Prefix, Key string
+	Log         []byte           `json:",omitempty"`
+	Patch       jsonpatch2.Patch `json:",omitempty"`
+	seq         uint64
+}
+
+func (e *spoolEntry) String() string {
+	if e.Patch != nil {
+		return fmt.Sprintf("patch to %s:%s", e.Prefix, e.Key)
+	}
+	return fmt.Sprintf("%d bytes of log for %s:%s", len(e.Log), e.Prefix, e.Key)
+}
+
+// spool makes job log writes and state updates for the agent, and
+// queues them when dr-provision cannot be reached so that tasks keep
+// running through short outages and HA failovers.  Queued updates are
+// replayed in order in the background, and nothing new is sent until
+// everything queued before it has been.
+//
+// If dir is set, queued updates are also written to it, so that they
+// survive the agent restarting and are replayed when it starts again.
+// The spool holds a lock on dir until it is closed, so that only one
+// spool replays what is in it.
+type spool struct {
+	dir      string
+	c        *api.Client
+	logger   io.Writer
+	mux      *sync.Mutex
+	flushMux *sync.Mutex
+	entries  []*spoolEntry
+	next     uint64
+	flushing bool
+	retry    time.Duration
+	stop     chan struct{}
+	replays  *sync.WaitGroup
+	unlock   func()
+}
+
+// newSpool makes a spool, loading anything that is queued in dir.
+func newSpool(dir string, c *api.Client, logger io.Writer) (*spool, error) {
+	s := &spool{
+		dir:      dir,
+		c:        c,
+		logger:   logger,
+		mux:      &sync.Mutex{},
+		flushMux: &sync.Mutex{},
+		retry:    spoolRetry,
+		stop:     make(chan struct{}),
+		replays:  &sync.WaitGroup{},
+		unlock:   func() {},
+	}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	unlock, err := lockFile(path.Join(dir, "lock"))
+	if err != nil {
+		return nil, err
+	}
+	s.unlock = unlock
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	for _, fi := range names {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(fi.Name(), ".json"), 16, 64)
+		if err != nil || !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		e := &spoolEntry{seq: seq}
+		buf, err := ioutil.ReadFile(path.Join(dir, fi.Name()))
+		if err == nil {
+			err = json.Unmarshal(buf, e)
+		}
+		if err != nil {
+			fmt.Fprintf(logger, "Spool: dropping unreadable %s: %v\n", fi.Name(), err)
+			os.Remove(path.Join(dir, fi.Name()))
+			continue
+		}
+		s.entries = append(s.entries, e)
+		if seq >= s.next {
+			s.next = seq + 1
+		}
+	}
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].seq < s.entries[j].seq })
+	if len(s.entries) > 0 {
+		fmt.Fprintf(logger, "Spool: %d queued updates to replay\n", len(s.entries))
+		s.startReplay()
+	}
+	return s, nil
+}
+
+// unreachable tests whether err means that dr-provision could not be
+// reached, as opposed to it refusing the update.
+func unreachable(err error) bool {
+	e, ok := err.(*models.Error)
+	if !ok {
+		return true
+	}
+	switch e.Code {
+	case 0, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+func (s *spool) do(e *spoolEntry, val interface{}) error {
+	if e.Patch != nil {
+		return s.c.Req().FailFast().Patch(e.Patch).UrlFor(e.Prefix, e.Key).Do(val)
+	}
+	return s.c.Req().FailFast().Put(e.Log).UrlFor(e.Prefix, e.Key, "log").Do(nil)
+}
+
+func (s *spool) fileFor(e *spoolEntry) string {
+	return path.Join(s.dir, fmt.Sprintf("%016x.json", e.seq))
+}
+
+// queue adds e to the end of the spool.  The caller must hold mux.
+func (s *spool) queue(e *spoolEntry) error {
+	e.seq = s.next
+	s.next++
+	if s.dir != "" {
+		buf, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		tgt := s.fileFor(e)
+		fi, err := os.OpenFile(tgt+".new", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = fi.Write(buf)
+		if err == nil {
+			err = fi.Sync()
+		}
+		fi.Close()
+		if err == nil {
+			err = os.Rename(tgt+".new", tgt)
+		}
+		if err != nil {
+			os.Remove(tgt + ".new")
+			return err
+		}
+	}
+	s.entries = append(s.entries, e)
+	if !s.flushing {
+		s.startReplay()
+	}
+	return nil
+}
+
+// startReplay starts replay.  The caller must hold mux, or be the only
+// user of the spool.
+func (s *spool) startReplay() {
+	select {
+	case <-s.stop:
+		// Closed, leave the entries for the next spool to replay.
+		return
+	default:
+	}
+	s.flushing = true
+	s.replays.Add(1)
+	go s.replay()
+}
+
+// send makes the update in e, unmarshalling the response into val.
+// If dr-provision cannot be reached, or there are older updates that
+// have not been made yet, e is queued and send returns true.
+func (s *spool) send(e *spoolEntry, val interface{}) (bool, error) {
+	if e.Log != nil {
+		e.Log = append([]byte{}, e.Log...)
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if len(s.entries) == 0 {
+		err := s.do(e, val)
+		if err == nil || !unreachable(err) {
+			return false, err
+		}
+	}
+	return true, s.queue(e)
+}
+
+// flush tries to make each queued update in order, stopping at the
+// first one that dr-provision cannot be reached for.  Updates that
+// dr-provision refuses are logged and dropped.
+func (s *spool) flush() error {
+	s.flushMux.Lock()
+	defer s.flushMux.Unlock()
+	for {
+		s.mux.Lock()
+		if len(s.entries) == 0 {
+			s.mux.Unlock()
+			return nil
+		}
+		e := s.entries[0]
+		s.mux.Unlock()
+		err := s.do(e, nil)
+		if err != nil && unreachable(err) {
+			return err
+		}
+		if err != nil {
+			fmt.Fprintf(s.logger, "Spool: dropping %s: %v\n", e, err)
+		}
+		s.mux.Lock()
+		s.entries = s.entries[1:]
+		if s.dir != "" {
+			os.Remove(s.fileFor(e))
+		}
+		s.mux.Unlock()
+	}
+}
+
+// replay runs flush every retry until the spool is empty or closed.
+func (s *spool) replay() {
+	defer s.replays.Done()
+	for {
+		err := s.flush()
+		s.mux.Lock()
+		if err == nil && len(s.entries) == 0 {
+			s.flushing = false
+			s.mux.Unlock()
+			return
+		}
+		s.mux.Unlock()
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(s.retry):
+		}
+	}
+}
+
+// close stops replaying, waits for a replay in progress to finish, and
+// releases the lock on dir.  Anything still queued stays in dir for
+// the next spool.
+func (s *spool) close() {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	select {
+	case <-s.stop:
+		s.mux.Unlock()
+		return
+	default:
+	}
+	close(s.stop)
+	s.mux.Unlock()
+	s.replays.Wait()
+	s.unlock()
+}
+
+// drain makes all the queued updates, and returns an error if it
+// could not.  The agent drains the spool before it creates or resets
+// jobs, so that dr-provision sees the updates in order.
+func (s *spool) drain() error {
+	if err := s.flush(); err != nil {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		return fmt.Errorf("Spool: %d updates waiting for dr-provision: %v", len(s.entries), err)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VictorLowther/jsonpatch2"
+	"github.com/digitalrebar/provision/v4/api"
+)
+
+func TestSpool(t *testing.T) {
+	spoolRetry = time.Hour
+	defer func() { spoolRetry = 5 * time.Second }()
+	mux := &sync.Mutex{}
+	up := false
+	seen := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		if !up {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		buf, _ := ioutil.ReadAll(r.Body)
+		seen = append(seen, r.Method+" "+strings.TrimPrefix(r.URL.Path, api.APIPATH)+" "+string(buf))
+		if strings.HasSuffix(r.URL.Path, "/refused") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"Code":409,"Messages":["no"]}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	setUp := func(b bool) {
+		mux.Lock()
+		up = b
+		seen = []string{}
+		mux.Unlock()
+	}
+	c, _ := api.TokenSessionProxy(srv.URL, "token", false)
+	dir, err := ioutil.TempDir("", "spool-")
+	if err != nil {
+		t.Fatalf("ERROR: Unable to make tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	log := &bytes.Buffer{}
+	s, err := newSpool(dir, c, log)
+	if err != nil {
+		t.Fatalf("ERROR: Unable to make spool: %v", err)
+	}
+	patch := jsonpatch2.Patch{{Op: "replace", Path: "/State", Value: "finished"}}
+	send := func(e *spoolEntry, wantQueued bool) {
+		t.Helper()
+		queued, err := s.send(e, nil)
+		if err != nil || queued != wantQueued {
+			t.Errorf("ERROR: Sending %s: expected queued %v, got %v: %v", e, wantQueued, queued, err)
+		}
+	}
+	send(&spoolEntry{Prefix: "jobs", Key: "j", Log: []byte("one\n")}, true)
+	setUp(true)
+	// Once something is queued, later updates queue behind it.
+	send(&spoolEntry{Prefix: "jobs", Key: "j", Log: []byte("two\n")}, true)
+	send(&spoolEntry{Prefix: "jobs", Key: "refused", Patch: patch}, true)
+	send(&spoolEntry{Prefix: "jobs", Key: "j", Patch: patch}, true)
+	if files, _ := ioutil.ReadDir(dir); len(files) != 5 {
+		t.Errorf("ERROR: Expected 4 spooled updates and the lock on disk, got %d", len(files))
+	}
+	if err := s.drain(); err != nil {
+		t.Errorf("ERROR: Unexpected error draining: %v", err)
+	}
+	want := []string{
+		"PUT /jobs/j/log one\n",
+		"PUT /jobs/j/log two\n",
+		`PATCH /jobs/refused [{"op":"replace","path":"/State","from":"","value":"finished"}]`,
+		`PATCH /jobs/j [{"op":"replace","path":"/State","from":"","value":"finished"}]`,
+	}
+	mux.Lock()
+	if strings.Join(seen, "|") != strings.Join(want, "|") {
+		t.Errorf("ERROR: Expected replay %q, got %q", want, seen)
+	}
+	mux.Unlock()
+	if !strings.Contains(log.String(), "dropping patch to jobs:refused") {
+		t.Errorf("ERROR: Expected the refused patch to be logged, got %q", log.String())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("ERROR: Expected only the lock after draining, got %d files", len(files))
+	}
+	send(&spoolEntry{Prefix: "jobs", Key: "j", Log: []byte("three\n")}, false)
+
+	// Queued updates survive a restart.
+	setUp(false)
+	send(&spoolEntry{Prefix: "jobs", Key: "j", Log: []byte("four\n")}, true)
+	if err := s.drain(); err == nil {
+		t.Errorf("ERROR: Expected draining to fail while unreachable")
+	} else {
+		t.Logf("Got expected error %v", err)
+	}
+	if _, err := newSpool(dir, c, log); err == nil {
+		t.Errorf("ERROR: Expected a second spool on %s to fail while the first is open", dir)
+	} else {
+		t.Logf("Got expected error %v", err)
+	}
+	s.close()
+	s, err = newSpool(dir, c, log)
+	if err != nil || len(s.entries) != 1 {
+		t.Fatalf("ERROR: Expected 1 update loaded from disk: %v", err)
+	}
+	setUp(true)
+	if err := s.drain(); err != nil {
+		t.Errorf("ERROR: Unexpected error draining: %v", err)
+	}
+	mux.Lock()
+	if len(seen) != 1 || seen[0] != "PUT /jobs/j/log four\n" {
+		t.Errorf("ERROR: Expected the reloaded log to be replayed, got %q", seen)
+	}
+	mux.Unlock()
+	s.close()
+}
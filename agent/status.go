@@ -0,0 +1,320 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+var stateNames = map[state]string{
+	AGENT_INIT:                  "AGENT_INIT",
+	AGENT_WAIT_FOR_RUNNABLE:     "AGENT_WAIT_FOR_RUNNABLE",
+	AGENT_RUN_TASK:              "AGENT_RUN_TASK",
+	AGENT_WAIT_FOR_CHANGE_STAGE: "AGENT_WAIT_FOR_CHANGE_STAGE",
+	AGENT_CHANGE_STAGE:          "AGENT_CHANGE_STAGE",
+	AGENT_EXIT:                  "AGENT_EXIT",
+	AGENT_REBOOT:                "AGENT_REBOOT",
+	AGENT_POWEROFF:              "AGENT_POWEROFF",
+	AGENT_KEXEC:                 "AGENT_KEXEC",
+	AGENT_RUN_CONTEXT:           "AGENT_RUN_CONTEXT",
+}
+
+func (s state) String() string {
+	if n, ok := stateNames[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("AGENT_UNKNOWN(%d)", int(s))
+}
+
+// Status is what the status API of a running agent reports.
+type Status struct {
+	// State is the state the agent is in, such as AGENT_RUN_TASK.
+	State string
+	// Machine is the name of the machine the agent is running tasks for.
+	Machine string
+	// Context is the Context the agent is running tasks in.
+	Context string `json:",omitempty"`
+	// Workflow and Stage are what the machine was in when the agent
+	// entered State.
+	Workflow string `json:",omitempty"`
+	Stage    string `json:",omitempty"`
+	// Job and Task are for the task the agent is running, if any.
+	Job  string `json:",omitempty"`
+	Task string `json:",omitempty"`
+	// ActionPid is the PID of the action that is running, if any.
+	ActionPid int `json:",omitempty"`
+	// Paused is whether the current task has been paused.
+	Paused bool
+	// LastError is the last error the agent ran into.
+	LastError string `json:",omitempty"`
+	// Started is when the agent started, and Uptime is how long ago that was.
+	Started time.Time
+	Uptime  string
+}
+
+// StatusSocket has the agent serve its status API on a unix socket
+// at path while it runs.
+func (a *Agent) StatusSocket(path string) *Agent {
+	a.statusSock = path
+	return a
+}
+
+// StatusAddr has the agent also serve GET /status over HTTP on addr,
+// which must be a loopback address.  Pause, resume, and cancel are
+// only served on the StatusSocket, which only root can connect to.
+func (a *Agent) StatusAddr(addr string) *Agent {
+	a.statusAddr = addr
+	return a
+}
+
+// snapshot records the state the agent is entering for Status.  The
+// caller must hold taskMux.
+func (a *Agent) snapshot() {
+	a.status.State = a.state.String()
+	a.status.Machine = a.machine.Name
+	a.status.Context = a.machine.Context
+	a.status.Workflow = a.machine.Workflow
+	a.status.Stage = a.machine.Stage
+	if a.err != nil {
+		a.status.LastError = a.err.Error()
+	}
+}
+
+// Status returns what the agent is doing right now.
+func (a *Agent) Status() *Status {
+	a.taskMux.Lock()
+	defer a.taskMux.Unlock()
+	res := a.status
+	res.Paused = a.paused
+	res.Uptime = time.Since(res.Started).Round(time.Second).String()
+	if a.task != nil {
+		res.ActionPid = a.task.pid()
+	}
+	return &res
+}
+
+// Pause stops the action that is running until Resume is called, and
+// keeps the agent from starting any new tasks.  Timeouts for the
+// action keep running while it is paused.
+func (a *Agent) Pause() error {
+	a.taskMux.Lock()
+	defer a.taskMux.Unlock()
+	if a.paused {
+		return nil
+	}
+	if a.task != nil {
+		if err := a.task.pause(true); err != nil {
+			return err
+		}
+	}
+	a.paused = true
+	return nil
+}
+
+// Resume undoes Pause.
+func (a *Agent) Resume() error {
+	a.taskMux.Lock()
+	defer a.taskMux.Unlock()
+	if !a.paused {
+		return nil
+	}
+	if a.task != nil {
+		if err := a.task.pause(false); err != nil {
+			return err
+		}
+	}
+	a.paused = false
+	a.pauseCond.Broadcast()
+	return nil
+}
+
+// Cancel kills the action that is running, which fails the task
+// with an ExitState of cancelled.
+func (a *Agent) Cancel() error {
+	a.taskMux.Lock()
+	defer a.taskMux.Unlock()
+	if a.task == nil {
+		return fmt.Errorf("No task is running")
+	}
+	return a.task.cancel()
+}
+
+func writeStatus(w http.ResponseWriter, code int, val interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(val)
+}
+
+// ServeHTTP implements the status API:
+//
+// * GET /status returns the Status of the agent.
+//
+// * POST /pause, /resume, and /cancel call Pause, Resume, and Cancel,
+//   and then return the Status.  They must be sent as
+//   application/json, so that a browser cannot send them with a plain
+//   form post.
+func (a *Agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.serveStatusAPI(w, r, true)
+}
+
+// loopbackHost tests whether the Host of r names a loopback address,
+// which keeps pages that rebind their DNS to 127.0.0.1 out.
+func loopbackHost(r *http.Request) bool {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serveLoopback serves the read-only part of the status API on
+// StatusAddr.
+func (a *Agent) serveLoopback(w http.ResponseWriter, r *http.Request) {
+	if !loopbackHost(r) {
+		res := &models.Error{Type: "AGENT_STATUS", Model: "agent", Key: r.URL.Path, Code: http.StatusForbidden}
+		res.Errorf("Host %s is not a loopback address", r.Host)
+		writeStatus(w, res.Code, res)
+		return
+	}
+	a.serveStatusAPI(w, r, false)
+}
+
+// serveStatusAPI serves the status API.  The control endpoints are
+// only served if control is set.
+func (a *Agent) serveStatusAPI(w http.ResponseWriter, r *http.Request, control bool) {
+	res := &models.Error{Type: "AGENT_STATUS", Model: "agent", Key: r.URL.Path}
+	var op func() error
+	switch r.URL.Path {
+	case "/status":
+	case "/pause":
+		op = a.Pause
+	case "/resume":
+		op = a.Resume
+	case "/cancel":
+		op = a.Cancel
+	}
+	if r.URL.Path != "/status" && (op == nil || !control) {
+		res.Code = http.StatusNotFound
+		res.Errorf("No such endpoint")
+		writeStatus(w, res.Code, res)
+		return
+	}
+	if (op == nil && r.Method != "GET") || (op != nil && r.Method != "POST") {
+		res.Code = http.StatusMethodNotAllowed
+		res.Errorf("Method %s not allowed", r.Method)
+		writeStatus(w, res.Code, res)
+		return
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); op != nil && mt != "application/json" {
+		res.Code = http.StatusUnsupportedMediaType
+		res.Errorf("Content-Type must be application/json")
+		writeStatus(w, res.Code, res)
+		return
+	}
+	if op != nil {
+		if err := op(); err != nil {
+			res.Code = http.StatusConflict
+			res.AddError(err)
+			writeStatus(w, res.Code, res)
+			return
+		}
+	}
+	writeStatus(w, http.StatusOK, a.Status())
+}
+
+// serveStatus starts the status API on the socket and address the
+// agent has been given.  The returned func stops it.
+func (a *Agent) serveStatus() (func(), error) {
+	listeners := []net.Listener{}
+	stop := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+		if a.statusSock != "" {
+			os.Remove(a.statusSock)
+		}
+	}
+	if a.statusSock != "" {
+		os.Remove(a.statusSock)
+		l, err := net.Listen("unix", a.statusSock)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+		if err := os.Chmod(a.statusSock, 0600); err != nil {
+			stop()
+			return nil, err
+		}
+	}
+	if a.statusAddr != "" {
+		host, _, err := net.SplitHostPort(a.statusAddr)
+		if err == nil {
+			if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+				err = fmt.Errorf("%s is not a loopback address", a.statusAddr)
+			}
+		}
+		var l net.Listener
+		if err == nil {
+			l, err = net.Listen("tcp", a.statusAddr)
+		}
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("Unable to serve status on %s: %v", a.statusAddr, err)
+		}
+		listeners = append(listeners, l)
+	}
+	// The socket, if there is one, is the first listener.
+	handlers := []http.Handler{a, http.HandlerFunc(a.serveLoopback)}
+	if a.statusSock == "" {
+		handlers = handlers[1:]
+	}
+	for i, l := range listeners {
+		go (&http.Server{Handler: handlers[i]}).Serve(l)
+	}
+	return stop, nil
+}
+
+// QueryStatus calls op on the status API of the agent listening on
+// the unix socket at sock.  op is one of status, pause, resume, or
+// cancel.
+func QueryStatus(sock, op string) (*Status, error) {
+	c := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+			},
+		},
+	}
+	var resp *http.Response
+	var err error
+	if op == "status" {
+		resp, err = c.Get("http://agent/status")
+	} else {
+		resp, err = c.Post("http://agent/"+op, "application/json", nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		res := &models.Error{}
+		if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+			return nil, fmt.Errorf("Agent returned %s", resp.Status)
+		}
+		return nil, res
+	}
+	res := &Status{}
+	return res, json.NewDecoder(resp.Body).Decode(res)
+}
@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+func TestStatusAPI(t *testing.T) {
+	a, err := New(nil, &models.Machine{Name: "status"}, true, true, false, nil)
+	if err != nil {
+		t.Fatalf("ERROR: Agent create failed: %v", err)
+	}
+	for _, tc := range []struct {
+		loopback           bool
+		method, host, path string
+		contentType        string
+		code               int
+	}{
+		{false, "GET", "", "/status", "", http.StatusOK},
+		{false, "POST", "", "/pause", "application/json", http.StatusOK},
+		{false, "POST", "", "/resume", "application/json; charset=utf-8", http.StatusOK},
+		{false, "POST", "", "/pause", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{false, "POST", "", "/pause", "", http.StatusUnsupportedMediaType},
+		{false, "GET", "", "/pause", "", http.StatusMethodNotAllowed},
+		{true, "GET", "127.0.0.1:8099", "/status", "", http.StatusOK},
+		{true, "GET", "localhost:8099", "/status", "", http.StatusOK},
+		{true, "GET", "evil.example.com:8099", "/status", "", http.StatusForbidden},
+		{true, "POST", "127.0.0.1:8099", "/pause", "application/json", http.StatusNotFound},
+		{true, "POST", "127.0.0.1:8099", "/cancel", "application/json", http.StatusNotFound},
+	} {
+		r := httptest.NewRequest(tc.method, "http://agent"+tc.path, strings.NewReader(""))
+		if tc.host != "" {
+			r.Host = tc.host
+		}
+		if tc.contentType != "" {
+			r.Header.Set("Content-Type", tc.contentType)
+		}
+		w := httptest.NewRecorder()
+		if tc.loopback {
+			a.serveLoopback(w, r)
+		} else {
+			a.ServeHTTP(w, r)
+		}
+		if w.Code != tc.code {
+			t.Errorf("ERROR: %s %s (Host %q, loopback %v, %q): expected %d, got %d: %s",
+				tc.method, tc.path, tc.host, tc.loopback, tc.contentType, tc.code, w.Code, w.Body.String())
+		}
+	}
+	if a.Status().Paused {
+		t.Errorf("ERROR: Expected the agent to have been resumed")
+	}
+}
+
+func TestAgentStatus(t *testing.T) {
+	tjd, err := ioutil.TempDir("", "fakeagent-")
+	if err != nil {
+		t.Fatalf("Failed to create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(tjd)
+	task := &models.Task{
+		Name: "status-task",
+		Templates: []models.TemplateInfo{
+			{Name: "script", Contents: "#!/usr/bin/env bash\nsleep 30\n"},
+		},
+	}
+	stage := &models.Stage{Name: "status-stage", Tasks: []string{"status-task"}}
+	m := &models.Machine{
+		Name:  "status-agent",
+		Stage: "status-stage",
+		Meta:  models.Meta{"feature-flags": "change-stage-v2"},
+	}
+	defer cleanUp(m, stage, task)
+	for _, obj := range []models.Model{task, stage, m} {
+		if f, ok := obj.(models.Filler); ok {
+			f.Fill()
+		}
+		if err := session.CreateModel(obj); err != nil {
+			t.Fatalf("ERROR: Failed to create %s: %v", obj.Prefix(), err)
+		}
+	}
+	sock := path.Join(tjd, "status.sock")
+	log := &bytes.Buffer{}
+	a, err := New(session, m, true, true, false, log)
+	if err != nil {
+		t.Fatalf("ERROR: Agent create failed: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- a.Timeout(time.Second).StatusSocket(sock).Run() }()
+	var st *Status
+	for i := 0; i < 100; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if st, err = QueryStatus(sock, "status"); err == nil && st.ActionPid != 0 {
+			break
+		}
+	}
+	if st == nil || st.ActionPid == 0 || st.State != "AGENT_RUN_TASK" || st.Task != "status-task" || st.Machine != "status-agent" {
+		t.Fatalf("ERROR: Unexpected status %#v: %v", st, err)
+	}
+	// procState waits a bit for the action to be stopped or not,
+	// since signals are delivered asynchronously.
+	procState := func(stopped bool) string {
+		res := ""
+		for i := 0; i < 50; i++ {
+			buf, err := ioutil.ReadFile("/proc/" + strconv.Itoa(st.ActionPid) + "/stat")
+			if err != nil {
+				return ""
+			}
+			res = strings.Fields(string(buf[strings.LastIndex(string(buf), ")")+1:]))[0]
+			if (res == "T") == stopped {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return res
+	}
+	if st, err := QueryStatus(sock, "pause"); err != nil || !st.Paused {
+		t.Errorf("ERROR: Pause failed: %#v: %v", st, err)
+	}
+	if ps := procState(true); ps != "" && ps != "T" {
+		t.Errorf("ERROR: Expected paused action to be stopped, it is %s", ps)
+	}
+	if st, err := QueryStatus(sock, "resume"); err != nil || st.Paused {
+		t.Errorf("ERROR: Resume failed: %#v: %v", st, err)
+	}
+	if ps := procState(false); ps == "T" {
+		t.Errorf("ERROR: Expected resumed action to be running, it is %s", ps)
+	}
+	if _, err := QueryStatus(sock, "cancel"); err != nil {
+		t.Errorf("ERROR: Cancel failed: %v", err)
+	}
+	select {
+	case err := <-done:
+		t.Logf("Agent exited with %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("ERROR: Agent did not exit after cancel")
+	}
+	if err := session.FillModel(m, m.Key()); err != nil {
+		t.Fatalf("ERROR: Failed to refetch machine: %v", err)
+	}
+	job := &models.Job{}
+	if err := session.FillModel(job, m.CurrentJob.String()); err != nil || job.State != "failed" || job.ExitState != "cancelled" {
+		t.Errorf("ERROR: Unexpected job state %s:%s: %v", job.State, job.ExitState, err)
+	}
+	if _, err := os.Stat(sock); err == nil {
+		t.Errorf("ERROR: Status socket left behind after the agent exited")
+	}
+	t.Logf("Agent log:\n%s", log.String())
+}
@@ -46,8 +46,17 @@ func (j jcl) String() string {
 type runner struct {
 	// Status codes that may be returned when a script exits.
 	failed, incomplete, reboot, poweroff, stop, wantChroot bool
+	// Why the agent killed the last script, if it did.  It is used as
+	// the ExitState of the Job.
+	exitReason string
+	// Whether scripts should be stopped until the agent is resumed.
+	paused bool
 	// Client that the TaskRunner will use to communicate with the API
 	c *api.Client
+	// Spool for job log writes and state updates.
+	spool *spool
+	// Where exit codes are counted, if anywhere.
+	metrics *metrics
 	// The Job that the TaskRunner will log to and update the status of.
 	j *models.Job
 	// The machine the TaskRunner is running on.
@@ -81,6 +90,8 @@ func newRunner(a *Agent, m *models.Machine, agentDir, chrootDir string, logger i
 	}
 	res := &runner{
 		c:        a.client,
+		spool:    a.spool,
+		metrics:  a.metrics,
 		m:        m,
 		agentDir: agentDir,
 		logger:   logger,
@@ -116,10 +127,73 @@ func (r *runner) kill() {
 	r.cmdMux.Lock()
 	defer r.cmdMux.Unlock()
 	if r.cmd != nil && r.cmd.Process != nil {
-		r.cmd.Process.Kill()
+		signalGroup(r.cmd, syscall.SIGKILL)
 	}
 }
 
+// pid returns the PID of the running script, or 0.
+func (r *runner) pid() int {
+	r.cmdMux.Lock()
+	defer r.cmdMux.Unlock()
+	if r.cmd != nil && r.cmd.Process != nil {
+		return r.cmd.Process.Pid
+	}
+	return 0
+}
+
+// pause stops or continues the running script, and any that start
+// while the runner is paused.
+func (r *runner) pause(stop bool) error {
+	r.cmdMux.Lock()
+	defer r.cmdMux.Unlock()
+	if r.cmd != nil && r.cmd.Process != nil {
+		if err := pauseGroup(r.cmd, stop); err != nil {
+			return err
+		}
+		if stop {
+			r.log("Command paused")
+		} else {
+			r.log("Command resumed")
+		}
+	}
+	r.paused = stop
+	return nil
+}
+
+// cancel kills the running script and fails the task.
+func (r *runner) cancel() error {
+	r.cmdMux.Lock()
+	defer r.cmdMux.Unlock()
+	if r.cmd == nil || r.cmd.Process == nil {
+		return fmt.Errorf("No command is running")
+	}
+	r.exitReason = "cancelled"
+	return signalGroup(r.cmd, syscall.SIGKILL)
+}
+
+// watchdog enforces the timeout on cmd.  When it runs out, the
+// process group of cmd is sent SIGTERM, and then SIGKILL once
+// the grace period has passed or cmd has exited.  done must be
+// closed when cmd exits.
+func (r *runner) watchdog(cmd *exec.Cmd, l *actionLimits, done chan struct{}) {
+	select {
+	case <-done:
+		return
+	case <-time.After(l.timeout):
+	}
+	r.cmdMux.Lock()
+	r.exitReason = "timeout"
+	r.cmdMux.Unlock()
+	r.log("Command timed out after %v, sending SIGTERM", l.timeout)
+	signalGroup(cmd, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(l.grace):
+		r.log("Command still running after %v, sending SIGKILL", l.grace)
+	}
+	signalGroup(cmd, syscall.SIGKILL)
+}
+
 // Close() shuts down the writer side of the logging pipe.
 // This will also flush any remaining data to stderr
 func (r *runner) Close() {
@@ -142,6 +216,20 @@ func (r *runner) Close() {
 	}
 }
 
+// lockedWriter serializes writes to w.  The command's output is copied
+// to the log by goroutines in os/exec that can still be running after
+// the process has exited, while the runner is logging its own messages.
+type lockedWriter struct {
+	mux sync.Mutex
+	w   io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.w.Write(p)
+}
+
 // log writes the string (with a timestamp) to stderr and to the
 // server-side log for the current job.
 func (r *runner) log(s string, items ...interface{}) {
@@ -156,21 +244,57 @@ func (r *runner) expand(action *models.JobAction, taskDir string) error {
 	} else if r.chrootDir != "" {
 		action.Path = path.Join(r.chrootDir, action.Path)
 	}
+	placement, err := parsePlacement(action.Meta, r.t.Meta)
+	if err != nil {
+		r.log("Unable to get placement for %s: %v", action.Name, err)
+		return err
+	}
 	r.log("%s: Writing %s to %s", time.Now(), action.Name, action.Path)
 	if err := os.MkdirAll(filepath.Dir(action.Path), os.ModePerm); err != nil {
 		r.log("Unable to mkdirs for %s: %v", action.Path, err)
 		return err
 	}
-	if err := ioutil.WriteFile(action.Path, []byte(action.Content), 0644); err != nil {
+	var what string
+	if action.Link != "" {
+		what, err = placement.link(action.Path, action.Link)
+	} else {
+		what, err = placement.place(action.Path, []byte(action.Content))
+	}
+	if err != nil {
 		r.log("Unable to write to %s: %v", action.Path, err)
 		return err
 	}
+	r.log("%s: %s", action.Path, what)
 	r.failed = false
 	return nil
 }
 
 // perform runs a single script action.
 func (r *runner) perform(action *models.JobAction, taskDir string) error {
+	limits, err := parseLimits(action.Meta, r.t.Meta)
+	if err != nil {
+		r.log("Unable to get limits for %s: %v", action.Name, err)
+		return err
+	}
+	env, err := parseActionEnv(action.Meta, r.t.Meta)
+	if err != nil {
+		r.log("Unable to get environment for %s: %v", action.Name, err)
+		return err
+	}
+	sandbox, err := parseSandbox(action.Meta, r.t.Meta)
+	if err != nil {
+		r.log("Unable to get sandbox for %s: %v", action.Name, err)
+		return err
+	}
+	if env.runUser != "" {
+		// RunAs actions get a directory of their own to give to the
+		// user, so that the agent never writes into a directory the
+		// user owns.
+		if taskDir, err = ioutil.TempDir(taskDir, action.Name+"-"); err != nil {
+			r.log("Unable to make a directory for %s: %v", action.Name, err)
+			return err
+		}
+	}
 	taskFile := path.Join(taskDir, r.j.Task+"-"+action.Name)
 	if err := ioutil.WriteFile(taskFile, []byte(action.Content), 0700); err != nil {
 		r.log("Unable to write to script %s: %v", taskFile, err)
@@ -187,22 +311,31 @@ func (r *runner) perform(action *models.JobAction, taskDir string) error {
 		cmdArray = append(cmdArray, "powershell.exe")
 		cmdArray = append(cmdArray, "-File")
 	}
-	cmdArray = append(cmdArray, "./"+path.Base(taskFile))
+	if env.dir == "" {
+		cmdArray = append(cmdArray, "./"+path.Base(taskFile))
+	} else {
+		// The script is not in the directory it runs in.
+		cmdArray = append(cmdArray, taskFile)
+	}
+	if cmdArray, err = umaskCommand(env.umask, cmdArray); err != nil {
+		r.log("Unable to set the umask for %s: %v", action.Name, err)
+		return err
+	}
 	r.cmdMux.Lock()
 	r.cmd = exec.Command(cmdArray[0], cmdArray[1:]...)
-	r.cmd.Dir = taskDir
-	r.cmd.Env = append(os.Environ(),
-		"TMPDIR="+path.Dir(r.agentDir),
-		"TMP="+path.Dir(r.agentDir),
-		"RS_RUNNER_DIR="+r.agentDir,
-		"RS_TASK_DIR="+taskDir,
-		"RS_UUID="+r.m.Key(),
-		"RS_ENDPOINT="+r.c.Endpoint(),
-	)
+	r.cmd.Dir = env.workDir(taskDir)
+	vars := []string{
+		"TMPDIR=" + path.Dir(r.agentDir),
+		"TMP=" + path.Dir(r.agentDir),
+		"RS_RUNNER_DIR=" + r.agentDir,
+		"RS_TASK_DIR=" + taskDir,
+		"RS_UUID=" + r.m.Key(),
+		"RS_ENDPOINT=" + r.c.Endpoint(),
+	}
 	if r.token != "" {
-		r.cmd.Env = append(r.cmd.Env, "RS_TOKEN="+r.token)
+		vars = append(vars, "RS_TOKEN="+r.token)
 	} else {
-		r.cmd.Env = append(r.cmd.Env, "RS_TOKEN="+r.c.Token())
+		vars = append(vars, "RS_TOKEN="+r.c.Token())
 	}
 	r.cmd.Stdout = r.in
 	r.cmd.Stderr = r.in
@@ -211,22 +344,92 @@ func (r *runner) perform(action *models.JobAction, taskDir string) error {
 		r.cmdMux.Unlock()
 		return err
 	}
-	r.log("Starting command %s\n\n", r.cmd.Path)
-	if err := r.cmd.Start(); err != nil {
+	setProcGroup(r.cmd)
+	uid, gid, userVars, err := runAs(r.cmd, env)
+	if err == nil && uid >= 0 {
+		// The user needs to get through the task directory to its own.
+		if err = os.Chmod(path.Dir(taskDir), 0711); err == nil {
+			err = chownTree(taskDir, uid, gid)
+		}
+	}
+	if err != nil {
+		r.log("Command failed to set up RunAs: %v", err)
+		r.cmdMux.Unlock()
+		r.exitChroot()
+		return err
+	}
+	r.cmd.Env = env.environ(os.Environ(), append(vars, userVars...))
+	if uid >= 0 {
+		r.log("Running command as %s", env.runUser)
+	}
+	cmdPath := r.cmd.Path
+	leaveSandbox, err := r.enterSandbox(r.cmd, sandbox)
+	if err != nil {
+		r.log("Command failed to set up sandbox: %v", err)
+		r.cmdMux.Unlock()
+		r.exitChroot()
+		return err
+	}
+	defer leaveSandbox()
+	if sandbox.enabled {
+		r.log("Running command in a sandbox")
+	}
+	// Requested limits are not optional: an action that cannot be
+	// limited does not run.
+	cg, err := r.enterCgroup(r.cmd, limits)
+	if err != nil {
+		r.log("Unable to apply resource limits: %v", err)
+		r.cmdMux.Unlock()
+		r.exitChroot()
+		return err
+	}
+	r.log("Starting command %s\n\n", cmdPath)
+	err = r.cmd.Start()
+	cg.started()
+	if err != nil {
 		r.log("Command failed to start: %v", err)
 		r.cmdMux.Unlock()
+		cg.close()
+		r.exitChroot()
 		return err
 	}
+	cmd := r.cmd
+	if r.paused {
+		if err := pauseGroup(cmd, true); err != nil {
+			r.log("Unable to pause command: %v", err)
+		}
+	}
 	r.cmdMux.Unlock()
+	done := make(chan struct{})
+	if limits.timeout > 0 {
+		go r.watchdog(cmd, limits, done)
+	}
 	// Wait on the process, not the command to exit.
 	// We don't want to auto-close stdout and stderr,
 	// as we will continue to use them.
 	r.log("Command running")
-	pState, _ := r.cmd.Process.Wait()
+	pState, _ := cmd.Process.Wait()
+	close(done)
 	r.cmdMux.Lock()
 	r.cmd = nil
+	if r.exitReason == "" && cg.oomKilled() {
+		r.exitReason = "resource-limit"
+	}
+	reason := r.exitReason
 	r.cmdMux.Unlock()
+	cg.close()
 	r.exitChroot()
+	switch reason {
+	case "timeout":
+		r.log("Command killed because it ran longer than %v", limits.timeout)
+		return nil
+	case "resource-limit":
+		r.log("Command killed because it ran out of memory (MemoryLimit %d bytes)", limits.memory)
+		return nil
+	case "cancelled":
+		r.log("Command cancelled")
+		return nil
+	}
 	status := pState.Sys().(syscall.WaitStatus)
 	sane := r.t.HasFeature("sane-exit-codes")
 	if !sane {
@@ -235,6 +438,7 @@ func (r *runner) perform(action *models.JobAction, taskDir string) error {
 	}
 	code := uint(status.ExitStatus())
 	r.log("Command exited with status %d", code)
+	r.metrics.exitCode(r.t.Name, int(code))
 	if sane {
 		switch code {
 		case 0:
@@ -312,7 +516,7 @@ func (r *runner) run() error {
 	// Due to how io.Pipe works, this should wind up being fairly synchronous.
 	reader, writer := net.Pipe()
 
-	r.in = io.MultiWriter(writer, r.logger)
+	r.in = &lockedWriter{w: io.MultiWriter(writer, r.logger)}
 	r.pipeWriter = writer
 	helperWritten := false
 
@@ -328,7 +532,8 @@ func (r *runner) run() error {
 				continue
 			}
 			if pos > 0 {
-				if r.c.Req().Put(buf[:pos]).UrlFor("jobs", jKey, "log").Do(nil) != nil {
+				// The spool keeps the log if dr-provision is unreachable.
+				if _, err := r.spool.send(&spoolEntry{Prefix: "jobs", Key: jKey, Log: buf[:pos]}, nil); err != nil {
 					return
 				}
 				pos = 0
@@ -362,7 +567,14 @@ func (r *runner) run() error {
 		if r.failed || r.reboot || r.stop || r.poweroff || r.incomplete {
 			newM := models.Clone(r.m).(*models.Machine)
 			newM.Runnable = false
-			if err := r.c.Req().PatchTo(r.m, newM).Do(&newM); err == nil {
+			if queued, err := r.spool.send(&spoolEntry{
+				Prefix: r.m.Prefix(),
+				Key:    r.m.Key(),
+				Patch:  jsonpatch2.Patch{{Op: "replace", Path: "/Runnable", Value: false}},
+			}, &newM); queued {
+				r.log("Marking machine %s as not runnable once dr-provision is reachable", r.m.Name)
+				r.m = newM
+			} else if err == nil {
 				r.log("Marked machine %s as not runnable", r.m.Name)
 				r.m = newM
 			} else {
@@ -375,6 +587,9 @@ func (r *runner) run() error {
 		}
 		if finalState == "failed" {
 			exitState = "failed"
+			if r.exitReason != "" {
+				exitState = r.exitReason
+			}
 		}
 		if r.reboot {
 			exitState = "reboot"
@@ -388,7 +603,10 @@ func (r *runner) run() error {
 			{Op: "replace", Path: "/State", Value: finalState},
 			{Op: "replace", Path: "/ExitState", Value: exitState},
 		}
-		if err := r.c.Req().Patch(finalPatch).UrlForM(r.j).Do(&r.j); err != nil {
+		if queued, err := r.spool.send(&spoolEntry{Prefix: r.j.Prefix(), Key: r.j.Key(), Patch: finalPatch}, &r.j); queued {
+			r.j.State, r.j.ExitState = finalState, exitState
+			r.log("Updating job for %s:%s:%s to %s once dr-provision is reachable", r.j.Workflow, r.j.Stage, r.j.Task, finalState)
+		} else if err != nil {
 			r.log("Failed to update job %s:%s:%s to its final state %s", r.j.Workflow, r.j.Stage, r.j.Task, finalState)
 		} else {
 			r.log("Updated job for %s:%s:%s to %s", r.j.Workflow, r.j.Stage, r.j.Task, finalState)
@@ -420,6 +638,7 @@ func (r *runner) run() error {
 		r.poweroff = false
 		r.reboot = false
 		r.stop = false
+		r.exitReason = ""
 		var err error
 		if action.Path != "" {
 			err = r.expand(action, taskDir)
@@ -12,6 +12,7 @@ import (
 )
 
 func TestBootEnvCrud(t *testing.T) {
+	needServer(t)
 	localBootEnv := mustDecode(&models.BootEnv{}, `
 Description: "The boot environment you should use to have known machines boot off their local hard drive"
 Bundle: BasicStore
@@ -511,6 +512,7 @@ Templates:
 }
 
 func TestBootEnvImport(t *testing.T) {
+	needServer(t)
 	fredstage := mustDecode(&models.Stage{}, `
 Name: fred
 BootEnv: fredhammer
@@ -15,14 +15,43 @@ import (
 
 	"github.com/digitalrebar/provision/v4/models"
 	"github.com/digitalrebar/provision/v4/test"
+	"github.com/digitalrebar/provision/v4/test/fakeserver"
 	"github.com/ghodss/yaml"
 )
 
 var (
 	session *Client
 	tmpDir  string
+	// fakeServer is the in-process stand-in for dr-provision that the
+	// tests run against when dr-provision is not installed.
+	fakeServer *fakeserver.Server
 )
 
+// needServer skips tests whose expected results come from a real
+// dr-provision when running against fakeServer.
+func needServer(t *testing.T) {
+	t.Helper()
+	if fakeServer != nil {
+		t.Skip("dr-provision is not installed, skipping")
+	}
+}
+
+// startFakeServer starts fakeServer in tmpDir and logs in to it.
+func startFakeServer() error {
+	var err error
+	if fakeServer, err = fakeserver.New(tmpDir); err != nil {
+		return err
+	}
+	if err = fakeServer.Start("127.0.0.1:10011", "127.0.0.1:10012"); err != nil {
+		return err
+	}
+	session, err = UserSession(fakeServer.Endpoint(), fakeserver.DefaultUsername, fakeserver.DefaultPassword)
+	if err != nil {
+		return err
+	}
+	return session.MakeProxy(path.Join(tmpDir, ".socket"))
+}
+
 type crudTest struct {
 	name      string
 	expectRes interface{}
@@ -157,6 +186,18 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 	defer os.RemoveAll(tmpDir)
+	if _, err := exec.LookPath("dr-provision"); err != nil {
+		log.Printf("dr-provision is not installed, using the fake server")
+		if err := startFakeServer(); err != nil {
+			log.Printf("Error starting the fake server: %v", err)
+			os.RemoveAll(tmpDir)
+			os.Exit(1)
+		}
+		ret := m.Run()
+		fakeServer.Close()
+		os.RemoveAll(tmpDir)
+		os.Exit(ret)
+	}
 	if err := test.StartServer(tmpDir, 10011); err != nil {
 		log.Printf("Error starting dr-provision: %v", err)
 		os.RemoveAll(tmpDir)
@@ -1,10 +1,14 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/digitalrebar/provision/v4/models"
@@ -43,11 +47,21 @@ func (c *Client) DeleteContent(name string) error {
 	return c.Req().Del().UrlFor("contents", name).Do(nil)
 }
 
+// normalizeLineEndings turns CRLF line endings into LF, so that
+// bundles do not depend on how files were checked out.
+func normalizeLineEndings(s string) string {
+	return strings.Replace(s, "\r\n", "\n", -1)
+}
+
 func FindOrFake(src, field string, args map[string]string) string {
 	if src != "" {
 		filepath := fmt.Sprintf("._%s.meta", field)
 		buf, err := ioutil.ReadFile(path.Join(src, filepath))
 		if err == nil {
+			// Documentation is kept as written, like everywhere else.
+			if field == "Documentation" {
+				return normalizeLineEndings(string(buf))
+			}
 			return strings.TrimSpace(string(buf))
 		}
 	}
@@ -67,7 +81,51 @@ func FindOrFake(src, field string, args map[string]string) string {
 	return strings.TrimSpace(s)
 }
 
+// bundleItems returns the files in dir that hold objects, relative to
+// dir.  Templates can be in subdirectories, in which case their IDs
+// have the path to them.
+func bundleItems(dir string, recurse bool) ([]string, error) {
+	if !recurse {
+		res := []string{}
+		items, err := ioutil.ReadDir(dir)
+		for _, fileInfo := range items {
+			if !fileInfo.IsDir() {
+				res = append(res, fileInfo.Name())
+			}
+		}
+		return res, err
+	}
+	res := []string{}
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if p != dir && strings.HasPrefix(fi.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err == nil {
+			res = append(res, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	return res, err
+}
+
 func (c *Client) BundleContent(src string, dst store.Store, params map[string]string) error {
+	_, err := c.BundleContentWithSources(src, dst, params)
+	return err
+}
+
+// BundleContentWithSources is BundleContent that also returns the
+// files each object was loaded from, keyed by prefix/key.  If more
+// than one file has an object with the same key, all of them are
+// listed, and the object from the last one is the one saved to dst.
+func (c *Client) BundleContentWithSources(src string, dst store.Store, params map[string]string) (map[string][]string, error) {
+	sources := map[string][]string{}
 	if dm, ok := dst.(store.MetaSaver); ok {
 		meta := map[string]string{
 			"Name":             FindOrFake(src, "Name", params),
@@ -88,6 +146,8 @@ func (c *Client) BundleContent(src string, dst store.Store, params map[string]st
 			"Tags":             FindOrFake(src, "Tags", params),
 			"DocUrl":           FindOrFake(src, "DocUrl", params),
 			"Prerequisites":    FindOrFake(src, "Prerequisites", params),
+			"SigningKey":       FindOrFake(src, "SigningKey", params),
+			"Signature":        FindOrFake(src, "Signature", params),
 		}
 		dm.SetMetaData(meta)
 	}
@@ -104,43 +164,79 @@ func (c *Client) BundleContent(src string, dst store.Store, params map[string]st
 			// Skip things we can instantiate
 			continue
 		}
-		items, err := ioutil.ReadDir(path.Join(src, prefix))
+		items, err := bundleItems(path.Join(src, prefix), prefix == "templates")
 		if err != nil {
-			return fmt.Errorf("Cannot read substore %s: %v", prefix, err)
+			return sources, fmt.Errorf("Cannot read substore %s: %v", prefix, err)
 		}
-		for _, fileInfo := range items {
-			if fileInfo.IsDir() {
-				continue
-			}
-			itemName := fileInfo.Name()
+		for _, itemName := range items {
 			item, _ := models.New(prefix)
 			buf, err := ioutil.ReadFile(path.Join(src, prefix, itemName))
 			if err != nil {
-				return fmt.Errorf("Cannot read item %s: %v", path.Join(prefix, itemName), err)
+				return sources, fmt.Errorf("Cannot read item %s: %v", path.Join(prefix, itemName), err)
 			}
 			switch path.Ext(itemName) {
 			case ".yaml", ".yml":
 				if err := store.YamlCodec.Decode(buf, item); err != nil {
-					return fmt.Errorf("Cannot parse item %s: %v", path.Join(prefix, itemName), err)
+					return sources, fmt.Errorf("Cannot parse item %s: %v", path.Join(prefix, itemName), err)
 				}
 			case ".json":
 				if err := store.JsonCodec.Decode(buf, item); err != nil {
-					return fmt.Errorf("Cannot parse item %s: %v", path.Join(prefix, itemName), err)
+					return sources, fmt.Errorf("Cannot parse item %s: %v", path.Join(prefix, itemName), err)
 				}
 			default:
 				if tmpl, ok := item.(*models.Template); ok && prefix == "templates" {
 					tmpl.ID = itemName
-					tmpl.Contents = string(buf)
+					tmpl.Contents = normalizeLineEndings(string(buf))
 				} else {
-					return fmt.Errorf("No idea how to decode %s into %s", itemName, item.Prefix())
+					return sources, fmt.Errorf("No idea how to decode %s into %s", itemName, item.Prefix())
 				}
 			}
+			sources[prefix+"/"+item.Key()] = append(sources[prefix+"/"+item.Key()], path.Join(prefix, itemName))
 			if err := dst.Save(prefix, item.Key(), item); err != nil {
-				return fmt.Errorf("Failed to save %s:%s: %v", item.Prefix(), item.Key(), err)
+				return sources, fmt.Errorf("Failed to save %s:%s: %v", item.Prefix(), item.Key(), err)
 			}
 		}
 	}
-	return nil
+	return sources, nil
+}
+
+// BundleContentBytes bundles src the way BundleContent does, and
+// encodes the result with codec.  The output only depends on what is
+// in src: sections, keys, and meta data fields are sorted, the fields
+// of each object are in the order they are declared in for JSON (and
+// sorted for YAML), line endings are normalized, and nothing like a
+// timestamp is added.  The ContentHash meta data is set to the hash of
+// the bundled content.
+func (c *Client) BundleContentBytes(src string, params map[string]string, codec store.Codec) ([]byte, error) {
+	mem, _ := store.Open("memory:///")
+	defer mem.Close()
+	if err := c.BundleContent(src, mem, params); err != nil {
+		return nil, err
+	}
+	content := &models.Content{}
+	if err := content.FromStore(mem); err != nil {
+		return nil, err
+	}
+	hash, err := content.Hash()
+	if err != nil {
+		return nil, err
+	}
+	content.Meta.ContentHash = hash
+	sections := map[string]map[string]interface{}{}
+	for prefix, section := range content.Sections {
+		sections[prefix] = map[string]interface{}{}
+		for key, val := range section {
+			// The bundle is filled in when the content is loaded.
+			if b, ok := val.(models.Bundler); ok {
+				b.SetBundle("")
+			}
+			sections[prefix][key] = val
+		}
+	}
+	return codec.Encode(map[string]interface{}{
+		"meta":     content.GenerateMetaMap(),
+		"sections": sections,
+	})
 }
 
 func writeMetaFile(dst, field, data string) error {
@@ -151,13 +247,74 @@ func writeMetaFile(dst, field, data string) error {
 	return ioutil.WriteFile(path.Join(dst, fname), []byte(data), 0640)
 }
 
+// unbundleEncode encodes an object the way unbundle writes it.  JSON
+// is indented so that changes to objects make readable diffs.
+func unbundleEncode(codec store.Codec, item interface{}) ([]byte, error) {
+	if codec.Ext() == ".json" {
+		buf, err := json.MarshalIndent(item, "", "  ")
+		return append(buf, '\n'), err
+	}
+	return codec.Encode(item)
+}
+
+// unbundleCodec returns the codec for a file that holds an object, or
+// nil if the file is a raw template.
+func unbundleCodec(fname string) store.Codec {
+	switch path.Ext(fname) {
+	case ".yaml", ".yml":
+		return store.YamlCodec
+	case ".json":
+		return store.JsonCodec
+	}
+	return nil
+}
+
+// sameObject checks whether buf already holds item, so that files
+// that would not change are left alone.
+func sameObject(prefix string, codec store.Codec, buf []byte, item models.Model) bool {
+	old, _ := models.New(prefix)
+	if codec == nil {
+		tmpl, ok := item.(*models.Template)
+		return ok && tmpl.Contents == string(buf)
+	}
+	if err := codec.Decode(buf, old); err != nil {
+		return false
+	}
+	var a, b interface{}
+	if models.Remarshal(old, &a) != nil || models.Remarshal(item, &b) != nil {
+		return false
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// UnbundleContent expands content into dst in the layout that
+// BundleContent reads.  Template IDs with slashes in them are written
+// into subdirectories.  If dst already has an object in a file, that
+// file is updated in place with the codec matching its extension, and
+// it is not touched at all if it already holds the same object, so
+// unbundling into a checkout of the content only changes what really
+// changed.
 func (c *Client) UnbundleContent(content store.Store, dst string) error {
 	if err := os.MkdirAll(dst, 0750); err != nil {
 		return err
 	}
+	// Errors loading what is already there just mean we will not reuse
+	// the files that could not be read.
+	existing, _ := store.Open("memory:///")
+	sources, _ := c.BundleContentWithSources(dst, existing, map[string]string{})
+	existing.Close()
 	if cm, ok := content.(store.MetaSaver); ok {
 		meta := cm.MetaData()
 		for k, v := range meta {
+			// The hash is recomputed by bundle.
+			if k == "ContentHash" {
+				continue
+			}
+			// Leave out what bundle would fill in anyway, unless the
+			// file is already there.
+			if _, err := os.Stat(path.Join(dst, fmt.Sprintf("._%s.meta", k))); err != nil && v == FindOrFake("", k, map[string]string{}) {
+				continue
+			}
 			if err := writeMetaFile(dst, k, v); err != nil {
 				return err
 			}
@@ -167,6 +324,7 @@ func (c *Client) UnbundleContent(content store.Store, dst string) error {
 	if err != nil {
 		return err
 	}
+	sort.Strings(prefixes)
 	for _, prefix := range prefixes {
 		if err := os.MkdirAll(path.Join(dst, prefix), 0750); err != nil {
 			return err
@@ -179,26 +337,49 @@ func (c *Client) UnbundleContent(content store.Store, dst string) error {
 		if err != nil {
 			return fmt.Errorf("Failed to retrieve keys for substore %s: %v", prefix, err)
 		}
-		codec := content.GetCodec()
+		sort.Strings(keys)
 		for _, key := range keys {
 			item, _ := models.New(prefix)
 			if err := content.Load(prefix, key, item); err != nil {
 				return fmt.Errorf("Failed to load %s:%s: %v", prefix, key, err)
 			}
-			var buf []byte
+			// The bundle is filled in when the content is loaded, so it
+			// does not belong in the files.
+			if b, ok := item.(models.Bundler); ok {
+				b.SetBundle("")
+			}
 			var fname string
-			switch prefix {
-			case "templates":
-				fname = strings.Replace(key, "/", ".", -1)
-				buf = []byte(item.(*models.Template).Contents)
-			default:
+			codec := content.GetCodec()
+			if srcs := sources[prefix+"/"+key]; len(srcs) > 0 {
+				fname = strings.TrimPrefix(srcs[len(srcs)-1], prefix+"/")
+				codec = unbundleCodec(fname)
+			} else if prefix == "templates" {
+				fname = path.Clean("/" + key)[1:]
+				codec = nil
+			} else {
 				fname = strings.Replace(key, "/", ".", -1) + codec.Ext()
-				buf, err = codec.Encode(item)
+			}
+			target := path.Join(dst, prefix, fname)
+			if buf, err := ioutil.ReadFile(target); err == nil && sameObject(prefix, codec, buf, item) {
+				continue
+			}
+			var buf []byte
+			if codec == nil {
+				tmpl, ok := item.(*models.Template)
+				if !ok {
+					return fmt.Errorf("Cannot save %s:%s as a raw file", prefix, key)
+				}
+				buf = []byte(tmpl.Contents)
+			} else {
+				buf, err = unbundleEncode(codec, item)
 				if err != nil {
 					return fmt.Errorf("Failed to encode %s:%s: %v", prefix, key, err)
 				}
 			}
-			if err := ioutil.WriteFile(path.Join(dst, prefix, fname), buf, 0640); err != nil {
+			if err := os.MkdirAll(path.Dir(target), 0750); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(target, buf, 0640); err != nil {
 				return fmt.Errorf("Failed to save %s:%s: %v", prefix, key, err)
 			}
 		}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/digitalrebar/provision/v4/store"
+)
+
+func TestBundleContentBytes(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "bundle-bytes-")
+	if err != nil {
+		t.Fatalf("ERROR: Unable to make tmpdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	files := map[string]string{
+		"._Name.meta":          "bytes",
+		"._Documentation.meta": "Some docs\r\nover two lines\r\n",
+		"params/b.yaml":        "Name: b\nSchema:\n  type: string\n",
+		"params/a.json":        `{"Name":"a","Schema":{"type":"integer"}}`,
+		"tasks/t.yaml":         "Name: t\nTemplates:\n  - Name: x\n    Contents: \"echo x\\r\\n\"\n",
+		"templates/one.tmpl":   "line one\r\nline two\r\n",
+		"templates/sub/2.tmpl": "sub\r\n",
+	}
+	write := func(dir string, crlf bool) {
+		t.Helper()
+		for name, buf := range files {
+			if !crlf {
+				buf = strings.Replace(buf, "\r\n", "\n", -1)
+			}
+			name = filepath.Join(dir, filepath.FromSlash(name))
+			os.MkdirAll(filepath.Dir(name), 0755)
+			if err := ioutil.WriteFile(name, []byte(buf), 0644); err != nil {
+				t.Fatalf("ERROR: Unable to write %s: %v", name, err)
+			}
+		}
+	}
+	crlf, lf := filepath.Join(tmp, "crlf"), filepath.Join(tmp, "lf")
+	write(crlf, true)
+	write(lf, false)
+	cc := DisconnectedClient()
+	for _, codec := range []store.Codec{store.JsonCodec, store.YamlCodec} {
+		first, err := cc.BundleContentBytes(crlf, map[string]string{}, codec)
+		if err != nil {
+			t.Fatalf("ERROR: Unable to bundle %s: %v", crlf, err)
+		}
+		second, err := cc.BundleContentBytes(crlf, map[string]string{}, codec)
+		if err != nil {
+			t.Fatalf("ERROR: Unable to bundle %s again: %v", crlf, err)
+		}
+		if !bytes.Equal(first, second) {
+			t.Errorf("ERROR: Bundling %s twice with %s gave different bytes", crlf, codec.Ext())
+		}
+		other, err := cc.BundleContentBytes(lf, map[string]string{}, codec)
+		if err != nil {
+			t.Fatalf("ERROR: Unable to bundle %s: %v", lf, err)
+		}
+		if !bytes.Equal(first, other) {
+			t.Errorf("ERROR: Bundling with %s depends on line endings:\n%s\n%s", codec.Ext(), first, other)
+		}
+		if bytes.Contains(first, []byte(`line one\r\n`)) || !bytes.Contains(first, []byte("ContentHash")) {
+			t.Errorf("ERROR: Expected normalized templates and a ContentHash, got:\n%s", first)
+		}
+	}
+}
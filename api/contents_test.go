@@ -7,6 +7,7 @@ import (
 )
 
 func TestContentCrud(t *testing.T) {
+	needServer(t)
 	tests := []crudTest{
 		{
 			name:      "Get BarkingStore (that does not exist)",
@@ -9,6 +9,7 @@ import (
 )
 
 func TestFiles(t *testing.T) {
+	needServer(t)
 	tests := []crudTest{
 		{
 			name:      "list files",
@@ -10,6 +10,7 @@ import (
 )
 
 func TestInfo(t *testing.T) {
+	needServer(t)
 	localId := ""
 	intfs, _ := net.Interfaces()
 	for _, intf := range intfs {
@@ -7,6 +7,7 @@ import (
 )
 
 func TestInterfaces(t *testing.T) {
+	needServer(t)
 	tests := []*crudTest{
 		{
 			name:      "list interfaces",
@@ -9,6 +9,7 @@ import (
 )
 
 func TestIsos(t *testing.T) {
+	needServer(t)
 	tests := []crudTest{
 		{
 			name:      "list isos",
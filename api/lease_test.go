@@ -7,6 +7,7 @@ import (
 )
 
 func TestLeaseCrud(t *testing.T) {
+	needServer(t)
 	rt(t, "Get empty lease list", []models.Model{}, nil, func() (interface{}, error) {
 		return session.ListModel("leases")
 	}, nil)
@@ -7,6 +7,7 @@ import (
 )
 
 func TestMachineCrud(t *testing.T) {
+	needServer(t)
 	rt(t, "Create initial helpers", nil, nil,
 		func() (interface{}, error) {
 			for _, n := range []string{"stage-prof", "jill", "jean"} {
@@ -5,6 +5,7 @@ import (
 )
 
 func TestObject(t *testing.T) {
+	needServer(t)
 	test := &crudTest{
 		name: "get objects",
 		expectRes: []string{
@@ -7,6 +7,7 @@ import (
 )
 
 func TestLoadIncrementer(t *testing.T) {
+	needServer(t)
 	cliTest(false, false,
 		"plugin_providers", "upload", "incrementer", "from", path.Join("../bin", runtime.GOOS, runtime.GOARCH, "incrementer")).run(t)
 	cliTest(false, false, "plugin_providers", "list").run(t)
@@ -9,13 +9,13 @@ import (
 	"os"
 	"os/exec"
 	"path"
-	"runtime"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/VictorLowther/jsonpatch2"
 
+	"github.com/digitalrebar/provision/v4/agent"
 	"github.com/digitalrebar/provision/v4/api"
 
 	"github.com/digitalrebar/provision/v4/models"
@@ -25,15 +25,21 @@ import (
 )
 
 type agentOpts struct {
-	Endpoints       string
-	Token           string
-	MachineID       string
-	Context         string
-	Oneshot         bool
-	ExitOnFail      bool
-	SkipPower       bool
-	SkipRunnable    bool
-	AllowAutoUpdate bool
+	Endpoints         string
+	Token             string
+	MachineID         string
+	Context           string
+	Oneshot           bool
+	ExitOnFail        bool
+	SkipPower         bool
+	SkipRunnable      bool
+	AllowAutoUpdate   bool
+	Engines           []string
+	StatusAddr        string
+	MetricsAddr       string
+	MetricsDir        string
+	UpdateTrustedKeys []string
+	UpdateGracePeriod string
 }
 
 var agentScratchConfig = `---
@@ -82,8 +88,54 @@ SkipRunnable: false
 
 # AllowAutoUpdate allows the agent to try and automatically update itself
 # as needed whenever it is starting up.  This does not work on Windows.
+# The new binary must have the sha256 sum that dr-provision says it
+# has, and the old binary is kept next to it with a .prev extension.
+# Once updated, the agent restarts and tests the new binary.  If
+# dr-provision refuses its token, or it keeps failing to start, the old
+# one is put back and the new one will not be installed again.  If it
+# cannot reach dr-provision, the agent keeps running it and tests again
+# once UpdateGracePeriod (5m by default) has passed, or on its next
+# start if that is sooner.  If dr-provision still cannot be reached,
+# the old one is put back and the agent restarts as it, and the update
+# is tried again once dr-provision can be reached.
 
 AllowAutoUpdate: true
+UpdateGracePeriod: 5m
+
+# UpdateTrustedKeys is an (optional) list of public keys, as made by
+# drpcli contents keygen.  If it is set, the agent will only update to
+# binaries with a drpcli.<arch>.<os>.sig signature from one of them,
+# as made by drpcli agent sign-update.  Without it, the sum of the new
+# binary comes from the same dr-provision as the binary, which only
+# catches corrupted downloads, not a compromised or spoofed endpoint.
+
+UpdateTrustedKeys: []
+
+# Engines lets the agent run the tasks for Contexts itself.  Each entry
+# is engine=runtime, where engine is the Engine of the Contexts to run
+# and runtime is either an OCI runtime CLI like podman or docker, or
+# rootfs:dir to run them chrooted into dir/Image.
+#
+# Engines:
+#   - docker-context=podman
+
+Engines: []
+
+# StatusAddr is an (optional) loopback address, like 127.0.0.1:8099,
+# to serve the read-only agent status on over HTTP.  The full status
+# API, including pause, resume, and cancel, is only served on the
+# agent-status.sock unix socket in the agent state directory, which is
+# what drpcli agent status --detail uses.
+
+StatusAddr: ''
+
+# MetricsAddr is an (optional) address, like :9101, to serve Prometheus
+# metrics for the agent on at /metrics.  MetricsDir is an (optional)
+# directory, like the node exporter --collector.textfile.directory, to
+# keep the same metrics in as drp_agent.prom.
+
+MetricsAddr: ''
+MetricsDir: ''
 `
 
 type agentProg struct {
@@ -189,10 +241,22 @@ func sessionOrError(token string, endpoints []string) (res *api.Client, err erro
 	return
 }
 
+var agentStatusDetail bool
+
+func init() {
+	agentHandler.Flags().BoolVar(&agentStatusDetail, "detail", false, "Have status report what the running agent is doing")
+}
+
 var agentHandler = &cobra.Command{
 	Use:   "agent [operation]",
 	Short: "Manage drpcli running as an agent",
-	Long:  "Use this command to install, remove, stop, start, restart drpcli running as a task runner",
+	Long: `Use this command to install, remove, stop, start, restart drpcli running as a task runner.
+
+status --detail asks the running agent what it is doing, including its
+state, the task and job it is running, and the PID of the running action.
+pause stops the running action and keeps the agent from starting new
+tasks until resume is used, and cancel kills the running action, which
+fails its task.`,
 	Args: func(c *cobra.Command, args []string) error {
 		if len(args) > 1 {
 			return fmt.Errorf("%v needs at at most 1 argument", c.UseLine())
@@ -201,9 +265,9 @@ var agentHandler = &cobra.Command{
 			return nil
 		}
 		switch args[0] {
-		case "install", "remove", "stop", "start", "restart", "status":
+		case "install", "remove", "stop", "start", "restart", "status", "pause", "resume", "cancel":
 		default:
-			return fmt.Errorf("Unknown agent command %s. Try one of install,remove,stop,start,restart,status", args[0])
+			return fmt.Errorf("Unknown agent command %s. Try one of install,remove,stop,start,restart,status,pause,resume,cancel", args[0])
 		}
 		return nil
 	},
@@ -253,76 +317,49 @@ var agentHandler = &cobra.Command{
 			if err := models.DecodeYaml(buf, &options); err != nil {
 				return fmt.Errorf("Error loading config file %s: %v", cfgFileName, err)
 			}
-			// Auto-update can only happen on non-Windows, because we need to replace the running binary.
-			func() {
-				if runtime.GOOS == "windows" {
-					log.Printf("Unable to update on Windows")
-					return
-				}
-				if !options.AllowAutoUpdate {
-					log.Printf("Auto update disabled by config directive")
-					return
-				}
-				session, err := sessionOrError(options.Token, strings.Split(options.Endpoints, ","))
-				if err != nil {
-					log.Printf("No session")
-					return
-				}
-				info, err := session.Info()
-				if err != nil || !info.HasFeature("agent-auto-update") {
-					log.Printf("Missing agent-auto-update from dr-provision, will not auto update")
-					return
-				}
-				remoteName := fmt.Sprintf("drpcli.%s.%s", runtime.GOARCH, runtime.GOOS)
-				sum, err := session.GetBlobSum("files", remoteName)
-				if err != nil {
-					log.Printf("No blob sum for %s", remoteName)
-					return
-				}
-				exe, err := os.Open(exePath)
-				if err != nil {
-					log.Printf("No exe at %s", exePath)
-					return
-				}
-				mta := &models.ModTimeSha{}
-				if _, err := mta.Regenerate(exe); err == nil && mta.String() == sum {
-					log.Printf("Sums for %s already match. No update needed", exePath)
-					exe.Close()
-					return
-				}
-				exe.Close()
-				tmpName := exePath + ".new"
-				exe, err = os.OpenFile(tmpName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0755)
-				if err != nil {
-					log.Printf("Error opening tmp %s: %v", tmpName, err)
-					return
-				}
-				defer os.Remove(tmpName)
-				if err := session.GetBlob(exe, "files", remoteName); err != nil {
-					log.Printf("Error getting %s: %v", remoteName, err)
-					exe.Close()
-					return
-				}
-				session.Close()
-				exe.Close()
-				testCmd := exec.Command(tmpName, "version")
-				if err := testCmd.Run(); err != nil {
-					log.Printf("Error validating %s version: %v", tmpName, err)
-					return
-				}
-				if err := os.Rename(tmpName, exePath); err != nil {
-					log.Printf("Error renaming %s to %s: %v", tmpName, exePath, err)
-				} else {
-					log.Printf("%s updated from %s to %s", exePath, mta.String(), sum)
+			restart, env := agentSelfTest(exePath, stateLoc, &options), []string{}
+			if !restart && autoUpdateAgent(exePath, stateLoc, &options) {
+				restart, env = true, []string{agentUpdateStartEnv + "=" + loadAgentUpdate(stateLoc).To}
+			}
+			if restart {
+				if err := restartAgent(exePath, env...); err != nil {
+					log.Printf("Unable to restart the agent as %s: %v", exePath, err)
 				}
-			}()
+			}
 			prog.opts = options
 			prog.cmd = exec.Command(exePath, "machines", "processjobs", "--stateDir", stateLoc)
+			for _, engine := range options.Engines {
+				prog.cmd.Args = append(prog.cmd.Args, "--engine", engine)
+			}
+			prog.cmd.Args = append(prog.cmd.Args, "--statusSocket", path.Join(stateLoc, "agent-status.sock"))
+			if options.StatusAddr != "" {
+				prog.cmd.Args = append(prog.cmd.Args, "--statusAddr", options.StatusAddr)
+			}
+			if options.MetricsAddr != "" {
+				prog.cmd.Args = append(prog.cmd.Args, "--metricsAddr", options.MetricsAddr)
+			}
+			if options.MetricsDir != "" {
+				prog.cmd.Args = append(prog.cmd.Args, "--metricsDir", options.MetricsDir)
+			}
 			prog.cmd.Env = append(os.Environ(),
 				"RS_ENDPOINTS="+options.Endpoints,
 				"RS_TOKEN="+options.Token,
 				"RS_UUID="+options.MachineID,
 				"RS_CONTEXT="+options.Context)
+			// An update that could not be tested yet is rolled back
+			// when its grace period runs out, not when the agent
+			// next happens to start.
+			if timer := agentUpdateTimer(exePath, stateLoc, &options, func() {
+				prog.shuttingDown = true
+				if prog.cmd.Process != nil {
+					prog.cmd.Process.Kill()
+				}
+				if err := restartAgent(exePath); err != nil {
+					log.Fatalf("Unable to restart the agent as %s: %v", exePath, err)
+				}
+			}); timer != nil {
+				defer timer.Stop()
+			}
 			svc, err := service.New(prog, serviceConfig)
 			if err != nil {
 				return fmt.Errorf("Error creating service: %v", err)
@@ -410,7 +447,20 @@ Please fill it out with final running values, and rerun drpcli agent install`, c
 			if err := svc.Restart(); err != nil {
 				log.Fatalf("Error restarting service: %v", err)
 			}
+		case "pause", "resume", "cancel":
+			status, err := agent.QueryStatus(path.Join(stateLoc, "agent-status.sock"), args[0])
+			if err != nil {
+				return fmt.Errorf("Error asking the agent to %s: %v", args[0], err)
+			}
+			return prettyPrint(status)
 		case "status":
+			if agentStatusDetail {
+				status, err := agent.QueryStatus(path.Join(stateLoc, "agent-status.sock"), "status")
+				if err != nil {
+					return fmt.Errorf("Error getting agent status: %v", err)
+				}
+				return prettyPrint(status)
+			}
 			status, err := svc.Status()
 			if err != nil {
 				log.Fatalf("Error getting service status: %v", err)
@@ -0,0 +1,14 @@
+// +build !windows
+
+package cli
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartAgent replaces the running agent with the binary at exePath,
+// keeping the same arguments and environment, with env added.
+func restartAgent(exePath string, env ...string) error {
+	return syscall.Exec(exePath, os.Args, append(os.Environ(), env...))
+}
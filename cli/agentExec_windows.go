@@ -0,0 +1,9 @@
+// +build windows
+
+package cli
+
+import "fmt"
+
+func restartAgent(exePath string, env ...string) error {
+	return fmt.Errorf("Restarting the agent in place is not supported on Windows")
+}
@@ -0,0 +1,414 @@
+package cli
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/digitalrebar/provision/v4/api"
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	agentHandler.AddCommand(&cobra.Command{
+		Use:   "sign-update [binary] [key file]",
+		Short: "Sign a drpcli binary for agent auto-update",
+		Long: `Signs [binary] with the private key in [key file], as made by
+drpcli contents keygen, and writes the signature to [binary].sig.
+Upload both to files/drpcli.<arch>.<os> and files/drpcli.<arch>.<os>.sig
+for agents with UpdateTrustedKeys to update to it.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("%v requires 2 arguments", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			keyBuf, err := ioutil.ReadFile(args[1])
+			if err != nil {
+				return fmt.Errorf("Failed to read key: %v", err)
+			}
+			key, err := models.DecodeContentPrivateKey(string(keyBuf))
+			if err != nil {
+				return fmt.Errorf("Invalid key in %s: %v", args[1], err)
+			}
+			_, digest, err := fileSum(args[0])
+			if err != nil {
+				return fmt.Errorf("Failed to read %s: %v", args[0], err)
+			}
+			sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, digest))
+			return ioutil.WriteFile(args[0]+".sig", []byte(sig+"\n"), 0644)
+		},
+	})
+}
+
+// agentUpdate records the last auto-update of the agent.  It is kept
+// in agent-update.json in the agent state directory.
+type agentUpdate struct {
+	// Previous is where the binary that was replaced is kept.
+	Previous string
+	// From and To are the sha256 sums of the old and new binaries.
+	From, To string
+	// Pending is set until the new binary passes its self-test.
+	Pending bool
+	// GracePeriod is how long the new binary has to reach the endpoint
+	// before it is rolled back.
+	GracePeriod time.Duration
+	// Updated is when the new binary was installed.
+	Updated time.Time
+	// Starts is how many times the new binary has started without
+	// finishing its self-test.  The old binary counts the first start
+	// before it restarts as the new one, so that it is counted even if
+	// the new one dies before it gets as far as its self-test.
+	Starts int
+	// Bad are the sums of binaries that were rolled back, which will
+	// not be installed again.
+	Bad []string `json:",omitempty"`
+}
+
+// agentUpdateStartEnv is set to the sum of the new binary when the
+// old binary restarts as it, to tell the new binary that its first
+// start has already been counted.
+const agentUpdateStartEnv = "RS_AGENT_UPDATE_STARTED"
+
+func agentUpdateFile(stateLoc string) string {
+	return path.Join(stateLoc, "agent-update.json")
+}
+
+func loadAgentUpdate(stateLoc string) *agentUpdate {
+	res := &agentUpdate{}
+	if buf, err := ioutil.ReadFile(agentUpdateFile(stateLoc)); err == nil {
+		json.Unmarshal(buf, res)
+	}
+	return res
+}
+
+func (u *agentUpdate) save(stateLoc string) error {
+	buf, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := agentUpdateFile(stateLoc) + ".new"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, agentUpdateFile(stateLoc))
+}
+
+func (u *agentUpdate) isBad(sum string) bool {
+	for _, b := range u.Bad {
+		if b == sum {
+			return true
+		}
+	}
+	return false
+}
+
+// fileSum returns the hex sha256 sum of the file at name.
+func fileSum(name string) (string, []byte, error) {
+	fi, err := os.Open(name)
+	if err != nil {
+		return "", nil, err
+	}
+	defer fi.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fi); err != nil {
+		return "", nil, err
+	}
+	digest := h.Sum(nil)
+	return hex.EncodeToString(digest), digest, nil
+}
+
+// verifyAgentBinary checks that the binary downloaded to name has the
+// sum that dr-provision says it should.  If there are trusted keys,
+// remoteName.sig must also be an ed25519 signature of the sha256 sum
+// of the binary by one of them, as made by drpcli agent sign-update.
+func verifyAgentBinary(session *api.Client, name, remoteName, sum string, keys []ed25519.PublicKey) error {
+	got, digest, err := fileSum(name)
+	if err != nil {
+		return err
+	}
+	if got != sum {
+		return fmt.Errorf("%s has sum %s, but dr-provision says it should be %s", remoteName, got, sum)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sigBuf := &strings.Builder{}
+	if err := session.GetBlob(sigBuf, "files", remoteName+".sig"); err != nil {
+		return fmt.Errorf("Unable to get signature %s.sig: %v", remoteName, err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(sigBuf.String()))
+	if err != nil {
+		return fmt.Errorf("Invalid signature %s.sig: %v", remoteName, err)
+	}
+	for _, k := range keys {
+		if ed25519.Verify(k, digest, sig) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not signed by a trusted key", remoteName)
+}
+
+// autoUpdateAgent replaces the agent binary at exePath with the one
+// dr-provision has, if it is different and passes verification.  The
+// old binary is kept in exePath.prev, and the update is recorded as
+// pending until the new binary passes agentSelfTest, with the restart
+// the caller is about to do counted as its first start.  It returns
+// true if the binary was replaced, in which case the caller should
+// restart with agentUpdateStartEnv set to the sum of the new binary.
+func autoUpdateAgent(exePath, stateLoc string, options *agentOpts) bool {
+	// Auto-update can only happen on non-Windows, because we need to replace the running binary.
+	if runtime.GOOS == "windows" {
+		log.Printf("Unable to update on Windows")
+		return false
+	}
+	if !options.AllowAutoUpdate {
+		log.Printf("Auto update disabled by config directive")
+		return false
+	}
+	keys := []ed25519.PublicKey{}
+	for _, k := range options.UpdateTrustedKeys {
+		key, err := models.DecodeContentKey(k)
+		if err != nil {
+			log.Printf("Invalid UpdateTrustedKeys entry %q, will not auto update: %v", k, err)
+			return false
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		log.Printf("No UpdateTrustedKeys, so updates are only checked against the sum from the same dr-provision")
+	}
+	session, err := sessionOrError(options.Token, strings.Split(options.Endpoints, ","))
+	if err != nil {
+		log.Printf("No session")
+		return false
+	}
+	defer session.Close()
+	info, err := session.Info()
+	if err != nil || !info.HasFeature("agent-auto-update") {
+		log.Printf("Missing agent-auto-update from dr-provision, will not auto update")
+		return false
+	}
+	remoteName := fmt.Sprintf("drpcli.%s.%s", runtime.GOARCH, runtime.GOOS)
+	sum, err := session.GetBlobSum("files", remoteName)
+	if err != nil {
+		log.Printf("No blob sum for %s", remoteName)
+		return false
+	}
+	current, _, err := fileSum(exePath)
+	if err != nil {
+		log.Printf("No exe at %s", exePath)
+		return false
+	}
+	if current == sum {
+		log.Printf("Sums for %s already match. No update needed", exePath)
+		return false
+	}
+	rec := loadAgentUpdate(stateLoc)
+	if rec.isBad(sum) {
+		log.Printf("%s with sum %s was rolled back before, will not update to it", remoteName, sum)
+		return false
+	}
+	tmpName := exePath + ".new"
+	exe, err := os.OpenFile(tmpName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0755)
+	if err != nil {
+		log.Printf("Error opening tmp %s: %v", tmpName, err)
+		return false
+	}
+	defer os.Remove(tmpName)
+	if err := session.GetBlob(exe, "files", remoteName); err != nil {
+		log.Printf("Error getting %s: %v", remoteName, err)
+		exe.Close()
+		return false
+	}
+	exe.Close()
+	if err := verifyAgentBinary(session, tmpName, remoteName, sum, keys); err != nil {
+		log.Printf("Error verifying %s, will not update: %v", remoteName, err)
+		return false
+	}
+	testCmd := exec.Command(tmpName, "version")
+	if err := testCmd.Run(); err != nil {
+		log.Printf("Error validating %s version: %v", tmpName, err)
+		return false
+	}
+	grace := 5 * time.Minute
+	if options.UpdateGracePeriod != "" {
+		if grace, err = time.ParseDuration(options.UpdateGracePeriod); err != nil {
+			log.Printf("Invalid UpdateGracePeriod %q, will not auto update: %v", options.UpdateGracePeriod, err)
+			return false
+		}
+	}
+	prevName := exePath + ".prev"
+	if err := os.Rename(exePath, prevName); err != nil {
+		log.Printf("Error keeping %s as %s: %v", exePath, prevName, err)
+		return false
+	}
+	if err := os.Rename(tmpName, exePath); err != nil {
+		log.Printf("Error renaming %s to %s: %v", tmpName, exePath, err)
+		os.Rename(prevName, exePath)
+		return false
+	}
+	rec.Previous, rec.From, rec.To = prevName, current, sum
+	rec.Pending, rec.GracePeriod = true, grace
+	rec.Updated, rec.Starts = time.Now(), 1
+	if err := rec.save(stateLoc); err != nil {
+		log.Printf("Error recording update, rolling back: %v", err)
+		os.Rename(prevName, exePath)
+		return false
+	}
+	log.Printf("%s updated from %s to %s", exePath, current, sum)
+	return true
+}
+
+// maxSelfTestStarts is how many times an updated agent may start
+// without passing its self-test before it is considered broken.
+const maxSelfTestStarts = 3
+
+// selfTestEndpoints asks each endpoint for its info with the agent
+// token, and returns nil as soon as one answers.  Otherwise it returns
+// an authentication failure if there was one, or the last error.
+func selfTestEndpoints(options *agentOpts) error {
+	var err error
+	for _, endpoint := range strings.Split(options.Endpoints, ",") {
+		session, serr := api.TokenSession(endpoint, options.Token)
+		if serr == nil {
+			serr = session.Req().FailFast().UrlFor("info").Do(&models.Info{})
+			session.Close()
+		}
+		if serr == nil {
+			return nil
+		}
+		if err == nil || !authFailure(err) {
+			err = serr
+		}
+	}
+	return err
+}
+
+// authFailure tests whether err is dr-provision refusing the agent
+// token, as opposed to it not being reachable.
+func authFailure(err error) bool {
+	e, ok := err.(*models.Error)
+	return ok && (e.Code == http.StatusUnauthorized || e.Code == http.StatusForbidden)
+}
+
+// agentSelfTest checks a pending update.  The new binary passes once
+// it authenticates to dr-provision.  It is put back to the previous
+// binary and marked bad if dr-provision refuses its token, or if it
+// keeps starting without getting as far as the self-test.  If
+// dr-provision cannot be reached, the agent starts anyway, and tests
+// again when the grace period runs out (see agentUpdateTimer) or the
+// next time it starts.  Once the grace period has passed the previous
+// binary is put back without marking the new one bad, so it will be
+// installed again once dr-provision can be reached.  It returns true if
+// it rolled back, in which case the caller should restart.
+func agentSelfTest(exePath, stateLoc string, options *agentOpts) bool {
+	rec := loadAgentUpdate(stateLoc)
+	if !rec.Pending {
+		return false
+	}
+	if os.Getenv(agentUpdateStartEnv) != rec.To {
+		rec.Starts++
+	}
+	// Do not pass it on to the next restart, which the old binary
+	// has not counted.
+	os.Unsetenv(agentUpdateStartEnv)
+	if rec.Starts > maxSelfTestStarts {
+		return rollbackAgent(exePath, stateLoc, rec, true,
+			fmt.Errorf("started %d times without passing its self-test", rec.Starts-1))
+	}
+	// Count this start in case the new binary dies before it finishes.
+	if err := rec.save(stateLoc); err != nil {
+		log.Printf("Error recording update: %v", err)
+	}
+	if testAgentUpdate(exePath, stateLoc, rec, options) {
+		return true
+	}
+	if !rec.Pending {
+		return false
+	}
+	// The binary got this far, so this start does not count against it.
+	rec.Starts--
+	if err := rec.save(stateLoc); err != nil {
+		log.Printf("Error recording update: %v", err)
+	}
+	log.Printf("Will test updated agent %s again in %v or on the next start",
+		rec.To, time.Until(rec.Updated.Add(rec.GracePeriod)).Round(time.Second))
+	return false
+}
+
+// testAgentUpdate tests the pending update in rec against
+// dr-provision, and records it as passed or rolls it back.  It leaves
+// rec pending if dr-provision cannot be reached and the grace period
+// has not run out.  It returns true if it rolled back.
+func testAgentUpdate(exePath, stateLoc string, rec *agentUpdate, options *agentOpts) bool {
+	log.Printf("Testing updated agent %s", rec.To)
+	err := selfTestEndpoints(options)
+	switch {
+	case err == nil:
+		rec.Pending, rec.Starts = false, 0
+		if err := rec.save(stateLoc); err != nil {
+			log.Printf("Error recording update: %v", err)
+		}
+		log.Printf("Updated agent %s passed its self-test", rec.To)
+		return false
+	case authFailure(err):
+		return rollbackAgent(exePath, stateLoc, rec, true, err)
+	case !time.Now().Before(rec.Updated.Add(rec.GracePeriod)):
+		return rollbackAgent(exePath, stateLoc, rec, false,
+			fmt.Errorf("dr-provision not reachable within %v: %v", rec.GracePeriod, err))
+	}
+	log.Printf("Unable to reach dr-provision to test updated agent %s: %v", rec.To, err)
+	return false
+}
+
+// agentUpdateTimer arms a timer for an update that is still pending
+// after agentSelfTest, because dr-provision could not be reached.  When
+// the grace period runs out, the update is tested again, and if it is
+// rolled back restart is called to stop the agent and restart it as the
+// previous binary.  It returns nil if there is no pending update.
+func agentUpdateTimer(exePath, stateLoc string, options *agentOpts, restart func()) *time.Timer {
+	rec := loadAgentUpdate(stateLoc)
+	if !rec.Pending {
+		return nil
+	}
+	return time.AfterFunc(time.Until(rec.Updated.Add(rec.GracePeriod)), func() {
+		rec := loadAgentUpdate(stateLoc)
+		if rec.Pending && testAgentUpdate(exePath, stateLoc, rec, options) {
+			restart()
+		}
+	})
+}
+
+// rollbackAgent puts the previous binary back.  If bad is set, the new
+// binary is marked bad so that it will not be installed again.
+func rollbackAgent(exePath, stateLoc string, rec *agentUpdate, bad bool, why error) bool {
+	log.Printf("Updated agent %s failed its self-test, rolling back to %s: %v", rec.To, rec.From, why)
+	if err := os.Rename(rec.Previous, exePath); err != nil {
+		log.Printf("Error restoring %s: %v", rec.Previous, err)
+		return false
+	}
+	if bad {
+		rec.Bad = append(rec.Bad, rec.To)
+	}
+	rec.Pending, rec.Starts = false, 0
+	if err := rec.save(stateLoc); err != nil {
+		log.Printf("Error recording rollback: %v", err)
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package cli
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/v4/api"
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+func TestAgentUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-update-")
+	if err != nil {
+		t.Fatalf("ERROR: Unable to make tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	exePath := path.Join(dir, "drpcli")
+	if err := ioutil.WriteFile(exePath, []byte("new binary"), 0755); err != nil {
+		t.Fatalf("ERROR: Unable to write binary: %v", err)
+	}
+	sum, digest, err := fileSum(exePath)
+	if err != nil {
+		t.Fatalf("ERROR: Unable to sum binary: %v", err)
+	}
+	pub, priv, _ := models.GenerateContentKey()
+	other, _, _ := models.GenerateContentKey()
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, digest))
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case status != http.StatusOK:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"Code":%d,"Messages":["no"]}`, status)
+		case strings.HasSuffix(r.URL.Path, "/info"):
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"Features":["agent-auto-update"]}`))
+		case strings.HasSuffix(r.URL.Path, ".sig"):
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte(sig + "\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	session, _ := api.TokenSessionProxy(srv.URL, "token", false)
+	for _, keys := range [][]ed25519.PublicKey{nil, {other, pub}} {
+		if err := verifyAgentBinary(session, exePath, "drpcli.amd64.linux", sum, keys); err != nil {
+			t.Errorf("ERROR: Expected binary to verify with %d keys: %v", len(keys), err)
+		}
+	}
+	if err := verifyAgentBinary(session, exePath, "drpcli.amd64.linux", "0000", nil); err == nil {
+		t.Errorf("ERROR: Expected a bad sum to fail verification")
+	} else {
+		t.Logf("Got expected error %v", err)
+	}
+	if err := verifyAgentBinary(session, exePath, "drpcli.amd64.linux", sum, []ed25519.PublicKey{other}); err == nil {
+		t.Errorf("ERROR: Expected an untrusted signature to fail verification")
+	} else {
+		t.Logf("Got expected error %v", err)
+	}
+
+	// The self-test makes its own sessions, which must go straight to
+	// srv rather than through the proxy TestMain set up.
+	if proxy, ok := os.LookupEnv("RS_LOCAL_PROXY"); ok {
+		os.Unsetenv("RS_LOCAL_PROXY")
+		defer os.Setenv("RS_LOCAL_PROXY", proxy)
+	}
+	opts := &agentOpts{Endpoints: srv.URL, Token: "token"}
+	prev := exePath + ".prev"
+	pending := func(grace time.Duration, starts int) {
+		t.Helper()
+		ioutil.WriteFile(exePath, []byte("new binary"), 0755)
+		ioutil.WriteFile(prev, []byte("old binary"), 0755)
+		rec := &agentUpdate{Previous: prev, From: "old", To: sum, Pending: true, GracePeriod: grace, Updated: time.Now(), Starts: starts}
+		if err := rec.save(dir); err != nil {
+			t.Fatalf("ERROR: Unable to save update record: %v", err)
+		}
+	}
+	check := func(what string, rolledBack, wantRolledBack, wantPending, wantBad bool) {
+		t.Helper()
+		rec := loadAgentUpdate(dir)
+		want := "new binary"
+		if wantRolledBack {
+			want = "old binary"
+		}
+		buf, _ := ioutil.ReadFile(exePath)
+		if rolledBack != wantRolledBack || string(buf) != want || rec.Pending != wantPending || rec.isBad(sum) != wantBad {
+			t.Errorf("ERROR: %s: expected rollback %v, pending %v, bad %v, got %v with %q: %+v",
+				what, wantRolledBack, wantPending, wantBad, rolledBack, string(buf), rec)
+		}
+	}
+	pending(time.Hour, 0)
+	check("reachable", agentSelfTest(exePath, dir, opts), false, false, false)
+
+	status = http.StatusServiceUnavailable
+	pending(time.Hour, 0)
+	check("unreachable", agentSelfTest(exePath, dir, opts), false, true, false)
+	if rec := loadAgentUpdate(dir); rec.Starts != 0 {
+		t.Errorf("ERROR: Expected a start that could not reach dr-provision not to count, got %d", rec.Starts)
+	}
+	pending(time.Nanosecond, 0)
+	check("unreachable past the grace period", agentSelfTest(exePath, dir, opts), true, false, false)
+
+	// The old binary counted the first start before restarting as the
+	// new one, so the new one does not count it again.
+	pending(time.Hour, 1)
+	os.Setenv(agentUpdateStartEnv, sum)
+	check("counted by the old binary", agentSelfTest(exePath, dir, opts), false, true, false)
+	if rec := loadAgentUpdate(dir); rec.Starts != 0 {
+		t.Errorf("ERROR: Expected the start counted by the old binary to be uncounted, got %d", rec.Starts)
+	}
+	if v, ok := os.LookupEnv(agentUpdateStartEnv); ok {
+		t.Errorf("ERROR: Expected %s to be cleared, got %q", agentUpdateStartEnv, v)
+	}
+
+	// A running agent rolls back once the grace period runs out.
+	timerTest := func(what string, wantRolledBack, wantPending bool) {
+		t.Helper()
+		pending(100*time.Millisecond, 0)
+		restarted := make(chan struct{})
+		timer := agentUpdateTimer(exePath, dir, opts, func() { close(restarted) })
+		if timer == nil {
+			t.Fatalf("ERROR: %s: expected a timer for a pending update", what)
+		}
+		defer timer.Stop()
+		rolledBack := false
+		select {
+		case <-restarted:
+			rolledBack = true
+		case <-time.After(2 * time.Second):
+		}
+		check(what, rolledBack, wantRolledBack, wantPending, false)
+	}
+	timerTest("unreachable when the timer runs out", true, false)
+	status = http.StatusOK
+	timerTest("reachable when the timer runs out", false, false)
+	if timer := agentUpdateTimer(exePath, dir, opts, func() {}); timer != nil {
+		timer.Stop()
+		t.Errorf("ERROR: Expected no timer without a pending update")
+	}
+	status = http.StatusServiceUnavailable
+
+	pending(time.Hour, maxSelfTestStarts)
+	check("too many starts", agentSelfTest(exePath, dir, opts), true, false, true)
+
+	status = http.StatusUnauthorized
+	pending(time.Hour, 0)
+	check("unauthorized", agentSelfTest(exePath, dir, opts), true, false, true)
+}
@@ -93,52 +93,43 @@ func oneItem(cat *models.Content, name, version string) *models.CatalogItem {
 	return nil
 }
 
-func installItem(catalog *models.Content, name, version, arch, tgtos string, replaceWritable bool, inflight map[string]struct{}) error {
-	inflight[name] = struct{}{}
-	if name == "BasicStore" {
-		return nil
-	}
-	item := oneItem(catalog, name, version)
-	if item == nil {
-		return fmt.Errorf("%s version %s not in catalog", name, version)
-	}
+// downloadCatalogContent fetches the content pack for a catalog item.
+func downloadCatalogContent(item *models.CatalogItem, arch, tgtos string) (*models.Content, error) {
 	src, err := urlOrFileAsReadCloser(item.DownloadUrl(arch, tgtos))
 	if src != nil {
 		defer src.Close()
 	}
 	if err != nil {
-		return fmt.Errorf("Unable to contact source URL for %s: %v", item.Name, err)
+		return nil, fmt.Errorf("Unable to contact source URL for %s: %v", item.Name, err)
 	}
-	switch item.ContentType {
-	case "ContentPackage":
-		content := &models.Content{}
-		if err := json.NewDecoder(src).Decode(&content); err != nil {
-			return fmt.Errorf("Error downloading content bundle %s: %v", item.Name, err)
-		}
-
-		prereqs := strings.Split(content.Meta.Prerequisites, ",")
-		for _, p := range prereqs {
-			p = strings.TrimSpace(p)
-			if p == "" {
-				continue
-			}
-			pversion := version
-			if pversion != "tip" && pversion != "stable" {
-				pversion = "stable"
-			}
-			parts := strings.Split(p, ":")
-			pname := strings.TrimSpace(parts[0])
-
-			if _, err := Session.GetContentItem(pname); err == nil {
-				inflight[pname] = struct{}{}
-				continue
-			}
+	content := &models.Content{}
+	if err := json.NewDecoder(src).Decode(&content); err != nil {
+		return nil, fmt.Errorf("Error downloading content bundle %s: %v", item.Name, err)
+	}
+	return content, nil
+}
 
-			if err := installItem(catalog, pname, pversion, arch, tgtos, replaceWritable, inflight); err != nil {
+// installOneItem installs a single catalog item without looking at
+// its prerequisites.  content is the already downloaded content pack
+// for ContentPackage items, if there is one.
+func installOneItem(item *models.CatalogItem, content *models.Content, arch, tgtos string, replaceWritable bool) error {
+	if item.ContentType == "ContentPackage" {
+		if content == nil {
+			var err error
+			if content, err = downloadCatalogContent(item, arch, tgtos); err != nil {
 				return err
 			}
 		}
 		return doReplaceContent(content, "", replaceWritable)
+	}
+	src, err := urlOrFileAsReadCloser(item.DownloadUrl(arch, tgtos))
+	if src != nil {
+		defer src.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to contact source URL for %s: %v", item.Name, err)
+	}
+	switch item.ContentType {
 	case "PluginProvider":
 		res := &models.PluginProviderUploadInfo{}
 		req := Session.Req().Post(src).UrlFor("plugin_providers", item.Name)
@@ -167,6 +158,123 @@ func installItem(catalog *models.Content, name, version, arch, tgtos string, rep
 	}
 }
 
+// installItem installs name at version from the catalog, along with
+// the versions of its prerequisites picked by the resolver.  The plan
+// is printed before anything is installed, and if dryRun is set,
+// nothing is.  Installed content packs other than name are only
+// changed if upgradeInstalled is set, and are never downgraded unless
+// allowDowngrade is set.
+func installItem(catalog *models.Content, name, version, arch, tgtos string, replaceWritable, upgradeInstalled, allowDowngrade, dryRun bool) error {
+	if name == "BasicStore" {
+		return nil
+	}
+	summary, err := Session.GetContentSummary()
+	if err != nil {
+		return generateError(err, "Unable to fetch installed content")
+	}
+	// Only dynamic content packs come from the catalog, the same as in
+	// installedElements.
+	installed := []*models.ContentSummary{}
+	for _, cs := range summary {
+		if cs.Meta.Type == "dynamic" {
+			installed = append(installed, cs)
+		}
+	}
+	items := []*models.CatalogItem{}
+	for _, item := range itemsFromCatalog(catalog, "") {
+		items = append(items, item)
+	}
+	downloaded := map[string]*models.Content{}
+	resolver := &models.ContentResolver{
+		Items:            items,
+		Installed:        installed,
+		Tip:              version == "tip",
+		UpgradeInstalled: upgradeInstalled,
+		AllowDowngrade:   allowDowngrade,
+		Prerequisites: func(item *models.CatalogItem) (string, error) {
+			content, err := downloadCatalogContent(item, arch, tgtos)
+			if err != nil {
+				return "", err
+			}
+			downloaded[item.Id] = content
+			return content.Meta.Prerequisites, nil
+		},
+	}
+	plan, err := resolver.Resolve(name, version)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Install plan for %s %s:\n", name, version)
+	for _, step := range plan {
+		fmt.Printf("  %s\n", step)
+	}
+	if dryRun {
+		return nil
+	}
+	// Download and check every content pack before installing
+	// anything, so that a bad prerequisite does not leave the endpoint
+	// half upgraded.  Other items are only checked as they are
+	// installed.
+	for _, step := range plan {
+		if step.Item == nil || step.Item.ContentType != "ContentPackage" {
+			continue
+		}
+		content, ok := downloaded[step.Item.Id]
+		if !ok {
+			if content, err = downloadCatalogContent(step.Item, arch, tgtos); err != nil {
+				return err
+			}
+			downloaded[step.Item.Id] = content
+		}
+		if err := verifyContent(content); err != nil {
+			return err
+		}
+	}
+	for _, step := range plan {
+		if step.Item == nil {
+			continue
+		}
+		if err := installOneItem(step.Item, downloaded[step.Item.Id], arch, tgtos, replaceWritable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installedElements lists the versions of dr-provision, the UX, and
+// the content packs and plugin providers installed on the endpoint.
+func installedElements() ([]*models.Element, error) {
+	info, err := Session.Info()
+	if err != nil {
+		return nil, generateError(err, "Unable to fetch endpoint info")
+	}
+	res := []*models.Element{{Type: "DRP", Name: "drp", ActualVersion: info.Version}}
+	// The UX version is only known if the endpoint manages itself.
+	ux := &models.Element{Type: "DRPUX", Name: "drp-ux"}
+	if obj, err := Session.GetModel("endpoints", info.Id); err == nil {
+		ux.ActualVersion = obj.(*models.Endpoint).DRPUXVersion
+	}
+	res = append(res, ux)
+	summary, err := Session.GetContentSummary()
+	if err != nil {
+		return nil, generateError(err, "Unable to fetch installed content")
+	}
+	for _, cs := range summary {
+		if cs.Meta.Type != "dynamic" {
+			continue
+		}
+		res = append(res, &models.Element{Type: "ContentPackage", Name: cs.Meta.Name, ActualVersion: cs.Meta.Version})
+	}
+	providers := []*models.PluginProvider{}
+	if err := Session.Req().List("plugin_providers").Do(&providers); err != nil {
+		return nil, generateError(err, "Unable to fetch plugin providers")
+	}
+	for _, pp := range providers {
+		res = append(res, &models.Element{Type: "PluginProvider", Name: pp.Name, ActualVersion: pp.Version})
+	}
+	return res, nil
+}
+
 func catalogCommands() *cobra.Command {
 
 	type catItem struct {
@@ -275,10 +383,23 @@ and wind up in a file with the same name as the item + the default file extensio
 		},
 	})
 	replaceWritable := false
+	upgradeInstalled := false
+	allowDowngrade := false
+	dryRun := false
 	install := &cobra.Command{
 		Use:               "install [item]",
 		Short:             "Installs [item] from the catalog on the current dr-provision endpoint",
 		PersistentPreRunE: ppr,
+		Long: `Installs [item] from the catalog on the current dr-provision endpoint.
+
+If [item] is a content pack, versions of its prerequisites that satisfy all
+of the version constraints in the Prerequisites of the content packs
+involved, including the ones already installed, are picked from the catalog.
+Installed content packs are kept as they are, and the install fails with the
+conflicts if they do not work with [item].  Use --upgrade-installed to let
+the plan upgrade installed content packs, and --allow-downgrade to let it
+downgrade them.  The plan is printed and then installed with prerequisites
+first.  Use --dry-run to only print the plan.`,
 		Args: func(cmd *cobra.Command, args []string) error {
 			if len(args) != 1 {
 				return fmt.Errorf("item install requires 1 argument")
@@ -296,7 +417,7 @@ and wind up in a file with the same name as the item + the default file extensio
 			}
 			arch = info.Arch
 			tgtos = info.Os
-			err = installItem(catalog, args[0], version, arch, tgtos, replaceWritable, map[string]struct{}{})
+			err = installItem(catalog, args[0], version, arch, tgtos, replaceWritable, upgradeInstalled, allowDowngrade, dryRun)
 			if err != nil {
 				return err
 			}
@@ -304,6 +425,9 @@ and wind up in a file with the same name as the item + the default file extensio
 		},
 	}
 	install.Flags().BoolVar(&replaceWritable, "replaceWritable", false, "Replace identically named writable objects")
+	install.Flags().BoolVar(&upgradeInstalled, "upgrade-installed", false, "Allow installed content packs to be upgraded to satisfy prerequisites")
+	install.Flags().BoolVar(&allowDowngrade, "allow-downgrade", false, "Allow installed content packs to be downgraded")
+	install.Flags().BoolVar(&dryRun, "dry-run", false, "Show the install plan without installing anything")
 	itemCmd.AddCommand(install)
 	itemCmd.AddCommand(&cobra.Command{
 		Use:   "show [item]",
@@ -419,6 +543,53 @@ and wind up in a file with the same name as the item + the default file extensio
 	}
 	updateCmd.PersistentFlags().StringVar(&minVersion, "version", "", "Minimum version of the items")
 	cmd.AddCommand(updateCmd)
+	cmd.AddCommand(catalogMirrorCommand())
+
+	var outdatedTip, outdatedLocal bool
+	var outdatedVersionSet string
+	outdatedCmd := &cobra.Command{
+		Use:               "outdated",
+		Short:             "Show the installed components that are behind the catalog",
+		PersistentPreRunE: ppr,
+		Long: `Compares the versions of dr-provision, the UX, and the installed content
+packs and plugin providers with the stable and tip versions in the catalog,
+and lists how far behind each one is.
+
+Upgrades are to the stable versions unless --tip is passed.  Use --local to
+compare against the newest catalog in the endpoint's rebar-catalog files
+instead of --catalog.  With --version-set [id], a VersionSet with that id
+describing the endpoint after the upgrades is printed instead.`,
+		Args: cobra.NoArgs,
+		RunE: func(c *cobra.Command, args []string) error {
+			var cat *models.Content
+			var err error
+			if outdatedLocal {
+				cat, err = getLocalCatalog()
+			} else {
+				cat, err = fetchCatalog()
+			}
+			if err != nil {
+				return err
+			}
+			installed, err := installedElements()
+			if err != nil {
+				return err
+			}
+			items := []*models.CatalogItem{}
+			for _, item := range itemsFromCatalog(cat, "") {
+				items = append(items, item)
+			}
+			ups := models.CatalogUpgrades(items, installed, outdatedTip)
+			if outdatedVersionSet != "" {
+				return prettyPrint(models.UpgradeVersionSet(outdatedVersionSet, ups))
+			}
+			return prettyPrint(ups)
+		},
+	}
+	outdatedCmd.Flags().BoolVar(&outdatedTip, "tip", false, "Upgrade to tip versions instead of stable ones")
+	outdatedCmd.Flags().BoolVar(&outdatedLocal, "local", false, "Use the local catalog on the endpoint")
+	outdatedCmd.Flags().StringVar(&outdatedVersionSet, "version-set", "", "Print a VersionSet with this id for the upgraded endpoint")
+	cmd.AddCommand(outdatedCmd)
 
 	// Start of create stuff
 	var pkgVer string
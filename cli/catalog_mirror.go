@@ -0,0 +1,381 @@
+package cli
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/gofunky/semver"
+	"github.com/spf13/cobra"
+)
+
+// mirrorEntry records a file in a catalog mirror, so that later runs
+// only download what has changed.
+type mirrorEntry struct {
+	Source string
+	Sha256 string
+}
+
+// mirrorManifestName is the file in the top of a mirror that tracks
+// what has been downloaded, keyed by path relative to rebar-catalog.
+const mirrorManifestName = "mirror-manifest.json"
+
+// mirrorResult is what catalog mirror reports when it is done.
+type mirrorResult struct {
+	Catalog    string
+	Items      []string
+	Downloaded []string
+	Unchanged  []string
+	Uploaded   []string
+}
+
+// mirrorCleanRel cleans a path relative to rebar-catalog in the
+// mirror, and rejects paths that would land outside of it.
+func mirrorCleanRel(rel string) (string, error) {
+	res := path.Clean(rel)
+	if res == "." || res == ".." || strings.HasPrefix(res, "../") || path.IsAbs(res) {
+		return "", fmt.Errorf("%q is not a valid path in the mirror", rel)
+	}
+	return res, nil
+}
+
+// mirrorRelPath returns where a catalog item lives under rebar-catalog
+// in the mirror.  For plugin providers and drpcli, it is the directory
+// that holds the per-arch and OS binaries.
+func mirrorRelPath(item *models.CatalogItem) (string, error) {
+	rel := path.Join(item.Name, item.ActualVersion, item.FileName())
+	switch item.ContentType {
+	case "PluginProvider", "DRPCLI":
+		rel = path.Join(item.Name, item.ActualVersion)
+	}
+	if i := strings.Index(item.Source, "/rebar-catalog/"); i != -1 {
+		if src, err := url.QueryUnescape(item.Source[i+len("/rebar-catalog/"):]); err == nil {
+			rel = src
+		}
+	}
+	res, err := mirrorCleanRel(rel)
+	if err != nil {
+		return "", fmt.Errorf("Catalog item %s: %v", item.Id, err)
+	}
+	return res, nil
+}
+
+// mirrorFile is a single artifact to download for the mirror.
+type mirrorFile struct {
+	url    string
+	rel    string
+	sha256 string
+	exec   bool
+}
+
+// mirrorFiles returns the artifacts for item, limited to archOS for
+// items that have per-arch and OS binaries.
+func mirrorFiles(item *models.CatalogItem, archOS map[string]bool) ([]mirrorFile, error) {
+	rel, err := mirrorRelPath(item)
+	if err != nil {
+		return nil, err
+	}
+	switch item.ContentType {
+	case "PluginProvider", "DRPCLI":
+		res := []mirrorFile{}
+		keys := []string{}
+		for k := range item.Shasum256 {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			parts := strings.SplitN(k, "/", 2)
+			if len(parts) != 2 || !archOS[k] {
+				continue
+			}
+			src := item.DownloadUrl(parts[0], parts[1])
+			fileRel, err := mirrorCleanRel(path.Join(rel, strings.TrimPrefix(src, item.Source)))
+			if err != nil {
+				return nil, fmt.Errorf("Catalog item %s: %v", item.Id, err)
+			}
+			res = append(res, mirrorFile{
+				url:    src,
+				rel:    fileRel,
+				sha256: item.Shasum256[k],
+				exec:   true,
+			})
+		}
+		return res, nil
+	}
+	f := mirrorFile{url: item.Source, rel: rel}
+	switch {
+	case item.Shasum256["any/any"] != "":
+		f.sha256 = item.Shasum256["any/any"]
+	case len(item.Shasum256) == 1:
+		for _, v := range item.Shasum256 {
+			f.sha256 = v
+		}
+	case len(item.Shasum256) > 1:
+		return nil, fmt.Errorf("Catalog item %s has %d checksums and none for any/any", item.Id, len(item.Shasum256))
+	}
+	return []mirrorFile{f}, nil
+}
+
+// fileSha256 returns the hex sha256sum of a file.
+func fileSha256(name string) (string, error) {
+	fi, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer fi.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fi); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// mirrorDownload fetches f into dst, checking its sha256sum if the
+// catalog has one.
+func mirrorDownload(f mirrorFile, dst string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	src, err := urlOrFileAsReadCloser(f.url)
+	if src != nil {
+		defer src.Close()
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to contact source URL %s: %v", f.url, err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".mirror-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), src); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("Error downloading %s: %v", f.url, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if f.sha256 != "" && !strings.EqualFold(f.sha256, sum) {
+		return "", fmt.Errorf("Checksum mismatch for %s: expected %s, got %s", f.url, f.sha256, sum)
+	}
+	mode := os.FileMode(0644)
+	if f.exec {
+		mode = 0755
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return "", err
+	}
+	return sum, os.Rename(tmp.Name(), dst)
+}
+
+// mirrorSelection is the set of catalog items to mirror.
+type mirrorSelection struct {
+	ranges map[string]semver.Range
+	tip    bool
+}
+
+func (s *mirrorSelection) wants(item *models.CatalogItem) bool {
+	if item.Tip && !s.tip {
+		return false
+	}
+	if len(s.ranges) == 0 {
+		return true
+	}
+	rng, ok := s.ranges[item.Name]
+	if !ok {
+		return false
+	}
+	v, err := models.ParseSemver(item.ActualVersion)
+	return err == nil && rng(v)
+}
+
+func catalogMirrorCommand() *cobra.Command {
+	var arches, oses []string
+	var baseURL string
+	var tip, upload bool
+	mirror := &cobra.Command{
+		Use:   "mirror [dir] [items]...",
+		Short: "Mirror catalog items into [dir] for use without internet access",
+		Long: `Downloads the artifacts for the selected catalog items into [dir], and writes
+a catalog that points at the mirror instead of the original locations.
+
+[items] select what to mirror, and have the same format as content
+Prerequisites: a name, optionally followed by a colon and a version range,
+such as "drp-community-content: >=4.6.0".  With no [items], everything in the
+catalog is mirrored.  Tip versions are only mirrored with --tip.  Plugin
+providers and drpcli are mirrored for each --arch and --os.
+
+Files are laid out the way dr-provision lays out its rebar-catalog files
+area, and checked against the catalog checksums.  A manifest in [dir] records
+what has been downloaded, so running the command again only fetches what has
+changed.  The new catalog is written to [dir]/catalog.json and to
+[dir]/rebar-catalog/rackn-catalog.  Its sources point at --base-url, which
+defaults to a file:// URL for [dir].  Point --base-url at a web server
+serving [dir] to share the mirror.
+
+With --upload, the mirror is also uploaded to the files area of the endpoint,
+skipping files that are already there.  In that case, --base-url should be
+where the endpoint serves its files, such as https://drp:8090/files.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("%v requires at least 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			c.SilenceUsage = true
+			dir, err := filepath.Abs(args[0])
+			if err != nil {
+				return err
+			}
+			sel := &mirrorSelection{tip: tip, ranges: map[string]semver.Range{}}
+			for _, arg := range args[1:] {
+				rngs, err := models.ParseContentPrerequisites(arg)
+				if err != nil {
+					return fmt.Errorf("Invalid item selection %s: %v", arg, err)
+				}
+				for k, v := range rngs {
+					sel.ranges[k] = v
+				}
+			}
+			archOS := map[string]bool{}
+			for _, a := range arches {
+				for _, o := range oses {
+					archOS[a+"/"+o] = true
+				}
+			}
+			if baseURL == "" {
+				baseURL = (&url.URL{Scheme: "file", Path: dir}).String()
+			}
+			baseURL = strings.TrimSuffix(baseURL, "/")
+			if upload {
+				if err := ppr(c, args); err != nil {
+					return err
+				}
+			}
+			cat, err := fetchCatalog()
+			if err != nil {
+				return err
+			}
+			manifest := map[string]*mirrorEntry{}
+			manifestFile := filepath.Join(dir, mirrorManifestName)
+			if buf, err := ioutil.ReadFile(manifestFile); err == nil {
+				if err := json.Unmarshal(buf, &manifest); err != nil {
+					return fmt.Errorf("Invalid mirror manifest %s: %v", manifestFile, err)
+				}
+			}
+			res := &mirrorResult{Items: []string{}, Downloaded: []string{}, Unchanged: []string{}, Uploaded: []string{}}
+			newItems := map[string]interface{}{}
+			keys := []string{}
+			for k := range cat.Sections["catalog_items"] {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				item := &models.CatalogItem{}
+				if err := models.Remarshal(cat.Sections["catalog_items"][k], item); err != nil || !sel.wants(item) {
+					continue
+				}
+				files, err := mirrorFiles(item, archOS)
+				if err != nil {
+					return err
+				}
+				if len(files) == 0 {
+					continue
+				}
+				for _, f := range files {
+					dst := filepath.Join(dir, "rebar-catalog", filepath.FromSlash(f.rel))
+					if ent, ok := manifest[f.rel]; ok && ent.Source == f.url {
+						if sum, err := fileSha256(dst); err == nil && sum == ent.Sha256 &&
+							(f.sha256 == "" || strings.EqualFold(f.sha256, sum)) {
+							res.Unchanged = append(res.Unchanged, f.rel)
+							continue
+						}
+					}
+					fmt.Printf("Downloading %s to %s\n", f.url, dst)
+					sum, err := mirrorDownload(f, dst)
+					if err != nil {
+						return err
+					}
+					manifest[f.rel] = &mirrorEntry{Source: f.url, Sha256: sum}
+					res.Downloaded = append(res.Downloaded, f.rel)
+				}
+				rel, _ := mirrorRelPath(item)
+				item.Source = baseURL + "/rebar-catalog/" + rel
+				newItems[k] = item
+				res.Items = append(res.Items, k)
+			}
+			if buf, err := json.MarshalIndent(manifest, "", "  "); err != nil {
+				return err
+			} else if err := ioutil.WriteFile(manifestFile, buf, 0644); err != nil {
+				return err
+			}
+			cat.Sections["catalog_items"] = newItems
+			buf, err := json.MarshalIndent(cat, "", "  ")
+			if err != nil {
+				return err
+			}
+			catVersion := "v0.0.0"
+			if v, err := models.ParseSemver(cat.Meta.Version); err == nil {
+				catVersion = "v" + v.String()
+			}
+			catRel := path.Join("rackn-catalog", catVersion+".json")
+			res.Catalog = filepath.Join(dir, "catalog.json")
+			for _, name := range []string{res.Catalog, filepath.Join(dir, "rebar-catalog", filepath.FromSlash(catRel))} {
+				if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+					return err
+				}
+				if err := ioutil.WriteFile(name, buf, 0644); err != nil {
+					return err
+				}
+			}
+			if upload {
+				manifest[catRel] = &mirrorEntry{Sha256: fmt.Sprintf("%x", sha256.Sum256(buf))}
+				rels := []string{}
+				for rel := range manifest {
+					rels = append(rels, rel)
+				}
+				sort.Strings(rels)
+				for _, rel := range rels {
+					if _, err := mirrorCleanRel(rel); err != nil {
+						return fmt.Errorf("Invalid mirror manifest %s: %v", manifestFile, err)
+					}
+					at := path.Join("rebar-catalog", rel)
+					if sum, err := Session.GetBlobSum("files", at); err == nil && strings.EqualFold(sum, manifest[rel].Sha256) {
+						continue
+					}
+					fi, err := os.Open(filepath.Join(dir, "rebar-catalog", filepath.FromSlash(rel)))
+					if err != nil {
+						return err
+					}
+					fmt.Printf("Uploading %s\n", at)
+					_, err = Session.PostBlobExplode(fi, false, "files", at)
+					fi.Close()
+					if err != nil {
+						return generateError(err, "Failed to upload %s", at)
+					}
+					res.Uploaded = append(res.Uploaded, rel)
+				}
+			}
+			return prettyPrint(res)
+		},
+	}
+	mirror.Flags().StringSliceVar(&arches, "arch", []string{"amd64"}, "Architectures of plugin providers and drpcli to mirror")
+	mirror.Flags().StringSliceVar(&oses, "os", []string{"linux"}, "OSes of plugin providers and drpcli to mirror")
+	mirror.Flags().StringVar(&baseURL, "base-url", "", "URL the mirror will be served from")
+	mirror.Flags().BoolVar(&tip, "tip", false, "Also mirror tip versions")
+	mirror.Flags().BoolVar(&upload, "upload", false, "Upload the mirror to the files area of the endpoint")
+	return mirror
+}
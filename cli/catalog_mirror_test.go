@@ -0,0 +1,185 @@
+package cli
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+func TestMirrorPaths(t *testing.T) {
+	for _, item := range []*models.CatalogItem{
+		{Id: "up", Name: "x", ContentType: "ContentPackage", Source: "https://example.com/rebar-catalog/../../etc/cron.d/x"},
+		{Id: "escaped", Name: "x", ContentType: "ContentPackage", Source: "https://example.com/rebar-catalog/%2e%2e/%2e%2e/x"},
+		{Id: "name", Name: "../../x", ActualVersion: "..", ContentType: "PluginProvider", Source: "https://example.com/x"},
+	} {
+		if rel, err := mirrorRelPath(item); err == nil {
+			t.Errorf("ERROR: Expected %s to be rejected, got %s", item.Id, rel)
+		} else {
+			t.Logf("Got expected error %v", err)
+		}
+	}
+	item := &models.CatalogItem{Id: "ok", Name: "x", ActualVersion: "v1.0.0", ContentType: "ContentPackage", Source: "https://example.com/x.json"}
+	if rel, err := mirrorRelPath(item); err != nil || rel != "x/v1.0.0/x.json" {
+		t.Errorf("ERROR: Expected x/v1.0.0/x.json, got %s: %v", rel, err)
+	}
+	item.Shasum256 = map[string]string{"amd64/linux": "aaaa", "any/any": "bbbb"}
+	if files, err := mirrorFiles(item, nil); err != nil || len(files) != 1 || files[0].sha256 != "bbbb" {
+		t.Errorf("ERROR: Expected the any/any checksum, got %+v: %v", files, err)
+	}
+	item.Shasum256 = map[string]string{"amd64/linux": "aaaa", "arm64/linux": "bbbb"}
+	if files, err := mirrorFiles(item, nil); err == nil {
+		t.Errorf("ERROR: Expected ambiguous checksums to fail, got %+v", files)
+	} else {
+		t.Logf("Got expected error %v", err)
+	}
+}
+
+func TestCatalogMirror(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "catalog-mirror-")
+	if err != nil {
+		t.Fatalf("ERROR: Unable to make tmpdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "src", "rebar-catalog")
+	sum := func(buf string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(buf))) }
+	writeSrc := func(rel, buf string) {
+		t.Helper()
+		name := filepath.Join(src, filepath.FromSlash(rel))
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := ioutil.WriteFile(name, []byte(buf), 0644); err != nil {
+			t.Fatalf("ERROR: Unable to write %s: %v", name, err)
+		}
+	}
+	items := map[string]*models.CatalogItem{
+		"pack-v1.0.0": {Id: "pack-v1.0.0", Name: "pack", Version: "v1.0.0", ActualVersion: "v1.0.0", ContentType: "ContentPackage",
+			Source: src + "/pack/v1.0.0/pack.json"},
+		"pack-v2.0.0": {Id: "pack-v2.0.0", Name: "pack", Version: "v2.0.0", ActualVersion: "v2.0.0", ContentType: "ContentPackage",
+			Source: src + "/pack/v2.0.0/pack.json"},
+		"pack-tip": {Id: "pack-tip", Name: "pack", Version: "tip", ActualVersion: "v2.1.0-tip", ContentType: "ContentPackage", Tip: true,
+			Source: src + "/pack/tip/pack.json"},
+		"prov-v1.0.0": {Id: "prov-v1.0.0", Name: "prov", Version: "v1.0.0", ActualVersion: "v1.0.0", ContentType: "PluginProvider",
+			Source: src + "/prov/v1.0.0"},
+		"other-v1.0.0": {Id: "other-v1.0.0", Name: "other", Version: "v1.0.0", ActualVersion: "v1.0.0", ContentType: "ContentPackage",
+			Source: src + "/other/v1.0.0/other.json"},
+	}
+	files := map[string]string{
+		"pack/v1.0.0/pack.json":        "pack one",
+		"pack/v2.0.0/pack.json":        "pack two",
+		"pack/tip/pack.json":           "pack tip",
+		"prov/v1.0.0/amd64/linux/prov": "prov amd64",
+		"prov/v1.0.0/arm64/linux/prov": "prov arm64",
+		"other/v1.0.0/other.json":      "other",
+	}
+	for rel, buf := range files {
+		writeSrc(rel, buf)
+	}
+	items["pack-v1.0.0"].Shasum256 = map[string]string{"any/any": sum("pack one")}
+	items["pack-v2.0.0"].Shasum256 = map[string]string{"any/any": sum("pack two")}
+	items["prov-v1.0.0"].Shasum256 = map[string]string{"amd64/linux": sum("prov amd64"), "arm64/linux": sum("prov arm64")}
+	catFile := filepath.Join(tmp, "catalog.json")
+	writeCatalog := func() {
+		t.Helper()
+		cat := &models.Content{Meta: models.ContentMetaData{Name: "rackn-catalog", Version: "v1.2.3"}, Sections: models.Sections{"catalog_items": map[string]interface{}{}}}
+		for k, v := range items {
+			cat.Sections["catalog_items"][k] = v
+		}
+		buf, _ := json.Marshal(cat)
+		if err := ioutil.WriteFile(catFile, buf, 0644); err != nil {
+			t.Fatalf("ERROR: Unable to write catalog: %v", err)
+		}
+	}
+	writeCatalog()
+	oldCatalog, oldFormat := catalog, format
+	catalog, format = catFile, "json"
+	defer func() { catalog, format = oldCatalog, oldFormat }()
+	dir := filepath.Join(tmp, "mirror")
+	run := func() *models.Content {
+		t.Helper()
+		cmd := catalogMirrorCommand()
+		cmd.SetArgs([]string{dir, "pack: >=1.0.0", "prov"})
+		if err := cmd.Execute(); err != nil {
+			t.Fatalf("ERROR: Mirror failed: %v", err)
+		}
+		cat := &models.Content{}
+		buf, err := ioutil.ReadFile(filepath.Join(dir, "catalog.json"))
+		if err == nil {
+			err = json.Unmarshal(buf, cat)
+		}
+		if err != nil {
+			t.Fatalf("ERROR: Unable to read mirrored catalog: %v", err)
+		}
+		return cat
+	}
+	manifest := func() []string {
+		t.Helper()
+		res := []string{}
+		m := map[string]*mirrorEntry{}
+		buf, _ := ioutil.ReadFile(filepath.Join(dir, mirrorManifestName))
+		json.Unmarshal(buf, &m)
+		for k := range m {
+			res = append(res, k)
+		}
+		sort.Strings(res)
+		return res
+	}
+	cat := run()
+	keys := []string{}
+	for k := range cat.Sections["catalog_items"] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "pack-v1.0.0,pack-v2.0.0,prov-v1.0.0" {
+		t.Errorf("ERROR: Expected the selected non-tip items to be mirrored, got %v", keys)
+	}
+	want := "pack/v1.0.0/pack.json,pack/v2.0.0/pack.json,prov/v1.0.0/amd64/linux/prov"
+	if got := strings.Join(manifest(), ","); got != want {
+		t.Errorf("ERROR: Expected manifest %s, got %s", want, got)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(dir, "rebar-catalog", "pack", "v2.0.0", "pack.json")); err != nil || string(buf) != "pack two" {
+		t.Errorf("ERROR: Mirrored pack has %q: %v", string(buf), err)
+	}
+
+	// Changed files are fetched again, and unchanged ones are not.
+	stamp := filepath.Join(dir, "rebar-catalog", "pack", "v1.0.0", "pack.json")
+	before, _ := os.Stat(stamp)
+	writeSrc("pack/v2.0.0/pack.json", "pack two again")
+	items["pack-v2.0.0"].Shasum256["any/any"] = sum("pack two again")
+	writeCatalog()
+	run()
+	if buf, _ := ioutil.ReadFile(filepath.Join(dir, "rebar-catalog", "pack", "v2.0.0", "pack.json")); string(buf) != "pack two again" {
+		t.Errorf("ERROR: Expected the changed pack to be fetched again, got %q", string(buf))
+	}
+	if after, _ := os.Stat(stamp); before == nil || after == nil || !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("ERROR: Expected the unchanged pack to be left alone")
+	}
+
+	// A bad checksum or a path out of the mirror fails the mirror.
+	for _, bad := range []func(){
+		func() { items["pack-v1.0.0"].Shasum256["any/any"] = sum("something else") },
+		func() { items["pack-v1.0.0"].Source = src + "/../../../escape.json" },
+	} {
+		items["pack-v1.0.0"].Source = src + "/pack/v1.0.0/pack.json"
+		items["pack-v1.0.0"].Shasum256["any/any"] = sum("pack one")
+		os.RemoveAll(dir)
+		bad()
+		writeCatalog()
+		cmd := catalogMirrorCommand()
+		cmd.SetArgs([]string{dir, "pack"})
+		if err := cmd.Execute(); err == nil {
+			t.Errorf("ERROR: Expected mirroring a bad item to fail")
+		} else {
+			t.Logf("Got expected error %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "escape.json")); err == nil {
+		t.Errorf("ERROR: Mirror wrote outside of %s", dir)
+	}
+}
@@ -19,14 +19,43 @@ import (
 	"github.com/digitalrebar/provision/v4/api"
 	"github.com/digitalrebar/provision/v4/models"
 	"github.com/digitalrebar/provision/v4/test"
+	"github.com/digitalrebar/provision/v4/test/fakeserver"
 )
 
 var (
 	tmpDir  string
 	myToken string
 	running bool
+	// fakeServer is the in-process stand-in for dr-provision that the
+	// tests run against when dr-provision is not installed.
+	fakeServer *fakeserver.Server
 )
 
+// needServer skips tests whose expected output comes from a real
+// dr-provision when running against fakeServer.
+func needServer(t *testing.T) {
+	t.Helper()
+	if fakeServer != nil {
+		t.Skip("dr-provision is not installed, skipping")
+	}
+}
+
+// startFakeServer starts fakeServer in tmpDir and logs in to it.
+func startFakeServer() error {
+	var err error
+	if fakeServer, err = fakeserver.New(tmpDir); err != nil {
+		return err
+	}
+	if err = fakeServer.Start("127.0.0.1:0", "127.0.0.1:0"); err != nil {
+		return err
+	}
+	Session, err = api.UserSession(fakeServer.Endpoint(), fakeserver.DefaultUsername, fakeserver.DefaultPassword)
+	if err != nil {
+		return err
+	}
+	return Session.MakeProxy(path.Join(tmpDir, ".socket"))
+}
+
 var noErrorString string = ``
 var noContentString string = ``
 var noStdinString string = ``
@@ -459,6 +488,7 @@ func verifyClean(t *testing.T) {
 }
 
 func TestCorePieces(t *testing.T) {
+	needServer(t)
 	cliTest(false, false, "-E", "https://127.0.0.1:10001", "-U", "rocketskates", "-P", "r0cketsk8ts", "version").run(t)
 	cliTest(false, false, "gohai", "--help").run(t)
 	cliTest(false, true, "-F", "cow", "bootenvs", "list").run(t)
@@ -498,6 +528,18 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 	defer os.RemoveAll(tmpDir)
+	if _, err := exec.LookPath("dr-provision"); err != nil {
+		log.Printf("dr-provision is not installed, using the fake server")
+		if err := startFakeServer(); err != nil {
+			log.Printf("Error starting the fake server: %v", err)
+			os.RemoveAll(tmpDir)
+			os.Exit(1)
+		}
+		ret := m.Run()
+		fakeServer.Close()
+		os.RemoveAll(tmpDir)
+		os.Exit(ret)
+	}
 	if err := test.StartServer(tmpDir, 10001); err != nil {
 		log.Printf("Error starting dr-provision: %v", err)
 		os.RemoveAll(tmpDir)
@@ -127,6 +127,9 @@ func encryptAfterDownload(c *models.Content) (key []byte, err error) {
 }
 
 func doReplaceContent(layer *models.Content, key string, replaceWritable bool) error {
+	if err := verifyContent(layer); err != nil {
+		return err
+	}
 	if err := decryptForUpload(layer, key); err != nil {
 		return generateError(err, "Error preparing layer")
 	}
@@ -162,6 +165,33 @@ func replaceContent(path, key string, replaceWritable bool) error {
 	return doReplaceContent(layer, key, replaceWritable)
 }
 
+// loadContentSource loads a content bundle file, or a content
+// directory laid out the way bundle expects.  It also returns which
+// files each object was loaded from.
+func loadContentSource(src string) (*models.Content, map[string][]string, error) {
+	content := &models.Content{}
+	if fi, err := os.Stat(src); err == nil && fi.IsDir() {
+		mem, _ := store.Open("memory:///")
+		defer mem.Close()
+		sources, err := api.DisconnectedClient().BundleContentWithSources(src, mem, map[string]string{})
+		if err == nil {
+			err = content.FromStore(mem)
+		}
+		return content, sources, err
+	}
+	if err := into(src, content); err != nil {
+		return nil, nil, err
+	}
+	// Everything in a bundle file came from that file.
+	sources := map[string][]string{}
+	for prefix, section := range content.Sections {
+		for key := range section {
+			sources[prefix+"/"+key] = []string{src}
+		}
+	}
+	return content, sources, nil
+}
+
 func registerContent(app *cobra.Command) {
 	content := &cobra.Command{
 		Use:   "contents",
@@ -249,6 +279,9 @@ func registerContent(app *cobra.Command) {
 			if err := into(args[0], layer); err != nil {
 				return generateError(err, "Error parsing layer")
 			}
+			if err := verifyContent(layer); err != nil {
+				return err
+			}
 			if err := decryptForUpload(layer, key); err != nil {
 				return generateError(err, "Error preparing layer")
 			}
@@ -277,6 +310,9 @@ func registerContent(app *cobra.Command) {
 			if err := into(args[1], layer); err != nil {
 				return generateError(err, "Error parsing layer")
 			}
+			if err := verifyContent(layer); err != nil {
+				return err
+			}
 			if err := decryptForUpload(layer, key); err != nil {
 				return generateError(err, "Error preparing layer")
 			}
@@ -329,7 +365,12 @@ func registerContent(app *cobra.Command) {
 	content.AddCommand(&cobra.Command{
 		Use:   "bundle [file] [meta fields]",
 		Short: "Bundle the current directory into [file].  [meta fields] allows for the specification of the meta data.",
-		Long:  "Bundle assumes that the directories are the object types of the system.",
+		Long: `Bundle assumes that the directories are the object types of the system.
+
+Templates can be in subdirectories of the templates directory, the way
+unbundle writes templates with slashes in their IDs, and the path to the
+file is the template ID.  Subdirectories whose names start with a . are
+skipped.`,
 		Args: func(c *cobra.Command, args []string) error {
 			if len(args) == 0 {
 				return fmt.Errorf("Must provide a file")
@@ -353,40 +394,51 @@ func registerContent(app *cobra.Command) {
 			default:
 				return fmt.Errorf("Unknown store extension %s", ext)
 			}
-			storeURI := fmt.Sprintf("file:%s.tmp?codec=%s", target, codec)
 			params := map[string]string{}
 			for i := 1; i < len(args); i++ {
 				parts := strings.SplitN(args[i], "=", 2)
 				params[parts[0]] = parts[1]
 			}
-			s, err := store.Open(storeURI)
-			if err != nil {
-				return fmt.Errorf("Failed to open store %s: %v", target, err)
+			storeCodec := store.Codec(store.YamlCodec)
+			if codec == "json" {
+				storeCodec = store.JsonCodec
 			}
-			defer os.Remove(target + ".tmp")
 			cc := api.DisconnectedClient()
-			if err := cc.BundleContent(".", s, params); err != nil {
+			contents, err := cc.BundleContentBytes(".", params, storeCodec)
+			if err != nil {
 				return fmt.Errorf("Failed to load: %v", err)
 			}
-			s.Close()
-
 			if ext == ".go" {
-				if contents, err := ioutil.ReadFile(target + ".tmp"); err != nil {
-					return fmt.Errorf("Failed to readfile: %v\n", err)
-				} else {
-					if err := outputGoBuffer(target, contents); err != nil {
-						return fmt.Errorf("Failed to write file: %v\n", err)
-					}
+				if err := outputGoBuffer(target, contents); err != nil {
+					return fmt.Errorf("Failed to write file: %v\n", err)
 				}
-			} else {
-				os.Rename(target+".tmp", target)
+				return nil
 			}
-			return nil
+			defer os.Remove(target + ".tmp")
+			if err := ioutil.WriteFile(target+".tmp", contents, 0644); err != nil {
+				return fmt.Errorf("Failed to write file: %v\n", err)
+			}
+			return os.Rename(target+".tmp", target)
 		},
 	})
-	content.AddCommand(&cobra.Command{
+	var verify bool
+	unbundle := &cobra.Command{
 		Use:   "unbundle [file]",
 		Short: "Expand the content bundle [file] into the current directory",
+		Long: `Unbundle expands the content bundle [file] into the current directory, laid
+out the way bundle expects.  Objects are written with the codec picked by -F,
+templates are written as raw files with slashes in their IDs turned into
+subdirectories, and JSON is indented.
+
+Objects that are already in a file in the current directory are written back
+to that file, using the codec that matches its extension, and files that
+already hold the same object are left alone.  This keeps unbundling into a
+checkout of the content from making changes that are not real.
+
+With --verify, the current directory is bundled again afterwards, and the
+command fails if the result is not byte for byte the same as [file].  This
+only holds for files written by bundle, and any differences in the objects
+are printed to help find what changed.`,
 		Args: func(c *cobra.Command, args []string) error {
 			if len(args) != 1 {
 				return fmt.Errorf("Must provide a file")
@@ -419,9 +471,34 @@ func registerContent(app *cobra.Command) {
 			}
 			defer s.Close()
 			cc := api.DisconnectedClient()
-			return cc.UnbundleContent(s, ".")
+			if err := cc.UnbundleContent(s, "."); err != nil || !verify {
+				return err
+			}
+			c.SilenceUsage = true
+			bundleCodec := store.Codec(store.YamlCodec)
+			if ext == ".json" {
+				bundleCodec = store.JsonCodec
+			}
+			rebundled, err := cc.BundleContentBytes(".", map[string]string{}, bundleCodec)
+			if err != nil {
+				return fmt.Errorf("Failed to bundle the unbundled content: %v", err)
+			}
+			if bytes.Equal(rebundled, buf) {
+				return nil
+			}
+			// Say what changed if it is more than how things are encoded.
+			if again, _, err := loadContentSource("."); err == nil {
+				if diffs, err := models.ContentDifferences(content, again); err == nil {
+					for _, d := range diffs {
+						fmt.Fprintln(os.Stderr, d)
+					}
+				}
+			}
+			return fmt.Errorf("Bundling the current directory does not reproduce %s byte for byte", src)
 		},
-	})
+	}
+	unbundle.Flags().BoolVar(&verify, "verify", false, "Check that bundling the result reproduces [file]")
+	content.AddCommand(unbundle)
 
 	// Bundlize - takes a list of objects and makes them a bundle - deleting them optionaly.- interactive.
 	var delete = false
@@ -636,6 +713,109 @@ func registerContent(app *cobra.Command) {
 		},
 	})
 
+	content.AddCommand(&cobra.Command{
+		Use:   "lint [file]",
+		Short: "Check the content bundle or content directory [file] for problems",
+		Long: `Lint loads a content bundle, or a content directory laid out the way
+bundle expects, and checks it for problems without needing a server.
+
+Every object is validated, references from workflows to stages, from stages
+to tasks, bootenvs, and profiles, and from tasks and stages to templates are
+checked, all templates are parsed, and params are checked against their Param
+definitions.  References that are not in the content are errors unless the
+content has Prerequisites that could provide them, in which case they are
+warnings.
+
+With no [file], the current directory is checked.  Use -F text for a table,
+or -F json or -F yaml for machine-readable output.  The command fails if any
+errors are found.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("%v accepts at most 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			c.SilenceUsage = true
+			src := "."
+			if len(args) == 1 {
+				src = args[0]
+			}
+			content, sources, err := loadContentSource(src)
+			if err != nil {
+				prettyPrint([]*models.LintFinding{{Severity: "error", File: src, Message: err.Error()}})
+				return fmt.Errorf("Failed to load %s", src)
+			}
+			findings, err := models.LintContent(content, sources)
+			if err != nil {
+				return generateError(err, "Failed to lint content")
+			}
+			if findings == nil {
+				findings = []*models.LintFinding{}
+			}
+			if err := prettyPrint(findings); err != nil {
+				return err
+			}
+			errors := 0
+			for _, f := range findings {
+				if f.Severity == "error" {
+					errors++
+				}
+			}
+			if errors > 0 {
+				return fmt.Errorf("Found %d errors", errors)
+			}
+			return nil
+		},
+	})
+
+	markdown := false
+	changelog := &cobra.Command{
+		Use:   "changelog [old] [new]",
+		Short: "Summarize what changed between the content bundles or directories [old] and [new]",
+		Long: `Changelog loads two versions of a content bundle, each of which can be a
+bundle file or a content directory laid out the way bundle expects, and
+summarizes what changed between them by object type: objects that were added
+or removed, changes to RequiredParams and OptionalParams, diffs of templates,
+changes to the order of workflow stages and stage tasks, and param schema
+changes.
+
+Changes that can break users of the content are flagged as breaking.  These
+are removed objects, new RequiredParams, and param schema changes that can
+make values that used to be valid invalid.
+
+The summary is printed in the output format, or as Markdown release notes if
+--markdown is given.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("%v requires 2 arguments", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			c.SilenceUsage = true
+			versions := make([]*models.Content, 2)
+			for i, src := range args {
+				content, _, err := loadContentSource(src)
+				if err != nil {
+					return generateError(err, "Failed to load %s", src)
+				}
+				versions[i] = content
+			}
+			cl, err := models.NewContentChangelog(versions[0], versions[1])
+			if err != nil {
+				return generateError(err, "Failed to compare content")
+			}
+			if markdown {
+				fmt.Print(cl.Markdown())
+				return nil
+			}
+			return prettyPrint(cl)
+		},
+	}
+	changelog.Flags().BoolVar(&markdown, "markdown", false, "Print the summary as Markdown release notes")
+	content.AddCommand(changelog)
+
 	content.AddCommand(&cobra.Command{
 		Use:   "document [file]",
 		Short: "Expand the content bundle [file] into documentation",
@@ -709,6 +889,9 @@ func registerContent(app *cobra.Command) {
 			return err
 		},
 	})
+	addContentSigningCommands(content)
+	content.AddCommand(contentsNewCommand())
+	content.AddCommand(contentsDriftCommand())
 	app.AddCommand(content)
 }
 
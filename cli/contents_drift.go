@@ -0,0 +1,138 @@
+package cli
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/digitalrebar/provision/v4/api"
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/digitalrebar/provision/v4/store"
+	"github.com/spf13/cobra"
+)
+
+// driftPatch builds a content bundle from the writable objects that
+// have drifted from content.
+func driftPatch(content *models.Content, drifts []*models.ContentDrift, live map[string][]models.Model, params map[string]string) *models.Content {
+	if _, ok := params["Name"]; !ok {
+		params["Name"] = content.Meta.Name + "-drift"
+	}
+	if _, ok := params["Version"]; !ok {
+		params["Version"] = content.Meta.Version
+	}
+	if _, ok := params["Description"]; !ok {
+		params["Description"] = "Local changes to " + content.Meta.Name
+	}
+	if _, ok := params["Prerequisites"]; !ok {
+		params["Prerequisites"] = content.Meta.Name
+	}
+	patch := &models.Content{
+		Meta: models.ContentMetaData{
+			Name:          api.FindOrFake("", "Name", params),
+			Description:   api.FindOrFake("", "Description", params),
+			Documentation: api.FindOrFake("", "Documentation", params),
+			Version:       api.FindOrFake("", "Version", params),
+			Type:          api.FindOrFake("", "Type", params),
+			Prerequisites: api.FindOrFake("", "Prerequisites", params),
+		},
+		Sections: map[string]models.Section{},
+	}
+	for _, d := range drifts {
+		if !d.Writable() {
+			continue
+		}
+		for _, obj := range live[d.Prefix] {
+			if obj.Key() != d.Key {
+				continue
+			}
+			if patch.Sections[d.Prefix] == nil {
+				patch.Sections[d.Prefix] = models.Section{}
+			}
+			patch.Sections[d.Prefix][d.Key] = obj
+		}
+	}
+	return patch
+}
+
+func contentsDriftCommand() *cobra.Command {
+	var local bool
+	var patchFile string
+	drift := &cobra.Command{
+		Use:   "drift [id] [meta fields]",
+		Short: "Show how the objects on the endpoint have drifted from the content layer [id]",
+		Long: `Drift compares the objects in the installed content layer [id] with the live
+objects of the same types on the endpoint, and reports:
+
+  override: a writable object, or one from another content layer, that is
+            the same as the one in [id].
+  modified: a live object that is different from the one in [id], with the
+            fields that are different.
+  missing:  an object in [id] that is not on the endpoint.
+  local:    with --local, a writable object of a type [id] provides that is
+            not in any content layer.
+
+With --patch, the writable objects that have drifted are saved into a new
+content bundle in [file], like bundlize does.  [meta fields] are Field=Value
+pairs for the meta data of the patch.  Name defaults to [id]-drift, and
+Prerequisites to [id].`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("%v requires at least 1 argument", c.UseLine())
+			}
+			for _, arg := range args[1:] {
+				if !strings.ContainsAny(arg, "=") {
+					return fmt.Errorf("Meta fields must have '=' in them")
+				}
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			c.SilenceUsage = true
+			content, err := Session.GetContentItem(args[0])
+			if err != nil {
+				return generateError(err, "Failed to fetch content %s", args[0])
+			}
+			live := map[string][]models.Model{}
+			for prefix := range content.Sections {
+				objs, err := Session.ListModel(prefix)
+				if err != nil {
+					return generateError(err, "Failed to list %s", prefix)
+				}
+				live[prefix] = objs
+			}
+			drifts, err := models.ContentDrifts(content, live, local)
+			if err != nil {
+				return generateError(err, "Failed to compare content")
+			}
+			if patchFile != "" {
+				codec := ""
+				switch path.Ext(patchFile) {
+				case ".yaml", ".yml":
+					codec = "yaml"
+				case ".json":
+					codec = "json"
+				default:
+					return fmt.Errorf("Unknown store extension %s", path.Ext(patchFile))
+				}
+				params := map[string]string{}
+				for _, arg := range args[1:] {
+					parts := strings.SplitN(arg, "=", 2)
+					params[parts[0]] = parts[1]
+				}
+				patch := driftPatch(content, drifts, live, params)
+				s, err := store.Open(fmt.Sprintf("file:%s?codec=%s", patchFile, codec))
+				if err != nil {
+					return fmt.Errorf("Failed to open store %s: %v", patchFile, err)
+				}
+				if err := patch.ToStore(s); err != nil {
+					return fmt.Errorf("Failed to save content layer: %v", err)
+				}
+				s.Close()
+			}
+			return prettyPrint(drifts)
+		},
+	}
+	drift.Flags().BoolVar(&local, "local", false, "Also report writable objects that are not in any content layer")
+	drift.Flags().StringVar(&patchFile, "patch", "", "Save the drifted writable objects as a content bundle in this file")
+	return drift
+}
@@ -0,0 +1,369 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/digitalrebar/provision/v4/api"
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/spf13/cobra"
+)
+
+// scaffoldDirs are the directories a new content pack starts with.
+var scaffoldDirs = []string{"params", "profiles", "stages", "tasks", "templates", "workflows"}
+
+// scaffoldDropped are the fields that are never worth writing into a
+// scaffolded object.
+var scaffoldDropped = map[string]struct{}{
+	"Available": {}, "Validated": {}, "ReadOnly": {}, "Errors": {}, "Bundle": {}, "Endpoint": {},
+}
+
+// scaffoldFileName turns a key into a file name, since param names
+// usually have slashes in them.
+func scaffoldFileName(key string) string {
+	return strings.Replace(key, "/", "-", -1)
+}
+
+// scaffoldWrite writes buf to dir/prefix/name, refusing to replace
+// existing files unless force is set.
+func scaffoldWrite(dir, prefix, name string, buf []byte, force bool) error {
+	dst := filepath.Join(dir, prefix, name)
+	if _, err := os.Stat(dst); err == nil && !force {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	fmt.Printf("Writing %s\n", dst)
+	return ioutil.WriteFile(dst, buf, 0644)
+}
+
+// scaffoldPrune removes empty values from v, so that scaffolded
+// files only have what matters.  It returns false if v itself is
+// empty.
+func scaffoldPrune(v interface{}) (interface{}, bool) {
+	switch val := v.(type) {
+	case nil:
+		return nil, false
+	case string:
+		return val, val != ""
+	case bool:
+		return val, val
+	case []interface{}:
+		for i := range val {
+			val[i], _ = scaffoldPrune(val[i])
+		}
+		return val, len(val) > 0
+	case map[string]interface{}:
+		for k := range val {
+			if pruned, ok := scaffoldPrune(val[k]); ok {
+				val[k] = pruned
+			} else {
+				delete(val, k)
+			}
+		}
+		return val, len(val) > 0
+	}
+	return v, true
+}
+
+// scaffoldObject writes obj as YAML into the pack in dir.
+func scaffoldObject(dir string, obj models.Model, force bool) error {
+	fields := map[string]interface{}{}
+	if err := models.Remarshal(obj, &fields); err != nil {
+		return err
+	}
+	for k := range scaffoldDropped {
+		delete(fields, k)
+	}
+	// Schemas are written as given, since false and "" are meaningful
+	// defaults.
+	schema, hasSchema := fields["Schema"]
+	delete(fields, "Schema")
+	pruned, _ := scaffoldPrune(fields)
+	if hasSchema && schema != nil {
+		fields["Schema"] = schema
+	}
+	buf, err := api.Pretty("yaml", pruned)
+	if err != nil {
+		return err
+	}
+	return scaffoldWrite(dir, obj.Prefix(), scaffoldFileName(obj.Key())+".yaml", buf, force)
+}
+
+// scaffoldKeys returns the keys of the objects of type prefix in the
+// pack in dir.
+func scaffoldKeys(dir, prefix string) (map[string]bool, error) {
+	content, _, err := loadContentSource(dir)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]bool{}
+	for k := range content.Sections[prefix] {
+		res[k] = true
+	}
+	return res, nil
+}
+
+// scaffoldCheckRefs makes sure that everything in refs is defined in
+// the pack, unless force is set.
+func scaffoldCheckRefs(dir, prefix string, refs []string, force bool) error {
+	if force {
+		return nil
+	}
+	have, err := scaffoldKeys(dir, prefix)
+	if err != nil {
+		return err
+	}
+	missing := []string{}
+	for _, ref := range refs {
+		if !have[ref] {
+			missing = append(missing, ref)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s %s not defined in %s, use --force to add anyway", prefix, strings.Join(missing, ", "), dir)
+	}
+	return nil
+}
+
+// scaffoldMeta sets the Meta the UX uses to show an object.  The title
+// is left for the author to fill in.
+func scaffoldMeta(meta models.Meta, icon string) {
+	meta["icon"] = icon
+	meta["color"] = "blue"
+}
+
+// scaffoldParam builds the stub for a param.  def is parsed as JSON if
+// it can be, so that --default 3 works for integers.
+func scaffoldParam(name, typ, def, description string, secure bool) (*models.Param, error) {
+	schema := map[string]interface{}{"type": typ}
+	switch typ {
+	case "string":
+		schema["default"] = def
+	case "boolean", "integer", "number", "array", "object":
+		if def != "" {
+			var val interface{}
+			if err := json.Unmarshal([]byte(def), &val); err != nil {
+				return nil, fmt.Errorf("Invalid default %s for type %s: %v", def, typ, err)
+			}
+			schema["default"] = val
+		}
+	default:
+		return nil, fmt.Errorf("Invalid param type %s", typ)
+	}
+	if description == "" {
+		description = "Describe what " + name + " does"
+	}
+	p := &models.Param{
+		Name:          name,
+		Description:   description,
+		Documentation: fmt.Sprintf("Document %s here.\n", name),
+		Schema:        schema,
+		Secure:        secure,
+	}
+	p.Fill()
+	scaffoldMeta(p.Meta, "hashtag")
+	p.Validate()
+	return p, p.HasError()
+}
+
+// scaffoldTemplate is the stub script for a new task.
+func scaffoldTemplate(task string, params []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!/usr/bin/env bash\n# %s\n\nset -e\n\n", task)
+	fmt.Fprintf(&b, "echo \"Running %s on {{ .Machine.Name }}\"\n", task)
+	for _, p := range params {
+		fmt.Fprintf(&b, "echo \"%s: {{ .Param %q }}\"\n", p, p)
+	}
+	b.WriteString("exit 0\n")
+	return b.String()
+}
+
+func contentsNewCommand() *cobra.Command {
+	var force bool
+	newCmd := &cobra.Command{
+		Use:   "new [dir] [meta fields]",
+		Short: "Create a content pack skeleton in [dir].  [meta fields] allows for the specification of the meta data.",
+		Long: `New creates [dir] laid out the way bundle expects, with the meta data files and
+a directory for each common object type.  Name defaults to the last part of
+[dir] and Version to v0.0.1.  Meta fields are given as Field=Value, such as
+Description="My content" or Prerequisites=drp-community-content.
+
+Use the task, stage, workflow, and param subcommands from inside [dir], or
+with --dir, to add objects to the pack.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("%v requires at least 1 argument", c.UseLine())
+			}
+			for i := 1; i < len(args); i++ {
+				if !strings.ContainsAny(args[i], "=") {
+					return fmt.Errorf("Meta fields must have '=' in them")
+				}
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			c.SilenceUsage = true
+			dir := args[0]
+			abs, err := filepath.Abs(dir)
+			if err != nil {
+				return err
+			}
+			meta := map[string]string{
+				"Name":          filepath.Base(abs),
+				"Version":       "v0.0.1",
+				"Description":   "Describe the content pack here",
+				"Documentation": "Document the content pack here.",
+			}
+			for _, arg := range args[1:] {
+				parts := strings.SplitN(arg, "=", 2)
+				meta[parts[0]] = parts[1]
+			}
+			for _, d := range scaffoldDirs {
+				if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+					return err
+				}
+			}
+			keys := []string{}
+			for k := range meta {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if err := scaffoldWrite(dir, "", fmt.Sprintf("._%s.meta", k), []byte(meta[k]), force); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	newCmd.Flags().BoolVar(&force, "force", false, "Replace meta data files that already exist")
+
+	var dir string
+	var paramNames []string
+	task := &cobra.Command{
+		Use:   "task [name]",
+		Short: "Add a task named [name] with a template stub",
+		Long: `Adds tasks/[name].yaml and templates/[name].sh.tmpl to the pack.  Each
+--param is added to the task as an OptionalParam and used in the template.
+Params that the pack does not define yet get a string param stub.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			c.SilenceUsage = true
+			name := args[0]
+			have, err := scaffoldKeys(dir, "params")
+			if err != nil {
+				return err
+			}
+			for _, p := range paramNames {
+				if have[p] {
+					continue
+				}
+				param, err := scaffoldParam(p, "string", "", "", false)
+				if err != nil {
+					return err
+				}
+				if err := scaffoldObject(dir, param, force); err != nil {
+					return err
+				}
+			}
+			tmplID := name + ".sh.tmpl"
+			if err := scaffoldWrite(dir, "templates", tmplID, []byte(scaffoldTemplate(name, paramNames)), force); err != nil {
+				return err
+			}
+			t := &models.Task{
+				Name:           name,
+				Description:    "Describe what " + name + " does",
+				Documentation:  fmt.Sprintf("Document %s here.\n", name),
+				OptionalParams: paramNames,
+				Templates:      []models.TemplateInfo{{Name: name, ID: tmplID}},
+			}
+			t.Fill()
+			scaffoldMeta(t.Meta, "cogs")
+			return scaffoldObject(dir, t, force)
+		},
+	}
+	task.Flags().StringSliceVar(&paramNames, "param", []string{}, "Params the task uses")
+
+	stage := &cobra.Command{
+		Use:   "stage [name] [tasks]...",
+		Short: "Add a stage named [name] that runs [tasks]",
+		Long: `Adds stages/[name].yaml to the pack.  [tasks] must already be in the pack,
+unless --force is given.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			c.SilenceUsage = true
+			if err := scaffoldCheckRefs(dir, "tasks", args[1:], force); err != nil {
+				return err
+			}
+			s := &models.Stage{
+				Name:          args[0],
+				Description:   "Describe what " + args[0] + " does",
+				Documentation: fmt.Sprintf("Document %s here.\n", args[0]),
+				Tasks:         args[1:],
+			}
+			s.Fill()
+			scaffoldMeta(s.Meta, "cog")
+			return scaffoldObject(dir, s, force)
+		},
+	}
+
+	workflow := &cobra.Command{
+		Use:   "workflow [name] [stages]...",
+		Short: "Add a workflow named [name] that runs [stages]",
+		Long: `Adds workflows/[name].yaml to the pack.  [stages] must already be in the
+pack, unless --force is given.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			c.SilenceUsage = true
+			if err := scaffoldCheckRefs(dir, "stages", args[1:], force); err != nil {
+				return err
+			}
+			w := &models.Workflow{
+				Name:          args[0],
+				Description:   "Describe what " + args[0] + " does",
+				Documentation: fmt.Sprintf("Document %s here.\n", args[0]),
+				Stages:        args[1:],
+			}
+			w.Fill()
+			scaffoldMeta(w.Meta, "map")
+			return scaffoldObject(dir, w, force)
+		},
+	}
+
+	var paramType, paramDefault, paramDescription string
+	var secure bool
+	param := &cobra.Command{
+		Use:   "param [name]",
+		Short: "Add a param named [name] with a JSON schema",
+		Long: `Adds params/[name].yaml to the pack, with slashes in [name] replaced by
+dashes in the file name.  --type is the JSON schema type of the param, and
+--default is its default value, given as JSON for types other than string.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			c.SilenceUsage = true
+			p, err := scaffoldParam(args[0], paramType, paramDefault, paramDescription, secure)
+			if err != nil {
+				return err
+			}
+			return scaffoldObject(dir, p, force)
+		},
+	}
+	param.Flags().StringVar(&paramType, "type", "string", "JSON schema type of the param")
+	param.Flags().StringVar(&paramDefault, "default", "", "Default value of the param")
+	param.Flags().StringVar(&paramDescription, "description", "", "Description of the param")
+	param.Flags().BoolVar(&secure, "secure", false, "Make the param a secure param")
+
+	for _, sub := range []*cobra.Command{task, stage, workflow, param} {
+		sub.Flags().StringVar(&dir, "dir", ".", "Content pack directory to add to")
+		sub.Flags().BoolVar(&force, "force", false, "Replace files that already exist, and skip reference checks")
+		newCmd.AddCommand(sub)
+	}
+	return newCmd
+}
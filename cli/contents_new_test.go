@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+func TestContentsNew(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "contents-new-")
+	if err != nil {
+		t.Fatalf("ERROR: Unable to make tmpdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "my-pack")
+	for _, args := range [][]string{
+		{dir, "Description=My content"},
+		{"param", "--dir", dir, "my/count", "--type", "integer", "--default", "3"},
+		{"task", "--dir", dir, "my-task", "--param", "my/count", "--param", "my/greeting"},
+		{"stage", "--dir", dir, "my-stage", "my-task"},
+		{"workflow", "--dir", dir, "my-workflow", "my-stage"},
+	} {
+		cmd := contentsNewCommand()
+		cmd.SetArgs(args)
+		if err := cmd.Execute(); err != nil {
+			t.Fatalf("ERROR: contents new %v failed: %v", args, err)
+		}
+	}
+	cmd := contentsNewCommand()
+	cmd.SetArgs([]string{"stage", "--dir", dir, "bad-stage", "missing-task"})
+	if err := cmd.Execute(); err == nil {
+		t.Errorf("ERROR: Expected a stage with a missing task to fail")
+	} else {
+		t.Logf("Got expected error %v", err)
+	}
+	content, sources, err := loadContentSource(dir)
+	if err != nil {
+		t.Fatalf("ERROR: Unable to load scaffolded pack: %v", err)
+	}
+	findings, err := models.LintContent(content, sources)
+	if err != nil || len(findings) != 0 {
+		t.Errorf("ERROR: Expected the scaffolded pack to be lint-clean, got %v: %v", findings, err)
+	}
+	for prefix, keys := range map[string][]string{
+		"params":    {"my/count", "my/greeting"},
+		"tasks":     {"my-task"},
+		"stages":    {"my-stage"},
+		"workflows": {"my-workflow"},
+	} {
+		for _, key := range keys {
+			obj := map[string]interface{}{}
+			if raw, ok := content.Sections[prefix][key]; !ok || models.Remarshal(raw, &obj) != nil {
+				t.Errorf("ERROR: %s/%s was not scaffolded", prefix, key)
+				continue
+			}
+			meta, _ := obj["Meta"].(map[string]interface{})
+			if _, ok := meta["title"]; ok || meta["icon"] == nil {
+				t.Errorf("ERROR: Expected %s/%s to have an icon and no title, got %v", prefix, key, meta)
+			}
+		}
+	}
+}
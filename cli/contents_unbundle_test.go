@@ -0,0 +1,68 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/digitalrebar/provision/v4/api"
+	"github.com/digitalrebar/provision/v4/store"
+)
+
+func TestUnbundleVerify(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "contents-unbundle-")
+	if err != nil {
+		t.Fatalf("ERROR: Unable to make tmpdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "src")
+	for name, buf := range map[string]string{
+		"._Name.meta":           "my-pack",
+		"params/my-param.yaml":  "Name: my-param\nSchema:\n  type: string\n",
+		"templates/sub/my.tmpl": "line one\r\nline two\n",
+	} {
+		name = filepath.Join(src, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := ioutil.WriteFile(name, []byte(buf), 0644); err != nil {
+			t.Fatalf("ERROR: Unable to write %s: %v", name, err)
+		}
+	}
+	bundled, err := api.DisconnectedClient().BundleContentBytes(src, map[string]string{}, store.YamlCodec)
+	if err != nil {
+		t.Fatalf("ERROR: Unable to bundle %s: %v", src, err)
+	}
+	good, reformatted := filepath.Join(tmp, "good.yaml"), filepath.Join(tmp, "reformatted.yaml")
+	ioutil.WriteFile(good, bundled, 0644)
+	ioutil.WriteFile(reformatted, []byte(strings.Replace(string(bundled), "\n", "\n\n", 1)), 0644)
+
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	unbundle := func(name string) (string, error) {
+		t.Helper()
+		dst := filepath.Join(tmp, "out-"+filepath.Base(name))
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			t.Fatalf("ERROR: Unable to make %s: %v", dst, err)
+		}
+		if err := os.Chdir(dst); err != nil {
+			t.Fatalf("ERROR: Unable to change to %s: %v", dst, err)
+		}
+		outName, errName := filepath.Join(tmp, "stdout"), filepath.Join(tmp, "stderr")
+		err := runCliCommand(t, []string{"contents", "unbundle", name, "--verify"}, "", outName, errName, false)
+		stderr, _ := ioutil.ReadFile(errName)
+		return string(stderr), err
+	}
+	if stderr, err := unbundle(good); err != nil {
+		t.Errorf("ERROR: Expected %s to verify: %v\n%s", good, err, stderr)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(tmp, "out-good.yaml", "templates", "sub", "my.tmpl")); err != nil || string(buf) != "line one\nline two\n" {
+		t.Errorf("ERROR: Expected the template in a subdirectory, got %q (%v)", buf, err)
+	}
+	// The objects are the same, but the bytes are not.
+	if _, err := unbundle(reformatted); err == nil {
+		t.Errorf("ERROR: Expected %s not to verify", reformatted)
+	} else {
+		t.Logf("Got expected error %v", err)
+	}
+}
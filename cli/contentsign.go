@@ -0,0 +1,167 @@
+package cli
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/digitalrebar/provision/v4/api"
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/spf13/cobra"
+)
+
+// loadTrustedKeys loads the public keys from the --trusted-keys file.
+func loadTrustedKeys() (res []ed25519.PublicKey, err error) {
+	if trustedKeys == "" {
+		return nil, nil
+	}
+	fi, err := os.Open(trustedKeys)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open trusted keys: %v", err)
+	}
+	defer fi.Close()
+	res, err = models.ParseTrustedContentKeys(fi)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid trusted keys file %s: %v", trustedKeys, err)
+	}
+	return
+}
+
+// verifyContent checks the signature of a content bundle before it is
+// sent to the server.  Signed content must always have a valid
+// signature.  When trusted keys are configured, content must also be
+// signed by one of them.
+func verifyContent(layer *models.Content) error {
+	keys, err := loadTrustedKeys()
+	if err != nil {
+		return err
+	}
+	err = layer.VerifySignature(keys)
+	if err == models.ErrContentUnsigned && trustedKeys == "" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Content %s failed verification: %v", layer.Meta.Name, err)
+	}
+	return nil
+}
+
+// bundleCodec returns the codec to use for a content bundle file.
+func bundleCodec(file string) (string, error) {
+	switch path.Ext(file) {
+	case ".yaml", ".yml":
+		return "yaml", nil
+	case ".json":
+		return "json", nil
+	}
+	return "", fmt.Errorf("Unknown store extension %s", path.Ext(file))
+}
+
+func addContentSigningCommands(content *cobra.Command) {
+	content.AddCommand(&cobra.Command{
+		Use:   "keygen [name]",
+		Short: "Generate a key pair for signing content bundles",
+		Long: `Generates an ed25519 key pair for signing content bundles.  The private key is
+written to [name].key and the public key to [name].pub.  Add the public key
+to the --trusted-keys file of anyone who should trust content signed with it.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("%v requires 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			pub, priv, err := models.GenerateContentKey()
+			if err != nil {
+				return fmt.Errorf("Failed to generate key: %v", err)
+			}
+			if err := ioutil.WriteFile(args[0]+".key", []byte(models.EncodeContentKey(priv)+"\n"), 0600); err != nil {
+				return fmt.Errorf("Failed to write private key: %v", err)
+			}
+			pubKey := models.EncodeContentKey(pub)
+			if err := ioutil.WriteFile(args[0]+".pub", []byte(pubKey+" "+path.Base(args[0])+"\n"), 0644); err != nil {
+				return fmt.Errorf("Failed to write public key: %v", err)
+			}
+			fmt.Println(pubKey)
+			return nil
+		},
+	})
+	content.AddCommand(&cobra.Command{
+		Use:   "sign [file] [key file]",
+		Short: "Sign the content bundle [file] with the private key in [key file]",
+		Long: `Signs the content bundle [file] in place.  The signature and the public key
+are saved in the SigningKey and Signature fields of the bundle metadata.
+Changing anything else in the bundle afterwards invalidates the signature.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("%v requires 2 arguments", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			codec, err := bundleCodec(args[0])
+			if err != nil {
+				return err
+			}
+			buf, err := ioutil.ReadFile(args[0])
+			if err != nil {
+				return fmt.Errorf("Failed to read %s: %v", args[0], err)
+			}
+			layer := &models.Content{}
+			if err := api.DecodeYaml(buf, layer); err != nil {
+				return fmt.Errorf("Failed to unmarshal content: %v", err)
+			}
+			keyBuf, err := ioutil.ReadFile(args[1])
+			if err != nil {
+				return fmt.Errorf("Failed to read key: %v", err)
+			}
+			key, err := models.DecodeContentPrivateKey(string(keyBuf))
+			if err != nil {
+				return fmt.Errorf("Invalid key in %s: %v", args[1], err)
+			}
+			if err := layer.Sign(key); err != nil {
+				return fmt.Errorf("Failed to sign content: %v", err)
+			}
+			buf, err = api.Pretty(codec, layer)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(args[0], buf, 0644)
+		},
+	})
+	content.AddCommand(&cobra.Command{
+		Use:   "verify [file]",
+		Short: "Verify the signature of the content bundle [file]",
+		Long: `Checks that the content bundle [file] has not been changed since it was
+signed.  If --trusted-keys is set, the bundle must also have been signed by
+one of the trusted keys.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("%v requires 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			c.SilenceUsage = true
+			layer := &models.Content{}
+			if err := into(args[0], layer); err != nil {
+				return generateError(err, "Error parsing layer")
+			}
+			keys, err := loadTrustedKeys()
+			if err != nil {
+				return err
+			}
+			if err := layer.VerifySignature(keys); err != nil {
+				return fmt.Errorf("Content %s failed verification: %v", layer.Meta.Name, err)
+			}
+			trust := "trusted"
+			if len(keys) == 0 {
+				trust = "unchecked"
+			}
+			fmt.Printf("Content %s signed by %s (%s) verified\n", layer.Meta.Name, layer.Meta.SigningKey, trust)
+			return nil
+		},
+	})
+}
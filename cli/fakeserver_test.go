@@ -0,0 +1,115 @@
+package cli
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/digitalrebar/provision/v4/test/fakeserver"
+)
+
+// TestFakeServerCommands runs drpcli commands against its own fake
+// server, so that they are exercised whether or not dr-provision is
+// installed.
+func TestFakeServerCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cli-fake-")
+	if err != nil {
+		t.Fatalf("ERROR: Unable to make tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	srv, err := fakeserver.New(dir)
+	if err != nil {
+		t.Fatalf("ERROR: Unable to create the fake server: %v", err)
+	}
+	if err := srv.Start("127.0.0.1:0", "127.0.0.1:0"); err != nil {
+		t.Fatalf("ERROR: Unable to start the fake server: %v", err)
+	}
+	defer srv.Close()
+	// Talk to srv directly rather than through the proxy TestMain set
+	// up, and keep cached tokens away from the ones the other tests use.
+	for k, v := range map[string]string{"RS_LOCAL_PROXY": "", "RS_TOKEN_CACHE": path.Join(dir, "tokens")} {
+		if old, ok := os.LookupEnv(k); ok {
+			defer os.Setenv(k, old)
+		} else {
+			defer os.Unsetenv(k)
+		}
+		if v == "" {
+			os.Unsetenv(k)
+		} else {
+			os.Setenv(k, v)
+		}
+	}
+	saved := Session
+	Session = nil
+	defer func() { Session = saved }()
+
+	drpcli := func(args ...string) (string, error) {
+		t.Helper()
+		outName, errName := path.Join(dir, "stdout"), path.Join(dir, "stderr")
+		args = append([]string{"-E", srv.Endpoint(), "-U", fakeserver.DefaultUsername, "-P", fakeserver.DefaultPassword, "-F", "json"}, args...)
+		err := runCliCommand(t, args, "", outName, errName, false)
+		stdout, _ := ioutil.ReadFile(outName)
+		stderr, _ := ioutil.ReadFile(errName)
+		if err != nil {
+			t.Logf("drpcli %s: %s", strings.Join(args[8:], " "), stderr)
+		}
+		return string(stdout), err
+	}
+	must := func(args ...string) string {
+		t.Helper()
+		out, err := drpcli(args...)
+		if err != nil {
+			t.Errorf("ERROR: drpcli %s failed: %v", strings.Join(args, " "), err)
+		}
+		return out
+	}
+
+	info := &models.Info{}
+	if err := json.Unmarshal([]byte(must("info", "get")), info); err != nil || info.Id != "Fred" {
+		t.Errorf("ERROR: Expected info for Fred, got %v (%v)", info, err)
+	}
+	env := &models.BootEnv{}
+	if err := json.Unmarshal([]byte(must("bootenvs", "show", "ignore")), env); err != nil || !env.OnlyUnknown {
+		t.Errorf("ERROR: Expected the ignore bootenv, got %v (%v)", env, err)
+	}
+
+	machine := &models.Machine{}
+	if err := json.Unmarshal([]byte(must("machines", "create", `{"Name":"fake-machine"}`)), machine); err != nil || machine.Uuid == nil {
+		t.Fatalf("ERROR: Expected a created machine, got %v (%v)", machine, err)
+	}
+	if out := must("machines", "show", "Name:fake-machine"); !strings.Contains(out, machine.Uuid.String()) {
+		t.Errorf("ERROR: Expected to show machine %s, got %s", machine.UUID(), out)
+	}
+	must("machines", "set", machine.UUID(), "param", "test/value", "to", "3")
+	if out := must("machines", "get", machine.UUID(), "param", "test/value"); strings.TrimSpace(out) != "3" {
+		t.Errorf("ERROR: Expected test/value to be 3, got %q", out)
+	}
+	must("machines", "destroy", machine.UUID())
+	if _, err := drpcli("machines", "show", machine.UUID()); err == nil {
+		t.Errorf("ERROR: Expected machine %s to be gone", machine.UUID())
+	} else {
+		t.Logf("Got expected error %v", err)
+	}
+
+	src, dst := path.Join(dir, "upload"), path.Join(dir, "download")
+	if err := ioutil.WriteFile(src, []byte("fake file\n"), 0644); err != nil {
+		t.Fatalf("ERROR: Unable to write %s: %v", src, err)
+	}
+	must("files", "upload", src, "as", "test/file")
+	if out := must("files", "list", "test"); !strings.Contains(out, "file") {
+		t.Errorf("ERROR: Expected test/file to be listed, got %s", out)
+	}
+	must("files", "download", "test/file", "to", dst)
+	if buf, err := ioutil.ReadFile(dst); err != nil || string(buf) != "fake file\n" {
+		t.Errorf("ERROR: Expected the uploaded file back, got %q (%v)", buf, err)
+	}
+	must("files", "destroy", "test/file")
+
+	if out := must("contents", "list"); !strings.HasPrefix(strings.TrimSpace(out), "[") {
+		t.Errorf("ERROR: Expected a list of contents, got %s", out)
+	}
+}
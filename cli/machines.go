@@ -5,6 +5,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/digitalrebar/provision/v4/agent"
@@ -31,6 +32,19 @@ func init() {
 	addRegistrar(registerMachine)
 }
 
+// contextExecutor parses an engine=runtime spec from --engine into
+// the Executor for engine.
+func contextExecutor(spec string) (string, agent.Executor, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", nil, fmt.Errorf("Invalid engine %q: must be engine=runtime", spec)
+	}
+	if strings.HasPrefix(parts[1], "rootfs:") {
+		return parts[0], &agent.RootfsExecutor{Dir: strings.TrimPrefix(parts[1], "rootfs:")}, nil
+	}
+	return parts[0], &agent.OCIExecutor{Runtime: parts[1]}, nil
+}
+
 func registerMachine(app *cobra.Command) {
 	op := &ops{
 		name:       "machines",
@@ -375,6 +389,10 @@ pass in more than one task.`,
 	var skipPower = false
 	var runStateLoc string
 	var runContext string
+	var runEngines []string
+	var runStatusSock, runStatusAddr string
+	var runMetricsAddr, runMetricsDir string
+	var runDryRun string
 	processJobs := &cobra.Command{
 		Use:   "processjobs [id]",
 		Short: "For the given machine, process pending jobs until done.",
@@ -383,6 +401,28 @@ For the provided machine, identified by UUID, process the task list on
 that machine until an error occurs or all jobs are complete.  Upon
 completion, optionally wait for additional jobs as specified by
 the stage runner wait flag.
+
+Each --engine engine=runtime has the agent run the tasks for Contexts
+whose Engine is engine itself, instead of waiting for something else
+to.  runtime is either an OCI runtime CLI like podman or docker, which
+runs the tasks in a container made from the Image of the Context, or
+rootfs:dir, which runs them chrooted into the directory dir/Image.
+
+--statusSocket serves a local status API for the agent on a unix
+socket that only root can connect to.  GET /status reports what the
+agent is doing, and POST /pause, /resume, and /cancel control the task
+it is running.  --statusAddr also serves GET /status on a loopback HTTP
+address.
+
+--metricsAddr serves Prometheus metrics for the agent at /metrics, and
+--metricsDir keeps them in drp_agent.prom in a directory for the node
+exporter textfile collector.  If --stateDir is set, the counters are
+kept there so that they survive agent restarts and reboots.
+
+--dryRun dir reports what the agent would do instead of doing it.
+Files are written under dir, scripts are printed instead of run, and
+the reboots, poweroffs, and stage changes the agent would do are
+reported.  The machine is not changed and no jobs are created.
 `,
 		Args: func(c *cobra.Command, args []string) error {
 			if len(args) > 1 {
@@ -417,7 +457,21 @@ the stage runner wait flag.
 			if oneShot {
 				agent = agent.Timeout(time.Second)
 			}
-			return agent.StateLoc(runStateLoc).Context(runContext).Run()
+			for _, spec := range runEngines {
+				engine, executor, err := contextExecutor(spec)
+				if err != nil {
+					return err
+				}
+				agent = agent.Executor(engine, executor)
+			}
+			return agent.StateLoc(runStateLoc).
+				Context(runContext).
+				StatusSocket(runStatusSock).
+				StatusAddr(runStatusAddr).
+				MetricsAddr(runMetricsAddr).
+				MetricsTextfile(runMetricsDir).
+				DryRun(runDryRun).
+				Run()
 		},
 	}
 	processJobs.Flags().BoolVar(&exitOnFailure, "exit-on-failure", false, "Exit on failure of a task")
@@ -425,6 +479,12 @@ the stage runner wait flag.
 	processJobs.Flags().BoolVar(&skipPower, "skipPower", false, "Skip any power cycle actions")
 	processJobs.Flags().StringVar(&runStateLoc, "stateDir", "", "Location to save agent runtime state")
 	processJobs.Flags().StringVar(&runContext, "context", "", "Execution context this agent should pay attention to jobs in")
+	processJobs.Flags().StringArrayVar(&runEngines, "engine", []string{}, "Run tasks for contexts with this engine locally, as engine=runtime")
+	processJobs.Flags().StringVar(&runStatusSock, "statusSocket", "", "Unix socket to serve the agent status API on")
+	processJobs.Flags().StringVar(&runStatusAddr, "statusAddr", "", "Loopback address to serve the read-only agent status on over HTTP")
+	processJobs.Flags().StringVar(&runMetricsAddr, "metricsAddr", "", "Address to serve Prometheus metrics on")
+	processJobs.Flags().StringVar(&runMetricsDir, "metricsDir", "", "Directory to write Prometheus metrics to for the node exporter textfile collector")
+	processJobs.Flags().StringVar(&runDryRun, "dryRun", "", "Report what the agent would do, writing files to this directory instead")
 	op.addCommand(processJobs)
 	var tokenDuration = ""
 	tokenFetch := &cobra.Command{
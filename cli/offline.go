@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"os"
+
+	"github.com/digitalrebar/provision/v4/api"
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/digitalrebar/provision/v4/store"
+	"github.com/spf13/cobra"
+)
+
+// contentModels loads the objects with the passed-in prefixes from a
+// content bundle, which can be either a bundle file or a content
+// directory.
+func contentModels(src string, prefixes []string) ([]models.Model, error) {
+	content := &models.Content{}
+	if fi, err := os.Stat(src); err == nil && fi.IsDir() {
+		mem, _ := store.Open("memory:///")
+		defer mem.Close()
+		if err := api.DisconnectedClient().BundleContent(src, mem, map[string]string{}); err != nil {
+			return nil, err
+		}
+		if err := content.FromStore(mem); err != nil {
+			return nil, err
+		}
+	} else if err := into(src, content); err != nil {
+		return nil, err
+	}
+	res := []models.Model{}
+	for _, prefix := range prefixes {
+		for _, item := range content.Sections[prefix] {
+			obj, err := models.New(prefix)
+			if err != nil {
+				return nil, err
+			}
+			if err := models.Remarshal(item, obj); err != nil {
+				return nil, err
+			}
+			obj.Fill()
+			res = append(res, obj)
+		}
+	}
+	return res, nil
+}
+
+// serverModels fetches the objects with the passed-in prefixes from
+// the server.  The commands that use it do not always need a server,
+// so it creates the session itself.
+func serverModels(c *cobra.Command, args []string, prefixes []string) ([]models.Model, error) {
+	if err := ppr(c, args); err != nil {
+		return nil, err
+	}
+	res := []models.Model{}
+	for _, prefix := range prefixes {
+		objs, err := Session.ListModel(prefix)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, objs...)
+	}
+	return res, nil
+}
+
+// loadModels loads the objects to check and the objects to resolve
+// references with.  With no args, both come from the server.  With a
+// content bundle or directory in args, the objects to check come from
+// it, and references are also resolved against the server if
+// withServer is set.
+func loadModels(c *cobra.Command, args []string, prefixes []string, withServer bool) (objs, refs []models.Model, err error) {
+	if len(args) == 0 {
+		if objs, err = serverModels(c, args, prefixes); err != nil {
+			err = generateError(err, "Failed to fetch objects")
+			return
+		}
+		refs = objs
+		return
+	}
+	if objs, err = contentModels(args[0], prefixes); err != nil {
+		err = generateError(err, "Failed to load content")
+		return
+	}
+	refs = objs
+	if withServer {
+		var live []models.Model
+		if live, err = serverModels(c, args, prefixes); err != nil {
+			err = generateError(err, "Failed to fetch objects")
+			return
+		}
+		// Objects in the content bundle override those on the server.
+		refs = append(live, objs...)
+	}
+	return
+}
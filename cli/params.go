@@ -1,6 +1,8 @@
 package cli
 
 import (
+	"fmt"
+
 	"github.com/digitalrebar/provision/v4/models"
 	"github.com/spf13/cobra"
 )
@@ -9,11 +11,63 @@ func init() {
 	addRegistrar(registerParam)
 }
 
+// paramCheckPrefixes are the object types that either have params to
+// check or are needed to check them.
+var paramCheckPrefixes = []string{
+	"params",
+	"profiles",
+	"stages",
+	"tasks",
+	"bootenvs",
+	"plugin_providers",
+	"machines",
+	"plugins",
+}
+
 func registerParam(app *cobra.Command) {
 	op := &ops{
 		name:       "params",
 		singleName: "param",
 		example:    func() models.Model { return &models.Param{} },
 	}
+	withServer := false
+	validate := &cobra.Command{
+		Use:   "validate [content]",
+		Short: "Validate params against their Param schemas",
+		Long: `Checks the params set on machines, profiles, stages, and plugins against
+the schemas of their Param definitions, checks that the params required by
+tasks, stages, bootenvs, and plugin providers are set on machines and plugins,
+and reports params that have no Param definition.
+
+With no arguments, the objects on the server are checked.  If [content] is
+passed, the objects in that content bundle or content directory are checked
+instead.  Pass --with-server to also use the objects on the server to
+resolve references from the content bundle.
+
+The problems found are printed, and the command fails if there are any.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("%v accepts at most 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			c.SilenceUsage = true
+			objs, refs, err := loadModels(c, args, paramCheckPrefixes, withServer)
+			if err != nil {
+				return err
+			}
+			issues := models.NewParamChecker(refs...).CheckAll(objs...)
+			if err := prettyPrint(issues); err != nil {
+				return err
+			}
+			if len(issues) > 0 {
+				return fmt.Errorf("Found %d param problems", len(issues))
+			}
+			return nil
+		},
+	}
+	validate.Flags().BoolVar(&withServer, "with-server", false, "Use objects on the server to resolve references from [content]")
+	op.addCommand(validate)
 	op.command(app)
 }
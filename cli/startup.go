@@ -42,6 +42,8 @@ var (
 	truncateLength        = 40
 	noHeader              = false
 	defaultNoHeader       = false
+	trustedKeys           = ""
+	defaultTrustedKeys    = ""
 	// Session is the global client access session
 	Session         *api.Client
 	noToken         = false
@@ -154,6 +156,9 @@ func NewApp() *cobra.Command {
 	if tk := os.Getenv("RS_PRINT_FIELDS"); tk != "" {
 		defaultPrintFields = tk
 	}
+	if tk := os.Getenv("RS_TRUSTED_KEYS"); tk != "" {
+		defaultTrustedKeys = tk
+	}
 	if tk := os.Getenv("RS_DOWNLOAD_PROXY"); tk != "" {
 		defaultDownloadProxy = tk
 	}
@@ -208,6 +213,8 @@ func NewApp() *cobra.Command {
 				defaultUrlProxy = parts[1]
 			case "RS_DOWNLOAD_PROXY":
 				defaultDownloadProxy = parts[1]
+			case "RS_TRUSTED_KEYS":
+				defaultTrustedKeys = parts[1]
 			case "RS_FORMAT":
 				defaultFormat = parts[1]
 			case "RS_PRINT_FIELDS":
@@ -276,6 +283,9 @@ func NewApp() *cobra.Command {
 	app.PersistentFlags().StringVarP(&downloadProxy,
 		"download-proxy", "D", defaultDownloadProxy,
 		"HTTP Proxy to use for downloading catalog and content")
+	app.PersistentFlags().StringVar(&trustedKeys,
+		"trusted-keys", defaultTrustedKeys,
+		"File of public keys trusted to sign content bundles.  If set, content must be signed by one of them to be uploaded")
 	app.PersistentFlags().BoolVarP(&noToken,
 		"noToken", "x", noToken,
 		"Do not use token auth or token cache")
@@ -315,7 +325,26 @@ func NewApp() *cobra.Command {
 			for _, sc := range c.Commands() {
 				if !strings.HasPrefix(sc.Use, "bundle") &&
 					!strings.HasPrefix(sc.Use, "unbundle") &&
-					!strings.HasPrefix(sc.Use, "document") {
+					!strings.HasPrefix(sc.Use, "document") &&
+					!strings.HasPrefix(sc.Use, "lint") &&
+					!strings.HasPrefix(sc.Use, "changelog") &&
+					!strings.HasPrefix(sc.Use, "new") &&
+					!strings.HasPrefix(sc.Use, "keygen") &&
+					!strings.HasPrefix(sc.Use, "sign") &&
+					!strings.HasPrefix(sc.Use, "verify") {
+					sc.PersistentPreRunE = ppr
+				}
+			}
+		case "params":
+			for _, sc := range c.Commands() {
+				if !strings.HasPrefix(sc.Use, "validate") {
+					sc.PersistentPreRunE = ppr
+				}
+			}
+		case "templates":
+			for _, sc := range c.Commands() {
+				if !strings.HasPrefix(sc.Use, "analyze") &&
+					!strings.HasPrefix(sc.Use, "render") {
 					sc.PersistentPreRunE = ppr
 				}
 			}
@@ -2,8 +2,13 @@ package cli
 
 import (
 	"fmt"
+	"net"
+	"net/url"
+	"strings"
 
 	"github.com/digitalrebar/provision/v4/models"
+	"github.com/digitalrebar/provision/v4/render"
+	"github.com/pborman/uuid"
 	"github.com/spf13/cobra"
 )
 
@@ -34,5 +39,140 @@ func registerTemplate(app *cobra.Command) {
 			return prettyPrint(tmpl)
 		},
 	})
+	withServer := false
+	analyze := &cobra.Command{
+		Use:   "analyze [content]",
+		Short: "Report the params used by task, stage, and bootenv templates",
+		Long: `Finds every param that the templates of each task, stage, and bootenv refer
+to with .Param, .ParamExists, and the rest of the Param family of render
+functions, following {{template}} and .CallTemplate into other templates.
+For each of them, it reports:
+
+* Undeclared params, which are used but not in RequiredParams or OptionalParams
+* Unused params, which are in RequiredParams or OptionalParams but not used
+* Undefined params, which are used or declared but have no Param definition
+
+Only params named with a constant string can be found.
+
+With no arguments, the objects on the server are analyzed.  If [content] is
+passed, the objects in that content bundle or content directory are analyzed
+instead.  Pass --with-server to also use the templates and params on the
+server to resolve references from the content bundle.
+
+The command fails if any problems are found.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("%v accepts at most 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			c.SilenceUsage = true
+			objs, refs, err := loadModels(c, args, []string{"templates", "params", "tasks", "stages", "bootenvs"}, withServer)
+			if err != nil {
+				return err
+			}
+			reports := models.NewTemplateAnalyzer(refs...).AnalyzeAll(objs...)
+			if err := prettyPrint(reports); err != nil {
+				return err
+			}
+			problems := 0
+			for _, r := range reports {
+				if r.HasProblems() {
+					problems++
+				}
+			}
+			if problems > 0 {
+				return fmt.Errorf("Found problems with %d objects", problems)
+			}
+			return nil
+		},
+	}
+	analyze.Flags().BoolVar(&withServer, "with-server", false, "Use objects on the server to resolve references from [content]")
+	op.addCommand(analyze)
+	provisionerURL := ""
+	apiURL := ""
+	renderCmd := &cobra.Command{
+		Use:   "render [content] [machine] [target]",
+		Short: "Render the templates of a task, stage, or bootenv for a machine without a server",
+		Long: `Renders the templates of [target] the same way dr-provision would for
+[machine], and prints the resulting job actions as the agent would receive
+them.
+
+[content] is a content bundle or content directory that provides the
+templates, params, profiles, stages, tasks, and bootenvs.  Pass --with-server
+to also look up objects on the server.
+
+[machine] is a machine object, either as a file or as JSON or YAML.  Its
+Params, Profiles, BootEnv, and Stage are used to look up params just like
+the server would.
+
+[target] is the name of a task, or one of tasks:name, stages:name, or
+bootenvs:name.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 3 {
+				return fmt.Errorf("%v requires 3 arguments", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			c.SilenceUsage = true
+			m := &models.Machine{}
+			if err := into(args[1], m); err != nil {
+				return generateError(err, "Failed to load machine")
+			}
+			m.Fill()
+			if m.Uuid == nil {
+				m.Uuid = uuid.NewRandom()
+			}
+			_, refs, err := loadModels(c, args[:1], []string{"templates", "params", "profiles", "stages", "tasks", "bootenvs"}, withServer)
+			if err != nil {
+				return err
+			}
+			prefix, name := "tasks", args[2]
+			if parts := strings.SplitN(args[2], ":", 2); len(parts) == 2 {
+				prefix, name = parts[0], parts[1]
+			}
+			src := render.NewObjects(refs...)
+			target := src.Find(prefix, name)
+			if target == nil {
+				return fmt.Errorf("%s:%s does not exist", prefix, name)
+			}
+			pURL, err := url.Parse(provisionerURL)
+			if err != nil {
+				return generateError(err, "Invalid provisioner URL")
+			}
+			info := &models.Info{Id: "offline", Version: version, Address: net.ParseIP(pURL.Hostname())}
+			info.Fill()
+			r := &render.Renderer{
+				Source:             src,
+				Info:               info,
+				ProvisionerAddress: pURL.Hostname(),
+				ProvisionerURL:     provisionerURL,
+				ApiURL:             apiURL,
+			}
+			var actions models.JobActions
+			var rerr *models.Error
+			switch t := target.(type) {
+			case *models.Task:
+				actions, rerr = r.RenderTask(m, t)
+			case *models.Stage:
+				actions, rerr = r.RenderStage(m, t)
+			case *models.BootEnv:
+				actions, rerr = r.RenderBootEnv(m, t)
+			default:
+				return fmt.Errorf("Cannot render %s", prefix)
+			}
+			if rerr != nil {
+				rerr.Model, rerr.Key = prefix, name
+				return generateError(rerr, "Failed to render")
+			}
+			return prettyPrint(actions)
+		},
+	}
+	renderCmd.Flags().StringVar(&provisionerURL, "provisioner-url", "http://127.0.0.1:8091", "The URL of the static file server to render with")
+	renderCmd.Flags().StringVar(&apiURL, "api-url", "https://127.0.0.1:8092", "The URL of the API to render with")
+	renderCmd.Flags().BoolVar(&withServer, "with-server", false, "Also look up objects on the server")
+	op.addCommand(renderCmd)
 	op.command(app)
 }
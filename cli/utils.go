@@ -243,7 +243,11 @@ func urlOrFileAsReadCloser(src string) (io.ReadCloser, error) {
 		}
 		return res.Body, nil
 	} else if err == nil && u.Scheme == "file" {
-		return nil, fmt.Errorf("file:// scheme not supported")
+		fi, err := os.Open(u.Path)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening %s: %v", src, err)
+		}
+		return fi, nil
 	}
 	return nil, fmt.Errorf("Must specify a file or url")
 }
@@ -279,7 +283,7 @@ func bufOrFile(src string) ([]byte, error) {
 		body, err := ioutil.ReadAll(res.Body)
 		return []byte(body), err
 	} else if err == nil && u.Scheme == "file" {
-		return nil, fmt.Errorf("file:// scheme not supported")
+		return ioutil.ReadFile(u.Path)
 	}
 	return []byte(src), nil
 }
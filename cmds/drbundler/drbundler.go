@@ -60,22 +60,14 @@ func main() {
 		cleanUp(filename, fmt.Sprintf("Unknown extension: %s\n", ext))
 	}
 
-	if dst, err := store.Open(fmt.Sprintf("file:%s.tmp?codec=%s", filename, codec)); err != nil {
-		cleanUp(filename, fmt.Sprintf("Failed to open store: %v\n", err))
-	} else {
-		client := api.DisconnectedClient()
-		if err := client.BundleContent(directory, dst, map[string]string{}); err != nil {
-			cleanUp(filename, fmt.Sprintf("Failed to load: %v\n", err))
-		}
-		dst.Close()
+	storeCodec := store.Codec(store.YamlCodec)
+	if codec == "json" {
+		storeCodec = store.JsonCodec
 	}
-
-	if contents, err := ioutil.ReadFile(filename + ".tmp"); err != nil {
-		cleanUp(filename, fmt.Sprintf("Failed to readfile: %v\n", err))
-	} else {
-		if err := outputBuffer(filename, contents); err != nil {
-			cleanUp(filename, fmt.Sprintf("Failed to write file: %v\n", err))
-		}
+	client := api.DisconnectedClient()
+	if contents, err := client.BundleContentBytes(directory, map[string]string{}, storeCodec); err != nil {
+		cleanUp(filename, fmt.Sprintf("Failed to load: %v\n", err))
+	} else if err := outputBuffer(filename, contents); err != nil {
+		cleanUp(filename, fmt.Sprintf("Failed to write file: %v\n", err))
 	}
-	os.Remove(filename + ".tmp")
 }
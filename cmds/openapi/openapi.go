@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+
+	"github.com/digitalrebar/logger"
+	v4 "github.com/digitalrebar/provision/v4"
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/ghodss/yaml"
+)
+
+// Parameter is an OpenAPI 3 parameter object.
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// MediaType is an OpenAPI 3 media type object.
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Header is an OpenAPI 3 header object.
+type Header struct {
+	Description string  `json:"description,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// RequestBody is an OpenAPI 3 request body object.
+type RequestBody struct {
+	Required bool                  `json:"required,omitempty"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+// Response is an OpenAPI 3 response object.
+type Response struct {
+	Description string                `json:"description"`
+	Headers     map[string]*Header    `json:"headers,omitempty"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+// Operation is an OpenAPI 3 operation object.
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Summary     string               `json:"summary,omitempty"`
+	Tags        []string             `json:"tags,omitempty"`
+	Parameters  []*Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+// PathItem maps HTTP methods to operations for a single path.
+type PathItem map[string]*Operation
+
+// Document is the top level OpenAPI 3 document.
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       map[string]string   `json:"info"`
+	Servers    []map[string]string `json:"servers"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components struct {
+		Schemas         map[string]*Schema           `json:"schemas"`
+		SecuritySchemes map[string]map[string]string `json:"securitySchemes"`
+	} `json:"components"`
+	GlobalSecurity []map[string][]string `json:"security"`
+}
+
+func jsonBody(s *Schema) map[string]*MediaType {
+	return map[string]*MediaType{"application/json": {Schema: s}}
+}
+
+func binaryBody() map[string]*MediaType {
+	return map[string]*MediaType{"application/octet-stream": {Schema: &Schema{Type: "string", Format: "binary"}}}
+}
+
+func arrayOf(s *Schema) *Schema {
+	return &Schema{Type: "array", Items: s}
+}
+
+func pathParam(name, desc string) *Parameter {
+	return &Parameter{Name: name, In: "path", Description: desc, Required: true, Schema: &Schema{Type: "string"}}
+}
+
+func queryParam(name, typ, desc string) *Parameter {
+	return &Parameter{Name: name, In: "query", Description: desc, Schema: &Schema{Type: typ}}
+}
+
+// builder accumulates the paths of the document.
+type builder struct {
+	gen   *generator
+	doc   *Document
+	error *Schema
+}
+
+// op adds an operation to the document.  Every operation can fail
+// with the standard models.Error response.
+func (b *builder) op(p, method, id, summary, tag string, params []*Parameter, body *RequestBody, responses map[string]*Response) {
+	item, ok := b.doc.Paths[p]
+	if !ok {
+		item = PathItem{}
+		b.doc.Paths[p] = item
+	}
+	if responses == nil {
+		responses = map[string]*Response{}
+	}
+	responses["default"] = &Response{Description: "Error", Content: jsonBody(b.error)}
+	item[method] = &Operation{
+		OperationID: id,
+		Summary:     summary,
+		Tags:        []string{tag},
+		Parameters:  params,
+		RequestBody: body,
+		Responses:   responses,
+	}
+}
+
+func ok(desc string, s *Schema) map[string]*Response {
+	return map[string]*Response{"200": {Description: desc, Content: jsonBody(s)}}
+}
+
+// listParams returns the query parameters the list operation for m
+// accepts.  Every top level scalar field can be used as a filter.
+func (b *builder) listParams(m models.Model) []*Parameter {
+	res := []*Parameter{
+		queryParam("offset", "integer", "Number of objects to skip"),
+		queryParam("limit", "integer", "Maximum number of objects to return"),
+		queryParam("sort", "string", "Field to sort the results by"),
+		queryParam("reverse", "boolean", "Reverse the sort order"),
+		queryParam("slim", "string", "Comma separated list of Meta, Params to leave out of the results"),
+		queryParam("params", "string", "Comma separated list of params to return"),
+		queryParam("aggregate", "boolean", "Include params from profiles and the global profile"),
+	}
+	schema := b.gen.schemas[b.gen.name(reflect.TypeOf(m).Elem())]
+	names := []string{}
+	for name, prop := range schema.Properties {
+		switch prop.Type {
+		case "string", "integer", "number", "boolean":
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		res = append(res, queryParam(name, "string",
+			fmt.Sprintf("Filter on %s.  Takes a value or one of Eq, Ne, Lt, Lte, Gt, Gte, Re, In, Nin, Between, Except applied to a value, e.g. Eq(foo)", name)))
+	}
+	return res
+}
+
+// addModel adds the CRUD routes for a single model type.
+func (b *builder) addModel(m models.Model) {
+	prefix := m.Prefix()
+	typeName := reflect.TypeOf(m).Elem().Name()
+	ref := b.gen.ref(reflect.TypeOf(m).Elem())
+	key := pathParam(m.KeyName(), fmt.Sprintf("The %s of the %s.  Any unique index can be used in the form Index:value", m.KeyName(), typeName))
+	coll := "/" + prefix
+	item := coll + "/{" + m.KeyName() + "}"
+	patch := &RequestBody{Required: true, Content: map[string]*MediaType{
+		"application/json":       {Schema: arrayOf(b.gen.ref(reflect.TypeOf(PatchOperation{})))},
+		"application/json-patch": {Schema: arrayOf(b.gen.ref(reflect.TypeOf(PatchOperation{})))},
+	}}
+	force := queryParam("force", "boolean", "Force the change even if it would otherwise be refused")
+
+	b.op(coll, "get", "list"+typeName, "List "+prefix, prefix, b.listParams(m), nil,
+		map[string]*Response{"200": {
+			Description: "A list of " + prefix,
+			Headers:     map[string]*Header{"X-DRP-LIST-COUNT": {Description: "Number of objects matched", Schema: &Schema{Type: "integer"}}},
+			Content:     jsonBody(arrayOf(ref)),
+		}})
+	b.op(coll, "head", "stats"+typeName, "Count "+prefix, prefix, b.listParams(m), nil,
+		map[string]*Response{"200": {
+			Description: "The number of matching " + prefix,
+			Headers:     map[string]*Header{"X-DRP-LIST-COUNT": {Description: "Number of objects matched", Schema: &Schema{Type: "integer"}}},
+		}})
+	b.op(coll, "post", "create"+typeName, "Create a "+typeName, prefix, nil,
+		&RequestBody{Required: true, Content: jsonBody(ref)},
+		map[string]*Response{"201": {Description: "The created " + typeName, Content: jsonBody(ref)}})
+	b.op(item, "get", "get"+typeName, "Get a "+typeName, prefix, []*Parameter{key}, nil, ok("The "+typeName, ref))
+	b.op(item, "head", "exists"+typeName, "Test whether a "+typeName+" exists", prefix, []*Parameter{key}, nil,
+		map[string]*Response{"200": {Description: "The " + typeName + " exists"}})
+	b.op(item, "put", "put"+typeName, "Replace a "+typeName, prefix, []*Parameter{key, force},
+		&RequestBody{Required: true, Content: jsonBody(ref)}, ok("The updated "+typeName, ref))
+	b.op(item, "patch", "patch"+typeName, "Patch a "+typeName, prefix, []*Parameter{key, force}, patch, ok("The updated "+typeName, ref))
+	b.op(item, "delete", "delete"+typeName, "Delete a "+typeName, prefix, []*Parameter{key}, nil, ok("The deleted "+typeName, ref))
+
+	if _, isParamer := m.(models.Paramer); isParamer {
+		params := item + "/params"
+		anyMap := &Schema{Type: "object", AdditionalProperties: &Schema{}}
+		agg := queryParam("aggregate", "boolean", "Include params from profiles and the global profile")
+		b.op(params, "get", "get"+typeName+"Params", "Get the params of a "+typeName, prefix, []*Parameter{key, agg}, nil, ok("The params", anyMap))
+		b.op(params, "post", "set"+typeName+"Params", "Replace the params of a "+typeName, prefix, []*Parameter{key},
+			&RequestBody{Required: true, Content: jsonBody(anyMap)}, ok("The params", anyMap))
+		b.op(params, "patch", "patch"+typeName+"Params", "Patch the params of a "+typeName, prefix, []*Parameter{key}, patch, ok("The params", anyMap))
+		param := params + "/{param}"
+		pp := pathParam("param", "The name of the param")
+		b.op(param, "get", "get"+typeName+"Param", "Get a single param of a "+typeName, prefix, []*Parameter{key, pp, agg}, nil, ok("The param value", &Schema{}))
+		b.op(param, "post", "set"+typeName+"Param", "Set a single param of a "+typeName, prefix, []*Parameter{key, pp},
+			&RequestBody{Required: true, Content: jsonBody(&Schema{})}, ok("The param value", &Schema{}))
+		b.op(param, "delete", "delete"+typeName+"Param", "Remove a single param from a "+typeName, prefix, []*Parameter{key, pp}, nil, ok("The removed param value", &Schema{}))
+	}
+
+	if a, isActor := m.(models.Actor); isActor && a.CanHaveActions() {
+		action := b.gen.ref(reflect.TypeOf(models.AvailableAction{}))
+		actions := item + "/actions"
+		b.op(actions, "get", "list"+typeName+"Actions", "List the plugin actions available on a "+typeName, prefix, []*Parameter{key}, nil,
+			ok("The available actions", arrayOf(action)))
+		cmd := pathParam("cmd", "The name of the action")
+		b.op(actions+"/{cmd}", "get", "get"+typeName+"Action", "Get a plugin action available on a "+typeName, prefix, []*Parameter{key, cmd}, nil,
+			ok("The action", action))
+		b.op(actions+"/{cmd}", "post", "run"+typeName+"Action", "Run a plugin action on a "+typeName, prefix, []*Parameter{key, cmd},
+			&RequestBody{Content: jsonBody(&Schema{Type: "object", AdditionalProperties: &Schema{}})}, ok("The result of the action", &Schema{}))
+	}
+}
+
+// PatchOperation describes a single RFC 6902 JSON Patch operation.
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// addMisc adds the routes that are not tied to a single model.
+func (b *builder) addMisc() {
+	ref := func(i interface{}) *Schema { return b.gen.ref(reflect.TypeOf(i)) }
+	strs := arrayOf(&Schema{Type: "string"})
+	b.op("/info", "get", "getInfo", "Get information about the server", "info", nil, nil, ok("Server information", ref(models.Info{})))
+	b.op("/objects", "get", "listObjects", "List the object types the server manages", "objects", nil, nil, ok("Object prefixes", strs))
+	b.op("/logs", "get", "getLogs", "Get the recent server log lines", "logs", nil, nil, ok("Log lines", arrayOf(ref(logger.Line{}))))
+	b.op("/events", "post", "postEvent", "Post an event to the event bus", "events", nil,
+		&RequestBody{Required: true, Content: jsonBody(ref(models.Event{}))}, map[string]*Response{"204": {Description: "The event was posted"}})
+
+	idx := ref(models.Index{})
+	prefix := pathParam("prefix", "The object type")
+	b.op("/indexes", "get", "listIndexes", "List the indexes of every object type", "indexes", nil, nil,
+		ok("Indexes by object type", &Schema{Type: "object", AdditionalProperties: &Schema{Type: "object", AdditionalProperties: idx}}))
+	b.op("/indexes/{prefix}", "get", "getIndexes", "List the indexes of an object type", "indexes", []*Parameter{prefix}, nil,
+		ok("Indexes by field", &Schema{Type: "object", AdditionalProperties: idx}))
+	b.op("/indexes/{prefix}/{param}", "get", "getIndex", "Get a single index", "indexes",
+		[]*Parameter{prefix, pathParam("param", "The indexed field")}, nil, ok("The index", idx))
+
+	// The path of a file can contain slashes, which OpenAPI 3 path
+	// parameters cannot match.  The routes are described with a single
+	// {path} parameter, and clients have to send the slashes as is
+	// rather than percent encoding them.
+	for _, at := range []string{"files", "isos"} {
+		name := pathParam("path", "The path of the "+at[:len(at)-1]+
+			", which may contain slashes.  Send the slashes as is; they must not be percent encoded")
+		blob := "/" + at + "/{path}"
+		b.op("/"+at, "get", "list"+at, "List "+at, at, []*Parameter{queryParam("path", "string", "The directory to list")}, nil, ok("The names", strs))
+		b.op(blob, "get", "get"+at, "Download a "+at[:len(at)-1], at, []*Parameter{name}, nil,
+			map[string]*Response{"200": {
+				Description: "The contents",
+				Headers:     map[string]*Header{"X-DRP-SHA256SUM": {Description: "The SHA256 sum of the contents", Schema: &Schema{Type: "string"}}},
+				Content:     binaryBody(),
+			}})
+		b.op(blob, "head", "stat"+at, "Get the checksum of a "+at[:len(at)-1], at, []*Parameter{name}, nil,
+			map[string]*Response{"200": {
+				Description: "The file exists",
+				Headers:     map[string]*Header{"X-DRP-SHA256SUM": {Description: "The SHA256 sum of the contents", Schema: &Schema{Type: "string"}}},
+			}})
+		b.op(blob, "post", "upload"+at, "Upload a "+at[:len(at)-1], at,
+			[]*Parameter{name, queryParam("explode", "boolean", "Unpack the uploaded archive")},
+			&RequestBody{Required: true, Content: binaryBody()},
+			map[string]*Response{"201": {Description: "The uploaded file", Content: jsonBody(ref(models.BlobInfo{}))}})
+		b.op(blob, "delete", "delete"+at, "Delete a "+at[:len(at)-1], at, []*Parameter{name}, nil,
+			map[string]*Response{"204": {Description: "The file was deleted"}})
+	}
+
+	content := ref(models.Content{})
+	summary := ref(models.ContentSummary{})
+	cname := pathParam("name", "The name of the content bundle")
+	replace := queryParam("replaceWritable", "boolean", "Replace writable objects that conflict with the content bundle")
+	b.op("/contents", "get", "listContents", "List the installed content bundles", "contents", nil, nil, ok("Content summaries", arrayOf(summary)))
+	b.op("/contents", "post", "createContent", "Install a content bundle", "contents", []*Parameter{replace},
+		&RequestBody{Required: true, Content: jsonBody(content)},
+		map[string]*Response{"201": {Description: "The installed content", Content: jsonBody(summary)}})
+	b.op("/contents/{name}", "get", "getContent", "Get a content bundle", "contents", []*Parameter{cname}, nil, ok("The content bundle", content))
+	b.op("/contents/{name}", "put", "replaceContent", "Replace a content bundle", "contents", []*Parameter{cname, replace},
+		&RequestBody{Required: true, Content: jsonBody(content)}, ok("The installed content", summary))
+	b.op("/contents/{name}", "delete", "deleteContent", "Remove a content bundle", "contents", []*Parameter{cname}, nil,
+		map[string]*Response{"204": {Description: "The content bundle was removed"}})
+
+	user := pathParam("name", "The name of the user")
+	b.op("/users/{name}/token", "get", "getUserToken", "Get an authentication token for a user", "users",
+		[]*Parameter{user,
+			queryParam("ttl", "integer", "Lifetime of the token in seconds"),
+			queryParam("roles", "string", "Comma separated list of roles to restrict the token to"),
+		}, nil, ok("The token", ref(models.UserToken{})))
+	b.op("/users/{name}/password", "put", "putUserPassword", "Set the password of a user", "users", []*Parameter{user},
+		&RequestBody{Required: true, Content: jsonBody(ref(models.UserPassword{}))}, ok("The user", ref(models.User{})))
+
+	job := pathParam("Uuid", "The UUID of the job")
+	b.op("/jobs/{Uuid}/actions", "get", "getJobActions", "Get the rendered actions of a job", "jobs",
+		[]*Parameter{job, queryParam("os", "string", "Only return actions for this OS")}, nil, ok("The job actions", b.gen.schema(reflect.TypeOf(models.JobActions{}))))
+	b.op("/jobs/{Uuid}/log", "get", "getJobLog", "Get the log of a job", "jobs", []*Parameter{job}, nil,
+		map[string]*Response{"200": {Description: "The job log", Content: binaryBody()}})
+	b.op("/jobs/{Uuid}/log", "put", "putJobLog", "Append to the log of a job", "jobs", []*Parameter{job},
+		&RequestBody{Required: true, Content: binaryBody()}, map[string]*Response{"204": {Description: "The log was appended"}})
+}
+
+// Build generates the OpenAPI document for the models in models.All()
+// using the doc comments from the models source in modelsDir.
+func Build(modelsDir string) (*Document, error) {
+	d, err := loadDocs(modelsDir)
+	if err != nil {
+		return nil, err
+	}
+	doc := &Document{
+		OpenAPI: "3.0.3",
+		Info: map[string]string{
+			"title":       "Digital Rebar Provision API",
+			"description": "The REST API of dr-provision, generated from the models package.",
+			"version":     v4.RSVersion,
+		},
+		Servers: []map[string]string{{"url": "https://127.0.0.1:8092/api/v3"}},
+		Paths:   map[string]PathItem{},
+	}
+	doc.Components.SecuritySchemes = map[string]map[string]string{
+		"basicAuth":  {"type": "http", "scheme": "basic"},
+		"bearerAuth": {"type": "http", "scheme": "bearer"},
+	}
+	doc.GlobalSecurity = []map[string][]string{{"basicAuth": {}}, {"bearerAuth": {}}}
+	gen := newGenerator(d)
+	b := &builder{gen: gen, doc: doc, error: gen.ref(reflect.TypeOf(models.Error{}))}
+	for _, m := range models.All() {
+		b.addModel(m)
+	}
+	b.addMisc()
+	doc.Components.Schemas = gen.schemas
+	return doc, nil
+}
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprintf(os.Stderr, "Usage: %s <models source dir> <output file>\n", os.Args[0])
+		os.Exit(1)
+	}
+	doc, err := Build(os.Args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read models: %v\n", err)
+		os.Exit(1)
+	}
+	buf, err := json.MarshalIndent(doc, "", "  ")
+	if err == nil {
+		switch path.Ext(os.Args[2]) {
+		case ".json":
+		case ".yaml", ".yml":
+			buf, err = yaml.JSONToYAML(buf)
+		default:
+			err = fmt.Errorf("Unknown extension: %s", path.Ext(os.Args[2]))
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate spec: %v\n", err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(os.Args[2], buf, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write file: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+// Info has the same name as models.Info.
+type Info struct {
+	Local string
+}
+
+// refs collects every $ref in a decoded JSON document.
+func refs(v interface{}, res map[string]bool) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, sub := range val {
+			if s, ok := sub.(string); ok && k == "$ref" {
+				res[s] = true
+				continue
+			}
+			refs(sub, res)
+		}
+	case []interface{}:
+		for _, sub := range val {
+			refs(sub, res)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	doc, err := Build("../../models")
+	if err != nil {
+		t.Fatalf("ERROR: Failed to build the spec: %v", err)
+	}
+	buf, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("ERROR: Failed to marshal the spec: %v", err)
+	}
+	var raw interface{}
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		t.Fatalf("ERROR: Failed to unmarshal the spec: %v", err)
+	}
+	found := map[string]bool{}
+	refs(raw, found)
+	if len(found) == 0 {
+		t.Errorf("ERROR: Expected the spec to have references")
+	}
+	for ref := range found {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		if name == ref {
+			t.Errorf("ERROR: Reference %s is not to a component schema", ref)
+		} else if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("ERROR: Reference %s does not resolve", ref)
+		}
+	}
+	if s := doc.Components.Schemas["Machine"]; s == nil || s.Description == "" || s.Properties["Uuid"] == nil {
+		t.Errorf("ERROR: Expected a documented Machine schema, got %v", s)
+	}
+	if item := doc.Paths["/machines/{Uuid}"]; item["get"] == nil || item["patch"] == nil {
+		t.Errorf("ERROR: Expected machine routes, got %v", item)
+	}
+}
+
+func TestSchemaNames(t *testing.T) {
+	gen := newGenerator(docs{"Info": {Description: "models info"}})
+	// The local type comes first, and must still not take the bare name.
+	li := gen.ref(reflect.TypeOf(Info{}))
+	mi := gen.ref(reflect.TypeOf(models.Info{}))
+	if mi.Ref == li.Ref {
+		t.Errorf("ERROR: Types with the same name share the reference %s", mi.Ref)
+	}
+	localName := path.Base(reflect.TypeOf(Info{}).PkgPath()) + ".Info"
+	if mi.Ref != "#/components/schemas/Info" || li.Ref != "#/components/schemas/"+localName {
+		t.Errorf("ERROR: Unexpected references %s and %s", mi.Ref, li.Ref)
+	}
+	if again := gen.ref(reflect.TypeOf(Info{})); again.Ref != li.Ref {
+		t.Errorf("ERROR: Expected %s again, got %s", li.Ref, again.Ref)
+	}
+	local := gen.schemas[localName]
+	if local == nil || local.Properties["Local"] == nil || local.Description != "" {
+		t.Errorf("ERROR: Expected the local Info schema without the models docs, got %v", local)
+	}
+	if gen.schemas["Info"].Description != "models info" {
+		t.Errorf("ERROR: Expected the models Info docs, got %q", gen.schemas["Info"].Description)
+	}
+}
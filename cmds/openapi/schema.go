@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/pborman/uuid"
+)
+
+// Schema is the subset of an OpenAPI 3 schema object that the
+// generator emits.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	ReadOnly             bool               `json:"readOnly,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+}
+
+// fieldDoc is the documentation and swagger annotations attached to a
+// struct field or type in the models source.
+type fieldDoc struct {
+	Description string
+	Required    bool
+	ReadOnly    bool
+	Format      string
+}
+
+// parseDoc splits a doc comment into its description and the
+// go-swagger style annotations we understand.
+func parseDoc(text string) fieldDoc {
+	res := fieldDoc{}
+	desc := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "required: true":
+			res.Required = true
+		case trimmed == "read only: true":
+			res.ReadOnly = true
+		case strings.HasPrefix(trimmed, "swagger:strfmt "):
+			res.Format = strings.TrimSpace(strings.TrimPrefix(trimmed, "swagger:strfmt "))
+		case strings.HasPrefix(trimmed, "swagger:"):
+		default:
+			desc = append(desc, line)
+		}
+	}
+	res.Description = strings.TrimSpace(strings.Join(desc, "\n"))
+	return res
+}
+
+// docs holds the parsed doc comments from the models package, keyed
+// by type name and by type name.field name.
+type docs map[string]fieldDoc
+
+// loadDocs parses the Go source in dir to recover the doc comments
+// and swagger annotations, which are not available via reflection.
+func loadDocs(dir string) (docs, error) {
+	res := docs{}
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, nil, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				gd, ok := decl.(*ast.GenDecl)
+				if !ok || gd.Tok != token.TYPE {
+					continue
+				}
+				for _, spec := range gd.Specs {
+					ts := spec.(*ast.TypeSpec)
+					doc := ts.Doc
+					if doc == nil {
+						doc = gd.Doc
+					}
+					if doc != nil {
+						res[ts.Name.Name] = parseDoc(doc.Text())
+					}
+					st, ok := ts.Type.(*ast.StructType)
+					if !ok {
+						continue
+					}
+					for _, field := range st.Fields.List {
+						if field.Doc == nil {
+							continue
+						}
+						fd := parseDoc(field.Doc.Text())
+						for _, name := range field.Names {
+							res[ts.Name.Name+"."+name.Name] = fd
+						}
+					}
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	uuidType    = reflect.TypeOf(uuid.UUID{})
+	ipType      = reflect.TypeOf(net.IP{})
+	ipNetType   = reflect.TypeOf(net.IPNet{})
+	macType     = reflect.TypeOf(net.HardwareAddr{})
+	rawType     = reflect.TypeOf(json.RawMessage{})
+	durType     = reflect.TypeOf(time.Duration(0))
+	marshalType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	modelsPkg   = reflect.TypeOf(models.Info{}).PkgPath()
+)
+
+// generator turns Go types into OpenAPI component schemas.
+type generator struct {
+	docs    docs
+	schemas map[string]*Schema
+	names   map[reflect.Type]string
+}
+
+func newGenerator(d docs) *generator {
+	return &generator{docs: d, schemas: map[string]*Schema{}, names: map[reflect.Type]string{}}
+}
+
+// doc returns the doc comment for key in the type t.  Only the models
+// source is parsed, so types from other packages have no docs.
+func (g *generator) doc(t reflect.Type, key string) fieldDoc {
+	if t.PkgPath() != modelsPkg {
+		return fieldDoc{}
+	}
+	return g.docs[key]
+}
+
+// name returns the component name for the struct type t.  Types from
+// the models package are named by their bare type name, and types
+// from any other package have the package name prepended, so that
+// the name of a type does not depend on the order types are seen in.
+func (g *generator) name(t reflect.Type) string {
+	if name, ok := g.names[t]; ok {
+		return name
+	}
+	name := t.Name()
+	if t.PkgPath() != modelsPkg {
+		name = path.Base(t.PkgPath()) + "." + t.Name()
+	}
+	g.names[t] = name
+	return name
+}
+
+// ref returns a reference to the component schema for the named
+// struct type t, generating the component if needed.
+func (g *generator) ref(t reflect.Type) *Schema {
+	_, known := g.names[t]
+	name := g.name(t)
+	if !known {
+		s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+		// Reserve the name before walking the fields to handle
+		// recursive types.
+		g.schemas[name] = s
+		s.Description = g.doc(t, t.Name()).Description
+		g.addFields(s, t)
+		sort.Strings(s.Required)
+	}
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+// jsonName returns the name a field marshals as, and whether it is
+// marshalled at all.
+func jsonName(f reflect.StructField) (string, bool) {
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	name := strings.Split(tag, ",")[0]
+	if name == "" {
+		name = f.Name
+	}
+	return name, true
+}
+
+func (g *generator) addFields(s *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name, ok := jsonName(f)
+		if !ok {
+			continue
+		}
+		ft := f.Type
+		if f.Anonymous && f.Tag.Get("json") == "" {
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.addFields(s, ft)
+				continue
+			}
+		}
+		fd := g.doc(t, t.Name()+"."+f.Name)
+		if f.Anonymous {
+			fd = g.doc(ft, ft.Name())
+		}
+		prop := g.schema(ft)
+		if fd.Format != "" && prop.Ref == "" {
+			prop.Format = fd.Format
+		}
+		if prop.Ref != "" && (fd.Description != "" || fd.ReadOnly) {
+			// $ref siblings are ignored, so wrap the reference.
+			prop = &Schema{AllOf: []*Schema{prop}, Description: fd.Description, ReadOnly: fd.ReadOnly}
+		} else {
+			prop.Description = fd.Description
+			prop.ReadOnly = fd.ReadOnly
+		}
+		s.Properties[name] = prop
+		if fd.Required {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+// schema returns the schema for an arbitrary Go type.
+func (g *generator) schema(t reflect.Type) *Schema {
+	switch t {
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case uuidType:
+		return &Schema{Type: "string", Format: "uuid"}
+	case ipType:
+		return &Schema{Type: "string", Format: "ip"}
+	case ipNetType:
+		return &Schema{Type: "string", Format: "cidr"}
+	case macType:
+		return &Schema{Type: "string", Format: "mac"}
+	case rawType:
+		return &Schema{}
+	case durType:
+		return &Schema{Type: "integer", Format: "int64"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" || t.Implements(marshalType) || reflect.PtrTo(t).Implements(marshalType) {
+			return &Schema{Type: "object"}
+		}
+		return g.ref(t)
+	}
+	// interface{} and anything else we cannot describe can hold any
+	// JSON value.
+	return &Schema{}
+}
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"sort"
+)
+
+// CatalogUpgrade describes how an installed component compares with
+// what is available in a catalog.
+//
+// swagger:model
+type CatalogUpgrade struct {
+	// Type is the ContentType of the component: DRP, DRPUX,
+	// ContentPackage, or PluginProvider.
+	Type string
+	// Name is the name of the component.
+	Name string
+	// Installed is the installed version.  It is empty if the version
+	// could not be found.
+	Installed string
+	// Stable is the version of the stable catalog item.
+	Stable string
+	// StableDistance is how far Stable is from Installed.
+	StableDistance string
+	// Tip is the version of the tip catalog item.
+	Tip string
+	// TipDistance is how far Tip is from Installed.
+	TipDistance string
+	// Channel is the channel the upgrade comes from, either stable or
+	// tip.
+	Channel string
+	// Target is the version that would be upgraded to from Channel.
+	Target string
+	// Upgrade is whether Target is newer than Installed.
+	Upgrade bool
+}
+
+// VersionDistance describes how far apart two versions are.  It
+// returns "none" if to is not newer than from, the most significant
+// part of the version that changed ("major", "minor", "patch", or
+// "prerelease") if it is, and "unknown" if either version cannot be
+// parsed.
+func VersionDistance(from, to string) string {
+	fv, ferr := ParseSemver(from)
+	tv, terr := ParseSemver(to)
+	if ferr != nil || terr != nil {
+		return "unknown"
+	}
+	switch {
+	case !tv.GT(fv):
+		return "none"
+	case tv.Major != fv.Major:
+		return "major"
+	case tv.Minor != fv.Minor:
+		return "minor"
+	case tv.Patch != fv.Patch:
+		return "patch"
+	}
+	return "prerelease"
+}
+
+// CatalogUpgrades compares the installed components with the stable
+// and tip versions of them in the catalog.  installed uses the Type,
+// Name, and ActualVersion of each Element.  If tip is set, upgrades
+// are to the tip versions, otherwise they are to the stable versions.
+// Components that are not in the catalog are left out.
+func CatalogUpgrades(items []*CatalogItem, installed []*Element, tip bool) []*CatalogUpgrade {
+	type channels struct{ stable, tip string }
+	avail := map[string]*channels{}
+	for _, item := range items {
+		k := item.ContentType + "/" + item.Name
+		if avail[k] == nil {
+			avail[k] = &channels{}
+		}
+		switch item.Version {
+		case "stable":
+			avail[k].stable = item.ActualVersion
+		case "tip":
+			avail[k].tip = item.ActualVersion
+		}
+	}
+	res := []*CatalogUpgrade{}
+	for _, e := range installed {
+		ch, ok := avail[e.Type+"/"+e.Name]
+		if !ok {
+			continue
+		}
+		up := &CatalogUpgrade{
+			Type:           e.Type,
+			Name:           e.Name,
+			Installed:      e.ActualVersion,
+			Stable:         ch.stable,
+			StableDistance: VersionDistance(e.ActualVersion, ch.stable),
+			Tip:            ch.tip,
+			TipDistance:    VersionDistance(e.ActualVersion, ch.tip),
+			Channel:        "stable",
+			Target:         ch.stable,
+		}
+		if tip && ch.tip != "" {
+			up.Channel, up.Target = "tip", ch.tip
+		}
+		up.Upgrade = up.Target != "" && up.Target != up.Installed &&
+			VersionDistance(up.Installed, up.Target) != "none"
+		res = append(res, up)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Type != res[j].Type {
+			return res[i].Type < res[j].Type
+		}
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// UpgradeVersionSet builds a VersionSet that describes the endpoint
+// after the upgrades in ups are applied.  Components that are not
+// being upgraded keep their installed versions.
+func UpgradeVersionSet(id string, ups []*CatalogUpgrade) *VersionSet {
+	vs := &VersionSet{Id: id, Description: "Upgrade target generated from the catalog"}
+	vs.Fill()
+	for _, up := range ups {
+		version, channel := up.Installed, up.Installed
+		if up.Upgrade {
+			version, channel = up.Target, up.Channel
+		}
+		switch up.Type {
+		case "DRP":
+			vs.DRPVersion = channel
+		case "DRPUX":
+			vs.DRPUXVersion = channel
+		default:
+			vs.Components = append(vs.Components, &Element{
+				Type:          up.Type,
+				Name:          up.Name,
+				Version:       channel,
+				ActualVersion: version,
+			})
+		}
+	}
+	return vs
+}
@@ -0,0 +1,68 @@
+package models
+
+import "testing"
+
+func TestVersionDistance(t *testing.T) {
+	for _, tc := range [][3]string{
+		{"v4.6.0-beta.1", "v4.9.0", "minor"},
+		{"v4.6.0", "v5.0.0", "major"},
+		{"v4.6.0", "v4.6.2", "patch"},
+		{"v4.6.0-alpha.1", "v4.6.0-alpha.2", "prerelease"},
+		{"v4.6.0", "v4.6.0", "none"},
+		{"v4.7.0", "v4.6.0", "none"},
+		{"", "v4.6.0", "unknown"},
+	} {
+		if got := VersionDistance(tc[0], tc[1]); got != tc[2] {
+			t.Errorf("ERROR: %s -> %s: expected %s, got %s", tc[0], tc[1], tc[2], got)
+		}
+	}
+}
+
+func TestCatalogUpgrades(t *testing.T) {
+	items := []*CatalogItem{
+		{Name: "drp", ContentType: "DRP", Version: "stable", ActualVersion: "v4.9.0"},
+		{Name: "drp", ContentType: "DRP", Version: "tip", ActualVersion: "v4.10.0-alpha.3"},
+		{Name: "task-library", ContentType: "ContentPackage", Version: "stable", ActualVersion: "v4.9.1"},
+		{Name: "task-library", ContentType: "ContentPackage", Version: "v4.9.1", ActualVersion: "v4.9.1"},
+		{Name: "ipmi", ContentType: "PluginProvider", Version: "stable", ActualVersion: "v4.9.0"},
+	}
+	installed := []*Element{
+		{Type: "DRP", Name: "drp", ActualVersion: "v4.8.2"},
+		{Type: "ContentPackage", Name: "task-library", ActualVersion: "v4.9.1"},
+		{Type: "ContentPackage", Name: "custom", ActualVersion: "v1.0.0"},
+		{Type: "PluginProvider", Name: "ipmi", ActualVersion: "v4.10.0"},
+	}
+	ups := CatalogUpgrades(items, installed, false)
+	if len(ups) != 3 {
+		t.Fatalf("ERROR: Expected 3 components, got %d", len(ups))
+	}
+	want := []struct {
+		name, target, distance string
+		upgrade                bool
+	}{
+		{"task-library", "v4.9.1", "none", false},
+		{"drp", "v4.9.0", "minor", true},
+		{"ipmi", "v4.9.0", "none", false},
+	}
+	for i, w := range want {
+		up := ups[i]
+		if up.Name != w.name || up.Target != w.target || up.StableDistance != w.distance || up.Upgrade != w.upgrade {
+			t.Errorf("ERROR: Expected %v, got %+v", w, up)
+		}
+	}
+	ups = CatalogUpgrades(items, installed, true)
+	if ups[1].Channel != "tip" || ups[1].Target != "v4.10.0-alpha.3" || ups[1].TipDistance != "minor" {
+		t.Errorf("ERROR: Expected tip upgrade for drp, got %+v", ups[1])
+	}
+	// Components with no tip version stay on stable.
+	if ups[0].Channel != "stable" {
+		t.Errorf("ERROR: Expected stable channel for task-library, got %+v", ups[0])
+	}
+	vs := UpgradeVersionSet("upgrade", ups)
+	if vs.Id != "upgrade" || vs.DRPVersion != "tip" || len(vs.Components) != 2 {
+		t.Fatalf("ERROR: Bad version set: %+v", vs)
+	}
+	if c := vs.Components[0]; c.Name != "task-library" || c.Version != "v4.9.1" {
+		t.Errorf("ERROR: Expected task-library to stay at v4.9.1, got %+v", c)
+	}
+}
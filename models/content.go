@@ -1,7 +1,11 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/digitalrebar/provision/v4/store"
@@ -76,6 +80,21 @@ type ContentMetaData struct {
 	// DocUrl should contain a link to external documentation for this content, if available.
 	DocUrl string
 
+	// ContentHash is the sha256 digest of the meta data and objects of
+	// the content bundle, as computed by Hash.  It is set when the
+	// content is bundled.
+	ContentHash string
+
+	// Signing fields.  These are set by Sign, and are not part of
+	// what is signed.
+
+	// SigningKey is the base64 encoded ed25519 public key that signed
+	// this content bundle.
+	SigningKey string
+	// Signature is the base64 encoded ed25519 signature of the
+	// content bundle.
+	Signature string
+
 	// Informational Fields
 
 	// Type contains what type of content bundle this is.  It is read-only, and cannot be changed voa the API.
@@ -147,6 +166,18 @@ func ParseContentPrerequisites(prereqs string) (map[string]semver.Range, error)
 	return res, nil
 }
 
+// ParseSemver parses a version string like the ones used for content
+// bundles and catalog items, with or without a leading "v".  Unlike
+// semver.ParseTolerant, it handles prerelease versions with a zero
+// patch level, such as v4.6.0-beta.1.
+func ParseSemver(v string) (semver.Version, error) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if res, err := semver.Parse(v); err == nil {
+		return res, nil
+	}
+	return semver.ParseTolerant(v)
+}
+
 func (c *Content) GenerateMetaMap() map[string]string {
 	meta := map[string]string{
 		"Name":        strings.TrimSpace(c.Meta.Name),
@@ -170,10 +201,135 @@ func (c *Content) GenerateMetaMap() map[string]string {
 		"Tags":          strings.TrimSpace(c.Meta.Tags),
 		"DocUrl":        strings.TrimSpace(c.Meta.DocUrl),
 		"Prerequisites": strings.TrimSpace(c.Meta.Prerequisites),
+		"ContentHash":   strings.TrimSpace(c.Meta.ContentHash),
+		"SigningKey":    strings.TrimSpace(c.Meta.SigningKey),
+		"Signature":     strings.TrimSpace(c.Meta.Signature),
 	}
 	return meta
 }
 
+// normalizedSection decodes every object in a section into its model
+// and back, so that objects can be compared without caring how they
+// were encoded.
+func normalizedSection(prefix string, section Section) (map[string]interface{}, error) {
+	res := map[string]interface{}{}
+	for key, v := range section {
+		obj, err := New(prefix)
+		if err != nil {
+			return nil, err
+		}
+		var norm interface{}
+		if err := Remarshal(v, obj); err != nil {
+			return nil, fmt.Errorf("%s/%s: %v", prefix, key, err)
+		}
+		// The bundle is filled in from the content name when it is loaded.
+		if b, ok := obj.(Bundler); ok {
+			b.SetBundle("")
+		}
+		if err := Remarshal(obj, &norm); err != nil {
+			return nil, fmt.Errorf("%s/%s: %v", prefix, key, err)
+		}
+		res[key] = norm
+	}
+	return res, nil
+}
+
+// ContentDifferences lists the ways two content bundles differ,
+// ignoring how their objects were encoded.  It is empty if they have
+// the same meta data and objects.
+func ContentDifferences(a, b *Content) ([]string, error) {
+	res := []string{}
+	am, bm := a.GenerateMetaMap(), b.GenerateMetaMap()
+	// An empty Type means dynamic when the content is loaded.
+	am["Type"], _, _ = getExtraFields(am["Name"], am["Type"])
+	bm["Type"], _, _ = getExtraFields(bm["Name"], bm["Type"])
+	fields := []string{}
+	for k := range am {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	for _, k := range fields {
+		// The hash is derived from everything else.
+		if k == "ContentHash" {
+			continue
+		}
+		if am[k] != bm[k] {
+			res = append(res, fmt.Sprintf("meta %s: %q != %q", k, am[k], bm[k]))
+		}
+	}
+	prefixes := map[string]struct{}{}
+	for p := range a.Sections {
+		prefixes[p] = struct{}{}
+	}
+	for p := range b.Sections {
+		prefixes[p] = struct{}{}
+	}
+	for _, prefix := range setToList(prefixes) {
+		if _, err := New(prefix); err != nil {
+			continue
+		}
+		as, err := normalizedSection(prefix, a.Sections[prefix])
+		if err != nil {
+			return nil, err
+		}
+		bs, err := normalizedSection(prefix, b.Sections[prefix])
+		if err != nil {
+			return nil, err
+		}
+		keys := map[string]struct{}{}
+		for k := range as {
+			keys[k] = struct{}{}
+		}
+		for k := range bs {
+			keys[k] = struct{}{}
+		}
+		for _, key := range setToList(keys) {
+			av, aok := as[key]
+			bv, bok := bs[key]
+			switch {
+			case !bok:
+				res = append(res, fmt.Sprintf("%s/%s: only in first", prefix, key))
+			case !aok:
+				res = append(res, fmt.Sprintf("%s/%s: only in second", prefix, key))
+			case !reflect.DeepEqual(av, bv):
+				res = append(res, fmt.Sprintf("%s/%s: differs", prefix, key))
+			}
+		}
+	}
+	return res, nil
+}
+
+// Hash returns the sha256 digest of the content bundle, in the form
+// sha256:<hex>.  It covers the meta data other than Type, ContentHash,
+// and the signing fields, and every object after it has been decoded
+// into its model, so content with the same meta data and objects
+// always has the same hash no matter how it was encoded.
+func (c *Content) Hash() (string, error) {
+	meta := c.GenerateMetaMap()
+	for _, k := range []string{"Type", "ContentHash", "SigningKey", "Signature"} {
+		delete(meta, k)
+	}
+	sections := map[string]interface{}{}
+	for prefix, section := range c.Sections {
+		if _, err := New(prefix); err != nil {
+			continue
+		}
+		norm, err := normalizedSection(prefix, section)
+		if err != nil {
+			return "", err
+		}
+		sections[prefix] = norm
+	}
+	buf, err := json.Marshal(map[string]interface{}{
+		"meta":     meta,
+		"sections": sections,
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(buf)), nil
+}
+
 // ToStore saves a Content bundle into a format that can be used but
 // the stackable store system dr-provision uses to save its working
 // data.
@@ -251,6 +407,12 @@ func (c *Content) FromStore(src store.Store) error {
 				c.Meta.DocUrl = tv
 			case "Prerequisites":
 				c.Meta.Prerequisites = tv
+			case "ContentHash":
+				c.Meta.ContentHash = tv
+			case "SigningKey":
+				c.Meta.SigningKey = tv
+			case "Signature":
+				c.Meta.Signature = tv
 			}
 		}
 	}
@@ -376,6 +538,12 @@ func (c *ContentSummary) FromStore(src store.Store) {
 				c.Meta.DocUrl = tv
 			case "Prerequisites":
 				c.Meta.Prerequisites = tv
+			case "ContentHash":
+				c.Meta.ContentHash = tv
+			case "SigningKey":
+				c.Meta.SigningKey = tv
+			case "Signature":
+				c.Meta.Signature = tv
 			}
 		}
 	}
@@ -0,0 +1,595 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ContentChange is a change to a single object between two versions
+// of a content bundle.
+//
+// swagger:model
+type ContentChange struct {
+	// Prefix is the type of the object.
+	Prefix string
+	// Key is the key of the object.
+	Key string
+	// Change is one of "added", "removed", or "changed".
+	Change string
+	// Breaking is set when the change can break things that use the
+	// object, such as removing it, adding a required param, or
+	// changing the type of a param.
+	Breaking bool
+	// Details describe what changed.
+	Details []string
+	// Diffs are line diffs of the templates that changed, keyed by
+	// template name.
+	Diffs map[string]string `json:",omitempty"`
+}
+
+// ContentChangelog is the summary of what changed between two
+// versions of a content bundle.
+//
+// swagger:model
+type ContentChangelog struct {
+	Name       string
+	OldVersion string
+	NewVersion string
+	// Meta describes changes to the content bundle metadata.
+	Meta []string
+	// Changes are the objects that changed, sorted by prefix and key.
+	Changes []*ContentChange
+}
+
+// Breaking returns whether any of the changes are breaking.
+func (cl *ContentChangelog) Breaking() bool {
+	for _, c := range cl.Changes {
+		if c.Breaking {
+			return true
+		}
+	}
+	return false
+}
+
+// changelogIgnored are fields that change without the object
+// changing in a way anyone cares about, or that are handled by the
+// per-type comparisons.
+var changelogIgnored = map[string]struct{}{
+	"Validated": {}, "Available": {}, "Errors": {}, "ReadOnly": {},
+	"Bundle": {}, "Endpoint": {},
+	"Templates": {}, "RequiredParams": {}, "OptionalParams": {},
+	"Stages": {}, "Tasks": {}, "Schema": {}, "Contents": {}, "Secure": {},
+}
+
+func changelogModels(c *Content, prefix string) (map[string]Model, error) {
+	res := map[string]Model{}
+	for key, v := range c.Sections[prefix] {
+		obj, err := New(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if err := Remarshal(v, obj); err != nil {
+			return nil, fmt.Errorf("%s/%s: %v", prefix, key, err)
+		}
+		obj.Fill()
+		res[obj.Key()] = obj
+	}
+	return res, nil
+}
+
+// listChanges describes the items added to and removed from a list.
+func listChanges(old, new []string) (added, removed []string) {
+	o, n := map[string]bool{}, map[string]bool{}
+	for _, v := range old {
+		o[v] = true
+	}
+	for _, v := range new {
+		n[v] = true
+		if !o[v] {
+			added = append(added, v)
+		}
+	}
+	for _, v := range old {
+		if !n[v] {
+			removed = append(removed, v)
+		}
+	}
+	return
+}
+
+// orderedList describes changes to a list where the order matters,
+// such as the stages of a workflow or the tasks of a stage.
+func orderedList(ch *ContentChange, what string, old, new []string) {
+	added, removed := listChanges(old, new)
+	if len(added) > 0 {
+		ch.Details = append(ch.Details, fmt.Sprintf("%s added: %s", what, strings.Join(added, ", ")))
+	}
+	if len(removed) > 0 {
+		ch.Details = append(ch.Details, fmt.Sprintf("%s removed: %s", what, strings.Join(removed, ", ")))
+	}
+	if len(added) == 0 && len(removed) == 0 && !reflect.DeepEqual(old, new) {
+		ch.Details = append(ch.Details, fmt.Sprintf("%s reordered: %s -> %s", what,
+			strings.Join(old, ", "), strings.Join(new, ", ")))
+	}
+}
+
+func (ch *ContentChange) params(old, new []string, required bool) {
+	added, removed := listChanges(old, new)
+	what := "OptionalParams"
+	if required {
+		what = "RequiredParams"
+	}
+	if len(added) > 0 {
+		ch.Details = append(ch.Details, fmt.Sprintf("%s added: %s", what, strings.Join(added, ", ")))
+		// Things that used to work without these params will not any more.
+		ch.Breaking = ch.Breaking || required
+	}
+	if len(removed) > 0 {
+		ch.Details = append(ch.Details, fmt.Sprintf("%s removed: %s", what, strings.Join(removed, ", ")))
+	}
+}
+
+func (ch *ContentChange) templates(old, new []TemplateInfo) {
+	o, n := map[string]TemplateInfo{}, map[string]TemplateInfo{}
+	names := []string{}
+	for _, t := range old {
+		o[t.Name] = t
+	}
+	for _, t := range new {
+		n[t.Name] = t
+		names = append(names, t.Name)
+	}
+	for _, t := range old {
+		if _, ok := n[t.Name]; !ok {
+			ch.Details = append(ch.Details, fmt.Sprintf("Template %s removed", t.Name))
+		}
+	}
+	for _, name := range names {
+		ot, ok := o[name]
+		nt := n[name]
+		switch {
+		case !ok:
+			ch.Details = append(ch.Details, fmt.Sprintf("Template %s added", name))
+		case ot.ID != nt.ID:
+			ch.Details = append(ch.Details, fmt.Sprintf("Template %s now uses %s instead of %s", name, nt.ID, ot.ID))
+		case ot.Path != nt.Path:
+			ch.Details = append(ch.Details, fmt.Sprintf("Template %s path changed from %s to %s", name, ot.Path, nt.Path))
+		}
+		if ok && ot.Contents != nt.Contents {
+			ch.Details = append(ch.Details, fmt.Sprintf("Template %s contents changed", name))
+			ch.diff(name, ot.Contents, nt.Contents)
+		}
+	}
+	oNames := []string{}
+	for _, t := range old {
+		if _, ok := n[t.Name]; ok {
+			oNames = append(oNames, t.Name)
+		}
+	}
+	nNames := []string{}
+	for _, name := range names {
+		if _, ok := o[name]; ok {
+			nNames = append(nNames, name)
+		}
+	}
+	if !reflect.DeepEqual(oNames, nNames) {
+		ch.Details = append(ch.Details, fmt.Sprintf("Templates reordered: %s -> %s",
+			strings.Join(oNames, ", "), strings.Join(nNames, ", ")))
+	}
+}
+
+func (ch *ContentChange) diff(name, old, new string) {
+	if ch.Diffs == nil {
+		ch.Diffs = map[string]string{}
+	}
+	ch.Diffs[name] = LineDiff(old, new)
+}
+
+// schema describes changes to a param schema.  Changes that can make
+// values that used to be valid invalid are breaking.
+func (ch *ContentChange) schema(old, new *Param) {
+	if old.Secure != new.Secure {
+		ch.Details = append(ch.Details, fmt.Sprintf("Secure changed from %v to %v", old.Secure, new.Secure))
+		ch.Breaking = true
+	}
+	if reflect.DeepEqual(old.Schema, new.Schema) {
+		return
+	}
+	oSchema, _ := old.Schema.(map[string]interface{})
+	nSchema, _ := new.Schema.(map[string]interface{})
+	if oSchema == nil || nSchema == nil {
+		ch.Details = append(ch.Details, "Schema changed")
+		ch.Breaking = true
+		return
+	}
+	keys := map[string]struct{}{}
+	for k := range oSchema {
+		keys[k] = struct{}{}
+	}
+	for k := range nSchema {
+		keys[k] = struct{}{}
+	}
+	for _, k := range setToList(keys) {
+		ov, oOk := oSchema[k]
+		nv, nOk := nSchema[k]
+		if reflect.DeepEqual(ov, nv) {
+			continue
+		}
+		switch k {
+		case "type":
+			ch.Details = append(ch.Details, fmt.Sprintf("Schema type changed from %v to %v", ov, nv))
+			ch.Breaking = true
+		case "default":
+			ch.Details = append(ch.Details, fmt.Sprintf("Schema default changed from %v to %v", ov, nv))
+		case "enum":
+			ol, _ := ov.([]interface{})
+			nl, _ := nv.([]interface{})
+			removed := []string{}
+			for _, o := range ol {
+				found := false
+				for _, n := range nl {
+					if reflect.DeepEqual(o, n) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					removed = append(removed, fmt.Sprintf("%v", o))
+				}
+			}
+			switch {
+			case !nOk:
+				ch.Details = append(ch.Details, "Schema enum removed")
+			case !oOk:
+				ch.Details = append(ch.Details, "Schema enum added")
+				ch.Breaking = true
+			case len(removed) > 0:
+				ch.Details = append(ch.Details, fmt.Sprintf("Schema enum values removed: %s", strings.Join(removed, ", ")))
+				ch.Breaking = true
+			default:
+				ch.Details = append(ch.Details, "Schema enum values added")
+			}
+		default:
+			if _, ok := schemaAnnotations[k]; ok {
+				ch.Details = append(ch.Details, fmt.Sprintf("Schema %s changed", k))
+				continue
+			}
+			switch {
+			case !nOk:
+				ch.Details = append(ch.Details, fmt.Sprintf("Schema %s removed", k))
+			case !oOk:
+				ch.Details = append(ch.Details, fmt.Sprintf("Schema %s added", k))
+			default:
+				ch.Details = append(ch.Details, fmt.Sprintf("Schema %s changed from %v to %v", k, ov, nv))
+			}
+			// Any new or tighter constraint can reject existing values.
+			ch.Breaking = ch.Breaking || schemaTightened(k, ov, nv, oOk, nOk)
+		}
+	}
+}
+
+// schemaAnnotations are the schema keywords that do not change which
+// values are valid.
+var schemaAnnotations = map[string]struct{}{
+	"title": {}, "description": {}, "$comment": {}, "examples": {},
+	"readOnly": {}, "writeOnly": {}, "deprecated": {}, "$id": {}, "$schema": {},
+}
+
+// schemaMaximums and schemaMinimums are the schema keywords that are
+// numeric upper and lower bounds.
+var (
+	schemaMaximums = map[string]struct{}{
+		"maximum": {}, "exclusiveMaximum": {}, "maxLength": {}, "maxItems": {}, "maxProperties": {},
+	}
+	schemaMinimums = map[string]struct{}{
+		"minimum": {}, "exclusiveMinimum": {}, "minLength": {}, "minItems": {}, "minProperties": {},
+	}
+)
+
+func schemaNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// schemaTightened tests whether changing the schema keyword k from ov
+// to nv can make values that used to be valid invalid.  Removing a
+// keyword never does.  Changes that it cannot tell about are assumed
+// to be tighter.
+func schemaTightened(k string, ov, nv interface{}, oOk, nOk bool) bool {
+	if !nOk {
+		return false
+	}
+	if !oOk {
+		return true
+	}
+	on, ook := schemaNumber(ov)
+	nn, nok := schemaNumber(nv)
+	if _, ok := schemaMaximums[k]; ok && ook && nok {
+		return nn < on
+	}
+	if _, ok := schemaMinimums[k]; ok && ook && nok {
+		return nn > on
+	}
+	switch k {
+	case "required":
+		ol, _ := ov.([]interface{})
+		nl, _ := nv.([]interface{})
+		for _, n := range nl {
+			found := false
+			for _, o := range ol {
+				if reflect.DeepEqual(o, n) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return true
+			}
+		}
+		return false
+	case "uniqueItems":
+		return nv == true
+	case "additionalProperties":
+		return nv != true
+	}
+	return true
+}
+
+// compare fills in the details of how an object changed.  It returns
+// false if nothing changed.
+func (ch *ContentChange) compare(old, new Model) (bool, error) {
+	switch o := old.(type) {
+	case *Task:
+		n := new.(*Task)
+		ch.params(o.RequiredParams, n.RequiredParams, true)
+		ch.params(o.OptionalParams, n.OptionalParams, false)
+		ch.templates(o.Templates, n.Templates)
+	case *Stage:
+		n := new.(*Stage)
+		ch.params(o.RequiredParams, n.RequiredParams, true)
+		ch.params(o.OptionalParams, n.OptionalParams, false)
+		ch.templates(o.Templates, n.Templates)
+		orderedList(ch, "Tasks", o.Tasks, n.Tasks)
+	case *BootEnv:
+		n := new.(*BootEnv)
+		ch.params(o.RequiredParams, n.RequiredParams, true)
+		ch.params(o.OptionalParams, n.OptionalParams, false)
+		ch.templates(o.Templates, n.Templates)
+	case *Workflow:
+		orderedList(ch, "Stages", o.Stages, new.(*Workflow).Stages)
+	case *Template:
+		n := new.(*Template)
+		if o.Contents != n.Contents {
+			ch.Details = append(ch.Details, "Contents changed")
+			ch.diff(o.ID, o.Contents, n.Contents)
+		}
+	case *Param:
+		ch.schema(o, new.(*Param))
+	}
+	var om, nm map[string]interface{}
+	if err := Remarshal(old, &om); err != nil {
+		return false, err
+	}
+	if err := Remarshal(new, &nm); err != nil {
+		return false, err
+	}
+	fields := map[string]struct{}{}
+	for k := range om {
+		fields[k] = struct{}{}
+	}
+	for k := range nm {
+		fields[k] = struct{}{}
+	}
+	for _, k := range setToList(fields) {
+		if _, ok := changelogIgnored[k]; ok {
+			continue
+		}
+		if !reflect.DeepEqual(om[k], nm[k]) {
+			ch.Details = append(ch.Details, fmt.Sprintf("%s changed", k))
+		}
+	}
+	return len(ch.Details) > 0, nil
+}
+
+// NewContentChangelog compares two versions of a content bundle.
+func NewContentChangelog(old, new *Content) (*ContentChangelog, error) {
+	res := &ContentChangelog{
+		Name:       new.Meta.Name,
+		OldVersion: old.Meta.Version,
+		NewVersion: new.Meta.Version,
+		Meta:       []string{},
+		Changes:    []*ContentChange{},
+	}
+	om, nm := old.GenerateMetaMap(), new.GenerateMetaMap()
+	for _, k := range []string{"Name", "Version", "Prerequisites", "RequiredFeatures", "Description", "Documentation"} {
+		if om[k] == nm[k] {
+			continue
+		}
+		if k == "Documentation" || k == "Description" {
+			res.Meta = append(res.Meta, fmt.Sprintf("%s changed", k))
+		} else {
+			res.Meta = append(res.Meta, fmt.Sprintf("%s changed from %q to %q", k, om[k], nm[k]))
+		}
+	}
+	prefixes := map[string]struct{}{}
+	for p := range old.Sections {
+		prefixes[p] = struct{}{}
+	}
+	for p := range new.Sections {
+		prefixes[p] = struct{}{}
+	}
+	for _, prefix := range setToList(prefixes) {
+		if _, err := New(prefix); err != nil {
+			continue
+		}
+		oObjs, err := changelogModels(old, prefix)
+		if err != nil {
+			return nil, err
+		}
+		nObjs, err := changelogModels(new, prefix)
+		if err != nil {
+			return nil, err
+		}
+		keys := map[string]struct{}{}
+		for k := range oObjs {
+			keys[k] = struct{}{}
+		}
+		for k := range nObjs {
+			keys[k] = struct{}{}
+		}
+		for _, key := range setToList(keys) {
+			ch := &ContentChange{Prefix: prefix, Key: key, Details: []string{}}
+			o, oOk := oObjs[key]
+			n, nOk := nObjs[key]
+			switch {
+			case !oOk:
+				ch.Change = "added"
+			case !nOk:
+				ch.Change = "removed"
+				ch.Breaking = true
+			default:
+				ch.Change = "changed"
+				changed, err := ch.compare(o, n)
+				if err != nil {
+					return nil, err
+				}
+				if !changed {
+					continue
+				}
+			}
+			res.Changes = append(res.Changes, ch)
+		}
+	}
+	return res, nil
+}
+
+// Markdown renders the changelog as Markdown release notes.
+func (cl *ContentChangelog) Markdown() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "# %s %s\n\n", cl.Name, cl.NewVersion)
+	fmt.Fprintf(b, "Changes since %s.\n", cl.OldVersion)
+	if len(cl.Meta) > 0 {
+		b.WriteString("\n## Metadata\n\n")
+		for _, m := range cl.Meta {
+			fmt.Fprintf(b, "- %s\n", m)
+		}
+	}
+	if cl.Breaking() {
+		b.WriteString("\n## Breaking changes\n\n")
+		for _, c := range cl.Changes {
+			if c.Breaking {
+				fmt.Fprintf(b, "- %s `%s` %s\n", c.Prefix, c.Key, c.Change)
+			}
+		}
+	}
+	prefix := ""
+	for _, c := range cl.Changes {
+		if c.Prefix != prefix {
+			prefix = c.Prefix
+			fmt.Fprintf(b, "\n## %s\n\n", prefix)
+		}
+		mark := ""
+		if c.Breaking {
+			mark = " (breaking)"
+		}
+		fmt.Fprintf(b, "- `%s` %s%s\n", c.Key, c.Change, mark)
+		for _, d := range c.Details {
+			fmt.Fprintf(b, "  - %s\n", d)
+		}
+		names := make([]string, 0, len(c.Diffs))
+		for name := range c.Diffs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(b, "\n  ```diff\n  --- %s\n  +++ %s\n", name, name)
+			for _, line := range strings.Split(strings.TrimSuffix(c.Diffs[name], "\n"), "\n") {
+				fmt.Fprintf(b, "  %s\n", line)
+			}
+			b.WriteString("  ```\n")
+		}
+	}
+	return b.String()
+}
+
+// LineDiff returns a diff of the lines of old and new, in the style of
+// a unified diff with 3 lines of context and no line numbers.
+func LineDiff(old, new string) string {
+	if strings.HasSuffix(old, "\n") && strings.HasSuffix(new, "\n") {
+		old, new = old[:len(old)-1], new[:len(new)-1]
+	}
+	a, b := strings.Split(old, "\n"), strings.Split(new, "\n")
+	// lcs[i][j] is the length of the longest common subsequence of
+	// a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	lines := []string{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, " "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "-"+a[i])
+			i++
+		default:
+			lines = append(lines, "+"+b[j])
+			j++
+		}
+	}
+	// Only keep 3 lines of context around the changes.
+	const context = 3
+	keep := make([]bool, len(lines))
+	for n, l := range lines {
+		if l[0] == ' ' {
+			continue
+		}
+		for k := n - context; k <= n+context; k++ {
+			if k >= 0 && k < len(lines) {
+				keep[k] = true
+			}
+		}
+	}
+	res := &strings.Builder{}
+	skipped := false
+	for n, l := range lines {
+		if !keep[n] {
+			skipped = true
+			continue
+		}
+		if skipped || n == 0 {
+			res.WriteString("@@\n")
+			skipped = false
+		}
+		res.WriteString(l + "\n")
+	}
+	return res.String()
+}
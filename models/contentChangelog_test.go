@@ -0,0 +1,111 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContentChangelog(t *testing.T) {
+	mk := func(version string, objs ...Model) *Content {
+		c := &Content{}
+		c.Fill()
+		c.Meta.Name = "changelog-test"
+		c.Meta.Version = version
+		for _, obj := range objs {
+			if c.Sections[obj.Prefix()] == nil {
+				c.Sections[obj.Prefix()] = Section{}
+			}
+			c.Sections[obj.Prefix()][obj.Key()] = obj
+		}
+		return c
+	}
+	old := mk("v1.0.0",
+		&Task{Name: "same", Description: "unchanged"},
+		&Task{Name: "gone"},
+		&Task{Name: "task", RequiredParams: []string{"a"}, Templates: []TemplateInfo{
+			{Name: "inline", Contents: "one\ntwo\nthree\n"},
+		}},
+		&Template{ID: "tmpl", Contents: "hello\n"},
+		&Workflow{Name: "flow", Stages: []string{"s1", "s2"}},
+		&Param{Name: "num", Schema: map[string]interface{}{"type": "integer", "default": 1}},
+		&Param{Name: "pick", Schema: map[string]interface{}{"type": "string", "enum": []interface{}{"x", "y"}}},
+		&Param{Name: "desc", Schema: map[string]interface{}{"type": "string", "description": "old", "title": "Old"}},
+		&Param{Name: "loose", Schema: map[string]interface{}{"type": "string", "maxLength": 5, "minLength": 3, "pattern": "^a"}},
+		&Param{Name: "tight", Schema: map[string]interface{}{"type": "integer", "maximum": 10}},
+		&Param{Name: "req", Schema: map[string]interface{}{"type": "object", "required": []interface{}{"a", "b"}}},
+	)
+	new := mk("v1.1.0",
+		&Task{Name: "same", Description: "unchanged"},
+		&Task{Name: "added"},
+		&Task{Name: "task", RequiredParams: []string{"a", "b"}, Description: "new", Templates: []TemplateInfo{
+			{Name: "inline", Contents: "one\n2\nthree\n"},
+		}},
+		&Template{ID: "tmpl", Contents: "hello world\n"},
+		&Workflow{Name: "flow", Stages: []string{"s2", "s1"}},
+		&Param{Name: "num", Schema: map[string]interface{}{"type": "integer", "default": 2}},
+		&Param{Name: "pick", Schema: map[string]interface{}{"type": "string", "enum": []interface{}{"x", "z"}}},
+		&Param{Name: "desc", Schema: map[string]interface{}{"type": "string", "description": "new", "title": "New"}},
+		&Param{Name: "loose", Schema: map[string]interface{}{"type": "string", "maxLength": 10, "minLength": 1}},
+		&Param{Name: "tight", Schema: map[string]interface{}{"type": "integer", "maximum": 5}},
+		&Param{Name: "req", Schema: map[string]interface{}{"type": "object", "required": []interface{}{"a", "c"}}},
+	)
+	cl, err := NewContentChangelog(old, new)
+	if err != nil {
+		t.Fatalf("ERROR: Unexpected changelog failure: %v", err)
+	}
+	if len(cl.Meta) != 1 || !strings.Contains(cl.Meta[0], "Version changed") {
+		t.Errorf("ERROR: Expected a version change, got %v", cl.Meta)
+	}
+	want := []struct {
+		key, change string
+		breaking    bool
+		detail      string
+	}{
+		{"desc", "changed", false, "Schema description changed"},
+		{"loose", "changed", false, "Schema maxLength changed from 5 to 10"},
+		{"num", "changed", false, "Schema default changed from 1 to 2"},
+		{"pick", "changed", true, "Schema enum values removed: y"},
+		{"req", "changed", true, "Schema required changed from [a b] to [a c]"},
+		{"tight", "changed", true, "Schema maximum changed from 10 to 5"},
+		{"added", "added", false, ""},
+		{"gone", "removed", true, ""},
+		{"task", "changed", true, "RequiredParams added: b"},
+		{"tmpl", "changed", false, "Contents changed"},
+		{"flow", "changed", false, "Stages reordered: s1, s2 -> s2, s1"},
+	}
+	if len(cl.Changes) != len(want) {
+		t.Fatalf("ERROR: Expected %d changes, got %d: %+v", len(want), len(cl.Changes), cl.Changes)
+	}
+	for i, w := range want {
+		ch := cl.Changes[i]
+		if ch.Key != w.key || ch.Change != w.change || ch.Breaking != w.breaking {
+			t.Errorf("ERROR: Expected %v, got %+v", w, ch)
+			continue
+		}
+		if w.detail != "" && (len(ch.Details) == 0 || ch.Details[0] != w.detail) {
+			t.Errorf("ERROR: Expected %s detail %q, got %v", w.key, w.detail, ch.Details)
+		}
+	}
+	task := cl.Changes[8]
+	if strings.Join(task.Details, "; ") != "RequiredParams added: b; Template inline contents changed; Description changed" {
+		t.Errorf("ERROR: Bad task details: %v", task.Details)
+	}
+	if task.Diffs["inline"] != "@@\n one\n-two\n+2\n three\n" {
+		t.Errorf("ERROR: Bad template diff: %q", task.Diffs["inline"])
+	}
+	md := cl.Markdown()
+	for _, s := range []string{"# changelog-test v1.1.0", "## Breaking changes", "- tasks `gone` removed", "```diff"} {
+		if !strings.Contains(md, s) {
+			t.Errorf("ERROR: Expected Markdown to contain %q", s)
+		}
+	}
+	t.Logf("%s", md)
+}
+
+func TestLineDiff(t *testing.T) {
+	old := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10"
+	new := "1\n2\n3\n4\n5\nsix\n7\n8\n9\n10"
+	if d := LineDiff(old, new); d != "@@\n 3\n 4\n 5\n-6\n+six\n 7\n 8\n 9\n" {
+		t.Errorf("ERROR: Bad diff: %q", d)
+	}
+}
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// ContentDrift describes how an object on an endpoint has drifted
+// from the content bundle that provides it.
+//
+// swagger:model
+type ContentDrift struct {
+	// Prefix is the type of the object.
+	Prefix string
+	// Key is the key of the object.
+	Key string
+	// Drift is one of:
+	//
+	// override: the live object is a writable object, or comes from
+	// another content bundle, and is the same as the one in the content.
+	//
+	// modified: the live object is different from the one in the
+	// content.
+	//
+	// missing: the object is in the content, but not on the endpoint.
+	//
+	// local: the live object is a writable object of a type the
+	// content provides, but the content does not have it.
+	Drift string
+	// Bundle is the content bundle the live object comes from.  It is
+	// empty for writable objects.
+	Bundle string
+	// Fields are the fields that are different for modified objects.
+	Fields []string `json:",omitempty"`
+}
+
+// Writable returns whether the drifted live object is a writable
+// object, and so would belong in a patch bundle.
+func (d *ContentDrift) Writable() bool {
+	return d.Drift != "missing" && d.Bundle == ""
+}
+
+// driftIgnored are fields that are different on live objects without
+// the object being different.
+var driftIgnored = map[string]struct{}{
+	"Validated": {}, "Available": {}, "Errors": {}, "ReadOnly": {}, "Bundle": {}, "Endpoint": {},
+}
+
+func driftFields(obj interface{}) (map[string]interface{}, error) {
+	res := map[string]interface{}{}
+	if err := Remarshal(obj, &res); err != nil {
+		return nil, err
+	}
+	for k := range driftIgnored {
+		delete(res, k)
+	}
+	return res, nil
+}
+
+// ContentDrifts compares the objects in content with the live
+// objects on an endpoint, keyed by prefix.  live should have all the
+// objects of each type the content provides.  Writable objects that
+// are not in the content are only reported if local is set.  The
+// results are sorted by prefix and key.
+func ContentDrifts(content *Content, live map[string][]Model, local bool) ([]*ContentDrift, error) {
+	res := []*ContentDrift{}
+	prefixes := make([]string, 0, len(content.Sections))
+	for prefix := range content.Sections {
+		if _, err := New(prefix); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		have := map[string]Model{}
+		for _, obj := range live[prefix] {
+			have[obj.Key()] = obj
+		}
+		keys := map[string]struct{}{}
+		for key := range content.Sections[prefix] {
+			keys[key] = struct{}{}
+		}
+		for key := range have {
+			keys[key] = struct{}{}
+		}
+		for _, key := range setToList(keys) {
+			d := &ContentDrift{Prefix: prefix, Key: key}
+			obj, isLive := have[key]
+			if b, ok := obj.(Bundler); ok {
+				d.Bundle = b.GetBundle()
+			}
+			packed, inContent := content.Sections[prefix][key]
+			switch {
+			case !isLive:
+				d.Drift = "missing"
+			case !inContent:
+				if !local || d.Bundle != "" {
+					continue
+				}
+				d.Drift = "local"
+			default:
+				ref, _ := New(prefix)
+				if err := Remarshal(packed, ref); err != nil {
+					return nil, fmt.Errorf("%s/%s: %v", prefix, key, err)
+				}
+				want, err := driftFields(ref)
+				if err != nil {
+					return nil, fmt.Errorf("%s/%s: %v", prefix, key, err)
+				}
+				got, err := driftFields(obj)
+				if err != nil {
+					return nil, fmt.Errorf("%s/%s: %v", prefix, key, err)
+				}
+				fields := map[string]struct{}{}
+				for k := range want {
+					fields[k] = struct{}{}
+				}
+				for k := range got {
+					fields[k] = struct{}{}
+				}
+				for _, k := range setToList(fields) {
+					if !reflect.DeepEqual(want[k], got[k]) {
+						d.Fields = append(d.Fields, k)
+					}
+				}
+				switch {
+				case len(d.Fields) > 0:
+					d.Drift = "modified"
+				case d.Bundle != content.Meta.Name:
+					d.Drift = "override"
+				default:
+					continue
+				}
+			}
+			res = append(res, d)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContentDrifts(t *testing.T) {
+	c := &Content{}
+	c.Fill()
+	c.Meta.Name = "drift-test"
+	c.Sections["tasks"] = Section{
+		"same":     map[string]interface{}{"Name": "same", "Description": "d"},
+		"copied":   map[string]interface{}{"Name": "copied", "Description": "d"},
+		"edited":   map[string]interface{}{"Name": "edited", "Description": "d"},
+		"shadowed": map[string]interface{}{"Name": "shadowed"},
+		"gone":     map[string]interface{}{"Name": "gone"},
+	}
+	task := func(name, desc, bundle string) Model {
+		t := &Task{Name: name, Description: desc}
+		t.Fill()
+		t.Validated, t.Available, t.ReadOnly = true, true, bundle != ""
+		t.SetBundle(bundle)
+		return t
+	}
+	live := map[string][]Model{
+		"tasks": {
+			task("same", "d", "drift-test"),
+			task("copied", "d", ""),
+			task("edited", "changed", ""),
+			task("shadowed", "", "other"),
+			task("extra", "", ""),
+			task("theirs", "", "other"),
+		},
+	}
+	expect := func(drifts []*ContentDrift, want ...string) {
+		t.Helper()
+		got := []string{}
+		for _, d := range drifts {
+			s := d.Drift + " " + d.Key
+			if len(d.Fields) > 0 {
+				s += " " + strings.Join(d.Fields, ",")
+			}
+			got = append(got, s)
+		}
+		if strings.Join(got, "; ") != strings.Join(want, "; ") {
+			t.Errorf("ERROR: Expected %v, got %v", want, got)
+		}
+	}
+	drifts, err := ContentDrifts(c, live, false)
+	if err != nil {
+		t.Fatalf("ERROR: Unexpected drift failure: %v", err)
+	}
+	expect(drifts, "override copied", "modified edited Description", "missing gone", "override shadowed")
+	if !drifts[0].Writable() || drifts[3].Writable() || drifts[3].Bundle != "other" {
+		t.Errorf("ERROR: Bad drift details: %+v %+v", drifts[0], drifts[3])
+	}
+	drifts, _ = ContentDrifts(c, live, true)
+	expect(drifts, "override copied", "modified edited Description", "local extra", "missing gone", "override shadowed")
+}
@@ -0,0 +1,233 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// LintFinding is a single problem found in a content bundle by
+// LintContent.
+//
+// swagger:model
+type LintFinding struct {
+	// Severity is either "error" for problems that will keep the
+	// content from working, or "warning" for things that may be
+	// problems.
+	Severity string
+	// File is where the object with the problem came from, if known.
+	File string
+	// Model is the prefix of the object with the problem.
+	Model string
+	// Key is the key of the object with the problem.
+	Key string
+	// Message describes the problem.
+	Message string
+}
+
+func (f *LintFinding) String() string {
+	where := f.File
+	if where == "" {
+		where = f.Model + "/" + f.Key
+	}
+	return fmt.Sprintf("%s: %s: %s", where, f.Severity, f.Message)
+}
+
+// builtinObjects are the objects that dr-provision always has, so
+// content can refer to them without providing them.
+var builtinObjects = map[string]struct{}{
+	"bootenvs/ignore": {},
+	"bootenvs/local":  {},
+	"stages/none":     {},
+	"stages/local":    {},
+	"profiles/global": {},
+}
+
+type linter struct {
+	content  *Content
+	sources  map[string][]string
+	objs     map[string]Model
+	prereqs  []string
+	findings []*LintFinding
+}
+
+func (l *linter) add(severity string, obj Model, format string, args ...interface{}) {
+	f := &LintFinding{
+		Severity: severity,
+		Model:    obj.Prefix(),
+		Key:      obj.Key(),
+		Message:  fmt.Sprintf(format, args...),
+	}
+	if files := l.sources[f.Model+"/"+f.Key]; len(files) > 0 {
+		f.File = files[len(files)-1]
+	}
+	l.findings = append(l.findings, f)
+}
+
+// ref checks that the object with the passed-in prefix and key is in
+// the content bundle.  Objects that are not are errors unless the
+// content has prerequisites that could provide them.
+func (l *linter) ref(obj Model, what, prefix, key string) {
+	if key == "" {
+		return
+	}
+	if _, ok := l.objs[prefix+"/"+key]; ok {
+		return
+	}
+	if _, ok := builtinObjects[prefix+"/"+key]; ok {
+		return
+	}
+	if len(l.prereqs) > 0 {
+		l.add("warning", obj, "%s %s is not in this content, and must come from one of its prerequisites: %s",
+			what, key, strings.Join(l.prereqs, ", "))
+		return
+	}
+	l.add("error", obj, "%s %s does not exist", what, key)
+}
+
+func (l *linter) templates(obj Model, tmpls []TemplateInfo) {
+	for i := range tmpls {
+		ti := &tmpls[i]
+		if ti.ID != "" {
+			l.ref(obj, fmt.Sprintf("Templates[%d] template", i), "templates", ti.ID)
+		}
+		if ti.Contents != "" {
+			if _, err := template.New(ti.Name).Funcs(DrpSafeFuncMap()).Parse(ti.Contents); err != nil {
+				l.add("error", obj, "Templates[%d] (%s) does not parse: %v", i, ti.Name, err)
+			}
+		}
+	}
+}
+
+func (l *linter) taskList(obj Model, what string, tasks []string) {
+	for _, t := range tasks {
+		// Entries like stage:foo and bootenv:bar are not tasks.
+		if strings.Contains(t, ":") {
+			continue
+		}
+		l.ref(obj, what, "tasks", t)
+	}
+}
+
+func (l *linter) check(obj Model) {
+	if v, ok := obj.(Validator); ok {
+		v.ClearValidation()
+		v.Validate()
+		if vv, ok := obj.(interface{ SaveValidation() *Validation }); ok {
+			for _, e := range vv.SaveValidation().Errors {
+				l.add("error", obj, "%s", e)
+			}
+		}
+	}
+	if p, ok := obj.(Profiler); ok {
+		for _, name := range p.GetProfiles() {
+			l.ref(obj, "Profile", "profiles", name)
+		}
+	}
+	switch o := obj.(type) {
+	case *Template:
+		if _, err := template.New(o.ID).Funcs(DrpSafeFuncMap()).Parse(o.Contents); err != nil {
+			l.add("error", obj, "Template does not parse: %v", err)
+		}
+	case *Task:
+		l.templates(obj, o.Templates)
+		l.taskList(obj, "Prerequisite task", o.Prerequisites)
+	case *Stage:
+		l.templates(obj, o.Templates)
+		l.taskList(obj, "Task", o.Tasks)
+		l.ref(obj, "BootEnv", "bootenvs", o.BootEnv)
+	case *BootEnv:
+		l.templates(obj, o.Templates)
+	case *Workflow:
+		for _, st := range o.Stages {
+			l.ref(obj, "Stage", "stages", st)
+		}
+	}
+}
+
+// LintContent checks the objects in a content bundle.  It runs the
+// Validate method of every object, checks that the objects they
+// refer to are in the bundle (or could come from its prerequisites),
+// makes sure all the templates parse, and checks params against their
+// Param definitions.  sources maps prefix/key to the files the object
+// was loaded from, as returned by BundleContentWithSources, and may
+// be nil.
+func LintContent(c *Content, sources map[string][]string) ([]*LintFinding, error) {
+	l := &linter{
+		content: c,
+		sources: sources,
+		objs:    map[string]Model{},
+	}
+	if l.sources == nil {
+		l.sources = map[string][]string{}
+	}
+	if c.Meta.Prerequisites != "" {
+		prereqs, err := ParseContentPrerequisites(c.Meta.Prerequisites)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Prerequisites: %v", err)
+		}
+		for name := range prereqs {
+			l.prereqs = append(l.prereqs, name)
+		}
+		sort.Strings(l.prereqs)
+	}
+	if c.Meta.ContentHash != "" {
+		hash, err := c.Hash()
+		if err != nil {
+			return nil, err
+		}
+		if hash != c.Meta.ContentHash {
+			l.findings = append(l.findings, &LintFinding{
+				Severity: "error",
+				Message:  fmt.Sprintf("ContentHash %s does not match the content, which hashes to %s", c.Meta.ContentHash, hash),
+			})
+		}
+	}
+	prefixes := make([]string, 0, len(c.Sections))
+	for prefix := range c.Sections {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	all := []Model{}
+	for _, prefix := range prefixes {
+		keys := make([]string, 0, len(c.Sections[prefix]))
+		for key := range c.Sections[prefix] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			obj, err := New(prefix)
+			if err != nil {
+				return nil, err
+			}
+			if err := Remarshal(c.Sections[prefix][key], obj); err != nil {
+				return nil, fmt.Errorf("%s/%s: %v", prefix, key, err)
+			}
+			obj.Fill()
+			l.objs[prefix+"/"+obj.Key()] = obj
+			all = append(all, obj)
+		}
+	}
+	for _, obj := range all {
+		if files := l.sources[obj.Prefix()+"/"+obj.Key()]; len(files) > 1 {
+			l.add("error", obj, "Defined in more than one file: %s", strings.Join(files, ", "))
+		}
+		l.check(obj)
+	}
+	pc := NewParamChecker(all...)
+	for _, obj := range all {
+		for _, issue := range pc.Check(obj) {
+			switch issue.Type {
+			case "type":
+				l.add("error", obj, "%s: %s", issue.Param, issue.Message)
+			case "unknown":
+				// The Param definition may come from a prerequisite.
+				if len(l.prereqs) == 0 {
+					l.add("warning", obj, "%s: %s", issue.Param, issue.Message)
+				}
+			}
+		}
+	}
+	return l.findings, nil
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLintContent(t *testing.T) {
+	c := &Content{}
+	c.Fill()
+	c.Meta.Name = "lint-test"
+	add := func(obj Model) {
+		if c.Sections[obj.Prefix()] == nil {
+			c.Sections[obj.Prefix()] = Section{}
+		}
+		c.Sections[obj.Prefix()][obj.Key()] = obj
+	}
+	add(&Param{Name: "num", Schema: map[string]interface{}{"type": "integer"}})
+	add(&Template{ID: "good.tmpl", Contents: `{{.Param "num"}}`})
+	add(&Template{ID: "bad.tmpl", Contents: `{{if}}`})
+	add(&Task{Name: "task", Templates: []TemplateInfo{
+		{Name: "ok", ID: "good.tmpl"},
+		{Name: "missing", ID: "missing.tmpl"},
+		{Name: "inline", Contents: `{{ .Param "num" `},
+	}})
+	add(&Stage{Name: "stage", BootEnv: "local", Tasks: []string{"task", "gone", "stage:other"}})
+	add(&Workflow{Name: "flow", Stages: []string{"stage", "none", "missing-stage"}})
+	add(&Profile{Name: "prof", Params: map[string]interface{}{"num": "three"}})
+	sources := map[string][]string{
+		"profiles/prof": {"profiles/prof.yaml", "profiles/prof2.yaml"},
+		"tasks/task":    {"tasks/task.yaml"},
+	}
+
+	expect := func(findings []*LintFinding, want ...string) {
+		t.Helper()
+		if len(findings) != len(want) {
+			t.Errorf("ERROR: expected %d findings, got %d: %v", len(want), len(findings), findings)
+			return
+		}
+		for i := range want {
+			if !strings.Contains(findings[i].String(), want[i]) {
+				t.Errorf("ERROR: expected finding %d to contain %q, got %q", i, want[i], findings[i])
+			} else {
+				t.Logf("%s", findings[i])
+			}
+		}
+	}
+
+	findings, err := LintContent(c, sources)
+	if err != nil {
+		t.Fatalf("ERROR: Unexpected lint failure: %v", err)
+	}
+	expect(findings,
+		"profiles/prof2.yaml: error: Defined in more than one file",
+		"stages/stage: error: Task gone does not exist",
+		"tasks/task.yaml: error: Templates[1] template missing.tmpl does not exist",
+		"tasks/task.yaml: error: Templates[2] (inline) does not parse",
+		"templates/bad.tmpl: error: Template does not parse",
+		"workflows/flow: error: Stage missing-stage does not exist",
+		"profiles/prof2.yaml: error: num:",
+	)
+
+	c.Meta.Prerequisites = "other-content"
+	findings, err = LintContent(c, nil)
+	if err != nil {
+		t.Fatalf("ERROR: Unexpected lint failure: %v", err)
+	}
+	for _, f := range findings {
+		if strings.Contains(f.Message, "does not exist") {
+			t.Errorf("ERROR: Missing references should be warnings with prerequisites: %s", f)
+		}
+	}
+	c.Meta.Prerequisites = "other-content: >>1"
+	if _, err := LintContent(c, nil); err == nil {
+		t.Errorf("ERROR: Expected invalid prerequisites to fail")
+	}
+}
@@ -0,0 +1,467 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gofunky/semver"
+)
+
+// ContentPlanStep is one content pack in the plan made by
+// ContentResolver.
+//
+// swagger:model
+type ContentPlanStep struct {
+	// Name is the name of the content pack.
+	Name string
+	// Action is what needs to happen to the content pack.  It is one
+	// of "install", "upgrade", "downgrade", "reinstall", or "keep".
+	Action string
+	// Version is the catalog version of the item to install.  It is
+	// empty when the installed content pack is kept.
+	Version string
+	// ActualVersion is the version the content pack will be at after
+	// the plan is carried out.
+	ActualVersion string
+	// InstalledVersion is the version that is installed now, if any.
+	InstalledVersion string
+	// RequiredBy lists the content packs in the plan that have this one
+	// as a prerequisite.
+	RequiredBy []string
+	// Item is the catalog item to install, if any.
+	Item *CatalogItem `json:"-"`
+}
+
+func (s *ContentPlanStep) String() string {
+	res := fmt.Sprintf("%s %s %s", s.Action, s.Name, s.ActualVersion)
+	if s.InstalledVersion != "" && s.InstalledVersion != s.ActualVersion {
+		res += " (from " + s.InstalledVersion + ")"
+	}
+	if len(s.RequiredBy) > 0 {
+		res += " required by " + strings.Join(s.RequiredBy, ", ")
+	}
+	return res
+}
+
+// ContentResolver picks the versions of a content pack and all of its
+// prerequisites to install from a catalog, such that every
+// prerequisite version constraint is met, including the ones of the
+// content packs that are already installed and will stay that way.
+//
+// Installed content packs other than the one being installed are
+// fixed unless UpgradeInstalled is set, and no installed content pack
+// is downgraded unless AllowDowngrade is set.  When a plan would need
+// either, Resolve fails with the conflicts instead.
+type ContentResolver struct {
+	// Items are the items in the catalog.
+	Items []*CatalogItem
+	// Installed are the content packs that are currently installed, as
+	// returned by the contents API.  Only the dynamic ones are
+	// considered; the stores the server builds itself (such as
+	// BackingStore and BasicStore) do not have catalog versions.
+	Installed []*ContentSummary
+	// Tip allows tip versions to be picked for prerequisites.
+	Tip bool
+	// UpgradeInstalled allows installed content packs to be upgraded or
+	// reinstalled to satisfy the prerequisites of the one being
+	// installed.
+	UpgradeInstalled bool
+	// AllowDowngrade allows installed content packs to be downgraded.
+	AllowDowngrade bool
+	// Prerequisites returns the Prerequisites of the content pack in
+	// a catalog item.  It is only called when the item does not have
+	// them in its Meta.
+	Prerequisites func(*CatalogItem) (string, error)
+}
+
+// candidate is a version of a content pack that could be picked.
+type candidate struct {
+	name      string
+	version   semver.Version
+	item      *CatalogItem
+	installed bool
+	loaded    bool
+	prereqs   map[string]semver.Range
+	raw       map[string]string
+}
+
+// constraint is a version constraint placed on a content pack by a
+// prerequisite of another one.
+type constraint struct {
+	from string
+	text string
+	rng  semver.Range
+}
+
+type resolveState struct {
+	picked      map[string]*candidate
+	constraints map[string][]constraint
+}
+
+func (s *resolveState) clone() *resolveState {
+	res := &resolveState{
+		picked:      map[string]*candidate{},
+		constraints: map[string][]constraint{},
+	}
+	for k, v := range s.picked {
+		res.picked[k] = v
+	}
+	for k, v := range s.constraints {
+		res.constraints[k] = append([]constraint{}, v...)
+	}
+	return res
+}
+
+// violations returns the constraints on name that v does not satisfy.
+func (s *resolveState) violations(name string, v semver.Version) []string {
+	res := []string{}
+	for _, c := range s.constraints[name] {
+		if !c.rng(v) {
+			res = append(res, fmt.Sprintf("%s requires %s %s", c.from, name, c.text))
+		}
+	}
+	return res
+}
+
+func parseVersion(name, v string) (semver.Version, error) {
+	res, err := ParseSemver(v)
+	if err != nil {
+		return res, fmt.Errorf("%s has invalid version %q: %v", name, v, err)
+	}
+	return res, nil
+}
+
+// parsePrereqs parses a Prerequisites string, keeping the text of each
+// constraint for error messages.
+func parsePrereqs(prereqs string) (map[string]semver.Range, map[string]string, error) {
+	rngs, err := ParseContentPrerequisites(prereqs)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw := map[string]string{}
+	for _, v := range strings.Split(prereqs, ",") {
+		parts := strings.SplitN(strings.TrimSpace(v), ":", 2)
+		if parts[0] == "" {
+			continue
+		}
+		if len(parts) == 1 {
+			parts = append(parts, ">=0.0.0")
+		}
+		raw[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return rngs, raw, nil
+}
+
+type resolver struct {
+	*ContentResolver
+	root       string
+	installed  map[string]*candidate
+	candidates map[string][]*candidate
+	conflicts  []string
+}
+
+func (r *resolver) loadPrereqs(c *candidate, prereqs string) error {
+	rngs, raw, err := parsePrereqs(prereqs)
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", c.name, c.version, err)
+	}
+	c.prereqs, c.raw, c.loaded = rngs, raw, true
+	return nil
+}
+
+// load fetches the prerequisites of a candidate from the catalog.
+// This can mean downloading the content pack, so it is only done for
+// the candidates that are tried.
+func (r *resolver) load(c *candidate) error {
+	if c.loaded {
+		return nil
+	}
+	prereqs, ok := c.item.Meta["Prerequisites"]
+	if !ok && c.item.ContentType == "ContentPackage" && r.Prerequisites != nil {
+		var err error
+		if prereqs, err = r.Prerequisites(c.item); err != nil {
+			return fmt.Errorf("%s %s: %v", c.name, c.version, err)
+		}
+	}
+	return r.loadPrereqs(c, prereqs)
+}
+
+// itemCandidate makes a candidate from a catalog item.
+func (r *resolver) itemCandidate(item *CatalogItem) (*candidate, error) {
+	v := item.ActualVersion
+	if v == "" {
+		v = item.Version
+	}
+	ver, err := parseVersion(item.Name, v)
+	if err != nil {
+		return nil, err
+	}
+	return &candidate{name: item.Name, version: ver, item: item}, nil
+}
+
+// catalogCandidates returns the versions of name in the catalog that
+// can be picked to satisfy a prerequisite, best first.
+func (r *resolver) catalogCandidates(name string) []*candidate {
+	if res, ok := r.candidates[name]; ok {
+		return res
+	}
+	preferred := "stable"
+	if r.Tip {
+		preferred = "tip"
+	}
+	cands := []*candidate{}
+	for _, item := range r.Items {
+		if item.Name != name || (item.Tip && !r.Tip) {
+			continue
+		}
+		c, err := r.itemCandidate(item)
+		if err != nil {
+			r.conflicts = append(r.conflicts, err.Error())
+			continue
+		}
+		cands = append(cands, c)
+	}
+	sort.SliceStable(cands, func(i, j int) bool {
+		if (cands[i].item.Version == preferred) != (cands[j].item.Version == preferred) {
+			return cands[i].item.Version == preferred
+		}
+		return cands[i].version.GT(cands[j].version)
+	})
+	res := []*candidate{}
+	seen := map[string]bool{}
+	for _, c := range cands {
+		if seen[c.version.String()] {
+			continue
+		}
+		seen[c.version.String()] = true
+		res = append(res, c)
+	}
+	r.candidates[name] = res
+	return res
+}
+
+// replaces returns why c may not replace the installed version of its
+// content pack, if it may not.
+func (r *resolver) replaces(c *candidate) string {
+	inst, ok := r.installed[c.name]
+	if !ok || inst == c {
+		return ""
+	}
+	if c.version.LT(inst.version) {
+		if !r.AllowDowngrade {
+			return fmt.Sprintf("%s %s: would downgrade installed %s %s, which is not allowed",
+				c.name, c.version, c.name, inst.version)
+		}
+		return ""
+	}
+	if c.name != r.root && !r.UpgradeInstalled {
+		return fmt.Sprintf("%s %s: would replace installed %s %s, which is not allowed",
+			c.name, c.version, c.name, inst.version)
+	}
+	return ""
+}
+
+// pick tries c for its content pack, and returns the new state, or
+// nil if c conflicts with what has been picked already or may not
+// replace what is installed.
+func (r *resolver) pick(s *resolveState, c *candidate) *resolveState {
+	if why := r.replaces(c); why != "" {
+		r.conflicts = append(r.conflicts, why)
+		return nil
+	}
+	if errs := s.violations(c.name, c.version); len(errs) > 0 {
+		r.conflicts = append(r.conflicts, fmt.Sprintf("%s %s: %s", c.name, c.version, strings.Join(errs, ", ")))
+		return nil
+	}
+	if err := r.load(c); err != nil {
+		r.conflicts = append(r.conflicts, err.Error())
+		return nil
+	}
+	ns := s.clone()
+	ns.picked[c.name] = c
+	if inst, ok := r.installed[c.name]; ok && inst != c {
+		// The installed version is being replaced, so its prerequisites
+		// no longer apply.
+		from := c.name + " (installed)"
+		for name, cs := range ns.constraints {
+			keep := cs[:0]
+			for _, con := range cs {
+				if con.from != from {
+					keep = append(keep, con)
+				}
+			}
+			ns.constraints[name] = keep
+		}
+	}
+	for name, rng := range c.prereqs {
+		con := constraint{from: c.name, text: c.raw[name], rng: rng}
+		if p, ok := ns.picked[name]; ok && !rng(p.version) {
+			r.conflicts = append(r.conflicts, fmt.Sprintf("%s %s requires %s %s, but %s is needed",
+				c.name, c.version, name, con.text, p.version))
+			return nil
+		}
+		ns.constraints[name] = append(ns.constraints[name], con)
+	}
+	return ns
+}
+
+// solve picks versions for every content pack in todo and their
+// prerequisites.
+func (r *resolver) solve(s *resolveState, todo []string) *resolveState {
+	for len(todo) > 0 && s.picked[todo[0]] != nil {
+		todo = todo[1:]
+	}
+	if len(todo) == 0 {
+		return s
+	}
+	name := todo[0]
+	cands := r.catalogCandidates(name)
+	if inst, ok := r.installed[name]; ok {
+		// Reinstalling the same version would not satisfy anything the
+		// installed one does not.
+		res := []*candidate{inst}
+		for _, c := range cands {
+			if !c.version.EQ(inst.version) {
+				res = append(res, c)
+			}
+		}
+		cands = res
+	}
+	if len(cands) == 0 {
+		r.conflicts = append(r.conflicts, fmt.Sprintf("%s is not installed and not in the catalog", name))
+		return nil
+	}
+	for _, c := range cands {
+		ns := r.pick(s, c)
+		if ns == nil {
+			continue
+		}
+		if res := r.solve(ns, append(todo[1:], sortedPrereqs(c)...)); res != nil {
+			return res
+		}
+	}
+	return nil
+}
+
+func sortedPrereqs(c *candidate) []string {
+	res := make([]string, 0, len(c.prereqs))
+	for name := range c.prereqs {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Resolve makes a plan to install the catalog item name at version
+// (such as "stable", "tip", or "v4.5.0"), along with all of its
+// prerequisites.  The steps are in the order they must be installed
+// in, with prerequisites first.
+func (cr *ContentResolver) Resolve(name, version string) ([]*ContentPlanStep, error) {
+	r := &resolver{
+		ContentResolver: cr,
+		root:            name,
+		installed:       map[string]*candidate{},
+		candidates:      map[string][]*candidate{},
+	}
+	s := &resolveState{picked: map[string]*candidate{}, constraints: map[string][]constraint{}}
+	for _, cs := range cr.Installed {
+		// An empty Type means dynamic when the content is loaded.
+		if cs.Meta.Type != "" && cs.Meta.Type != "dynamic" {
+			continue
+		}
+		ver, err := parseVersion(cs.Meta.Name, cs.Meta.Version)
+		if err != nil {
+			return nil, fmt.Errorf("Installed content %v", err)
+		}
+		c := &candidate{name: cs.Meta.Name, version: ver, installed: true}
+		if err := r.loadPrereqs(c, cs.Meta.Prerequisites); err != nil {
+			return nil, fmt.Errorf("Installed content %v", err)
+		}
+		r.installed[c.name] = c
+	}
+	// Installed content packs stay as they are unless they are picked
+	// again, so their prerequisites must keep being met.
+	for _, c := range r.installed {
+		for pname, rng := range c.prereqs {
+			s.constraints[pname] = append(s.constraints[pname],
+				constraint{from: c.name + " (installed)", text: c.raw[pname], rng: rng})
+		}
+	}
+	var root *CatalogItem
+	for _, item := range cr.Items {
+		if item.Name == name && item.Version == version {
+			root = item
+			break
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("%s version %s not in catalog", name, version)
+	}
+	rc, err := r.itemCandidate(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(rc); err != nil {
+		return nil, err
+	}
+	ns := r.pick(s, rc)
+	var res *resolveState
+	if ns != nil {
+		res = r.solve(ns, sortedPrereqs(rc))
+	}
+	if res == nil {
+		msg := fmt.Sprintf("Unable to find versions of %s %s and its prerequisites that work together", name, version)
+		seen := map[string]bool{}
+		for _, c := range r.conflicts {
+			if !seen[c] {
+				seen[c] = true
+				msg += "\n  " + c
+			}
+		}
+		return nil, fmt.Errorf("%s", msg)
+	}
+	return r.plan(res, rc), nil
+}
+
+// plan orders the picked content packs so that prerequisites come
+// before the packs that need them.
+func (r *resolver) plan(s *resolveState, root *candidate) []*ContentPlanStep {
+	res := []*ContentPlanStep{}
+	steps := map[string]*ContentPlanStep{}
+	var visit func(c *candidate)
+	visit = func(c *candidate) {
+		if _, ok := steps[c.name]; ok {
+			return
+		}
+		step := &ContentPlanStep{Name: c.name, ActualVersion: c.version.String(), RequiredBy: []string{}}
+		steps[c.name] = step
+		for _, pname := range sortedPrereqs(c) {
+			visit(s.picked[pname])
+			steps[pname].RequiredBy = append(steps[pname].RequiredBy, c.name)
+		}
+		inst, isInstalled := r.installed[c.name]
+		if isInstalled {
+			step.InstalledVersion = inst.version.String()
+		}
+		switch {
+		case c.installed:
+			step.Action = "keep"
+		case !isInstalled:
+			step.Action = "install"
+		case c.version.GT(inst.version):
+			step.Action = "upgrade"
+		case c.version.LT(inst.version):
+			step.Action = "downgrade"
+		default:
+			step.Action = "reinstall"
+		}
+		if c.item != nil {
+			step.Version = c.item.Version
+			step.Item = c.item
+		}
+		res = append(res, step)
+	}
+	visit(root)
+	return res
+}
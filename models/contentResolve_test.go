@@ -0,0 +1,142 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContentResolver(t *testing.T) {
+	prereqs := map[string]string{}
+	items := []*CatalogItem{}
+	add := func(name, version, actual, pre string) {
+		item := &CatalogItem{
+			Id:            name + "-" + version,
+			Name:          name,
+			Version:       version,
+			ActualVersion: actual,
+			ContentType:   "ContentPackage",
+			Tip:           version == "tip",
+		}
+		items = append(items, item)
+		prereqs[item.Id] = pre
+	}
+	add("a", "stable", "v2.0.0", "b: >=1.0.0 <2.0.0")
+	add("a", "v2.0.0", "v2.0.0", "b: >=1.0.0 <2.0.0")
+	add("a", "v1.0.0", "v1.0.0", "b")
+	add("b", "stable", "v2.0.0", "")
+	add("b", "v2.0.0", "v2.0.0", "")
+	add("b", "v1.5.0", "v1.5.0", "base")
+	add("b", "v1.0.0", "v1.0.0", "")
+	add("b", "tip", "v2.1.0-tip.1", "")
+	add("base", "stable", "v1.0.0", "")
+	add("c", "stable", "v1.0.0", "")
+	add("bad", "stable", "latest", "")
+	fetched := map[string]int{}
+	upgrade, downgrade := false, false
+	resolve := func(installed []*ContentSummary, name, version string) ([]*ContentPlanStep, error) {
+		r := &ContentResolver{
+			Items:            items,
+			Installed:        installed,
+			UpgradeInstalled: upgrade,
+			AllowDowngrade:   downgrade,
+			Prerequisites: func(item *CatalogItem) (string, error) {
+				fetched[item.Id]++
+				return prereqs[item.Id], nil
+			},
+		}
+		return r.Resolve(name, version)
+	}
+	installed := func(name, version, pre string) *ContentSummary {
+		cs := &ContentSummary{}
+		cs.Meta.Name, cs.Meta.Version, cs.Meta.Prerequisites = name, version, pre
+		return cs
+	}
+	expect := func(plan []*ContentPlanStep, err error, want ...string) {
+		t.Helper()
+		if err != nil {
+			t.Errorf("ERROR: Unexpected resolve failure: %v", err)
+			return
+		}
+		got := []string{}
+		for _, step := range plan {
+			got = append(got, step.Action+" "+step.Name+" "+step.ActualVersion)
+		}
+		if strings.Join(got, ", ") != strings.Join(want, ", ") {
+			t.Errorf("ERROR: Expected plan %v, got %v", want, got)
+		} else {
+			t.Logf("Plan: %v", plan)
+		}
+	}
+
+	plan, err := resolve(nil, "a", "stable")
+	expect(plan, err, "install base 1.0.0", "install b 1.5.0", "install a 2.0.0")
+	if fetched["b-v1.0.0"] != 0 {
+		t.Errorf("ERROR: Prerequisites fetched for candidates that were not needed")
+	}
+	if plan[0].RequiredBy[0] != "b" || plan[1].Item.Id != "b-v1.5.0" {
+		t.Errorf("ERROR: Bad plan details: %v %v", plan[0].RequiredBy, plan[1].Item)
+	}
+
+	plan, err = resolve([]*ContentSummary{installed("b", "v1.0.0", "")}, "a", "stable")
+	expect(plan, err, "keep b 1.0.0", "install a 2.0.0")
+
+	inst := []*ContentSummary{installed("b", "v2.0.0", ""), installed("a", "v1.0.0", "b")}
+	_, err = resolve(inst, "a", "stable")
+	if err == nil || !strings.Contains(err.Error(), "would downgrade installed b 2.0.0") {
+		t.Errorf("ERROR: Expected downgrade to need AllowDowngrade, got %v", err)
+	} else {
+		t.Logf("Got expected error %v", err)
+	}
+	downgrade = true
+	plan, err = resolve(inst, "a", "stable")
+	expect(plan, err, "install base 1.0.0", "downgrade b 1.5.0", "upgrade a 2.0.0")
+	downgrade = false
+
+	inst = []*ContentSummary{installed("b", "v1.0.0", ""), installed("c", "v0.9.0", "")}
+	add("d", "stable", "v1.0.0", "b: >=1.5.0, c")
+	_, err = resolve(inst, "d", "stable")
+	if err == nil || !strings.Contains(err.Error(), "would replace installed b 1.0.0") {
+		t.Errorf("ERROR: Expected upgrade of installed content to need UpgradeInstalled, got %v", err)
+	} else {
+		t.Logf("Got expected error %v", err)
+	}
+	upgrade = true
+	plan, err = resolve(inst, "d", "stable")
+	expect(plan, err, "upgrade b 2.0.0", "keep c 0.9.0", "install d 1.0.0")
+	upgrade = false
+
+	plan, err = resolve([]*ContentSummary{installed("c", "v0.9.0", "")}, "c", "stable")
+	expect(plan, err, "upgrade c 1.0.0")
+
+	_, err = resolve([]*ContentSummary{installed("c", "v1.0.0", "b: >=2.0.0")}, "a", "stable")
+	if err == nil || !strings.Contains(err.Error(), "c (installed) requires b >=2.0.0") {
+		t.Errorf("ERROR: Expected conflict with installed content, got %v", err)
+	} else {
+		t.Logf("Conflict: %v", err)
+	}
+
+	if _, err = resolve(nil, "a", "v9.9.9"); err == nil {
+		t.Errorf("ERROR: Expected missing version to fail")
+	}
+
+	if _, err = resolve(nil, "bad", "stable"); err == nil || !strings.Contains(err.Error(), `invalid version "latest"`) {
+		t.Errorf("ERROR: Expected invalid version to fail, got %v", err)
+	} else {
+		t.Logf("Got expected error %v", err)
+	}
+	stores := []*ContentSummary{}
+	for name, typ := range map[string]string{"BackingStore": "writable", "LocalStore": "local", "DefaultStore": "default", "BasicStore": "basic"} {
+		cs := installed(name, "", "")
+		cs.Meta.Type = typ
+		stores = append(stores, cs)
+	}
+	stores = append(stores, installed("b", "v1.0.0", ""))
+	stores[len(stores)-1].Meta.Type = "dynamic"
+	plan, err = resolve(stores, "a", "stable")
+	expect(plan, err, "keep b 1.0.0", "install a 2.0.0")
+	if _, err = resolve([]*ContentSummary{installed("x", "junk", "")}, "a", "stable"); err == nil {
+		t.Errorf("ERROR: Expected invalid installed version to fail")
+	} else {
+		t.Logf("Got expected error %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package models
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	// ErrContentUnsigned is returned by VerifySignature when the content
+	// bundle has no signature.
+	ErrContentUnsigned = errors.New("Content is not signed")
+	// ErrContentUntrusted is returned by VerifySignature when the content
+	// bundle has a valid signature from a key that is not trusted.
+	ErrContentUntrusted = errors.New("Content is signed by an untrusted key")
+)
+
+// SigningBytes returns the canonical form of the content bundle that
+// is signed.  It is the JSON encoding of the metadata (except for the
+// signing and informational fields) and the sections, with all object
+// keys sorted, so that it does not depend on whether the bundle was
+// read from JSON or YAML or on the field order of the objects.
+func (c *Content) SigningBytes() ([]byte, error) {
+	meta := c.GenerateMetaMap()
+	delete(meta, "Type")
+	delete(meta, "SigningKey")
+	delete(meta, "Signature")
+	var sections interface{}
+	if err := Remarshal(c.Sections, &sections); err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]interface{}{
+		"meta":     meta,
+		"sections": sections,
+	})
+}
+
+// Sign signs the content bundle with key, and saves the signature and
+// the public part of key in the metadata.
+func (c *Content) Sign(key ed25519.PrivateKey) error {
+	buf, err := c.SigningBytes()
+	if err != nil {
+		return err
+	}
+	c.Meta.SigningKey = EncodeContentKey(key.Public().(ed25519.PublicKey))
+	c.Meta.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, buf))
+	return nil
+}
+
+// VerifySignature checks the signature of the content bundle.  If
+// trusted is empty, only the integrity of the content is checked
+// against the key it says it was signed with.  Otherwise, the content
+// must also have been signed by one of the trusted keys, or
+// ErrContentUntrusted is returned.  ErrContentUnsigned is returned if the
+// content has no signature.
+func (c *Content) VerifySignature(trusted []ed25519.PublicKey) error {
+	if c.Meta.Signature == "" && c.Meta.SigningKey == "" {
+		return ErrContentUnsigned
+	}
+	pub, err := DecodeContentKey(c.Meta.SigningKey)
+	if err != nil {
+		return fmt.Errorf("Invalid SigningKey: %v", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(c.Meta.Signature)
+	if err != nil {
+		return fmt.Errorf("Invalid Signature: %v", err)
+	}
+	buf, err := c.SigningBytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, buf, sig) {
+		return fmt.Errorf("Signature of content %s does not match its contents", c.Meta.Name)
+	}
+	if len(trusted) == 0 {
+		return nil
+	}
+	for _, k := range trusted {
+		if pub.Equal(k) {
+			return nil
+		}
+	}
+	return ErrContentUntrusted
+}
+
+// GenerateContentKey creates a new key for signing content bundles.
+func GenerateContentKey() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	return ed25519.GenerateKey(rand.Reader)
+}
+
+// EncodeContentKey returns the base64 encoding of a key used for
+// content signing.  It is the format used for key files and for
+// ContentMetaData.SigningKey.
+func EncodeContentKey(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// DecodeContentKey decodes a public key encoded with
+// EncodeContentKey.
+func DecodeContentKey(s string) (ed25519.PublicKey, error) {
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Public key must be %d bytes, not %d", ed25519.PublicKeySize, len(buf))
+	}
+	return ed25519.PublicKey(buf), nil
+}
+
+// DecodeContentPrivateKey decodes a private key encoded with
+// EncodeContentKey.
+func DecodeContentPrivateKey(s string) (ed25519.PrivateKey, error) {
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("Private key must be %d bytes, not %d", ed25519.PrivateKeySize, len(buf))
+	}
+	return ed25519.PrivateKey(buf), nil
+}
+
+// ParseTrustedContentKeys reads a list of trusted public keys, one
+// per line.  Anything after the key on a line is a comment, as are
+// blank lines and lines starting with #.
+func ParseTrustedContentKeys(r io.Reader) ([]ed25519.PublicKey, error) {
+	res := []ed25519.PublicKey{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		key, err := DecodeContentKey(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		res = append(res, key)
+	}
+	return res, scanner.Err()
+}
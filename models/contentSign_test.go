@@ -0,0 +1,65 @@
+package models
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+)
+
+func TestContentSigning(t *testing.T) {
+	pub, priv, err := GenerateContentKey()
+	if err != nil {
+		t.Fatalf("ERROR: Failed to generate key: %v", err)
+	}
+	otherPub, _, _ := GenerateContentKey()
+	c := &Content{}
+	c.Fill()
+	c.Meta.Name = "signed"
+	c.Meta.Version = "v1.0.0"
+	c.Sections["params"] = Section{"p1": &Param{Name: "p1", Schema: map[string]interface{}{"type": "integer"}}}
+
+	if err := c.VerifySignature(nil); err != ErrContentUnsigned {
+		t.Errorf("ERROR: Expected ErrContentUnsigned, got %v", err)
+	}
+	if err := c.Sign(priv); err != nil {
+		t.Fatalf("ERROR: Failed to sign: %v", err)
+	}
+	if c.Meta.SigningKey != EncodeContentKey(pub) {
+		t.Errorf("ERROR: SigningKey %s is not the public key", c.Meta.SigningKey)
+	}
+	if err := c.VerifySignature(nil); err != nil {
+		t.Errorf("ERROR: Signature did not verify: %v", err)
+	}
+	if err := c.VerifySignature([]ed25519.PublicKey{otherPub, pub}); err != nil {
+		t.Errorf("ERROR: Signature did not verify with trusted key: %v", err)
+	}
+	if err := c.VerifySignature([]ed25519.PublicKey{otherPub}); err != ErrContentUntrusted {
+		t.Errorf("ERROR: Expected ErrContentUntrusted, got %v", err)
+	}
+
+	// The signature must survive a trip through the generic form
+	// the CLI reads bundles into.
+	raw := &Content{}
+	if err := Remarshal(c, raw); err != nil {
+		t.Fatalf("ERROR: Failed to remarshal: %v", err)
+	}
+	if err := raw.VerifySignature(nil); err != nil {
+		t.Errorf("ERROR: Remarshaled content did not verify: %v", err)
+	}
+	raw.Meta.Type = "dynamic"
+	if err := raw.VerifySignature(nil); err != nil {
+		t.Errorf("ERROR: Informational fields should not be signed: %v", err)
+	}
+	raw.Meta.Version = "v1.0.1"
+	if err := raw.VerifySignature(nil); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("ERROR: Expected changed content to fail verification, got %v", err)
+	}
+
+	keys, err := ParseTrustedContentKeys(strings.NewReader("# trusted\n\n" + EncodeContentKey(pub) + " me\n"))
+	if err != nil || len(keys) != 1 || !keys[0].Equal(pub) {
+		t.Errorf("ERROR: Failed to parse trusted keys: %v %v", keys, err)
+	}
+	if _, err := ParseTrustedContentKeys(strings.NewReader("bogus\n")); err == nil {
+		t.Errorf("ERROR: Expected invalid trusted key to fail")
+	}
+}
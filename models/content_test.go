@@ -0,0 +1,72 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContentDifferences(t *testing.T) {
+	a := &Content{}
+	a.Fill()
+	a.Meta.Name = "diff-test"
+	a.Meta.Documentation = "docs\n"
+	a.Sections["tasks"] = Section{
+		"same":    map[string]interface{}{"Name": "same", "Description": "d"},
+		"changed": map[string]interface{}{"Name": "changed"},
+		"gone":    map[string]interface{}{"Name": "gone"},
+	}
+	b := &Content{}
+	b.Fill()
+	b.Meta.Name = "diff-test"
+	b.Meta.Type = "dynamic"
+	b.Meta.Documentation = "docs\n"
+	same := &Task{Name: "same", Description: "d"}
+	same.Fill()
+	same.SetBundle("diff-test")
+	b.Sections["tasks"] = Section{
+		"same":    same,
+		"changed": &Task{Name: "changed", Description: "new"},
+		"new":     &Task{Name: "new"},
+	}
+	diffs, err := ContentDifferences(a, b)
+	if err != nil {
+		t.Fatalf("ERROR: Unexpected failure: %v", err)
+	}
+	want := "tasks/changed: differs; tasks/gone: only in first; tasks/new: only in second"
+	if got := strings.Join(diffs, "; "); got != want {
+		t.Errorf("ERROR: Expected %q, got %q", want, got)
+	}
+	b.Meta.Documentation = "docs"
+	diffs, _ = ContentDifferences(a, b)
+	if len(diffs) != 4 || !strings.HasPrefix(diffs[0], "meta Documentation") {
+		t.Errorf("ERROR: Expected Documentation to differ, got %v", diffs)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	a := &Content{}
+	a.Fill()
+	a.Meta.Name = "hash-test"
+	a.Sections["tasks"] = Section{"t": map[string]interface{}{"Name": "t", "Description": "d"}}
+	b := &Content{}
+	b.Fill()
+	b.Meta.Name = "hash-test"
+	b.Meta.Type = "dynamic"
+	b.Meta.ContentHash = "sha256:stale"
+	task := &Task{Name: "t", Description: "d"}
+	task.Fill()
+	task.SetBundle("hash-test")
+	b.Sections["tasks"] = Section{"t": task}
+	ha, err := a.Hash()
+	if err != nil {
+		t.Fatalf("ERROR: Unexpected hash failure: %v", err)
+	}
+	hb, _ := b.Hash()
+	if ha != hb || !strings.HasPrefix(ha, "sha256:") {
+		t.Errorf("ERROR: Expected the same hash, got %s and %s", ha, hb)
+	}
+	task.Description = "changed"
+	if hc, _ := b.Hash(); hc == ha {
+		t.Errorf("ERROR: Expected changing an object to change the hash")
+	}
+}
@@ -33,6 +33,11 @@ type JobAction struct {
 	// JobAction.
 	// required: true
 	Content string
+	// Link is the rendered Link of the corresponding Template.  If it
+	// is set, a symlink to Link is made at Path instead of writing
+	// Content.
+	// required: false
+	Link string `json:",omitempty"`
 	// Meta is a copt of the Meta field of the corresponding Template from the Task this Job was built from.
 	// required: true
 	Meta map[string]string
@@ -108,7 +113,11 @@ type Job struct {
 	// required: true
 	State string
 	// The final disposition of the job.
-	// Can be one of "reboot","poweroff","stop", or "complete"
+	// Can be one of "reboot","poweroff","stop", or "complete".
+	// Failed jobs can also be "failed", "timeout" if the agent killed
+	// the task for running too long, "resource-limit" if the task
+	// was killed for exceeding its MemoryLimit, or "cancelled" if the
+	// task was cancelled from the agent status API.
 	// Other substates may be added as time goes on
 	ExitState string
 	// The time the job started running.
@@ -174,7 +183,7 @@ func (j *Job) Validate() {
 	}
 	if j.ExitState != "" {
 		switch j.ExitState {
-		case "reboot", "poweroff", "stop", "complete", "failed":
+		case "reboot", "poweroff", "stop", "complete", "failed", "timeout", "resource-limit", "cancelled":
 		default:
 			j.AddError(fmt.Errorf("Invalid ExitState `%s`", j.ExitState))
 		}
@@ -0,0 +1,276 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// ParamIssue is a single problem found while checking the params of
+// an object.
+//
+// swagger:model
+type ParamIssue struct {
+	// Model is the prefix of the object that has the problem.
+	Model string
+	// Key is the key of the object that has the problem.
+	Key string
+	// Param is the name of the param that has the problem.
+	Param string
+	// Type is the kind of problem.  It is one of "type" for values
+	// that do not match the Param schema, "required" for required
+	// params that are not set, or "unknown" for params that have no
+	// Param definition.
+	Type string
+	// Message describes the problem.
+	Message string
+}
+
+func (i *ParamIssue) String() string {
+	return fmt.Sprintf("%s:%s: %s: %s", i.Model, i.Key, i.Param, i.Message)
+}
+
+// ParamChecker checks the params set on objects against the schemas
+// of their Param definitions, and checks that the params required by
+// tasks, stages, bootenvs, and plugin providers are set.  It only
+// uses the objects it is created with, so it works equally well with
+// objects fetched from a dr-provision server or loaded from a content
+// bundle.
+type ParamChecker struct {
+	params    map[string]*Param
+	profiles  map[string]*Profile
+	stages    map[string]*Stage
+	tasks     map[string]*Task
+	bootenvs  map[string]*BootEnv
+	providers map[string]*PluginProvider
+	schemas   map[string]*gojsonschema.Schema
+	errs      map[string]error
+}
+
+// NewParamChecker creates a ParamChecker that resolves params,
+// profiles, stages, tasks, bootenvs, and plugin providers from objs.
+// Other objects in objs are ignored.
+func NewParamChecker(objs ...Model) *ParamChecker {
+	pc := &ParamChecker{
+		params:    map[string]*Param{},
+		profiles:  map[string]*Profile{},
+		stages:    map[string]*Stage{},
+		tasks:     map[string]*Task{},
+		bootenvs:  map[string]*BootEnv{},
+		providers: map[string]*PluginProvider{},
+		schemas:   map[string]*gojsonschema.Schema{},
+		errs:      map[string]error{},
+	}
+	for _, obj := range objs {
+		switch o := obj.(type) {
+		case *Param:
+			pc.params[o.Name] = o
+		case *Profile:
+			pc.profiles[o.Name] = o
+		case *Stage:
+			pc.stages[o.Name] = o
+		case *Task:
+			pc.tasks[o.Name] = o
+		case *BootEnv:
+			pc.bootenvs[o.Name] = o
+		case *PluginProvider:
+			pc.providers[o.Name] = o
+		}
+	}
+	return pc
+}
+
+func (pc *ParamChecker) schema(p *Param) (*gojsonschema.Schema, error) {
+	if s, ok := pc.schemas[p.Name]; ok {
+		return s, nil
+	}
+	if err, ok := pc.errs[p.Name]; ok {
+		return nil, err
+	}
+	s, err := gojsonschema.NewSchema(gojsonschema.NewGoLoader(p.Schema))
+	if err != nil {
+		pc.errs[p.Name] = err
+		return nil, err
+	}
+	pc.schemas[p.Name] = s
+	return s, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// CheckValue checks a single param value against the schema of its
+// Param definition.  Values of secure params that are still encrypted
+// are not checked.
+func (pc *ParamChecker) CheckValue(name string, val interface{}) (issues []*ParamIssue) {
+	p, ok := pc.params[name]
+	if !ok {
+		return []*ParamIssue{{Param: name, Type: "unknown", Message: "No Param definition"}}
+	}
+	if p.Schema == nil || (p.Secure && IsSecureData(val)) {
+		return nil
+	}
+	s, err := pc.schema(p)
+	if err != nil {
+		return []*ParamIssue{{Param: name, Type: "type", Message: fmt.Sprintf("Invalid schema: %v", err)}}
+	}
+	res, err := s.Validate(gojsonschema.NewGoLoader(val))
+	if err != nil {
+		return []*ParamIssue{{Param: name, Type: "type", Message: fmt.Sprintf("Error validating value: %v", err)}}
+	}
+	for _, e := range res.Errors() {
+		issues = append(issues, &ParamIssue{Param: name, Type: "type", Message: e.String()})
+	}
+	return
+}
+
+// provided returns the set of params that are available when
+// rendering for m: those set on the machine, its profiles, its stage
+// and the profiles of its stage, the global profile, and those with a
+// default value.
+func (pc *ParamChecker) provided(m *Machine) map[string]struct{} {
+	res := map[string]struct{}{}
+	addProfile := func(name string) {
+		if prof, ok := pc.profiles[name]; ok {
+			for k := range prof.Params {
+				res[k] = struct{}{}
+			}
+		}
+	}
+	for k := range m.Params {
+		res[k] = struct{}{}
+	}
+	for _, name := range m.Profiles {
+		addProfile(name)
+	}
+	if st, ok := pc.stages[m.Stage]; ok {
+		for k := range st.Params {
+			res[k] = struct{}{}
+		}
+		for _, name := range st.Profiles {
+			addProfile(name)
+		}
+	}
+	addProfile("global")
+	for name, p := range pc.params {
+		if _, ok := p.DefaultValue(); ok {
+			res[name] = struct{}{}
+		}
+	}
+	return res
+}
+
+// required returns the params required by the stage, bootenv, and
+// tasks of m, along with what requires each of them.
+func (pc *ParamChecker) required(m *Machine) map[string][]string {
+	res := map[string][]string{}
+	add := func(by string, params []string) {
+		for _, p := range params {
+			res[p] = append(res[p], by)
+		}
+	}
+	if st, ok := pc.stages[m.Stage]; ok {
+		add("stages:"+st.Name, st.RequiredParams)
+	}
+	if env, ok := pc.bootenvs[m.BootEnv]; ok {
+		add("bootenvs:"+env.Name, env.RequiredParams)
+	}
+	seen := map[string]struct{}{}
+	for _, name := range m.Tasks {
+		if strings.Contains(name, ":") {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		if t, ok := pc.tasks[name]; ok {
+			add("tasks:"+t.Name, t.RequiredParams)
+		}
+	}
+	return res
+}
+
+func (pc *ParamChecker) checkDeclared(required, optional []string) (issues []*ParamIssue) {
+	for _, name := range required {
+		if _, ok := pc.params[name]; !ok {
+			issues = append(issues, &ParamIssue{Param: name, Type: "unknown", Message: "Required param has no Param definition"})
+		}
+	}
+	for _, name := range optional {
+		if _, ok := pc.params[name]; !ok {
+			issues = append(issues, &ParamIssue{Param: name, Type: "unknown", Message: "Optional param has no Param definition"})
+		}
+	}
+	return
+}
+
+// Check returns all the param problems with obj.
+func (pc *ParamChecker) Check(obj Model) []*ParamIssue {
+	issues := []*ParamIssue{}
+	if pr, ok := obj.(Paramer); ok {
+		params := pr.GetParams()
+		for _, name := range sortedKeys(params) {
+			issues = append(issues, pc.CheckValue(name, params[name])...)
+		}
+	}
+	switch o := obj.(type) {
+	case *Machine:
+		have := pc.provided(o)
+		req := pc.required(o)
+		names := make([]string, 0, len(req))
+		for name := range req {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if _, ok := have[name]; !ok {
+				issues = append(issues, &ParamIssue{Param: name, Type: "required",
+					Message: fmt.Sprintf("Required by %s but not set", strings.Join(req[name], ", "))})
+			}
+		}
+	case *Plugin:
+		if pp, ok := pc.providers[o.Provider]; ok {
+			for _, name := range pp.RequiredParams {
+				if _, ok := o.Params[name]; ok {
+					continue
+				}
+				if p, ok := pc.params[name]; ok {
+					if _, ok := p.DefaultValue(); ok {
+						continue
+					}
+				}
+				issues = append(issues, &ParamIssue{Param: name, Type: "required",
+					Message: fmt.Sprintf("Required by plugin_providers:%s but not set", pp.Name)})
+			}
+		}
+	case *Task:
+		issues = append(issues, pc.checkDeclared(o.RequiredParams, o.OptionalParams)...)
+	case *Stage:
+		issues = append(issues, pc.checkDeclared(o.RequiredParams, o.OptionalParams)...)
+	case *BootEnv:
+		issues = append(issues, pc.checkDeclared(o.RequiredParams, o.OptionalParams)...)
+	}
+	for _, issue := range issues {
+		issue.Model = obj.Prefix()
+		issue.Key = obj.Key()
+	}
+	return issues
+}
+
+// CheckAll returns all the param problems with objs.
+func (pc *ParamChecker) CheckAll(objs ...Model) []*ParamIssue {
+	res := []*ParamIssue{}
+	for _, obj := range objs {
+		res = append(res, pc.Check(obj)...)
+	}
+	return res
+}
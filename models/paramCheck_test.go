@@ -0,0 +1,46 @@
+package models
+
+import "testing"
+
+func TestParamChecker(t *testing.T) {
+	str := &Param{Name: "str", Schema: map[string]interface{}{"type": "string"}}
+	num := &Param{Name: "num", Schema: map[string]interface{}{"type": "integer", "default": 3}}
+	req := &Param{Name: "req", Schema: map[string]interface{}{"type": "boolean"}}
+	task := &Task{Name: "task", RequiredParams: []string{"req", "num"}, OptionalParams: []string{"nope"}}
+	stage := &Stage{Name: "stage", Tasks: []string{"task"}}
+	prof := &Profile{Name: "prof", Params: map[string]interface{}{"str": 5}}
+	pp := &PluginProvider{Name: "pp", RequiredParams: []string{"str"}}
+	pc := NewParamChecker(str, num, req, task, stage, prof, pp)
+
+	check := func(obj Model, want ...string) {
+		t.Helper()
+		issues := pc.Check(obj)
+		if len(issues) != len(want) {
+			t.Errorf("ERROR: %s:%s: expected %d issues, got %d: %v", obj.Prefix(), obj.Key(), len(want), len(issues), issues)
+			return
+		}
+		for i := range want {
+			if got := issues[i].Param + "/" + issues[i].Type; got != want[i] {
+				t.Errorf("ERROR: %s:%s: expected issue %s, got %s", obj.Prefix(), obj.Key(), want[i], got)
+			} else {
+				t.Logf("%s", issues[i])
+			}
+		}
+	}
+
+	check(prof, "str/type")
+	check(task, "nope/unknown")
+	check(&Machine{Name: "m1", Stage: "stage", Tasks: []string{"stage:stage", "task"}}, "req/required")
+	check(&Machine{Name: "m2", Stage: "stage", Tasks: []string{"task"},
+		Params: map[string]interface{}{"req": true, "other": 1, "num": "three"}},
+		"num/type", "other/unknown")
+	check(&Plugin{Name: "p1", Provider: "pp"}, "str/required")
+	check(&Plugin{Name: "p2", Provider: "pp", Params: map[string]interface{}{"str": "ok"}})
+	secure := &Param{Name: "secret", Secure: true, Schema: map[string]interface{}{"type": "string"}}
+	sd := &SecureData{}
+	if err := sd.Marshal(make([]byte, 32), "hidden"); err != nil {
+		t.Fatalf("ERROR: Failed to marshal secure data: %v", err)
+	}
+	pc = NewParamChecker(secure)
+	check(&Profile{Name: "sec", Params: map[string]interface{}{"secret": sd}})
+}
@@ -0,0 +1,361 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"text/template/parse"
+)
+
+// paramFuncs are the methods of the render data that take the name of
+// a param as their first argument.
+var paramFuncs = map[string]struct{}{
+	"Param":              {},
+	"ParamExists":        {},
+	"ParamAsJSON":        {},
+	"ParamExpand":        {},
+	"ParamCompose":       {},
+	"ParamComposeExpand": {},
+	"ComposeParam":       {},
+}
+
+// templateBuiltins are the functions text/template provides on its
+// own.  The parser needs to know about them, but not what they do.
+var templateBuiltins = map[string]interface{}{}
+
+func init() {
+	for _, name := range []string{
+		"and", "call", "html", "index", "slice", "js", "len", "not", "or",
+		"print", "printf", "println", "urlquery",
+		"eq", "ge", "gt", "le", "lt", "ne",
+	} {
+		templateBuiltins[name] = true
+	}
+}
+
+// TemplateParamReport lists the params used by the templates of a
+// task, stage, or bootenv, and how they compare to the params it
+// declares.
+//
+// swagger:model
+type TemplateParamReport struct {
+	// Model is the prefix of the object that was analyzed.
+	Model string
+	// Key is the key of the object that was analyzed.
+	Key string
+	// Referenced is every param the templates refer to.
+	Referenced []string
+	// Undeclared are params the templates refer to that are not in
+	// RequiredParams or OptionalParams.
+	Undeclared []string
+	// Unused are params in RequiredParams or OptionalParams that the
+	// templates never refer to.
+	Unused []string
+	// Undefined are referenced or declared params that have no Param
+	// definition.
+	Undefined []string
+	// Errors are any problems parsing the templates.
+	Errors []string
+}
+
+// HasProblems returns whether the report found anything wrong.
+func (r *TemplateParamReport) HasProblems() bool {
+	return len(r.Undeclared)+len(r.Unused)+len(r.Undefined)+len(r.Errors) > 0
+}
+
+// templateRefs are the params and templates referenced by a single
+// template.
+type templateRefs struct {
+	params   map[string]struct{}
+	includes map[string]struct{}
+	err      error
+}
+
+// TemplateAnalyzer finds the params that templates refer to through
+// the Param family of render functions, following
+// {{template "name"}} and .CallTemplate into the Template objects it
+// knows about.  Only params named with a constant string can be found.
+type TemplateAnalyzer struct {
+	templates map[string]*Template
+	params    map[string]*Param
+	cache     map[string]*templateRefs
+}
+
+// NewTemplateAnalyzer creates a TemplateAnalyzer that resolves
+// templates and params from objs.  Other objects in objs are ignored.
+func NewTemplateAnalyzer(objs ...Model) *TemplateAnalyzer {
+	ta := &TemplateAnalyzer{
+		templates: map[string]*Template{},
+		params:    map[string]*Param{},
+		cache:     map[string]*templateRefs{},
+	}
+	for _, obj := range objs {
+		switch o := obj.(type) {
+		case *Template:
+			ta.templates[o.ID] = o
+		case *Param:
+			ta.params[o.Name] = o
+		}
+	}
+	return ta
+}
+
+// parseRefs parses src and finds what it refers to.
+func parseRefs(name, src string) *templateRefs {
+	res := &templateRefs{params: map[string]struct{}{}, includes: map[string]struct{}{}}
+	trees, err := parse.Parse(name, src, "{{", "}}", templateBuiltins, map[string]interface{}(DrpSafeFuncMap()))
+	if err != nil {
+		res.err = err
+		return res
+	}
+	for _, tree := range trees {
+		if tree.Root != nil {
+			res.walk(tree.Root)
+		}
+	}
+	// Templates defined inline are already part of this one.
+	for tname := range trees {
+		delete(res.includes, tname)
+	}
+	return res
+}
+
+// lastIdent returns the name of the method or field a node refers to.
+func lastIdent(n parse.Node) string {
+	var idents []string
+	switch v := n.(type) {
+	case *parse.FieldNode:
+		idents = v.Ident
+	case *parse.VariableNode:
+		idents = v.Ident[1:]
+	case *parse.ChainNode:
+		idents = v.Field
+	}
+	if len(idents) == 0 {
+		return ""
+	}
+	return idents[len(idents)-1]
+}
+
+func (r *templateRefs) walk(n parse.Node) {
+	switch v := n.(type) {
+	case *parse.ListNode:
+		if v == nil {
+			return
+		}
+		for _, c := range v.Nodes {
+			r.walk(c)
+		}
+	case *parse.ActionNode:
+		r.walk(v.Pipe)
+	case *parse.IfNode:
+		r.walkBranch(&v.BranchNode)
+	case *parse.RangeNode:
+		r.walkBranch(&v.BranchNode)
+	case *parse.WithNode:
+		r.walkBranch(&v.BranchNode)
+	case *parse.TemplateNode:
+		r.includes[v.Name] = struct{}{}
+		if v.Pipe != nil {
+			r.walk(v.Pipe)
+		}
+	case *parse.PipeNode:
+		if v == nil {
+			return
+		}
+		for _, c := range v.Cmds {
+			r.walk(c)
+		}
+	case *parse.ChainNode:
+		r.walk(v.Node)
+	case *parse.CommandNode:
+		if len(v.Args) > 1 {
+			if arg, ok := v.Args[1].(*parse.StringNode); ok {
+				name := lastIdent(v.Args[0])
+				if _, isParam := paramFuncs[name]; isParam {
+					r.params[arg.Text] = struct{}{}
+				} else if name == "CallTemplate" {
+					r.includes[arg.Text] = struct{}{}
+				}
+			}
+		}
+		for _, arg := range v.Args {
+			r.walk(arg)
+		}
+	}
+}
+
+func (r *templateRefs) walkBranch(b *parse.BranchNode) {
+	r.walk(b.Pipe)
+	r.walk(b.List)
+	r.walk(b.ElseList)
+}
+
+// templateRefs returns the references of the Template object with
+// the passed-in ID.
+func (ta *TemplateAnalyzer) templateRefs(id string) *templateRefs {
+	if res, ok := ta.cache[id]; ok {
+		return res
+	}
+	t, ok := ta.templates[id]
+	if !ok {
+		return nil
+	}
+	res := parseRefs(id, t.Contents)
+	ta.cache[id] = res
+	return res
+}
+
+// collect adds the params referenced by src and everything it
+// includes to params.
+func (ta *TemplateAnalyzer) collect(name, src string, params map[string]struct{}, seen map[string]struct{}) []string {
+	return ta.follow(parseRefs(name, src), params, seen)
+}
+
+func (ta *TemplateAnalyzer) follow(refs *templateRefs, params map[string]struct{}, seen map[string]struct{}) (errs []string) {
+	if refs.err != nil {
+		return []string{refs.err.Error()}
+	}
+	for p := range refs.params {
+		params[p] = struct{}{}
+	}
+	for inc := range refs.includes {
+		if _, ok := seen[inc]; ok {
+			continue
+		}
+		seen[inc] = struct{}{}
+		incRefs := ta.templateRefs(inc)
+		if incRefs == nil {
+			// Templates built at render time (such as the per-machine
+			// ones) cannot be followed.
+			continue
+		}
+		errs = append(errs, ta.follow(incRefs, params, seen)...)
+	}
+	return
+}
+
+// Params returns the params referenced by src and any templates it
+// includes.
+func (ta *TemplateAnalyzer) Params(name, src string) ([]string, error) {
+	params := map[string]struct{}{}
+	errs := ta.collect(name, src, params, map[string]struct{}{})
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", errs[0])
+	}
+	return setToList(params), nil
+}
+
+func setToList(set map[string]struct{}) []string {
+	res := make([]string, 0, len(set))
+	for k := range set {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Analyze returns the report for obj, or nil if obj is not a task,
+// stage, or bootenv.
+func (ta *TemplateAnalyzer) Analyze(obj Model) *TemplateParamReport {
+	var tmpls []TemplateInfo
+	var required, optional []string
+	extra := map[string]string{}
+	switch o := obj.(type) {
+	case *Task:
+		tmpls, required, optional = o.Templates, o.RequiredParams, o.OptionalParams
+	case *Stage:
+		tmpls, required, optional = o.Templates, o.RequiredParams, o.OptionalParams
+	case *BootEnv:
+		tmpls, required, optional = o.Templates, o.RequiredParams, o.OptionalParams
+		extra["BootParams"] = o.BootParams
+		for arch, ai := range o.OS.SupportedArchitectures {
+			extra["OS.SupportedArchitectures."+arch+".BootParams"] = ai.BootParams
+		}
+	default:
+		return nil
+	}
+	res := &TemplateParamReport{Model: obj.Prefix(), Key: obj.Key(), Errors: []string{}}
+	params := map[string]struct{}{}
+	seen := map[string]struct{}{}
+	addErrs := func(where string, errs []string) {
+		for _, e := range errs {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: %s", where, e))
+		}
+	}
+	for i := range tmpls {
+		ti := &tmpls[i]
+		where := fmt.Sprintf("Templates[%d] (%s)", i, ti.Name)
+		if ti.Path != "" {
+			addErrs(where+" Path", ta.collect(ti.Name+".path", ti.Path, params, seen))
+		}
+		if ti.Link != "" {
+			addErrs(where+" Link", ta.collect(ti.Name+".link", ti.Link, params, seen))
+		}
+		switch {
+		case ti.ID != "":
+			if ta.templateRefs(ti.ID) == nil {
+				res.Errors = append(res.Errors, fmt.Sprintf("%s: No template %s", where, ti.ID))
+				continue
+			}
+			seen[ti.ID] = struct{}{}
+			addErrs(where, ta.follow(ta.templateRefs(ti.ID), params, seen))
+		case ti.Contents != "":
+			addErrs(where, ta.collect(ti.Name, ti.Contents, params, seen))
+		}
+	}
+	keys := make([]string, 0, len(extra))
+	for k := range extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if extra[k] != "" {
+			addErrs(k, ta.collect(k, extra[k], params, seen))
+		}
+	}
+	declared := map[string]struct{}{}
+	for _, p := range required {
+		declared[p] = struct{}{}
+	}
+	for _, p := range optional {
+		declared[p] = struct{}{}
+	}
+	res.Referenced = setToList(params)
+	res.Undeclared = []string{}
+	res.Unused = []string{}
+	res.Undefined = []string{}
+	for _, p := range res.Referenced {
+		if _, ok := declared[p]; !ok {
+			res.Undeclared = append(res.Undeclared, p)
+		}
+	}
+	undefined := map[string]struct{}{}
+	for p := range params {
+		if _, ok := ta.params[p]; !ok {
+			undefined[p] = struct{}{}
+		}
+	}
+	for p := range declared {
+		if _, ok := params[p]; !ok {
+			res.Unused = append(res.Unused, p)
+		}
+		if _, ok := ta.params[p]; !ok {
+			undefined[p] = struct{}{}
+		}
+	}
+	sort.Strings(res.Unused)
+	res.Undefined = append(res.Undefined, setToList(undefined)...)
+	return res
+}
+
+// AnalyzeAll returns the reports for all the tasks, stages, and
+// bootenvs in objs.
+func (ta *TemplateAnalyzer) AnalyzeAll(objs ...Model) []*TemplateParamReport {
+	res := []*TemplateParamReport{}
+	for _, obj := range objs {
+		if r := ta.Analyze(obj); r != nil {
+			res = append(res, r)
+		}
+	}
+	return res
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTemplateAnalyzer(t *testing.T) {
+	common := &Template{ID: "common.tmpl", Contents: `{{if .ParamExists "from-common"}}{{.Param "from-common"}}{{end}}`}
+	looped := &Template{ID: "looped.tmpl", Contents: `{{template "looped.tmpl" .}}{{$.Param "from-loop"}}`}
+	defined := &Param{Name: "declared"}
+	task := &Task{
+		Name:           "task",
+		RequiredParams: []string{"declared"},
+		OptionalParams: []string{"unused"},
+		Templates: []TemplateInfo{
+			{Name: "inline", Path: `/tmp/{{.Param "in-path"}}`, Contents: `{{define "sub"}}{{.ParamAsJSON "in-define"}}{{end}}
+{{range $i, $v := (.Param "declared")}}{{template "sub" $}}{{end}}
+{{.CallTemplate "common.tmpl" .}}{{ .Param (printf "%s" "dynamic") }}{{ b64enc "x" }}`},
+			{Name: "byid", ID: "looped.tmpl"},
+		},
+	}
+	ta := NewTemplateAnalyzer(common, looped, defined)
+	r := ta.Analyze(task)
+	check := func(what string, got []string, want ...string) {
+		t.Helper()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ERROR: %s: expected %v, got %v", what, want, got)
+		}
+	}
+	check("Referenced", r.Referenced, "declared", "from-common", "from-loop", "in-define", "in-path")
+	check("Undeclared", r.Undeclared, "from-common", "from-loop", "in-define", "in-path")
+	check("Unused", r.Unused, "unused")
+	check("Undefined", r.Undefined, "from-common", "from-loop", "in-define", "in-path", "unused")
+	check("Errors", r.Errors, []string{}...)
+
+	bad := &Stage{Name: "bad", Templates: []TemplateInfo{
+		{Name: "broken", Contents: `{{.Param "x"`},
+		{Name: "missing", ID: "nope.tmpl"},
+		{Name: "nofunc", Contents: `{{ env "HOME" }}`},
+	}}
+	if r := ta.Analyze(bad); len(r.Errors) != 3 || !r.HasProblems() {
+		t.Errorf("ERROR: Expected 3 errors, got %v", r.Errors)
+	}
+	if r := ta.Analyze(&Profile{Name: "p"}); r != nil {
+		t.Errorf("ERROR: Expected no report for a profile")
+	}
+}
@@ -0,0 +1,391 @@
+// Package render emulates the template rendering that dr-provision
+// does for machines, so that the templates of tasks and bootenvs can
+// be expanded without a running server.
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+// Renderer holds the server-wide information used when rendering.
+type Renderer struct {
+	// Source is where templates, params, profiles, stages, and
+	// bootenvs are looked up.
+	Source Source
+	// Info is available to templates as .Info
+	Info *models.Info
+	// ProvisionerAddress is the IP address of the provisioner.
+	ProvisionerAddress string
+	// ProvisionerURL is the base URL of the static file server.
+	ProvisionerURL string
+	// ApiURL is the base URL of the API.
+	ApiURL string
+	// Token is called to create the tokens returned by
+	// .GenerateToken and .GenerateInfiniteToken.  If it is nil, a
+	// fixed placeholder is used.
+	Token func(m *models.Machine, infinite bool) string
+	// ProfileToken is called to create the tokens returned by
+	// .GenerateProfileToken.  If it is nil, a fixed placeholder is
+	// used.
+	ProfileToken func(profile string, duration int) string
+}
+
+// Machine wraps a Machine with the helper methods that templates
+// expect to be able to call on .Machine
+type Machine struct {
+	*models.Machine
+	r *Renderer
+}
+
+// HexAddress returns the IPv4 address of the machine in hex format.
+func (m *Machine) HexAddress() string {
+	addr := m.Address.To4()
+	if addr == nil {
+		return ""
+	}
+	return fmt.Sprintf("%02X%02X%02X%02X", addr[0], addr[1], addr[2], addr[3])
+}
+
+// ShortName returns the first component of the machine name.
+func (m *Machine) ShortName() string {
+	return strings.Split(m.Name, ".")[0]
+}
+
+// Path returns the path on the static file server where
+// machine-specific files are rendered.
+func (m *Machine) Path() string {
+	return "machines/" + m.UUID()
+}
+
+// Url returns the URL of the machine-specific file area.
+func (m *Machine) Url() string {
+	return m.r.ProvisionerURL + "/" + m.Path()
+}
+
+// Data is the data that templates are rendered with.
+type Data struct {
+	Machine            *Machine
+	Env                *models.BootEnv
+	Task               *models.Task
+	Stage              *models.Stage
+	Info               *models.Info
+	ProvisionerAddress string
+	ProvisionerURL     string
+	ApiURL             string
+	r                  *Renderer
+	layers             []map[string]interface{}
+	params             map[string]interface{}
+	root               *template.Template
+}
+
+// NewData builds the render data for m.  The bootenv and stage are
+// the ones m is currently in.
+func (r *Renderer) NewData(m *models.Machine) *Data {
+	d := &Data{
+		Machine:            &Machine{Machine: m, r: r},
+		Info:               r.Info,
+		ProvisionerAddress: r.ProvisionerAddress,
+		ProvisionerURL:     r.ProvisionerURL,
+		ApiURL:             r.ApiURL,
+		r:                  r,
+		layers:             paramLayers(r.Source, m),
+	}
+	d.params = aggregate(d.layers)
+	if env, ok := r.Source.Find("bootenvs", m.BootEnv).(*models.BootEnv); ok {
+		d.Env = env
+	}
+	d.Stage = Stage(r.Source, m.Stage)
+	return d
+}
+
+// Param returns the aggregated value of a param for the machine.
+func (d *Data) Param(key string) (interface{}, error) {
+	if v, ok := d.params[key]; ok {
+		return v, nil
+	}
+	return nil, fmt.Errorf("No such machine parameter %s", key)
+}
+
+// ParamExists returns whether the param is set anywhere for the machine.
+func (d *Data) ParamExists(key string) bool {
+	_, ok := d.params[key]
+	return ok
+}
+
+// ParamAsJSON returns the param rendered as a JSON string.
+func (d *Data) ParamAsJSON(key string) (string, error) {
+	v, err := d.Param(key)
+	if err != nil {
+		return "", err
+	}
+	buf, err := json.Marshal(v)
+	return string(buf), err
+}
+
+// ParamExpand renders a string param as a template.
+func (d *Data) ParamExpand(key string) (string, error) {
+	v, err := d.Param(key)
+	if err != nil {
+		return "", err
+	}
+	str, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("Param %s is not a string", key)
+	}
+	return d.expand(key, str)
+}
+
+// ParamCompose returns the value of a param composed across every
+// place it is set for the machine, instead of just the one with the
+// highest precedence.
+func (d *Data) ParamCompose(key string) (interface{}, error) {
+	if v, ok := composeParam(d.layers, key); ok {
+		return v, nil
+	}
+	return nil, fmt.Errorf("No such machine parameter %s", key)
+}
+
+// ComposeParam is the same as ParamCompose.
+func (d *Data) ComposeParam(key string) (interface{}, error) {
+	return d.ParamCompose(key)
+}
+
+// ParamComposeExpand composes a param and then renders every string
+// in it as a template.
+func (d *Data) ParamComposeExpand(key string) (interface{}, error) {
+	v, err := d.ParamCompose(key)
+	if err != nil {
+		return nil, err
+	}
+	return d.expandObject(key, v)
+}
+
+// CallTemplate renders the named template with the passed-in data.
+func (d *Data) CallTemplate(name string, data interface{}) (string, error) {
+	tmpl := d.root.Lookup(name)
+	if tmpl == nil {
+		return "", fmt.Errorf("Missing template %s", name)
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// BootParams renders the boot parameters of the current bootenv.
+func (d *Data) BootParams() (string, error) {
+	if d.Env == nil {
+		return "", nil
+	}
+	return d.expand("bootparams", d.Env.BootParams)
+}
+
+// ParseUrl returns the named segment of a URL.
+func (d *Data) ParseUrl(segment, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	switch segment {
+	case "scheme":
+		return u.Scheme, nil
+	case "host":
+		return u.Host, nil
+	case "path":
+		return u.Path, nil
+	}
+	return "", fmt.Errorf("No idea how to get URL part %s from %s", segment, rawURL)
+}
+
+// GenerateToken returns a token that can be used to access the API
+// on behalf of the machine.
+func (d *Data) GenerateToken() string {
+	if d.r.Token == nil {
+		return "rendered-offline-token"
+	}
+	return d.r.Token(d.Machine.Machine, false)
+}
+
+// GenerateInfiniteToken returns a token that never expires that can
+// be used to access the API on behalf of the machine.
+func (d *Data) GenerateInfiniteToken() string {
+	if d.r.Token == nil {
+		return "rendered-offline-token"
+	}
+	return d.r.Token(d.Machine.Machine, true)
+}
+
+// GenerateProfileToken returns a token that can be used to update
+// the named profile for duration seconds.
+func (d *Data) GenerateProfileToken(profile string, duration int) string {
+	if d.r.ProfileToken == nil {
+		return "rendered-offline-token"
+	}
+	return d.r.ProfileToken(profile, duration)
+}
+
+// Repos is not supported, because the repos that dr-provision builds
+// from the package-repositories param depend on the ISOs it has.
+func (d *Data) Repos(tags ...string) (interface{}, error) {
+	return nil, unsupported("Repos")
+}
+
+// MachineRepos is not supported, for the same reason as Repos.
+func (d *Data) MachineRepos() (interface{}, error) {
+	return nil, unsupported("MachineRepos")
+}
+
+// InstallRepos is not supported, for the same reason as Repos.
+func (d *Data) InstallRepos() (interface{}, error) {
+	return nil, unsupported("InstallRepos")
+}
+
+func unsupported(name string) error {
+	return fmt.Errorf(".%s is only supported when rendered by dr-provision", name)
+}
+
+// expandObject renders every string in v, including the ones in
+// maps and lists, as a template.
+func (d *Data) expandObject(name string, v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case string:
+		return d.expand(name, val)
+	case map[string]interface{}:
+		res := map[string]interface{}{}
+		for k, sub := range val {
+			exp, err := d.expandObject(name, sub)
+			if err != nil {
+				return nil, err
+			}
+			res[k] = exp
+		}
+		return res, nil
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for i, sub := range val {
+			exp, err := d.expandObject(name, sub)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = exp
+		}
+		return res, nil
+	}
+	return v, nil
+}
+
+func (d *Data) expand(name, tmpl string) (string, error) {
+	t, err := d.root.New(name).Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, d); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// buildRoot parses all the Template objects into a common root
+// template, and merges tmpls into it.
+func (d *Data) buildRoot(tmpls []models.TemplateInfo) *models.Error {
+	e := &models.Error{Code: http.StatusUnprocessableEntity, Type: "ValidationError"}
+	root := template.New("").Funcs(models.DrpSafeFuncMap()).Option("missingkey=error")
+	for _, o := range d.r.Source.List("templates") {
+		t := o.(*models.Template)
+		if _, err := root.New(t.ID).Parse(t.Contents); err != nil {
+			e.Errorf("Error parsing template %s: %v", t.ID, err)
+		}
+	}
+	d.root = models.MergeTemplates(root, tmpls, e)
+	if e.ContainsError() {
+		return e
+	}
+	return nil
+}
+
+// RenderActions renders tmpls into the JobActions that the agent
+// runs.  Templates with a Path become files, and the rest become
+// scripts.
+func (d *Data) RenderActions(tmpls []models.TemplateInfo) (models.JobActions, *models.Error) {
+	tis := make([]models.TemplateInfo, len(tmpls))
+	copy(tis, tmpls)
+	if err := d.buildRoot(tis); err != nil {
+		return nil, err
+	}
+	e := &models.Error{Code: http.StatusUnprocessableEntity, Type: "ValidationError"}
+	res := models.JobActions{}
+	for i := range tis {
+		ti := &tis[i]
+		action := &models.JobAction{Name: ti.Name, Meta: ti.Meta}
+		if action.Meta == nil {
+			action.Meta = map[string]string{}
+		}
+		buf := &bytes.Buffer{}
+		if ti.PathTmpl != nil {
+			if err := ti.PathTmpl.Execute(buf, d); err != nil {
+				e.Errorf("Error rendering path for %s: %v", ti.Name, err)
+				continue
+			}
+			action.Path = buf.String()
+			buf.Reset()
+		}
+		if ti.LinkTmpl != nil {
+			if err := ti.LinkTmpl.Execute(buf, d); err != nil {
+				e.Errorf("Error rendering link for %s: %v", ti.Name, err)
+				continue
+			}
+			action.Link = buf.String()
+			res = append(res, action)
+			continue
+		}
+		tmpl := d.root.Lookup(ti.Id())
+		if tmpl == nil {
+			e.Errorf("Missing template %s", ti.Id())
+			continue
+		}
+		if err := tmpl.Execute(buf, d); err != nil {
+			e.Errorf("Error rendering %s: %v", ti.Name, err)
+			continue
+		}
+		action.Content = buf.String()
+		res = append(res, action)
+	}
+	if e.ContainsError() {
+		return nil, e
+	}
+	return res, nil
+}
+
+// RenderTask renders the templates of task for m.
+func (r *Renderer) RenderTask(m *models.Machine, task *models.Task) (models.JobActions, *models.Error) {
+	d := r.NewData(m)
+	d.Task = task
+	return d.RenderActions(task.Templates)
+}
+
+// RenderBootEnv renders the templates of env for m as if m were in
+// env.  The Path of each action is where the file would be placed on
+// the static file server.
+func (r *Renderer) RenderBootEnv(m *models.Machine, env *models.BootEnv) (models.JobActions, *models.Error) {
+	d := r.NewData(m)
+	d.Env = env
+	return d.RenderActions(env.Templates)
+}
+
+// RenderStage renders the templates of stage for m as if m were in
+// stage.
+func (r *Renderer) RenderStage(m *models.Machine, stage *models.Stage) (models.JobActions, *models.Error) {
+	d := r.NewData(m)
+	d.Stage = stage
+	return d.RenderActions(stage.Templates)
+}
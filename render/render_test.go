@@ -0,0 +1,106 @@
+package render
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/pborman/uuid"
+)
+
+func TestRenderTask(t *testing.T) {
+	src := NewObjects(
+		&models.Param{Name: "def", Schema: map[string]interface{}{"type": "string", "default": "from-default"}},
+		&models.Profile{Name: "global", Params: map[string]interface{}{"g": "from-global", "p": "global-loses"}},
+		&models.Profile{Name: "prof", Params: map[string]interface{}{"p": "from-profile"}},
+		&models.Stage{Name: "stage", Params: map[string]interface{}{"s": "from-stage"}},
+		&models.BootEnv{Name: "env", BootParams: `console={{.Param "p"}}`},
+		&models.Template{ID: "shared.tmpl", Contents: `shared {{.Machine.ShortName}}`},
+	)
+	m := &models.Machine{
+		Name:     "m1.example.com",
+		Uuid:     uuid.NewRandom(),
+		Stage:    "stage",
+		BootEnv:  "env",
+		Profiles: []string{"prof"},
+		Params:   map[string]interface{}{"m": "from-machine"},
+	}
+	task := &models.Task{Name: "task", Templates: []models.TemplateInfo{
+		{Name: "file", Path: `/tmp/{{.Machine.ShortName}}`, Contents: `{{.Param "m"}} {{.Param "p"}} {{.Param "s"}} {{.Param "g"}} {{.Param "def"}}`},
+		{Name: "script", Contents: `{{.BootParams}} {{.Task.Name}} {{template "shared.tmpl" .}} {{.Machine.Url}}`},
+		{Name: "byid", ID: "shared.tmpl"},
+		{Name: "link", Path: `/tmp/{{.Machine.ShortName}}.link`, Link: `/tmp/{{.Machine.ShortName}}`},
+	}}
+	r := &Renderer{Source: src, ProvisionerURL: "http://fred:8091"}
+	actions, err := r.RenderTask(m, task)
+	if err != nil {
+		t.Fatalf("ERROR: Render failed: %v", err)
+	}
+	want := []struct{ name, path, content, link string }{
+		{"file", "/tmp/m1", "from-machine from-profile from-stage from-global from-default", ""},
+		{"script", "", "console=from-profile task shared m1 http://fred:8091/machines/" + m.UUID(), ""},
+		{"byid", "", "shared m1", ""},
+		{"link", "/tmp/m1.link", "", "/tmp/m1"},
+	}
+	if len(actions) != len(want) {
+		t.Fatalf("ERROR: Expected %d actions, got %d", len(want), len(actions))
+	}
+	for i, w := range want {
+		a := actions[i]
+		if a.Name != w.name || a.Path != w.path || a.Content != w.content || a.Link != w.link {
+			t.Errorf("ERROR: Action %d: expected %s %q %q %q, got %s %q %q %q", i, w.name, w.path, w.content, w.link, a.Name, a.Path, a.Content, a.Link)
+		}
+	}
+	missing := &models.Task{Name: "missing", Templates: []models.TemplateInfo{{Name: "x", Contents: `{{.Param "nope"}}`}}}
+	if _, err := r.RenderTask(m, missing); err == nil {
+		t.Errorf("ERROR: Expected rendering a missing param to fail")
+	}
+}
+
+func TestRenderCompose(t *testing.T) {
+	src := NewObjects(
+		&models.Param{Name: "list", Schema: map[string]interface{}{"type": "array", "default": []interface{}{"def"}}},
+		&models.Profile{Name: "global", Params: map[string]interface{}{
+			"list": []interface{}{"global", "shared"},
+			"map":  map[string]interface{}{"a": "global", "g": "global"},
+		}},
+		&models.Profile{Name: "prof", Params: map[string]interface{}{"map": map[string]interface{}{"a": "profile", "p": "{{.Machine.ShortName}}"}}},
+	)
+	m := &models.Machine{
+		Name:     "m1.example.com",
+		Uuid:     uuid.NewRandom(),
+		Profiles: []string{"prof"},
+		Params:   map[string]interface{}{"list": []interface{}{"shared", "machine"}},
+	}
+	task := &models.Task{Name: "task", Templates: []models.TemplateInfo{
+		{Name: "list", Contents: `{{.ParamCompose "list"}}`},
+		{Name: "map", Contents: `{{.ComposeParam "map"}}`},
+		{Name: "expand", Contents: `{{(.ParamComposeExpand "map").p}}`},
+		{Name: "token", Contents: `{{.GenerateProfileToken "prof" 60}}`},
+	}}
+	r := &Renderer{Source: src, ProfileToken: func(profile string, duration int) string {
+		return fmt.Sprintf("%s-%d", profile, duration)
+	}}
+	actions, err := r.RenderTask(m, task)
+	if err != nil {
+		t.Fatalf("ERROR: Render failed: %v", err)
+	}
+	want := []string{
+		"[shared machine global def]",
+		"map[a:profile g:global p:{{.Machine.ShortName}}]",
+		"m1",
+		"prof-60",
+	}
+	for i, w := range want {
+		if actions[i].Content != w {
+			t.Errorf("ERROR: Action %s: expected %q, got %q", actions[i].Name, w, actions[i].Content)
+		}
+	}
+	repos := &models.Task{Name: "repos", Templates: []models.TemplateInfo{{Name: "x", Contents: `{{range .InstallRepos}}{{.Install}}{{end}}`}}}
+	if _, err := r.RenderTask(m, repos); err == nil || !strings.Contains(err.Error(), ".InstallRepos") {
+		t.Errorf("ERROR: Expected an error naming .InstallRepos, got %v", err)
+	} else {
+		t.Logf("Got expected error %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package render
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+// Source provides the objects that rendering needs to look up.
+type Source interface {
+	// Find returns the object with the passed-in prefix and key, or
+	// nil if there is no such object.
+	Find(prefix, key string) models.Model
+	// List returns all the objects with the passed-in prefix, sorted
+	// by key.
+	List(prefix string) []models.Model
+}
+
+// Objects is a Source backed by an in-memory set of objects, such as
+// the contents of a content bundle.
+type Objects map[string]map[string]models.Model
+
+// NewObjects creates an Objects from objs.  Later objects replace
+// earlier ones with the same prefix and key.
+func NewObjects(objs ...models.Model) Objects {
+	res := Objects{}
+	for _, obj := range objs {
+		res.Add(obj)
+	}
+	return res
+}
+
+// Add adds obj to o, replacing any existing object with the same
+// prefix and key.
+func (o Objects) Add(obj models.Model) {
+	if _, ok := o[obj.Prefix()]; !ok {
+		o[obj.Prefix()] = map[string]models.Model{}
+	}
+	o[obj.Prefix()][obj.Key()] = obj
+}
+
+// Find satisfies the Source interface.
+func (o Objects) Find(prefix, key string) models.Model {
+	return o[prefix][key]
+}
+
+// List satisfies the Source interface.
+func (o Objects) List(prefix string) []models.Model {
+	keys := make([]string, 0, len(o[prefix]))
+	for k := range o[prefix] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := make([]models.Model, len(keys))
+	for i, k := range keys {
+		res[i] = o[prefix][k]
+	}
+	return res
+}
+
+func profile(src Source, name string) *models.Profile {
+	if p, ok := src.Find("profiles", name).(*models.Profile); ok {
+		return p
+	}
+	return nil
+}
+
+// Stage returns the named stage from src, or nil if it does not exist.
+func Stage(src Source, name string) *models.Stage {
+	if s, ok := src.Find("stages", name).(*models.Stage); ok {
+		return s
+	}
+	return nil
+}
+
+// appendProfiles appends the params of the named profiles (and any
+// profiles they refer to) to layers, skipping profiles in seen.
+func appendProfiles(src Source, layers []map[string]interface{}, names []string, seen map[string]bool) []map[string]interface{} {
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		p := profile(src, name)
+		if p == nil {
+			continue
+		}
+		layers = append(layers, p.Params)
+		layers = appendProfiles(src, layers, p.Profiles, seen)
+	}
+	return layers
+}
+
+// paramLayers returns every set of params that applies to obj, from
+// the highest precedence to the lowest: the params of obj, its
+// profiles, its stage if it is a machine, the global profile, and
+// finally the defaults from the Param definitions.
+func paramLayers(src Source, obj models.Paramer) []map[string]interface{} {
+	layers := []map[string]interface{}{obj.GetParams()}
+	seen := map[string]bool{}
+	if p, ok := obj.(models.Profiler); ok {
+		layers = appendProfiles(src, layers, p.GetProfiles(), seen)
+	}
+	if m, ok := obj.(*models.Machine); ok {
+		if st := Stage(src, m.Stage); st != nil {
+			layers = append(layers, st.Params)
+			layers = appendProfiles(src, layers, st.Profiles, seen)
+		}
+	}
+	if _, ok := obj.(*models.Profile); !ok || obj.Key() != "global" {
+		layers = appendProfiles(src, layers, []string{"global"}, seen)
+	}
+	defaults := map[string]interface{}{}
+	for _, o := range src.List("params") {
+		p := o.(*models.Param)
+		if def, ok := p.DefaultValue(); ok {
+			defaults[p.Name] = def
+		}
+	}
+	return append(layers, defaults)
+}
+
+// aggregate returns the highest precedence value of every param in
+// layers.
+func aggregate(layers []map[string]interface{}) map[string]interface{} {
+	res := map[string]interface{}{}
+	for _, layer := range layers {
+		for k, v := range layer {
+			if _, ok := res[k]; !ok {
+				res[k] = v
+			}
+		}
+	}
+	return res
+}
+
+// AggregateParams returns the params for obj, merged with the params
+// from its profiles, its stage if it is a machine, the global
+// profile, and finally any defaults from the Param definitions.
+func AggregateParams(src Source, obj models.Paramer) map[string]interface{} {
+	return aggregate(paramLayers(src, obj))
+}
+
+// compose merges lo, a value from a lower precedence layer, into hi.
+// Maps are merged key by key, lists are joined with the values from
+// hi first and without repeating any value, and anything else is
+// taken from hi.
+func compose(hi, lo interface{}) interface{} {
+	switch h := hi.(type) {
+	case map[string]interface{}:
+		l, ok := lo.(map[string]interface{})
+		if !ok {
+			return hi
+		}
+		res := map[string]interface{}{}
+		for k, v := range l {
+			res[k] = v
+		}
+		for k, v := range h {
+			if lv, ok := res[k]; ok {
+				res[k] = compose(v, lv)
+			} else {
+				res[k] = v
+			}
+		}
+		return res
+	case []interface{}:
+		l, ok := lo.([]interface{})
+		if !ok {
+			return hi
+		}
+		res := append([]interface{}{}, h...)
+	outer:
+		for _, v := range l {
+			for _, have := range res {
+				if reflect.DeepEqual(v, have) {
+					continue outer
+				}
+			}
+			res = append(res, v)
+		}
+		return res
+	}
+	return hi
+}
+
+// composeParam returns the value of the param key composed across
+// layers, and whether it was set in any of them.
+func composeParam(layers []map[string]interface{}, key string) (interface{}, bool) {
+	var res interface{}
+	found := false
+	for _, layer := range layers {
+		v, ok := layer[key]
+		if !ok {
+			continue
+		}
+		if found {
+			res = compose(res, v)
+		} else {
+			res, found = v, true
+		}
+	}
+	return res, found
+}
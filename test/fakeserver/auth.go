@@ -0,0 +1,61 @@
+package fakeserver
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+// authorize checks the Authorization header of the request.  Basic
+// auth is checked against the users in the backend, and Bearer
+// tokens are checked against the tokens the Server has handed out.
+// The fake server does not implement roles or claims, so any
+// authenticated principal can do anything.
+func (s *Server) authorize(r *http.Request, parts []string) (string, *models.Error) {
+	hdr := r.Header.Get("Authorization")
+	fields := strings.SplitN(hdr, " ", 2)
+	if len(fields) == 2 {
+		switch fields[0] {
+		case "Basic":
+			buf, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				break
+			}
+			up := strings.SplitN(string(buf), ":", 2)
+			if len(up) != 2 {
+				break
+			}
+			s.mux.Lock()
+			defer s.mux.Unlock()
+			user := &models.User{}
+			if err := s.backend.Load("users", up[0], user); err != nil || !user.CheckPassword(up[1]) {
+				break
+			}
+			return "user:" + user.Name, nil
+		case "Bearer":
+			s.mux.Lock()
+			defer s.mux.Unlock()
+			if principal, ok := s.tokens[fields[1]]; ok {
+				return principal, nil
+			}
+		}
+	}
+	return "", newErr(http.StatusUnauthorized, "AUTH", "", "", "Failed to authenticate user")
+}
+
+// serveToken hands out a fresh token for the named user.  Tokens
+// never expire for the lifetime of the Server.
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request, name string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	user := &models.User{}
+	if err := s.backend.Load("users", name, user); err != nil {
+		writeErr(w, notFound("GET", "users", name))
+		return
+	}
+	tok := models.RandString(32)
+	s.tokens[tok] = "user:" + name
+	writeJSON(w, http.StatusOK, &models.UserToken{Token: tok, Info: *s.Info()})
+}
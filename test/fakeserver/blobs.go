@@ -0,0 +1,192 @@
+package fakeserver
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+// blobPath maps a files or isos path to its location on disk,
+// refusing paths that try to escape the blob area.
+func (s *Server) blobPath(at, name string) (string, *models.Error) {
+	base := filepath.Join(s.root, "tftpboot", at)
+	clean := path.Clean("/" + name)
+	if at == "isos" && strings.Count(clean, "/") > 1 {
+		return "", newErr(http.StatusForbidden, "API_ERROR", at, name, "isos must not be in subdirectories")
+	}
+	return filepath.Join(base, filepath.FromSlash(clean)), nil
+}
+
+func sha256sum(p string) (string, error) {
+	fi, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer fi.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fi); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// serveBlobs handles the files and isos routes.
+func (s *Server) serveBlobs(w http.ResponseWriter, r *http.Request, at, name string) {
+	if name == "" {
+		if r.Method != "GET" {
+			writeErr(w, newErr(http.StatusMethodNotAllowed, "API_ERROR", at, "", "Method %s not allowed", r.Method))
+			return
+		}
+		s.listBlobs(w, r, at)
+		return
+	}
+	p, err := s.blobPath(at, name)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		st, serr := os.Stat(p)
+		if serr != nil || st.IsDir() {
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writeErr(w, notFound(r.Method, at, name))
+			return
+		}
+		sum, _ := sha256sum(p)
+		etag := `"SHA256:` + sum + `"`
+		w.Header().Set("X-DRP-SHA256SUM", sum)
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.ServeFile(w, r, p)
+	case "POST", "PUT":
+		if merr := os.MkdirAll(filepath.Dir(p), 0755); merr != nil {
+			writeErr(w, newErr(http.StatusInternalServerError, "API_ERROR", at, name, "%v", merr))
+			return
+		}
+		fi, ferr := os.Create(p)
+		if ferr != nil {
+			writeErr(w, newErr(http.StatusConflict, "API_ERROR", at, name, "%v", ferr))
+			return
+		}
+		sz, cerr := io.Copy(fi, r.Body)
+		fi.Close()
+		if cerr != nil {
+			os.Remove(p)
+			writeErr(w, newErr(http.StatusInternalServerError, "API_ERROR", at, name, "%v", cerr))
+			return
+		}
+		if r.URL.Query().Get("explode") == "true" {
+			if xerr := explode(p); xerr != nil {
+				writeErr(w, newErr(http.StatusInternalServerError, "API_ERROR", at, name, "Failed to explode: %v", xerr))
+				return
+			}
+		}
+		writeJSON(w, http.StatusCreated, &models.BlobInfo{Path: "/" + strings.TrimPrefix(name, "/"), Size: sz})
+	case "DELETE":
+		if rerr := os.Remove(p); rerr != nil {
+			writeErr(w, notFound(r.Method, at, name))
+			return
+		}
+		writeJSON(w, http.StatusNoContent, nil)
+	default:
+		writeErr(w, newErr(http.StatusMethodNotAllowed, "API_ERROR", at, name, "Method %s not allowed", r.Method))
+	}
+}
+
+// listBlobs lists the entries in a directory.  Subdirectories have a
+// trailing slash.
+func (s *Server) listBlobs(w http.ResponseWriter, r *http.Request, at string) {
+	p, err := s.blobPath(at, r.URL.Query().Get("path"))
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	ents, rerr := ioutil.ReadDir(p)
+	if rerr != nil {
+		writeErr(w, notFound("GET", at, r.URL.Query().Get("path")))
+		return
+	}
+	res := []string{}
+	for _, ent := range ents {
+		name := ent.Name()
+		if ent.IsDir() {
+			name += "/"
+		}
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	writeJSON(w, http.StatusOK, res)
+}
+
+// explode unpacks a tar or gzipped tar archive into the directory it
+// was uploaded to.
+func explode(p string) error {
+	fi, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	var src io.Reader = fi
+	if strings.HasSuffix(p, ".tgz") || strings.HasSuffix(p, ".gz") {
+		gz, err := gzip.NewReader(fi)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		src = gz
+	}
+	dir := filepath.Dir(p)
+	tr := tar.NewReader(src)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		tgt := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+hdr.Name)))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(tgt, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(tgt), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(tgt, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode)&0777)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
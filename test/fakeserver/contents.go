@@ -0,0 +1,164 @@
+package fakeserver
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/digitalrebar/provision/v4/store"
+)
+
+func summarize(c *models.Content) *models.ContentSummary {
+	mem, _ := store.Open("memory:///")
+	defer mem.Close()
+	res := &models.ContentSummary{}
+	if err := c.ToStore(mem); err != nil {
+		res.Fill()
+		res.Meta = c.Meta
+		res.Warnings = append(res.Warnings, err.Error())
+		return res
+	}
+	res.FromStore(mem)
+	return res
+}
+
+// serveContents handles the contents routes.  Content bundles are
+// installed by saving each of their objects read-only with their
+// Bundle set to the name of the content bundle.
+func (s *Server) serveContents(w http.ResponseWriter, r *http.Request, parts []string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if len(parts) == 0 {
+		switch r.Method {
+		case "GET":
+			names := []string{}
+			for name := range s.contents {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			res := []*models.ContentSummary{}
+			for _, name := range names {
+				res = append(res, summarize(s.contents[name]))
+			}
+			writeJSON(w, http.StatusOK, res)
+		case "POST":
+			c := &models.Content{}
+			if err := decodeBody(r, c); err != nil {
+				writeErr(w, err)
+				return
+			}
+			c.Fill()
+			if _, ok := s.contents[c.Meta.Name]; ok {
+				writeErr(w, newErr(http.StatusConflict, "CONFLICT", "contents", c.Meta.Name, "Content %s already exists", c.Meta.Name))
+				return
+			}
+			s.installContent(w, r, c, http.StatusCreated)
+		default:
+			writeErr(w, newErr(http.StatusMethodNotAllowed, "API_ERROR", "contents", "", "Method %s not allowed", r.Method))
+		}
+		return
+	}
+	name := parts[0]
+	old, found := s.contents[name]
+	switch r.Method {
+	case "GET":
+		if !found {
+			writeErr(w, notFound("GET", "contents", name))
+			return
+		}
+		writeJSON(w, http.StatusOK, old)
+	case "PUT":
+		c := &models.Content{}
+		if err := decodeBody(r, c); err != nil {
+			writeErr(w, err)
+			return
+		}
+		c.Fill()
+		if c.Meta.Name != name {
+			writeErr(w, newErr(http.StatusBadRequest, "API_ERROR", "contents", name, "Cannot change content name from %s to %s", name, c.Meta.Name))
+			return
+		}
+		code := http.StatusOK
+		if !found {
+			code = http.StatusCreated
+		}
+		s.installContent(w, r, c, code)
+	case "DELETE":
+		if !found {
+			writeErr(w, notFound("DELETE", "contents", name))
+			return
+		}
+		s.uninstallContent(name)
+		delete(s.contents, name)
+		writeJSON(w, http.StatusNoContent, nil)
+	default:
+		writeErr(w, newErr(http.StatusMethodNotAllowed, "API_ERROR", "contents", name, "Method %s not allowed", r.Method))
+	}
+}
+
+func (s *Server) uninstallContent(name string) {
+	for prefix := range baseTypes() {
+		for _, obj := range s.list(prefix) {
+			if b, ok := obj.(models.Bundler); ok && b.GetBundle() == name {
+				s.remove(obj, "content:"+name)
+			}
+		}
+	}
+}
+
+// installContent replaces whatever objects were provided by the
+// content bundle with the objects in c.
+func (s *Server) installContent(w http.ResponseWriter, r *http.Request, c *models.Content, code int) {
+	name := c.Meta.Name
+	replaceWritable := r.URL.Query().Get("replaceWritable") == "true"
+	objs := []models.Model{}
+	e := &models.Error{Code: http.StatusConflict, Type: "CONFLICT", Model: "contents", Key: name}
+	for section, items := range c.Sections {
+		for key, item := range items {
+			obj, err := newModel(section)
+			if err != nil {
+				e.Errorf("Unknown section %s", section)
+				continue
+			}
+			if err := models.Remarshal(item, obj); err != nil {
+				e.Errorf("%s:%s: %v", section, key, err)
+				continue
+			}
+			if f, ok := obj.(models.Filler); ok {
+				f.Fill()
+			}
+			if existing, ok := s.loadRaw(section, obj.Key()); ok {
+				b, isB := existing.(models.Bundler)
+				if isB && b.GetBundle() != "" && b.GetBundle() != name {
+					e.Errorf("%s:%s is provided by content %s", section, obj.Key(), b.GetBundle())
+					continue
+				}
+				if (!isB || b.GetBundle() == "") && !replaceWritable {
+					e.Errorf("%s:%s already exists as a writable object", section, obj.Key())
+					continue
+				}
+			}
+			if b, ok := obj.(models.Bundler); ok {
+				b.SetBundle(name)
+			}
+			if a, ok := obj.(models.Accessor); ok {
+				a.SetReadOnly(true)
+			}
+			setValid(obj)
+			objs = append(objs, obj)
+		}
+	}
+	if e.ContainsError() {
+		writeErr(w, e)
+		return
+	}
+	s.uninstallContent(name)
+	for _, obj := range objs {
+		if err := s.save(obj, "create", "content:"+name); err != nil {
+			writeErr(w, err)
+			return
+		}
+	}
+	s.contents[name] = c
+	writeJSON(w, code, summarize(c))
+}
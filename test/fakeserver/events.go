@@ -0,0 +1,191 @@
+package fakeserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/gorilla/websocket"
+)
+
+// eventConn is a single websocket connection and the events it is
+// registered for.
+type eventConn struct {
+	conn      *websocket.Conn
+	principal string
+	mux       *sync.Mutex
+	regs      map[string]int
+	out       chan []byte
+	done      chan struct{}
+}
+
+// eventHub tracks all the websocket connections that can receive
+// events.
+type eventHub struct {
+	mux   *sync.Mutex
+	conns map[*eventConn]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{mux: &sync.Mutex{}, conns: map[*eventConn]struct{}{}}
+}
+
+func (h *eventHub) add(c *eventConn) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.conns[c] = struct{}{}
+}
+
+func (h *eventHub) del(c *eventConn) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	delete(h.conns, c)
+}
+
+func (h *eventHub) close() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for c := range h.conns {
+		c.conn.Close()
+		delete(h.conns, c)
+	}
+}
+
+// valueInList tests whether val is in the comma separated list, with
+// the same escapes as api.ValueInList.
+func valueInList(val, list string) bool {
+	for _, p := range strings.Split(list, ",") {
+		p = strings.Replace(p, "\\1", ".", -1)
+		p = strings.Replace(p, "\\2", ",", -1)
+		p = strings.Replace(p, "\\3", "*", -1)
+		if strings.TrimSpace(p) == val {
+			return true
+		}
+	}
+	return false
+}
+
+// matches tests whether evt matches a type.action.key registration.
+func matchesRegistration(evt *models.Event, reg string) bool {
+	tak := strings.SplitN(reg, ".", 3)
+	if len(tak) != 3 {
+		return false
+	}
+	return (tak[0] == "*" || valueInList(evt.Type, tak[0])) &&
+		(tak[1] == "*" || valueInList(evt.Action, tak[1])) &&
+		(tak[2] == "*" || valueInList(evt.Key, tak[2]))
+}
+
+func (h *eventHub) publish(evt *models.Event) {
+	buf, err := json.Marshal(evt)
+	if err != nil {
+		return
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for c := range h.conns {
+		c.mux.Lock()
+		want := false
+		for reg := range c.regs {
+			if matchesRegistration(evt, reg) {
+				want = true
+				break
+			}
+		}
+		c.mux.Unlock()
+		if want {
+			c.send(buf)
+		}
+	}
+}
+
+func (c *eventConn) send(buf []byte) {
+	select {
+	case c.out <- buf:
+	case <-c.done:
+	}
+}
+
+func (c *eventConn) writer() {
+	for {
+		select {
+		case buf := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if err := c.conn.WriteMessage(websocket.TextMessage, buf); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// serveEvents upgrades the request to a websocket and handles
+// register and deregister requests on it.  Every register and
+// deregister is acknowledged with a websocket event, which the client
+// EventStream waits for.
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request, principal string) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &eventConn{
+		conn:      conn,
+		principal: principal,
+		mux:       &sync.Mutex{},
+		regs:      map[string]int{},
+		out:       make(chan []byte, 1000),
+		done:      make(chan struct{}),
+	}
+	s.events.add(c)
+	go c.writer()
+	defer func() {
+		s.events.del(c)
+		close(c.done)
+		conn.Close()
+	}()
+	for {
+		mt, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if mt != websocket.TextMessage {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimSpace(string(msg)), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		c.mux.Lock()
+		switch fields[0] {
+		case "register":
+			c.regs[fields[1]]++
+		case "deregister":
+			if c.regs[fields[1]] <= 1 {
+				delete(c.regs, fields[1])
+			} else {
+				c.regs[fields[1]]--
+			}
+		default:
+			c.mux.Unlock()
+			continue
+		}
+		c.mux.Unlock()
+		ack, _ := json.Marshal(&models.Event{
+			Time:      time.Now(),
+			Type:      "websocket",
+			Action:    fields[0],
+			Key:       fields[1],
+			Principal: principal,
+		})
+		c.send(ack)
+	}
+}
@@ -0,0 +1,275 @@
+package fakeserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/v4/agent"
+	"github.com/digitalrebar/provision/v4/api"
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+var session *api.Client
+
+func TestMain(m *testing.M) {
+	tmpDir, err := ioutil.TempDir("", "fakeserver-")
+	if err != nil {
+		log.Printf("Creating temp dir for file root failed: %v", err)
+		os.Exit(1)
+	}
+	srv, err := New(tmpDir)
+	if err == nil {
+		err = srv.Start("127.0.0.1:0", "127.0.0.1:0")
+	}
+	if err != nil {
+		log.Printf("Error starting fake server: %v", err)
+		os.RemoveAll(tmpDir)
+		os.Exit(1)
+	}
+	session, err = api.UserSession(srv.Endpoint(), DefaultUsername, DefaultPassword)
+	if err == nil {
+		err = session.MakeProxy(path.Join(tmpDir, ".socket"))
+	}
+	if err != nil {
+		log.Printf("Error creating session: %v", err)
+		srv.Close()
+		os.RemoveAll(tmpDir)
+		os.Exit(1)
+	}
+	ret := m.Run()
+	srv.Close()
+	os.RemoveAll(tmpDir)
+	os.Exit(ret)
+}
+
+func TestCrud(t *testing.T) {
+	if _, err := api.UserSession(session.Endpoint(), DefaultUsername, "wrong"); err == nil {
+		t.Errorf("ERROR: Expected a bad password to fail")
+	}
+	bootenvs := []*models.BootEnv{}
+	if err := session.Req().UrlFor("bootenvs").Do(&bootenvs); err != nil || len(bootenvs) != 2 {
+		t.Errorf("ERROR: Expected 2 default bootenvs, got %d: %v", len(bootenvs), err)
+	}
+	m := &models.Machine{Name: "m1"}
+	m.Fill()
+	if err := session.CreateModel(m); err != nil {
+		t.Fatalf("ERROR: Failed to create machine: %v", err)
+	}
+	if m.Stage != "none" || m.BootEnv != "local" || !m.Runnable || !m.WorkflowComplete {
+		t.Errorf("ERROR: Unexpected machine defaults: %#v", m)
+	}
+	if err := session.CreateModel(m); err == nil {
+		t.Errorf("ERROR: Expected creating a duplicate machine to fail")
+	}
+	got := &models.Machine{}
+	if err := session.Req().UrlFor("machines", "Name:m1").Do(got); err != nil || got.Key() != m.Key() {
+		t.Errorf("ERROR: Failed to fetch machine by name: %v", err)
+	}
+	found := []*models.Machine{}
+	if err := session.Req().Filter("machines", "Name", "Re", "^m").Do(&found); err != nil || len(found) != 1 {
+		t.Errorf("ERROR: Expected 1 machine from filter, got %d: %v", len(found), err)
+	}
+	if err := session.Req().Filter("machines", "Name", "Eq", "m2").Do(&found); err != nil || len(found) != 0 {
+		t.Errorf("ERROR: Expected 0 machines from filter, got %d: %v", len(found), err)
+	}
+	mc := models.Clone(m).(*models.Machine)
+	mc.Stage = "missing"
+	if _, err := session.PatchTo(m, mc); err == nil {
+		t.Errorf("ERROR: Expected changing to a missing stage to fail")
+	}
+	st := &models.Stage{Name: "s1", Tasks: []string{"t1"}}
+	if err := session.CreateModel(st); err != nil {
+		t.Fatalf("ERROR: Failed to create stage: %v", err)
+	}
+	mc.Stage = "s1"
+	res, err := session.PatchTo(m, mc)
+	if err != nil {
+		t.Fatalf("ERROR: Failed to change stage: %v", err)
+	}
+	m = res.(*models.Machine)
+	if len(m.Tasks) != 1 || m.CurrentTask != -1 || m.WorkflowComplete {
+		t.Errorf("ERROR: Stage change did not set tasks: %v %d", m.Tasks, m.CurrentTask)
+	}
+	if _, err := session.DeleteModel("stages", "s1"); err != nil {
+		t.Errorf("ERROR: Failed to delete stage: %v", err)
+	}
+	if ok, _ := session.ExistsModel("stages", "s1"); ok {
+		t.Errorf("ERROR: Stage still exists after delete")
+	}
+}
+
+func TestParams(t *testing.T) {
+	param := &models.Param{Name: "p3", Schema: map[string]interface{}{"type": "string", "default": "def"}}
+	prof := &models.Profile{Name: "prof", Params: map[string]interface{}{"p1": "profile", "p2": "profile"}}
+	m := &models.Machine{Name: "params", Profiles: []string{"prof"}, Params: map[string]interface{}{"p1": "machine"}}
+	for _, obj := range []models.Model{param, prof, m} {
+		if f, ok := obj.(models.Filler); ok {
+			f.Fill()
+		}
+		if err := session.CreateModel(obj); err != nil {
+			t.Fatalf("ERROR: Failed to create %s: %v", obj.Prefix(), err)
+		}
+	}
+	params := map[string]interface{}{}
+	if err := session.Req().UrlFor("machines", m.Key(), "params").Params("aggregate", "true").Do(&params); err != nil {
+		t.Fatalf("ERROR: Failed to get params: %v", err)
+	}
+	if params["p1"] != "machine" || params["p2"] != "profile" || params["p3"] != "def" {
+		t.Errorf("ERROR: Unexpected aggregate params: %v", params)
+	}
+	var val interface{}
+	if err := session.Req().UrlFor("machines", m.Key(), "params", "missing/param").Params("aggregate", "true").Do(&val); err != nil || val != nil {
+		t.Errorf("ERROR: Expected nil for a missing param, got %v: %v", val, err)
+	}
+	if err := session.Req().Post("new").UrlFor("machines", m.Key(), "params", "p4").Do(&val); err != nil || val != "new" {
+		t.Errorf("ERROR: Failed to set param: %v", err)
+	}
+	if err := session.Req().UrlFor("machines", m.Key(), "params", "p4").Do(&val); err != nil || val != "new" {
+		t.Errorf("ERROR: Failed to get param: %v %v", val, err)
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	if _, err := session.PostBlob(strings.NewReader("hello"), "files", "a", "b.txt"); err != nil {
+		t.Fatalf("ERROR: Failed to upload file: %v", err)
+	}
+	names, err := session.ListBlobs("files", "path", "a")
+	if err != nil || len(names) != 1 || names[0] != "b.txt" {
+		t.Errorf("ERROR: Unexpected file list %v: %v", names, err)
+	}
+	buf := &bytes.Buffer{}
+	if err := session.GetBlob(buf, "files", "a", "b.txt"); err != nil || buf.String() != "hello" {
+		t.Errorf("ERROR: Unexpected file contents %q: %v", buf.String(), err)
+	}
+	if sum, err := session.GetBlobSum("files", "a", "b.txt"); err != nil || len(sum) != 64 {
+		t.Errorf("ERROR: Unexpected checksum %q: %v", sum, err)
+	}
+	rc, err := session.File("files", "a", "b.txt")
+	if err != nil {
+		t.Errorf("ERROR: Failed to fetch from static file server: %v", err)
+	} else {
+		rc.Close()
+	}
+	if err := session.DeleteBlob("files", "a", "b.txt"); err != nil {
+		t.Errorf("ERROR: Failed to delete file: %v", err)
+	}
+	if err := session.GetBlob(buf, "files", "a", "b.txt"); err == nil {
+		t.Errorf("ERROR: Expected fetching a deleted file to fail")
+	}
+}
+
+func TestContents(t *testing.T) {
+	c := &models.Content{}
+	c.Fill()
+	c.Meta.Name = "test"
+	c.Meta.Version = "v1.0.0"
+	c.Sections = models.Sections{
+		"tasks": models.Section{"t1": &models.Task{Name: "t1"}},
+	}
+	if _, err := session.CreateContent(c, false); err != nil {
+		t.Fatalf("ERROR: Failed to create content: %v", err)
+	}
+	task := &models.Task{}
+	if err := session.FillModel(task, "t1"); err != nil || !task.ReadOnly || task.Bundle != "test" {
+		t.Errorf("ERROR: Content task not installed correctly: %#v %v", task, err)
+	}
+	if _, err := session.DeleteModel("tasks", "t1"); err == nil {
+		t.Errorf("ERROR: Expected deleting a read-only task to fail")
+	}
+	sums, err := session.GetContentSummary()
+	if err != nil || len(sums) != 1 || sums[0].Counts["tasks"] != 1 {
+		t.Errorf("ERROR: Unexpected content summary: %v", err)
+	}
+	if err := session.DeleteContent("test"); err != nil {
+		t.Errorf("ERROR: Failed to delete content: %v", err)
+	}
+	if ok, _ := session.ExistsModel("tasks", "t1"); ok {
+		t.Errorf("ERROR: Content task still exists after content delete")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	m := &models.Machine{Name: "events"}
+	m.Fill()
+	if err := session.CreateModel(m); err != nil {
+		t.Fatalf("ERROR: Failed to create machine: %v", err)
+	}
+	es, err := session.Events()
+	if err != nil {
+		t.Fatalf("ERROR: Failed to open event stream: %v", err)
+	}
+	defer es.Close()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		mc := models.Clone(m).(*models.Machine)
+		mc.Description = "changed"
+		session.PatchTo(m, mc)
+	}()
+	wm := models.Clone(m).(*models.Machine)
+	found, err := es.WaitFor(wm, api.EqualItem("Description", "changed"), 5*time.Second)
+	if err != nil || found != "complete" {
+		t.Errorf("ERROR: WaitFor returned %s: %v", found, err)
+	}
+}
+
+func TestAgent(t *testing.T) {
+	tjd, err := ioutil.TempDir("", "fakeagent-")
+	if err != nil {
+		t.Fatalf("Failed to create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(tjd)
+	task := &models.Task{
+		Name: "agent-task",
+		Templates: []models.TemplateInfo{
+			{Name: "file", Path: path.Join(tjd, "{{.Machine.Name}}.txt"), Contents: "{{.Param \"greeting\"}}\n"},
+			{Name: "script", Contents: "#!/usr/bin/env bash\necho ran {{.Task.Name}}\n"},
+		},
+	}
+	stage := &models.Stage{Name: "agent-stage", Tasks: []string{"agent-task"}}
+	m := &models.Machine{
+		Name:   "agent",
+		Stage:  "agent-stage",
+		Params: map[string]interface{}{"greeting": "hello"},
+		Meta:   models.Meta{"feature-flags": "change-stage-v2"},
+	}
+	for _, obj := range []models.Model{task, stage, m} {
+		if f, ok := obj.(models.Filler); ok {
+			f.Fill()
+		}
+		if err := session.CreateModel(obj); err != nil {
+			t.Fatalf("ERROR: Failed to create %s: %v", obj.Prefix(), err)
+		}
+	}
+	log := &bytes.Buffer{}
+	a, err := agent.New(session, m, true, true, false, log)
+	if err != nil {
+		t.Fatalf("ERROR: Agent create failed: %v", err)
+	}
+	if err := a.Timeout(time.Second).Run(); err != nil {
+		t.Errorf("ERROR: Agent run failed: %v", err)
+	}
+	if err := session.FillModel(m, m.Key()); err != nil {
+		t.Fatalf("ERROR: Failed to refetch machine: %v", err)
+	}
+	if m.CurrentTask != 1 || !m.WorkflowComplete {
+		t.Errorf("ERROR: Machine did not finish its tasks: %d", m.CurrentTask)
+	}
+	job := &models.Job{}
+	if err := session.FillModel(job, m.CurrentJob.String()); err != nil || job.State != "finished" || job.ExitState != "complete" {
+		t.Errorf("ERROR: Unexpected job state %s:%s: %v", job.State, job.ExitState, err)
+	}
+	if buf, err := ioutil.ReadFile(path.Join(tjd, "agent.txt")); err != nil || string(buf) != "hello\n" {
+		t.Errorf("ERROR: Rendered file has %q: %v", string(buf), err)
+	}
+	jl := &bytes.Buffer{}
+	if err := session.Req().UrlFor("jobs", job.Key(), "log").Do(jl); err != nil || !strings.Contains(jl.String(), "ran agent-task") {
+		t.Errorf("ERROR: Job log missing script output: %q: %v", jl.String(), err)
+	}
+	t.Logf("Agent log:\n%s", log.String())
+}
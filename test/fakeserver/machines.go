@@ -0,0 +1,347 @@
+package fakeserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/pborman/uuid"
+)
+
+func (s *Server) pref(name, def string) string {
+	p := &models.Pref{}
+	if s.backend.Load("preferences", name, p) == nil && p.Val != "" {
+		return p.Val
+	}
+	return def
+}
+
+func (s *Server) stage(name string) *models.Stage {
+	if obj, ok := s.loadRaw("stages", name); ok {
+		return obj.(*models.Stage)
+	}
+	return nil
+}
+
+// workflowTasks expands a workflow into the task list that a machine
+// will run, in the same form dr-provision uses: each stage is
+// represented by a stage: entry, followed by a bootenv: entry if the
+// stage has a bootenv, followed by the tasks in the stage.
+func (s *Server) workflowTasks(name string) ([]string, string, *models.Error) {
+	obj, ok := s.loadRaw("workflows", name)
+	if !ok {
+		return nil, "", newErr(http.StatusUnprocessableEntity, "ValidationError", "workflows", name, "Workflow %s does not exist", name)
+	}
+	wf := obj.(*models.Workflow)
+	res := []string{}
+	for _, stageName := range wf.Stages {
+		st := s.stage(stageName)
+		if st == nil {
+			return nil, "", newErr(http.StatusUnprocessableEntity, "ValidationError", "workflows", name, "Stage %s does not exist", stageName)
+		}
+		res = append(res, "stage:"+st.Name)
+		if st.BootEnv != "" {
+			res = append(res, "bootenv:"+st.BootEnv)
+		}
+		res = append(res, st.Tasks...)
+	}
+	first := ""
+	if len(wf.Stages) > 0 {
+		first = wf.Stages[0]
+	}
+	return res, first, nil
+}
+
+func finishMachine(m *models.Machine) {
+	if m.CurrentTask > len(m.Tasks) {
+		m.CurrentTask = len(m.Tasks)
+	}
+	if len(m.Tasks) == 0 && m.CurrentTask == -1 {
+		m.CurrentTask = 0
+	}
+	m.WorkflowComplete = m.CurrentTask >= len(m.Tasks)
+}
+
+// fillMachine fills in the defaults for a new machine.
+func (s *Server) fillMachine(m *models.Machine) {
+	if m.Uuid == nil {
+		m.Uuid = uuid.NewRandom()
+	}
+	if m.Secret == "" {
+		m.Secret = models.RandString(16)
+	}
+	if m.Pool == "" {
+		m.Pool = "default"
+	}
+	if m.PoolStatus == "" {
+		m.PoolStatus = "Free"
+	}
+	if m.BootEnv == "" {
+		m.BootEnv = s.pref("defaultBootEnv", "local")
+	}
+	if m.Workflow == "" {
+		m.Workflow = s.pref("defaultWorkflow", "")
+	}
+	m.Runnable = true
+	m.CurrentJob = nil
+	m.CurrentTask = -1
+	if m.Workflow != "" {
+		if tasks, first, err := s.workflowTasks(m.Workflow); err == nil {
+			m.Tasks, m.Stage = tasks, first
+		}
+	} else {
+		if m.Stage == "" {
+			m.Stage = s.pref("defaultStage", "none")
+		}
+		if st := s.stage(m.Stage); st != nil {
+			m.Tasks = append([]string{}, st.Tasks...)
+			if st.BootEnv != "" {
+				m.BootEnv = st.BootEnv
+			}
+		}
+	}
+	finishMachine(m)
+}
+
+func machineErr(m *models.Machine, f string, args ...interface{}) *models.Error {
+	return newErr(http.StatusUnprocessableEntity, "ValidationError", "machines", m.Key(), f, args...)
+}
+
+// updateMachine enforces the rules dr-provision has around changing
+// the workflow, stage, and task list of a machine.
+func (s *Server) updateMachine(r *http.Request, old, m *models.Machine) *models.Error {
+	if m.Secret == "" {
+		m.Secret = old.Secret
+	}
+	force := r.URL.Query().Get("force") == "true"
+	switch {
+	case m.Workflow != old.Workflow && m.Workflow != "":
+		tasks, first, err := s.workflowTasks(m.Workflow)
+		if err != nil {
+			return err
+		}
+		m.Tasks, m.Stage, m.CurrentTask = tasks, first, -1
+	case m.Stage != old.Stage:
+		if old.CurrentTask < len(old.Tasks) && !force {
+			return machineErr(m, "Can not change stages with pending tasks unless forced")
+		}
+		st := s.stage(m.Stage)
+		if st == nil {
+			return machineErr(m, "Stage %s does not exist", m.Stage)
+		}
+		if m.Workflow == "" {
+			m.Tasks = append([]string{}, st.Tasks...)
+			m.CurrentTask = -1
+		}
+		if st.BootEnv != "" {
+			m.BootEnv = st.BootEnv
+		}
+	default:
+		if m.CurrentTask != old.CurrentTask && m.CurrentTask != -1 && m.CurrentTask > old.CurrentTask {
+			return machineErr(m, "Cannot advance CurrentTask from %d to %d without running jobs", old.CurrentTask, m.CurrentTask)
+		}
+		if reflect.DeepEqual(m.Tasks, old.Tasks) || m.CurrentTask == -1 {
+			break
+		}
+		past := []string{}
+		if old.CurrentTask >= 0 {
+			end := old.CurrentTask + 1
+			if end > len(old.Tasks) {
+				end = len(old.Tasks)
+			}
+			past = old.Tasks[:end]
+		}
+		if len(m.Tasks) < len(past) {
+			return machineErr(m, "Cannot remove tasks that have already executed or are already executing")
+		}
+		if !reflect.DeepEqual(m.Tasks[:len(past)], past) {
+			return machineErr(m, "Cannot change tasks that have already executed or are executing")
+		}
+		if old.CurrentTask >= len(old.Tasks) && len(m.Tasks) > len(old.Tasks) {
+			m.CurrentTask = len(old.Tasks) - 1
+		}
+	}
+	finishMachine(m)
+	return nil
+}
+
+func emptyJob(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createJob creates the next job for a machine, following the same
+// rules dr-provision does:
+//
+// * An incomplete job is retried in place.
+//
+// * A failed job is retried with a new job for the same task.
+//
+// * A finished job advances to the next task.
+//
+// stage:, bootenv:, and context: tasks are handled entirely on the server side,
+// and the jobs for them are returned in the finished state.  If there
+// is nothing left to do, an empty response is returned.
+func (s *Server) createJob(w http.ResponseWriter, r *http.Request, principal string) {
+	req := &models.Job{}
+	if err := decodeBody(r, req); err != nil {
+		writeErr(w, err)
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	obj, ok := s.loadRaw("machines", req.Machine.String())
+	if !ok {
+		writeErr(w, newErr(http.StatusUnprocessableEntity, "ValidationError", "jobs", "", "Machine %s does not exist", req.Machine))
+		return
+	}
+	m := obj.(*models.Machine)
+	if !m.Runnable || m.Context != req.Context {
+		emptyJob(w)
+		return
+	}
+	var prev *models.Job
+	if m.CurrentJob != nil {
+		if obj, ok := s.loadRaw("jobs", m.CurrentJob.String()); ok {
+			prev = obj.(*models.Job)
+		}
+	}
+	idx := m.CurrentTask
+	if idx < 0 {
+		idx = 0
+	} else if prev != nil && prev.CurrentIndex == idx {
+		switch prev.State {
+		case "created", "running":
+			writeErr(w, newErr(http.StatusConflict, "Conflict", "jobs", prev.Key(), "Machine %s already has a %s job", m.Key(), prev.State))
+			return
+		case "incomplete":
+			prev.State = "created"
+			prev.ExitState = ""
+			prev.StartTime = time.Now()
+			if err := s.save(prev, "update", principal); err != nil {
+				writeErr(w, err)
+				return
+			}
+			writeJSON(w, http.StatusAccepted, prev)
+			return
+		case "finished":
+			idx++
+		}
+	}
+	if idx >= len(m.Tasks) {
+		if m.CurrentTask != len(m.Tasks) {
+			m.CurrentTask = len(m.Tasks)
+			finishMachine(m)
+			s.save(m, "update", principal)
+		}
+		emptyJob(w)
+		return
+	}
+	task := m.Tasks[idx]
+	job := &models.Job{
+		Uuid:         uuid.NewRandom(),
+		Machine:      m.Uuid,
+		Task:         task,
+		Stage:        m.Stage,
+		Workflow:     m.Workflow,
+		BootEnv:      m.BootEnv,
+		Context:      m.Context,
+		State:        "created",
+		StartTime:    time.Now(),
+		CurrentIndex: idx,
+		NextIndex:    idx + 1,
+		Current:      true,
+	}
+	if prev != nil {
+		job.Previous = prev.Uuid
+	}
+	job.Fill()
+	parts := strings.SplitN(task, ":", 2)
+	if len(parts) == 2 {
+		switch parts[0] {
+		case "stage":
+			m.Stage = parts[1]
+			job.Stage = parts[1]
+			job.State, job.ExitState = "finished", "complete"
+		case "bootenv":
+			m.BootEnv = parts[1]
+			job.BootEnv = parts[1]
+			job.State, job.ExitState = "finished", "complete"
+		case "context":
+			m.Context = parts[1]
+			job.State, job.ExitState = "finished", "complete"
+		}
+		job.EndTime = job.StartTime
+	}
+	for _, o := range s.list("jobs") {
+		j := o.(*models.Job)
+		if j.Current && uuid.Equal(j.Machine, m.Uuid) {
+			j.Current = false
+			s.save(j, "update", principal)
+		}
+	}
+	setValid(job)
+	if err := s.save(job, "create", principal); err != nil {
+		writeErr(w, err)
+		return
+	}
+	m.CurrentJob = job.Uuid
+	m.CurrentTask = idx
+	finishMachine(m)
+	if err := s.save(m, "update", principal); err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, job)
+}
+
+// serveJobLog appends to (PUT) or fetches (GET) the log of a job.
+func (s *Server) serveJobLog(w http.ResponseWriter, r *http.Request, job *models.Job) {
+	switch r.Method {
+	case "PUT":
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeErr(w, newErr(http.StatusBadRequest, "API_ERROR", "jobs", job.Key(), "%v", err))
+			return
+		}
+		s.mux.Lock()
+		s.jobLogs[job.Key()] = append(s.jobLogs[job.Key()], buf...)
+		s.mux.Unlock()
+		writeJSON(w, http.StatusNoContent, nil)
+	case "GET":
+		s.mux.Lock()
+		buf := append([]byte{}, s.jobLogs[job.Key()]...)
+		s.mux.Unlock()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf)
+	default:
+		writeErr(w, newErr(http.StatusMethodNotAllowed, "API_ERROR", "jobs", job.Key(), "Method %s not allowed", r.Method))
+	}
+}
+
+// serveJobActions renders the templates of the task a job is for.
+func (s *Server) serveJobActions(w http.ResponseWriter, r *http.Request, job *models.Job) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	tObj, ok := s.loadRaw("tasks", job.Task)
+	if !ok {
+		writeErr(w, newErr(http.StatusUnprocessableEntity, "ValidationError", "jobs", job.Key(), "Task %s does not exist", job.Task))
+		return
+	}
+	mObj, ok := s.loadRaw("machines", job.Machine.String())
+	if !ok {
+		writeErr(w, newErr(http.StatusUnprocessableEntity, "ValidationError", "jobs", job.Key(), "Machine %s does not exist", job.Machine))
+		return
+	}
+	actions, err := s.renderer().RenderTask(mObj.(*models.Machine), tObj.(*models.Task))
+	if err != nil {
+		err.Model, err.Key = "jobs", job.Key()
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, actions)
+}
@@ -0,0 +1,710 @@
+package fakeserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VictorLowther/jsonpatch2"
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+// baseTypes returns a map of API prefix to a blank instance of the
+// model that lives at that prefix.
+func baseTypes() map[string]models.Model {
+	res := map[string]models.Model{}
+	for _, m := range models.All() {
+		res[m.Prefix()] = m
+	}
+	return res
+}
+
+func newModel(prefix string) (models.Model, *models.Error) {
+	if _, ok := baseTypes()[prefix]; !ok {
+		return nil, notFound("GET", prefix, "")
+	}
+	res, _ := models.New(prefix)
+	return res, nil
+}
+
+// fields returns a map of the top-level fields of m as they would be
+// rendered in JSON.
+func fields(m interface{}) map[string]interface{} {
+	res := map[string]interface{}{}
+	models.Remarshal(m, &res)
+	return res
+}
+
+func (s *Server) loadRaw(prefix, key string) (models.Model, bool) {
+	res, err := newModel(prefix)
+	if err != nil {
+		return nil, false
+	}
+	if s.backend.Load(prefix, key, res) != nil {
+		return nil, false
+	}
+	// The store resets ReadOnly on load, so derive it from whether
+	// the object came from a content bundle.
+	if b, ok := res.(models.Bundler); ok && b.GetBundle() != "" {
+		if a, ok := res.(models.Accessor); ok {
+			a.SetReadOnly(true)
+		}
+	}
+	if f, ok := res.(models.Filler); ok {
+		f.Fill()
+	}
+	return res, true
+}
+
+// load fetches the object at prefix with key.  Keys in the form of
+// Index:value are looked up against the named index, and must match
+// exactly one object.
+func (s *Server) load(prefix, key string) (models.Model, bool) {
+	if res, ok := s.loadRaw(prefix, key); ok {
+		return res, true
+	}
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	var found models.Model
+	for _, obj := range s.list(prefix) {
+		if v, ok := fields(obj)[parts[0]]; ok && scalar(v) == parts[1] {
+			if found != nil {
+				return nil, false
+			}
+			found = obj
+		}
+	}
+	return found, found != nil
+}
+
+// list returns all the objects of a given type sorted by key.
+func (s *Server) list(prefix string) []models.Model {
+	keys, _ := s.backend.Keys(prefix)
+	sort.Strings(keys)
+	res := make([]models.Model, 0, len(keys))
+	for _, k := range keys {
+		if obj, ok := s.loadRaw(prefix, k); ok {
+			res = append(res, obj)
+		}
+	}
+	return res
+}
+
+// save stores obj and publishes an event about it.
+func (s *Server) save(obj models.Model, action, principal string) *models.Error {
+	if err := s.backend.Save(obj.Prefix(), obj.Key(), obj); err != nil {
+		return newErr(http.StatusInternalServerError, "API_ERROR", obj.Prefix(), obj.Key(), "%v", err)
+	}
+	s.publish(obj, action, principal)
+	return nil
+}
+
+func (s *Server) remove(obj models.Model, principal string) *models.Error {
+	if err := s.backend.Remove(obj.Prefix(), obj.Key()); err != nil {
+		return newErr(http.StatusInternalServerError, "API_ERROR", obj.Prefix(), obj.Key(), "%v", err)
+	}
+	s.publish(obj, "delete", principal)
+	return nil
+}
+
+func (s *Server) publish(obj models.Model, action, principal string) {
+	s.events.publish(&models.Event{
+		Time:      time.Now(),
+		Type:      obj.Prefix(),
+		Action:    action,
+		Key:       obj.Key(),
+		Principal: principal,
+		Object:    sanitize(obj),
+	})
+}
+
+type sanitizer interface {
+	Sanitize() models.Model
+}
+
+func sanitize(obj models.Model) models.Model {
+	if s, ok := obj.(sanitizer); ok {
+		return s.Sanitize()
+	}
+	return obj
+}
+
+// validate runs the model validation for obj, and returns a
+// ValidationError if the object is not valid.
+func validate(obj models.Model) *models.Error {
+	v, ok := obj.(models.Validator)
+	if !ok {
+		setValid(obj)
+		return nil
+	}
+	v.ClearValidation()
+	if obj.Prefix() != "jobs" {
+		v.Validate()
+	}
+	if me, ok := obj.(interface {
+		MakeError(int, string, models.Model) error
+	}); ok {
+		if err := me.MakeError(http.StatusUnprocessableEntity, "ValidationError", obj); err != nil {
+			return err.(*models.Error)
+		}
+	}
+	setValid(obj)
+	return nil
+}
+
+func readOnly(obj models.Model) bool {
+	a, ok := obj.(models.Accessor)
+	return ok && a.IsReadOnly()
+}
+
+func decodeBody(r *http.Request, into interface{}) *models.Error {
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return newErr(http.StatusBadRequest, "API_ERROR", "", "", "%v", err)
+	}
+	if err := json.Unmarshal(buf, into); err != nil {
+		return newErr(http.StatusBadRequest, "API_ERROR", "", "", "Failed to decode body: %v", err)
+	}
+	return nil
+}
+
+// serveObjects handles the generic CRUD routes for all of the models.
+func (s *Server) serveObjects(w http.ResponseWriter, r *http.Request, parts []string, principal string) {
+	prefix := parts[0]
+	if len(parts) > 2 {
+		s.serveSubObject(w, r, parts, principal)
+		return
+	}
+	if len(parts) == 1 {
+		switch r.Method {
+		case "GET", "HEAD":
+			s.mux.Lock()
+			objs, err := s.filter(prefix, r)
+			s.mux.Unlock()
+			if err != nil {
+				writeErr(w, err)
+				return
+			}
+			w.Header().Set("X-DRP-LIST-COUNT", strconv.Itoa(len(objs)))
+			if r.Method == "HEAD" {
+				writeJSON(w, http.StatusOK, nil)
+				return
+			}
+			writeJSON(w, http.StatusOK, objs)
+		case "POST":
+			if prefix == "jobs" {
+				s.createJob(w, r, principal)
+				return
+			}
+			s.create(w, r, prefix, principal)
+		default:
+			writeErr(w, newErr(http.StatusMethodNotAllowed, "API_ERROR", prefix, "", "Method %s not allowed", r.Method))
+		}
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	obj, found := s.load(prefix, parts[1])
+	if !found {
+		writeErr(w, notFound(r.Method, prefix, parts[1]))
+		return
+	}
+	switch r.Method {
+	case "HEAD":
+		writeJSON(w, http.StatusOK, nil)
+	case "GET":
+		writeJSON(w, http.StatusOK, s.slim(sanitize(obj), r))
+	case "PUT", "PATCH":
+		if readOnly(obj) {
+			writeErr(w, newErr(http.StatusForbidden, "API_ERROR", prefix, obj.Key(), "Object is read only"))
+			return
+		}
+		newObj, _ := newModel(prefix)
+		if r.Method == "PUT" {
+			if err := decodeBody(r, newObj); err != nil {
+				writeErr(w, err)
+				return
+			}
+		} else if err := s.patchObj(r, obj, newObj); err != nil {
+			writeErr(w, err)
+			return
+		}
+		if f, ok := newObj.(models.Filler); ok {
+			f.Fill()
+		}
+		if newObj.Key() != obj.Key() {
+			writeErr(w, newErr(http.StatusBadRequest, "API_ERROR", prefix, obj.Key(), "Cannot change key from %s to %s", obj.Key(), newObj.Key()))
+			return
+		}
+		if err := s.beforeUpdate(r, obj, newObj); err != nil {
+			writeErr(w, err)
+			return
+		}
+		if err := validate(newObj); err != nil {
+			writeErr(w, err)
+			return
+		}
+		action := "save"
+		if r.Method == "PATCH" {
+			action = "update"
+		}
+		if err := s.save(newObj, action, principal); err != nil {
+			writeErr(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, sanitize(newObj))
+	case "DELETE":
+		if readOnly(obj) {
+			writeErr(w, newErr(http.StatusForbidden, "API_ERROR", prefix, obj.Key(), "Object is read only"))
+			return
+		}
+		if err := s.remove(obj, principal); err != nil {
+			writeErr(w, err)
+			return
+		}
+		if prefix == "jobs" {
+			delete(s.jobLogs, obj.Key())
+		}
+		writeJSON(w, http.StatusOK, sanitize(obj))
+	default:
+		writeErr(w, newErr(http.StatusMethodNotAllowed, "API_ERROR", prefix, obj.Key(), "Method %s not allowed", r.Method))
+	}
+}
+
+func (s *Server) patchObj(r *http.Request, obj, into models.Model) *models.Error {
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return newErr(http.StatusBadRequest, "API_ERROR", obj.Prefix(), obj.Key(), "%v", err)
+	}
+	patch, err := jsonpatch2.NewPatch(buf)
+	if err != nil {
+		return newErr(http.StatusBadRequest, "PATCH_ERROR", obj.Prefix(), obj.Key(), "Invalid patch: %v", err)
+	}
+	base, _ := json.Marshal(obj)
+	res, err, loc := patch.Apply(base)
+	if err != nil {
+		return newErr(http.StatusConflict, "PATCH_ERROR", obj.Prefix(), obj.Key(), "Patch error at line %d: %v", loc, err)
+	}
+	if err := json.Unmarshal(res, into); err != nil {
+		return newErr(http.StatusBadRequest, "PATCH_ERROR", obj.Prefix(), obj.Key(), "%v", err)
+	}
+	return nil
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request, prefix, principal string) {
+	obj, err := newModel(prefix)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	if err := decodeBody(r, obj); err != nil {
+		writeErr(w, err)
+		return
+	}
+	if f, ok := obj.(models.Filler); ok {
+		f.Fill()
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err := s.beforeCreate(obj); err != nil {
+		writeErr(w, err)
+		return
+	}
+	if obj.Key() == "" {
+		writeErr(w, newErr(http.StatusBadRequest, "API_ERROR", prefix, "", "Empty key not allowed"))
+		return
+	}
+	if s.backend.Exists(prefix, obj.Key()) {
+		writeErr(w, newErr(http.StatusConflict, "CONFLICT", prefix, obj.Key(), "already exists"))
+		return
+	}
+	if a, ok := obj.(models.Accessor); ok {
+		a.SetReadOnly(false)
+	}
+	if b, ok := obj.(models.Bundler); ok {
+		b.SetBundle("")
+	}
+	if err := validate(obj); err != nil {
+		writeErr(w, err)
+		return
+	}
+	if err := s.save(obj, "create", principal); err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, sanitize(obj))
+}
+
+// beforeCreate fills in the server-side defaults for new objects.
+func (s *Server) beforeCreate(obj models.Model) *models.Error {
+	switch o := obj.(type) {
+	case *models.Machine:
+		s.fillMachine(o)
+	case *models.User:
+		if o.Secret == "" {
+			o.Secret = models.RandString(16)
+		}
+	}
+	return nil
+}
+
+// beforeUpdate enforces the server-side rules for changing objects.
+func (s *Server) beforeUpdate(r *http.Request, old, obj models.Model) *models.Error {
+	if a, ok := obj.(models.Accessor); ok {
+		a.SetReadOnly(false)
+	}
+	switch o := obj.(type) {
+	case *models.Machine:
+		return s.updateMachine(r, old.(*models.Machine), o)
+	case *models.Job:
+		oj := old.(*models.Job)
+		switch o.State {
+		case "finished", "failed", "incomplete":
+			if oj.State != o.State {
+				o.EndTime = time.Now()
+			}
+		}
+	case *models.User:
+		if len(o.PasswordHash) == 0 {
+			o.PasswordHash = old.(*models.User).PasswordHash
+		}
+	}
+	return nil
+}
+
+// serveSubObject handles routes below an individual object, such as
+// params, actions, and job logs.
+func (s *Server) serveSubObject(w http.ResponseWriter, r *http.Request, parts []string, principal string) {
+	prefix, key, sub := parts[0], parts[1], parts[2]
+	s.mux.Lock()
+	obj, found := s.load(prefix, key)
+	s.mux.Unlock()
+	if !found {
+		writeErr(w, notFound(r.Method, prefix, key))
+		return
+	}
+	switch sub {
+	case "params":
+		s.serveParams(w, r, obj, strings.Join(parts[3:], "/"), principal)
+	case "actions", "plugin_actions":
+		s.serveActions(w, r, obj, parts[3:])
+	case "log":
+		if job, ok := obj.(*models.Job); ok {
+			s.serveJobLog(w, r, job)
+			return
+		}
+		writeErr(w, notFound(r.Method, prefix, key+"/log"))
+	default:
+		writeErr(w, notFound(r.Method, prefix, strings.Join(parts[1:], "/")))
+	}
+}
+
+// serveActions handles plugin-provided actions.  Since the fake
+// server does not run plugins, there never are any, except for the
+// job actions that are rendered from the job's task.
+func (s *Server) serveActions(w http.ResponseWriter, r *http.Request, obj models.Model, rest []string) {
+	if job, ok := obj.(*models.Job); ok && r.Method == "GET" && len(rest) == 0 {
+		s.serveJobActions(w, r, job)
+		return
+	}
+	if r.Method == "GET" && len(rest) == 0 {
+		writeJSON(w, http.StatusOK, []interface{}{})
+		return
+	}
+	writeErr(w, notFound(r.Method, obj.Prefix(), obj.Key()+"/actions/"+strings.Join(rest, "/")))
+}
+
+// scalar renders a JSON value as the string form used by filters and
+// key lookups.
+func scalar(v interface{}) string {
+	switch o := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return o
+	case float64:
+		return strconv.FormatFloat(o, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(o)
+	default:
+		buf, _ := json.Marshal(o)
+		return string(buf)
+	}
+}
+
+func compare(v interface{}, val string) int {
+	switch o := v.(type) {
+	case float64:
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			switch {
+			case o < f:
+				return -1
+			case o > f:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(scalar(v), val)
+}
+
+var filterOp = regexp.MustCompile(`^(Eq|Lt|Lte|Gt|Gte|Ne|In|Nin|Re|Between|Except)\((.*)\)$`)
+
+type filterFunc func(interface{}) bool
+
+func makeFilter(spec string) (filterFunc, error) {
+	op, arg := "Eq", spec
+	if m := filterOp.FindStringSubmatch(spec); m != nil {
+		op, arg = m[1], m[2]
+	}
+	switch op {
+	case "Eq":
+		return func(v interface{}) bool { return compare(v, arg) == 0 }, nil
+	case "Ne":
+		return func(v interface{}) bool { return compare(v, arg) != 0 }, nil
+	case "Lt":
+		return func(v interface{}) bool { return compare(v, arg) < 0 }, nil
+	case "Lte":
+		return func(v interface{}) bool { return compare(v, arg) <= 0 }, nil
+	case "Gt":
+		return func(v interface{}) bool { return compare(v, arg) > 0 }, nil
+	case "Gte":
+		return func(v interface{}) bool { return compare(v, arg) >= 0 }, nil
+	case "Re":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(v interface{}) bool { return re.MatchString(scalar(v)) }, nil
+	case "In", "Nin":
+		vals := strings.Split(arg, ",")
+		want := op == "In"
+		return func(v interface{}) bool {
+			for _, val := range vals {
+				if compare(v, val) == 0 {
+					return want
+				}
+			}
+			return !want
+		}, nil
+	default:
+		bounds := strings.SplitN(arg, ",", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("%s requires 2 parameters", op)
+		}
+		want := op == "Between"
+		return func(v interface{}) bool {
+			in := compare(v, bounds[0]) >= 0 && compare(v, bounds[1]) <= 0
+			return in == want
+		}, nil
+	}
+}
+
+// fieldValue fetches the value of the named index for an object.
+// Names that are not top-level fields are looked up as params on
+// objects that have them.
+func fieldValue(obj models.Model, flds map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := flds[name]; ok {
+		return v, true
+	}
+	if name == "Key" {
+		return obj.Key(), true
+	}
+	if p, ok := obj.(models.Paramer); ok {
+		v, ok := p.GetParams()[name]
+		return v, ok
+	}
+	return nil, false
+}
+
+// matches tests a value against a filter.  Lists match if any of
+// their members do.
+func matches(f filterFunc, v interface{}) bool {
+	if l, ok := v.([]interface{}); ok {
+		for _, item := range l {
+			if f(item) {
+				return true
+			}
+		}
+		return false
+	}
+	return f(v)
+}
+
+// filter handles the index filtering, sorting, and paging parameters
+// for list requests.
+func (s *Server) filter(prefix string, r *http.Request) ([]models.Model, *models.Error) {
+	q := r.URL.Query()
+	filters := map[string]filterFunc{}
+	for k, vals := range q {
+		switch k {
+		case "sort", "limit", "offset", "reverse", "slim", "params", "decode", "aggregate", "force", "commented", "reduced":
+			continue
+		}
+		f, err := makeFilter(vals[0])
+		if err != nil {
+			return nil, newErr(http.StatusBadRequest, "API_ERROR", prefix, "", "Invalid filter %s: %v", k, err)
+		}
+		filters[k] = f
+	}
+	objs := []models.Model{}
+	for _, obj := range s.list(prefix) {
+		flds := fields(obj)
+		ok := true
+		for name, f := range filters {
+			v, found := fieldValue(obj, flds, name)
+			if !found || !matches(f, v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			objs = append(objs, sanitize(obj))
+		}
+	}
+	if idx := q.Get("sort"); idx != "" {
+		sort.SliceStable(objs, func(i, j int) bool {
+			vi, _ := fieldValue(objs[i], fields(objs[i]), idx)
+			vj, _ := fieldValue(objs[j], fields(objs[j]), idx)
+			return compare(vi, scalar(vj)) < 0
+		})
+	}
+	if q.Get("reverse") == "true" {
+		for i, j := 0, len(objs)-1; i < j; i, j = i+1, j-1 {
+			objs[i], objs[j] = objs[j], objs[i]
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		off, err := strconv.Atoi(v)
+		if err != nil || off < 0 {
+			return nil, newErr(http.StatusBadRequest, "API_ERROR", prefix, "", "Invalid offset %s", v)
+		}
+		if off > len(objs) {
+			off = len(objs)
+		}
+		objs = objs[off:]
+	}
+	if v := q.Get("limit"); v != "" {
+		lim, err := strconv.Atoi(v)
+		if err != nil || lim < 0 {
+			return nil, newErr(http.StatusBadRequest, "API_ERROR", prefix, "", "Invalid limit %s", v)
+		}
+		if lim < len(objs) {
+			objs = objs[:lim]
+		}
+	}
+	for i := range objs {
+		objs[i] = s.slim(objs[i], r)
+	}
+	return objs, nil
+}
+
+// slim handles the slim and params query parameters.
+func (s *Server) slim(obj models.Model, r *http.Request) models.Model {
+	q := r.URL.Query()
+	slim, params := q.Get("slim"), q.Get("params")
+	if slim == "" && params == "" {
+		return obj
+	}
+	res := models.Clone(obj)
+	for _, part := range strings.Split(slim, ",") {
+		switch strings.TrimSpace(part) {
+		case "Meta":
+			if m, ok := res.(models.MetaHaver); ok {
+				m.SetMeta(models.Meta{})
+			}
+		case "Params":
+			if p, ok := res.(models.Paramer); ok {
+				p.SetParams(map[string]interface{}{})
+			}
+		}
+	}
+	if p, ok := res.(models.Paramer); ok && params != "" {
+		src := p.GetParams()
+		dst := map[string]interface{}{}
+		for _, name := range strings.Split(params, ",") {
+			if v, ok := src[name]; ok {
+				dst[name] = v
+			}
+		}
+		p.SetParams(dst)
+	}
+	return res
+}
+
+// serveIndexes returns the indexes for every model, for one model, or
+// a single index.  Every scalar top-level field of a model is indexed,
+// and the key field is the unique index.
+func (s *Server) serveIndexes(w http.ResponseWriter, r *http.Request, parts []string) {
+	all := map[string]map[string]models.Index{}
+	for prefix := range baseTypes() {
+		all[prefix] = indexesFor(prefix)
+	}
+	switch len(parts) {
+	case 0:
+		writeJSON(w, http.StatusOK, all)
+	case 1:
+		idx, ok := all[parts[0]]
+		if !ok {
+			writeErr(w, notFound("GET", "indexes", parts[0]))
+			return
+		}
+		writeJSON(w, http.StatusOK, idx)
+	default:
+		idx, ok := all[parts[0]][strings.Join(parts[1:], "/")]
+		if !ok {
+			writeErr(w, notFound("GET", "indexes", strings.Join(parts, "/")))
+			return
+		}
+		writeJSON(w, http.StatusOK, idx)
+	}
+}
+
+func indexesFor(prefix string) map[string]models.Index {
+	res := map[string]models.Index{}
+	obj, err := newModel(prefix)
+	if err != nil {
+		return res
+	}
+	val := reflect.ValueOf(obj).Elem()
+	if val.Kind() != reflect.Struct {
+		return res
+	}
+	keyName := obj.KeyName()
+	for name, v := range fields(obj) {
+		idx := models.Index{}
+		switch v.(type) {
+		case string:
+			idx.Type = "string"
+			idx.Regex = true
+		case float64:
+			idx.Type = "number"
+		case bool:
+			idx.Type = "boolean"
+			idx.Unordered = true
+		default:
+			continue
+		}
+		if name == keyName {
+			idx.Unique = true
+			if name == "Uuid" {
+				idx.Type = "UUID"
+				idx.Regex = false
+			}
+		}
+		res[name] = idx
+	}
+	if _, ok := res["Key"]; !ok {
+		res["Key"] = models.Index{Type: "string", Unique: true, Regex: true}
+	}
+	return res
+}
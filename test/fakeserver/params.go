@@ -0,0 +1,133 @@
+package fakeserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/VictorLowther/jsonpatch2"
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/digitalrebar/provision/v4/render"
+)
+
+// serveParams handles the params routes for objects that have params.
+func (s *Server) serveParams(w http.ResponseWriter, r *http.Request, obj models.Model, key, principal string) {
+	p, ok := obj.(models.Paramer)
+	if !ok {
+		writeErr(w, notFound(r.Method, obj.Prefix(), obj.Key()+"/params"))
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	// Reload the object under the lock so that concurrent param
+	// updates do not stomp on each other.
+	if fresh, ok := s.loadRaw(obj.Prefix(), obj.Key()); ok {
+		p = fresh.(models.Paramer)
+	}
+	params := p.GetParams()
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	switch r.Method {
+	case "GET":
+		if r.URL.Query().Get("aggregate") == "true" {
+			params = render.AggregateParams(source{s}, p)
+		}
+		if key == "" {
+			if want := r.URL.Query().Get("params"); want != "" {
+				res := map[string]interface{}{}
+				for _, k := range strings.Split(want, ",") {
+					if v, ok := params[k]; ok {
+						res[k] = v
+					}
+				}
+				params = res
+			}
+			writeJSON(w, http.StatusOK, params)
+			return
+		}
+		if v, ok := params[key]; ok {
+			writeJSON(w, http.StatusOK, v)
+		} else {
+			writeJSON(w, http.StatusOK, json.RawMessage("null"))
+		}
+		return
+	case "DELETE":
+		if key == "" {
+			writeErr(w, newErr(http.StatusMethodNotAllowed, "API_ERROR", obj.Prefix(), obj.Key(), "Cannot delete all params"))
+			return
+		}
+		res := params[key]
+		delete(params, key)
+		if err := s.saveParams(p, params, principal); err != nil {
+			writeErr(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+		return
+	case "POST", "PUT":
+		var val interface{}
+		if err := decodeBody(r, &val); err != nil {
+			writeErr(w, err)
+			return
+		}
+		if key != "" {
+			params[key] = val
+			if err := s.saveParams(p, params, principal); err != nil {
+				writeErr(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, val)
+			return
+		}
+		newParams, ok := val.(map[string]interface{})
+		if !ok {
+			writeErr(w, newErr(http.StatusBadRequest, "API_ERROR", obj.Prefix(), obj.Key(), "Params must be an object"))
+			return
+		}
+		if err := s.saveParams(p, newParams, principal); err != nil {
+			writeErr(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newParams)
+		return
+	case "PATCH":
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeErr(w, newErr(http.StatusBadRequest, "API_ERROR", obj.Prefix(), obj.Key(), "%v", err))
+			return
+		}
+		patch, err := jsonpatch2.NewPatch(buf)
+		if err != nil {
+			writeErr(w, newErr(http.StatusBadRequest, "PATCH_ERROR", obj.Prefix(), obj.Key(), "Invalid patch: %v", err))
+			return
+		}
+		base, _ := json.Marshal(params)
+		res, err, loc := patch.Apply(base)
+		if err != nil {
+			writeErr(w, newErr(http.StatusConflict, "PATCH_ERROR", obj.Prefix(), obj.Key(), "Patch error at line %d: %v", loc, err))
+			return
+		}
+		newParams := map[string]interface{}{}
+		if err := json.Unmarshal(res, &newParams); err != nil {
+			writeErr(w, newErr(http.StatusBadRequest, "PATCH_ERROR", obj.Prefix(), obj.Key(), "%v", err))
+			return
+		}
+		if err := s.saveParams(p, newParams, principal); err != nil {
+			writeErr(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newParams)
+		return
+	}
+	writeErr(w, newErr(http.StatusMethodNotAllowed, "API_ERROR", obj.Prefix(), obj.Key(), "Method %s not allowed", r.Method))
+}
+
+func (s *Server) saveParams(p models.Paramer, params map[string]interface{}, principal string) *models.Error {
+	if readOnly(p) {
+		return newErr(http.StatusForbidden, "API_ERROR", p.Prefix(), p.Key(), "Object is read only")
+	}
+	p.SetParams(params)
+	return s.save(p, "update", principal)
+}
@@ -0,0 +1,47 @@
+package fakeserver
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/digitalrebar/provision/v4/render"
+)
+
+// source lets the render package look up objects in the Server.  It
+// must only be used with the Server lock held.
+type source struct {
+	s *Server
+}
+
+func (src source) Find(prefix, key string) models.Model {
+	if obj, ok := src.s.loadRaw(prefix, key); ok {
+		return obj
+	}
+	return nil
+}
+
+func (src source) List(prefix string) []models.Model {
+	return src.s.list(prefix)
+}
+
+func (s *Server) provisionerURL() string {
+	return fmt.Sprintf("http://%s", net.JoinHostPort(s.address.String(), fmt.Sprintf("%d", s.filePort)))
+}
+
+// renderer returns a Renderer for the Server.  Tokens it generates
+// are valid for the API.  It must be called with the Server lock held.
+func (s *Server) renderer() *render.Renderer {
+	return &render.Renderer{
+		Source:             source{s},
+		Info:               s.Info(),
+		ProvisionerAddress: s.address.String(),
+		ProvisionerURL:     s.provisionerURL(),
+		ApiURL:             s.Endpoint(),
+		Token: func(m *models.Machine, infinite bool) string {
+			tok := models.RandString(32)
+			s.tokens[tok] = "machine:" + m.Key()
+			return tok
+		},
+	}
+}
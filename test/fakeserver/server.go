@@ -0,0 +1,327 @@
+// Package fakeserver implements an in-process stand-in for
+// dr-provision.  It serves an in-memory implementation of the core
+// REST API (object CRUD, filters and indexes, params, files and isos,
+// contents, jobs, and the websocket event stream) that is good enough
+// to run drpcli commands and the machine agent against without needing
+// a real dr-provision binary.
+//
+// Objects are kept in a store.Memory, and blobs are kept on disk under
+// the root directory the Server was created with.
+package fakeserver
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/digitalrebar/provision/v4/store"
+)
+
+// apiPath is the prefix of every API request, the same as api.APIPATH.
+// The api package is not imported so that its own tests can use the
+// Server.
+const apiPath = "/api/v3"
+
+// DefaultUsername and DefaultPassword are the credentials of the user
+// that every new Server is created with.
+const (
+	DefaultUsername = "rocketskates"
+	DefaultPassword = "r0cketsk8ts"
+)
+
+// Server is an in-memory fake dr-provision endpoint.
+type Server struct {
+	mux      *sync.Mutex
+	backend  store.Store
+	root     string
+	id       string
+	address  net.IP
+	apiPort  int
+	filePort int
+	tokens   map[string]string
+	jobLogs  map[string][]byte
+	contents map[string]*models.Content
+	events   *eventHub
+	apiSrv   *httptest.Server
+	fileSrv  *httptest.Server
+}
+
+// New creates a new Server that keeps its blobs under root.  The
+// Server starts out with the same basic objects a freshly installed
+// dr-provision has: the local and ignore bootenvs, the none and local
+// stages, the global profile, and the default user.
+func New(root string) (*Server, error) {
+	for _, dir := range []string{"files", "isos"} {
+		if err := os.MkdirAll(path.Join(root, "tftpboot", dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	backend, err := store.Open("memory:///")
+	if err != nil {
+		return nil, err
+	}
+	res := &Server{
+		mux:      &sync.Mutex{},
+		backend:  backend,
+		root:     root,
+		id:       "Fred",
+		address:  net.IPv4(127, 0, 0, 1),
+		tokens:   map[string]string{},
+		jobLogs:  map[string][]byte{},
+		contents: map[string]*models.Content{},
+		events:   newEventHub(),
+	}
+	if err := res.seed(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *Server) seed() error {
+	local := &models.BootEnv{
+		Name:        "local",
+		Description: "The boot environment you should use to have unknown machines boot off their local hard drive",
+		OnlyUnknown: false,
+	}
+	ignore := &models.BootEnv{
+		Name:        "ignore",
+		Description: "The boot environment you should use to have unknown machines ignored",
+		OnlyUnknown: true,
+	}
+	none := &models.Stage{Name: "none", Description: "Noop / Nothing stage"}
+	localStage := &models.Stage{Name: "local", BootEnv: "local", Description: "Stage to boot into the local BootEnv."}
+	global := &models.Profile{Name: "global", Description: "Global profile attached automatically to all machines."}
+	user := &models.User{Name: DefaultUsername}
+	user.ChangePassword(DefaultPassword)
+	prefs := []*models.Pref{
+		{Name: "defaultBootEnv", Val: "local"},
+		{Name: "unknownBootEnv", Val: "ignore"},
+		{Name: "defaultStage", Val: "none"},
+		{Name: "defaultWorkflow", Val: ""},
+		{Name: "knownTokenTimeout", Val: "3600"},
+		{Name: "unknownTokenTimeout", Val: "600"},
+	}
+	objs := []models.Model{local, ignore, none, localStage, global, user}
+	for _, p := range prefs {
+		objs = append(objs, p)
+	}
+	for _, obj := range objs {
+		if f, ok := obj.(models.Filler); ok {
+			f.Fill()
+		}
+		setValid(obj)
+		if err := s.backend.Save(obj.Prefix(), obj.Key(), obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Info returns the models.Info that the Server advertises.
+func (s *Server) Info() *models.Info {
+	res := &models.Info{
+		Version:            "v4.6.0-fake",
+		Id:                 s.id,
+		LocalId:            s.id,
+		HaId:               s.id,
+		ApiPort:            s.apiPort,
+		FilePort:           s.filePort,
+		Address:            s.address,
+		ProvisionerEnabled: s.filePort != 0,
+		HaIsActive:         true,
+		HaStatus:           "Up",
+		Features: []string{
+			"api-v3",
+			"sane-exit-codes",
+			"change-stage-v2",
+			"job-exit-states",
+			"package-repository-handling",
+			"profileless-machine",
+			"threaded-log-levels",
+			"embedded-content",
+		},
+	}
+	res.Fill()
+	return res
+}
+
+// Handler returns the http.Handler that implements the API.  All
+// requests must have paths that start with apiPath.
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(s.serveAPI)
+}
+
+// Start starts serving the API over TLS on apiAddr, and the static
+// file server (which serves the files and isos blobs) over plain HTTP
+// on fileAddr.  fileAddr may be empty if no static file server is
+// wanted.
+func (s *Server) Start(apiAddr, fileAddr string) error {
+	apiL, err := net.Listen("tcp", apiAddr)
+	if err != nil {
+		return err
+	}
+	s.apiPort = apiL.Addr().(*net.TCPAddr).Port
+	if fileAddr != "" {
+		fileL, err := net.Listen("tcp", fileAddr)
+		if err != nil {
+			apiL.Close()
+			return err
+		}
+		s.filePort = fileL.Addr().(*net.TCPAddr).Port
+		s.fileSrv = httptest.NewUnstartedServer(http.FileServer(http.Dir(path.Join(s.root, "tftpboot"))))
+		s.fileSrv.Listener.Close()
+		s.fileSrv.Listener = fileL
+		s.fileSrv.Start()
+	}
+	s.apiSrv = httptest.NewUnstartedServer(s.Handler())
+	s.apiSrv.Listener.Close()
+	s.apiSrv.Listener = apiL
+	s.apiSrv.TLS = &tls.Config{NextProtos: []string{"http/1.1"}}
+	s.apiSrv.StartTLS()
+	return nil
+}
+
+// Endpoint returns the URL the API is being served on.
+func (s *Server) Endpoint() string {
+	if s.apiSrv == nil {
+		return ""
+	}
+	return s.apiSrv.URL
+}
+
+// Close shuts down the API and static file servers.
+func (s *Server) Close() {
+	s.events.close()
+	if s.apiSrv != nil {
+		s.apiSrv.CloseClientConnections()
+		s.apiSrv.Close()
+	}
+	if s.fileSrv != nil {
+		s.fileSrv.Close()
+	}
+	s.backend.Close()
+}
+
+func setValid(m models.Model) {
+	if v, ok := m.(models.ValidateSetter); ok {
+		v.SetValid()
+		v.SetAvailable()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if obj == nil {
+		w.WriteHeader(code)
+		return
+	}
+	buf, err := json.Marshal(obj)
+	if err != nil {
+		code = http.StatusInternalServerError
+		buf, _ = json.Marshal(models.NewError("API_ERROR", code, err.Error()))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.WriteHeader(code)
+	w.Write(buf)
+}
+
+func writeErr(w http.ResponseWriter, err *models.Error) {
+	if err.Code == 0 {
+		err.Code = http.StatusInternalServerError
+	}
+	writeJSON(w, err.Code, err)
+}
+
+func newErr(code int, errType, prefix, key, f string, args ...interface{}) *models.Error {
+	res := &models.Error{Code: code, Type: errType, Model: prefix, Key: key}
+	res.Errorf(f, args...)
+	return res
+}
+
+func notFound(method, prefix, key string) *models.Error {
+	return newErr(http.StatusNotFound, method, prefix, key, "Not Found")
+}
+
+// serveAPI does the basic routing for the API.  Paths are split into
+// their components after apiPath, and dispatched based on the
+// first one.
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, apiPath+"/") {
+		writeErr(w, notFound(r.Method, "", r.URL.Path))
+		return
+	}
+	parts := []string{}
+	for _, p := range strings.Split(strings.TrimPrefix(r.URL.Path, apiPath+"/"), "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) == 0 {
+		writeErr(w, notFound(r.Method, "", r.URL.Path))
+		return
+	}
+	principal, err := s.authorize(r, parts)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	switch parts[0] {
+	case "info":
+		writeJSON(w, http.StatusOK, s.Info())
+	case "objects":
+		writeJSON(w, http.StatusOK, models.AllPrefixes())
+	case "logs":
+		writeJSON(w, http.StatusOK, []interface{}{})
+	case "ws":
+		s.serveEvents(w, r, principal)
+	case "events":
+		evt := &models.Event{}
+		if err := decodeBody(r, evt); err != nil {
+			writeErr(w, err)
+			return
+		}
+		if evt.Principal == "" {
+			evt.Principal = principal
+		}
+		s.events.publish(evt)
+		writeJSON(w, http.StatusNoContent, nil)
+	case "indexes":
+		s.serveIndexes(w, r, parts[1:])
+	case "files", "isos":
+		s.serveBlobs(w, r, parts[0], strings.Join(parts[1:], "/"))
+	case "contents":
+		s.serveContents(w, r, parts[1:])
+	case "users":
+		if len(parts) == 3 && parts[2] == "token" && r.Method == "GET" {
+			s.serveToken(w, r, parts[1])
+			return
+		}
+		s.serveObjects(w, r, parts, principal)
+	case "plugin_providers":
+		if len(parts) == 1 && r.Method == "GET" {
+			writeJSON(w, http.StatusOK, []interface{}{})
+			return
+		}
+		writeErr(w, newErr(http.StatusNotImplemented, "API_ERROR", "plugin_providers", "", "Plugin providers are not supported by the fake server"))
+	default:
+		if _, ok := baseTypes()[parts[0]]; !ok {
+			writeErr(w, notFound(r.Method, parts[0], ""))
+			return
+		}
+		s.serveObjects(w, r, parts, principal)
+	}
+}
+
+// String satisfies fmt.Stringer
+func (s *Server) String() string {
+	return fmt.Sprintf("fake dr-provision %s at %s", s.id, s.Endpoint())
+}
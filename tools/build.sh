@@ -33,6 +33,7 @@ builds="amd64:linux amd64:darwin amd64:windows arm64:linux arm:linux"
 for tool in cmds/*; do
     [[ -d $tool ]] || continue
     [[ $tool != cmds/drbundler ]] || continue
+    [[ $tool != cmds/openapi ]] || continue
     printf 'Building %s for' "$tool"
     for build in ${builds}; do
         export GOOS="${build##*:}" GOARCH="${build%:*}"